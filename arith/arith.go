@@ -0,0 +1,187 @@
+// Package arith implements lox's arithmetic, comparison and bitwise
+// operators on values. The vm runs them and the optimizer uses them to
+// fold constant expressions, so both agree on every result. Like natives,
+// the operations return an error message instead of a value when the
+// operands are wrong.
+package arith
+
+import (
+	"golox/chunk/opcode"
+	"golox/value"
+	"math"
+)
+
+func addInt(a int64, b int64) (int64, bool) {
+	result := a + b
+	overflow := (a > 0 && b > 0 && result < 0) || (a < 0 && b < 0 && result >= 0)
+	return result, !overflow
+}
+
+func subtractInt(a int64, b int64) (int64, bool) {
+	result := a - b
+	overflow := (a >= 0 && b < 0 && result < 0) || (a < 0 && b > 0 && result >= 0)
+	return result, !overflow
+}
+
+func multiplyInt(a int64, b int64) (int64, bool) {
+	if a == 0 || b == 0 {
+		return 0, true
+	}
+	if (a == -1 && b == math.MinInt64) || (b == -1 && a == math.MinInt64) {
+		return 0, false
+	}
+	result := a * b
+	return result, result/b == a
+}
+
+func moduloInt(a int64, b int64) (int64, bool) {
+	if b == 0 {
+		return 0, false
+	}
+	return a % b, true
+}
+
+func divideInt(a int64, b int64) (int64, bool) {
+	if b == 0 || a%b != 0 || (a == math.MinInt64 && b == -1) {
+		return 0, false
+	}
+	return a / b, true
+}
+
+// intOp applies an arithmetic operator to two ints. The boolean is false
+// when the result does not fit in an int, in which case the caller falls
+// back to float arithmetic.
+func intOp(op uint8, a int64, b int64) (int64, bool) {
+	switch op {
+	case opcode.OP_ADD:
+		return addInt(a, b)
+	case opcode.OP_SUBTRACT:
+		return subtractInt(a, b)
+	case opcode.OP_MULTIPLY:
+		return multiplyInt(a, b)
+	case opcode.OP_DIVIDE:
+		return divideInt(a, b)
+	case opcode.OP_MODULO:
+		return moduloInt(a, b)
+	}
+	return 0, false
+}
+
+// Add is `a + b`: string concatenation when either side is a string,
+// numeric addition otherwise.
+func Add(a value.Value, b value.Value) (value.Value, string) {
+	switch {
+	case a.IsString() && b.IsString():
+		return value.ValObjString(a.AsGoString() + b.AsGoString()), ""
+	case a.IsString():
+		return value.ValObjString(a.AsGoString() + b.Stringify()), ""
+	case b.IsString():
+		return value.ValObjString(a.Stringify() + b.AsGoString()), ""
+	}
+	return Binary(opcode.OP_ADD, a, b)
+}
+
+// Binary applies one of the numeric operators OP_ADD, OP_SUBTRACT,
+// OP_MULTIPLY, OP_DIVIDE, OP_MODULO, OP_GREATER and OP_LESS. Ints stay
+// ints unless the result doesn't fit or isn't whole.
+func Binary(op uint8, a value.Value, b value.Value) (value.Value, string) {
+	if !a.IsNumeric() || !b.IsNumeric() {
+		return value.ValNil(), "Operands must be numbers."
+	}
+
+	switch op {
+	case opcode.OP_GREATER:
+		c, ok := value.CompareNumbers(a, b)
+		return value.ValBool(ok && c > 0), ""
+	case opcode.OP_LESS:
+		return value.ValBool(LessNumbers(a, b)), ""
+	}
+
+	if a.IsInt() && b.IsInt() {
+		if op == opcode.OP_MODULO && b.AsInt() == 0 {
+			return value.ValNil(), "Modulo by zero."
+		}
+		if result, ok := intOp(op, a.AsInt(), b.AsInt()); ok {
+			return value.ValInt(result), ""
+		}
+	}
+
+	x := a.AsFloat()
+	y := b.AsFloat()
+	switch op {
+	case opcode.OP_ADD:
+		return value.ValNumber(x + y), ""
+	case opcode.OP_SUBTRACT:
+		return value.ValNumber(x - y), ""
+	case opcode.OP_MULTIPLY:
+		return value.ValNumber(x * y), ""
+	case opcode.OP_DIVIDE:
+		return value.ValNumber(x / y), ""
+	}
+	return value.ValNumber(math.Mod(x, y)), ""
+}
+
+// AddNumbers is `a + b` for operands already known to be numbers.
+func AddNumbers(a value.Value, b value.Value) value.Value {
+	if a.IsInt() && b.IsInt() {
+		if result, ok := addInt(a.AsInt(), b.AsInt()); ok {
+			return value.ValInt(result)
+		}
+	}
+	return value.ValNumber(a.AsFloat() + b.AsFloat())
+}
+
+// LessNumbers is `a < b` for operands already known to be numbers.
+func LessNumbers(a value.Value, b value.Value) bool {
+	c, ok := value.CompareNumbers(a, b)
+	return ok && c < 0
+}
+
+// Bitwise applies OP_BIT_AND, OP_BIT_OR, OP_BIT_XOR, OP_SHIFT_LEFT or
+// OP_SHIFT_RIGHT to two ints.
+func Bitwise(op uint8, a value.Value, b value.Value) (value.Value, string) {
+	if !a.IsInt() || !b.IsInt() {
+		return value.ValNil(), "Operands must be integers."
+	}
+
+	x := a.AsInt()
+	y := b.AsInt()
+
+	switch op {
+	case opcode.OP_BIT_AND:
+		return value.ValInt(x & y), ""
+	case opcode.OP_BIT_OR:
+		return value.ValInt(x | y), ""
+	case opcode.OP_BIT_XOR:
+		return value.ValInt(x ^ y), ""
+	}
+
+	if y < 0 {
+		return value.ValNil(), "Shift count must not be negative."
+	}
+	// shifting by 64 or more gives 0, or -1 for a negative int shifted right
+	if op == opcode.OP_SHIFT_LEFT {
+		return value.ValInt(x << uint64(y)), ""
+	}
+	return value.ValInt(x >> uint64(y)), ""
+}
+
+// Negate is `-a`. Negating the smallest int gives a number, as its
+// negation doesn't fit in an int.
+func Negate(a value.Value) (value.Value, string) {
+	if a.IsInt() && a.AsInt() != math.MinInt64 {
+		return value.ValInt(-a.AsInt()), ""
+	}
+	if a.IsNumeric() {
+		return value.ValNumber(-a.AsFloat()), ""
+	}
+	return value.ValNil(), "Operand must be a number."
+}
+
+// BitNot is `~a`.
+func BitNot(a value.Value) (value.Value, string) {
+	if !a.IsInt() {
+		return value.ValNil(), "Operand must be an integer."
+	}
+	return value.ValInt(^a.AsInt()), ""
+}
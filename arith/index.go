@@ -0,0 +1,92 @@
+package arith
+
+import (
+	"fmt"
+	"golox/value"
+	"golox/value/objtype"
+	"math"
+)
+
+// IntIndex converts an index or slice bound to an int. Floats are only
+// accepted when they hold a whole number.
+func IntIndex(val value.Value) (int, bool) {
+	if val.IsInt() {
+		return int(val.AsInt()), true
+	}
+	if val.IsNumber() && val.AsNumber() == math.Trunc(val.AsNumber()) {
+		return int(val.AsNumber()), true
+	}
+	return 0, false
+}
+
+// sequenceIndex checks that index is an integer within a sequence of
+// length items, counting negative indices from the end.
+func sequenceIndex(kind string, valueIndex value.Value, length int) (int, string) {
+	index, ok := IntIndex(valueIndex)
+	if !ok {
+		return 0, fmt.Sprintf("%s index must be an integer.", kind)
+	}
+
+	if index < 0 {
+		index += length
+	}
+
+	if index < 0 || index >= length {
+		return 0, fmt.Sprintf("%s index out of range.", kind)
+	}
+
+	return index, ""
+}
+
+// Index is container[index] for lists, strings and maps.
+func Index(container value.Value, index value.Value) (value.Value, string) {
+	switch {
+	case container.IsOBjType(objtype.OBJ_MAP):
+		val, ok := container.AsObjMap().Get(index)
+		if !ok {
+			return value.ValNil(), fmt.Sprintf("Undefined key '%s'.", index.Stringify())
+		}
+		return val, ""
+
+	case container.IsOBjType(objtype.OBJ_LIST):
+		list := container.AsObjList().List
+		i, err := sequenceIndex("List", index, len(list))
+		if len(err) > 0 {
+			return value.ValNil(), err
+		}
+		return list[i], ""
+
+	case container.IsString():
+		chars := []rune(container.AsGoString())
+		i, err := sequenceIndex("String", index, len(chars))
+		if len(err) > 0 {
+			return value.ValNil(), err
+		}
+		return value.ValObjString(string(chars[i])), ""
+	}
+
+	return value.ValNil(), "Invalid type to index into."
+}
+
+// SetIndex performs container[index] = newValue for lists and maps.
+func SetIndex(container value.Value, index value.Value, newValue value.Value) string {
+	switch {
+	case container.IsOBjType(objtype.OBJ_MAP):
+		container.AsObjMap().Set(index, newValue)
+		return ""
+
+	case container.IsOBjType(objtype.OBJ_LIST):
+		list := container.AsObjList().List
+		i, err := sequenceIndex("List", index, len(list))
+		if len(err) > 0 {
+			return err
+		}
+		list[i] = newValue
+		return ""
+
+	case container.IsString():
+		return "Strings can't be modified."
+	}
+
+	return "Invalid type to index into."
+}
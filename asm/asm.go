@@ -2,7 +2,6 @@ package asm
 
 import (
 	"encoding/binary"
-	"fmt"
 	"unsafe"
 )
 
@@ -13,7 +12,7 @@ import (
 #include <string.h>
 
 void* alloc_mem_exec(size_t length, uint8_t* code) {
-   void* mem = mmap(0, length, PROT_READ | PROT_WRITE | PROT_EXEC, MAP_ANON | MAP_PRIVATE, -1, 0);
+   void* mem = mmap(0, length, PROT_READ | PROT_WRITE, MAP_ANON | MAP_PRIVATE, -1, 0);
    memcpy(mem, code, length);
    mprotect(mem, length, PROT_READ | PROT_EXEC);
    return mem;
@@ -103,8 +102,26 @@ func (x *X86_64) setOp2(op1, op2 uint8) {
 	x.Op = []uint8{op1, op2}
 }
 
+// setModRm encodes dst in the reg field and src in the r/m field, with
+// the REX bits extending them to R8-R15.
 func (x *X86_64) setModRm(dst, src Reg, mode uint8) {
-	x.ModRm = []uint8{mode | uint8(dst)<<3 | uint8(src)}
+	if len(x.REX) > 0 {
+		x.SetRex_R(uint8(dst) >> 3)
+		x.REX[0] |= uint8(src) >> 3
+	}
+	x.ModRm = []uint8{mode | (uint8(dst)&7)<<3 | uint8(src)&7}
+}
+
+// setMem encodes reg in the reg field and [base+disp] as the memory
+// operand, always with a 32-bit displacement.
+func (x *X86_64) setMem(reg, base Reg, disp int32) {
+	x.setModRm(reg, base, 0x80)
+	if base&7 == RSP {
+		// RSP and R12 as a base need a SIB byte
+		x.SIB = []uint8{0x24}
+	}
+	x.Disp = make([]uint8, 4)
+	binary.LittleEndian.PutUint32(x.Disp, uint32(disp))
 }
 
 func (x *X86_64) setImm64(imm uint64) {
@@ -191,6 +208,153 @@ func (x *X86_64) XorRegReg(dst, src Reg) {
 	x.setModRm(dst, src, 0xc0)
 }
 
+// MovRegMem is `mov dst, [base+disp]`.
+func (x *X86_64) MovRegMem(dst, base Reg, disp int32) {
+	x.Init()
+	x.SetRex_W(1)
+	x.setOp(0x8B)
+	x.setMem(dst, base, disp)
+}
+
+// MovMemReg is `mov [base+disp], src`.
+func (x *X86_64) MovMemReg(base Reg, disp int32, src Reg) {
+	x.Init()
+	x.SetRex_W(1)
+	x.setOp(0x89)
+	x.setMem(src, base, disp)
+}
+
+// MovMemImm is `mov qword [base+disp], imm`, imm sign-extended.
+func (x *X86_64) MovMemImm(base Reg, disp int32, imm int) {
+	x.Init()
+	x.SetRex_W(1)
+	x.setOp(0xC7)
+	x.setMem(0, base, disp)
+	x.setImm32(imm)
+}
+
+// MovRegImm is `mov dst, imm`, imm sign-extended.
+func (x *X86_64) MovRegImm(dst Reg, imm int) {
+	x.Init()
+	x.SetRex_W(1)
+	x.setOp(0xC7)
+	x.setModRm(0, dst, 0xc0)
+	x.setImm32(imm)
+}
+
+// MovRegImm64 is `mov dst, imm` with the whole 64-bit immediate.
+func (x *X86_64) MovRegImm64(dst Reg, imm uint64) {
+	x.Init()
+	x.SetRex_W(1)
+	x.REX[0] |= uint8(dst) >> 3
+	x.setOp(0xB8 + uint8(dst)&7)
+	x.Imm = make([]uint8, 8)
+	binary.LittleEndian.PutUint64(x.Imm, imm)
+}
+
+func (x *X86_64) ImulRegReg(dst, src Reg) {
+	x.Init()
+	x.SetRex_W(1)
+	x.setOp2(0x0F, 0xAF)
+	x.setModRm(dst, src, 0xc0)
+}
+
+func (x *X86_64) SubRegImm(dst Reg, imm int) {
+	x.Init()
+	x.SetRex_W(1)
+	x.setOp(0x81)
+	x.setModRm(5, dst, 0xc0)
+	x.setImm32(imm)
+}
+
+// ShlRegImm is `shl dst, imm`.
+func (x *X86_64) ShlRegImm(dst Reg, imm int8) {
+	x.Init()
+	x.SetRex_W(1)
+	x.setOp(0xC1)
+	x.setModRm(4, dst, 0xc0)
+	x.setImm8(imm)
+}
+
+func (x *X86_64) CmpRegReg(a, b Reg) {
+	x.Init()
+	x.SetRex_W(1)
+	x.setOp(0x3B)
+	x.setModRm(a, b, 0xc0)
+}
+
+// CmpMemImm is `cmp qword [base+disp], imm`.
+func (x *X86_64) CmpMemImm(base Reg, disp int32, imm int) {
+	x.Init()
+	x.SetRex_W(1)
+	x.setOp(0x81)
+	x.setMem(7, base, disp)
+	x.setImm32(imm)
+}
+
+func (x *X86_64) TestRegReg(a, b Reg) {
+	x.Init()
+	x.SetRex_W(1)
+	x.setOp(0x85)
+	x.setModRm(b, a, 0xc0)
+}
+
+// Setcc sets the low byte of dst to 1 if cond holds and to 0 otherwise.
+func (x *X86_64) Setcc(cond Cond, dst Reg) {
+	x.Init()
+	x.setOp2(0x0F, 0x90+uint8(cond))
+	x.setModRm(0, dst, 0xc0)
+}
+
+// JmpMem is `jmp qword [base+disp]`.
+func (x *X86_64) JmpMem(base Reg, disp int32) {
+	x.Init()
+	x.setOp(0xFF)
+	x.setMem(4, base, disp)
+}
+
+// MovRegReg is `mov dst, src`.
+func (x *X86_64) MovRegReg(dst, src Reg) {
+	x.Init()
+	x.SetRex_W(1)
+	x.setOp(0x8B)
+	x.setModRm(dst, src, 0xc0)
+}
+
+// PushReg is `push reg`.
+func (x *X86_64) PushReg(reg Reg) {
+	x.Init()
+	x.REX[0] |= uint8(reg) >> 3
+	x.setOp(0x50 + uint8(reg)&7)
+}
+
+// PopReg is `pop reg`.
+func (x *X86_64) PopReg(reg Reg) {
+	x.Init()
+	x.REX[0] |= uint8(reg) >> 3
+	x.setOp(0x58 + uint8(reg)&7)
+}
+
+// CallReg is `call reg`.
+func (x *X86_64) CallReg(reg Reg) {
+	x.Init()
+	x.setOp(0xFF)
+	x.setModRm(2, reg, 0xc0)
+}
+
+// Cond is the condition code of a conditional jump or set.
+type Cond uint8
+
+const (
+	CondO  Cond = 0x0 // overflow
+	CondE  Cond = 0x4 // equal
+	CondNE Cond = 0x5 // not equal
+	CondL  Cond = 0xC // less, signed
+	CondGE Cond = 0xD // greater or equal, signed
+	CondLE Cond = 0xE // less or equal, signed
+	CondG  Cond = 0xF // greater, signed
+)
+
 func ExtendCode(code []uint8, x []X86_64) []uint8 {
 	for _, insn := range x {
 		code = append(code, insn.Encode()...)
@@ -207,70 +371,3 @@ func Run(code []uint8) int {
 	res := C.run_mem_exec(mem)
 	return int(res)
 }
-
-func Test() {
-	// 1:
-	//  xor rax, rax
-	//  add rax, 1111
-	//  ret
-	x := make([]X86_64, 3)
-
-	x[0].Init()
-	x[0].XorRegReg(RAX, RAX)
-	x[1].Init()
-	x[1].AddRegImm(RAX, 1111)
-	x[2].Init()
-	x[2].Ret()
-	codeBytes := ExtendCode(make([]uint8, 0), x)
-	fmt.Println(Run(codeBytes))
-
-	// 2:
-	// xor rax, rax
-	// label:
-	// add rax, 1
-	// cmp rax, 10
-	// jne label
-	// ret
-
-	var y [6]X86_64
-	y[0].XorRegReg(RAX, RAX)
-	codeBytes = ExtendCode(make([]uint8, 0), y[:1])
-	y[1].AddRegImm(RAX, 1)
-	y[2].AddRegImm(RAX, 1)
-	y[3].CmpRegImm(RAX, 10)
-	loopBytes := y[1].Encode()
-	loopBytes = append(loopBytes, y[2].Encode()...)
-	// take in account the length of the loopBytes and the length of the jne instruction
-	y[4].Jle(-len(loopBytes) - 6)
-	y[5].Ret()
-	codeBytes = append(codeBytes, loopBytes...)
-	codeBytes = ExtendCode(codeBytes, y[3:])
-	fmt.Println(Run(codeBytes))
-
-	// 3:
-	// xor rdi, rdi
-	// xor rax, rax
-	// label:
-	// add rdi, 1
-	// add rdi, 1
-	// cmp rdi, 10
-	// jne label
-	// add rax, rdi
-	// ret
-
-	var z [8]X86_64
-	z[0].XorRegReg(RDI, RDI)
-	z[1].XorRegReg(RAX, RAX)
-	codeBytes = ExtendCode(make([]uint8, 0), z[:2])
-	z[2].AddRegImm(RDI, 1)
-	z[3].AddRegImm(RDI, 1)
-	z[4].CmpRegImm(RDI, 10)
-	loopBytes = ExtendCode(make([]uint8, 0), z[2:5])
-	z[5].Jle(-len(loopBytes) - 6)
-	z[6].Init()
-	z[6].AddRegReg(RAX, RDI)
-	z[7].Ret()
-	codeBytes = append(codeBytes, loopBytes...)
-	codeBytes = ExtendCode(codeBytes, z[5:])
-	fmt.Println(Run(codeBytes))
-}
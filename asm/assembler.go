@@ -0,0 +1,73 @@
+package asm
+
+import "encoding/binary"
+
+// Label is a position in an Assembler's code, which jumps can refer to
+// before it's bound.
+type Label int
+
+type fixup struct {
+	at    int // offset of the rel32 to patch
+	label Label
+}
+
+// Assembler collects instructions and resolves the jumps between them.
+type Assembler struct {
+	code   []uint8
+	labels []int // offset of each label, -1 until bound
+	fixups []fixup
+}
+
+func (assembler *Assembler) Emit(insns ...X86_64) {
+	assembler.code = ExtendCode(assembler.code, insns)
+}
+
+// Offset is the offset of the next instruction.
+func (assembler *Assembler) Offset() int {
+	return len(assembler.code)
+}
+
+func (assembler *Assembler) NewLabel() Label {
+	assembler.labels = append(assembler.labels, -1)
+	return Label(len(assembler.labels) - 1)
+}
+
+// Bind makes label refer to the next instruction.
+func (assembler *Assembler) Bind(label Label) {
+	assembler.labels[label] = len(assembler.code)
+}
+
+// LabelOffset is where label was bound.
+func (assembler *Assembler) LabelOffset(label Label) int {
+	return assembler.labels[label]
+}
+
+// Jmp emits `jmp label`.
+func (assembler *Assembler) Jmp(label Label) {
+	assembler.code = append(assembler.code, 0xE9)
+	assembler.rel32(label)
+}
+
+// Jcc emits a jump to label taken if cond holds.
+func (assembler *Assembler) Jcc(cond Cond, label Label) {
+	assembler.code = append(assembler.code, 0x0F, 0x80+uint8(cond))
+	assembler.rel32(label)
+}
+
+func (assembler *Assembler) rel32(label Label) {
+	assembler.fixups = append(assembler.fixups, fixup{at: len(assembler.code), label: label})
+	assembler.code = append(assembler.code, 0, 0, 0, 0)
+}
+
+// Bytes patches the jumps and returns the code. Every label jumped to
+// must have been bound.
+func (assembler *Assembler) Bytes() []uint8 {
+	for _, fixup := range assembler.fixups {
+		target := assembler.labels[fixup.label]
+		if target < 0 {
+			panic("asm: jump to an unbound label")
+		}
+		binary.LittleEndian.PutUint32(assembler.code[fixup.at:], uint32(int32(target-(fixup.at+4))))
+	}
+	return assembler.code
+}
@@ -0,0 +1,94 @@
+package asm
+
+/*
+#include <stdint.h>
+
+extern int64_t asmCallHelper(void* context, uintptr_t sp, uintptr_t base, int64_t helper, int64_t arg);
+*/
+import "C"
+
+import (
+	"sync"
+	"unsafe"
+)
+
+// Helper is a Go function machine code can call through the bridge. It
+// gets the context, stack pointer and frame base the code was called
+// with, as they are at the call, and the argument of the call site, and
+// returns a status for the code to look at.
+//
+// A helper may run more machine code, which may call helpers in turn.
+type Helper func(context unsafe.Pointer, sp uintptr, base uintptr, arg int64) int64
+
+// HelperID is how machine code names a registered Helper.
+type HelperID int64
+
+// helpers are the registered Helpers, by HelperID. Machine code can't
+// hold Go pointers, so it refers to them by index.
+var helpers struct {
+	sync.Mutex
+	funcs []Helper
+	free  []HelperID
+}
+
+// RegisterHelper makes helper callable from machine code, until its ID
+// is released.
+func RegisterHelper(helper Helper) HelperID {
+	helpers.Lock()
+	defer helpers.Unlock()
+
+	if n := len(helpers.free); n > 0 {
+		id := helpers.free[n-1]
+		helpers.free = helpers.free[:n-1]
+		helpers.funcs[id] = helper
+		return id
+	}
+	helpers.funcs = append(helpers.funcs, helper)
+	return HelperID(len(helpers.funcs) - 1)
+}
+
+// Release unregisters the helper. Code calling it mustn't run anymore.
+func (id HelperID) Release() {
+	helpers.Lock()
+	defer helpers.Unlock()
+
+	helpers.funcs[id] = nil
+	helpers.free = append(helpers.free, id)
+}
+
+//export asmCallHelper
+func asmCallHelper(context unsafe.Pointer, sp C.uintptr_t, base C.uintptr_t, helper C.int64_t, arg C.int64_t) C.int64_t {
+	helpers.Lock()
+	call := helpers.funcs[helper]
+	helpers.Unlock()
+
+	if call == nil {
+		panic("asm: call to a released helper")
+	}
+	return C.int64_t(call(context, uintptr(sp), uintptr(base), int64(arg)))
+}
+
+// CallHelper emits a call of helper with arg, through a C function taking
+// the context in RDI, the stack pointer in RSI, the frame base in RDX, the
+// helper in RCX and arg in R8, as code called by Entry.Call has them.
+// This is the only way machine code runs Go: cgo sets up the goroutine
+// for the call, as for any C function calling back into Go.
+//
+// RDI, RSI and RDX are kept across the call and the helper's status is
+// left in RAX; the other caller-saved registers are lost. RSP must be as
+// it was when the code was entered, so that the three registers saved
+// on the stack align it for the call.
+func (assembler *Assembler) CallHelper(helper HelperID, arg int64) {
+	var x [10]X86_64
+	x[0].PushReg(RDI)
+	x[1].PushReg(RSI)
+	x[2].PushReg(RDX)
+	x[3].MovRegImm64(RCX, uint64(helper))
+	x[4].MovRegImm64(R8, uint64(arg))
+	x[5].MovRegImm64(RAX, uint64(uintptr(unsafe.Pointer(C.asmCallHelper))))
+	x[6].CallReg(RAX)
+	x[7].PopReg(RDX)
+	x[8].PopReg(RSI)
+	x[9].PopReg(RDI)
+	assembler.Emit(x[:]...)
+}
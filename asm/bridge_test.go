@@ -0,0 +1,217 @@
+package asm
+
+import (
+	"testing"
+	"unsafe"
+)
+
+// add is a helper giving back the sum of its stack pointer, frame base
+// and argument.
+func add(context unsafe.Pointer, sp uintptr, base uintptr, arg int64) int64 {
+	return int64(sp) + int64(base) + arg
+}
+
+// ret is code's last instruction.
+func ret() X86_64 {
+	var x X86_64
+	x.Ret()
+	return x
+}
+
+// addCode puts the code of assembler in cache.
+func addCode(t *testing.T, cache *CodeCache, assembler *Assembler) *Entry {
+	t.Helper()
+	entry, err := cache.Add(assembler.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return entry
+}
+
+func TestRun(t *testing.T) {
+	//  xor rax, rax
+	//  add rax, 1111
+	//  ret
+	x := make([]X86_64, 3)
+	x[0].XorRegReg(RAX, RAX)
+	x[1].AddRegImm(RAX, 1111)
+	x[2].Ret()
+	if got := Run(ExtendCode(nil, x)); got != 1111 {
+		t.Errorf("got %d, want 1111", got)
+	}
+
+	//  xor rax, rax
+	// label:
+	//  add rax, 1
+	//  add rax, 1
+	//  cmp rax, 10
+	//  jle label
+	//  ret
+	var y [6]X86_64
+	y[0].XorRegReg(RAX, RAX)
+	y[1].AddRegImm(RAX, 1)
+	y[2].AddRegImm(RAX, 1)
+	y[3].CmpRegImm(RAX, 10)
+	loop := ExtendCode(nil, y[1:4])
+	// back over the loop and the 6 bytes of the jle itself
+	y[4].Jle(-len(loop) - 6)
+	y[5].Ret()
+	code := ExtendCode(ExtendCode(nil, y[:1]), y[1:])
+	if got := Run(code); got != 12 {
+		t.Errorf("got %d, want 12", got)
+	}
+}
+
+func TestCallHelper(t *testing.T) {
+	var cache CodeCache
+	defer cache.Free()
+	helper := RegisterHelper(add)
+	defer helper.Release()
+
+	// the helper gets the code's arguments and its own
+	//  call add(rdi, rsi, rdx, 5)
+	//  ret
+	var a Assembler
+	a.CallHelper(helper, 5)
+	a.Emit(ret())
+	if got := addCode(t, &cache, &a).Call(0, nil, 10, 20); got != 35 {
+		t.Errorf("got %d, want 35", got)
+	}
+
+	// RSI and RDX are kept across calls
+	//  call add(rdi, rsi, rdx, 1)
+	//  mov rsi, rax
+	//  call add(rdi, rsi, rdx, 2)
+	//  ret
+	var b Assembler
+	b.CallHelper(helper, 1)
+	var mov X86_64
+	mov.MovRegReg(RSI, RAX)
+	b.Emit(mov)
+	b.CallHelper(helper, 2)
+	b.Emit(ret())
+	if got := addCode(t, &cache, &b).Call(0, nil, 10, 20); got != 53 {
+		t.Errorf("got %d, want 53", got)
+	}
+}
+
+func TestReentrantHelper(t *testing.T) {
+	var cache CodeCache
+	defer cache.Free()
+
+	// a helper running the code that calls it, computing sp!
+	//  call factorial(rdi, rsi, rdx, 0)
+	//  ret
+	var entry *Entry
+	factorial := RegisterHelper(func(context unsafe.Pointer, sp uintptr, base uintptr, arg int64) int64 {
+		if sp <= 1 {
+			return 1
+		}
+		return int64(sp) * entry.Call(0, context, sp-1, base)
+	})
+	defer factorial.Release()
+	var a Assembler
+	a.CallHelper(factorial, 0)
+	a.Emit(ret())
+	entry = addCode(t, &cache, &a)
+
+	if got := entry.Call(0, nil, 10, 0); got != 3628800 {
+		t.Errorf("got %d, want 3628800", got)
+	}
+}
+
+// deoptContext is where the code of TestDeopt says why it gave up.
+type deoptContext struct {
+	Reason uint64
+	Offset uint64
+}
+
+const (
+	deoptDone   = 7
+	deoptStatus = -3
+)
+
+func TestDeopt(t *testing.T) {
+	var cache CodeCache
+	defer cache.Free()
+
+	// the helper gives a reason to deoptimize, 0 for none, by stack
+	// pointer
+	check := RegisterHelper(func(context unsafe.Pointer, sp uintptr, base uintptr, arg int64) int64 {
+		if sp > 100 {
+			return int64(sp) - 100
+		}
+		return 0
+	})
+	defer check.Release()
+
+	//  call check(rdi, rsi, rdx, 0)
+	//  cmp rax, 0
+	//  jne deopt
+	//  mov rax, deoptDone
+	//  ret
+	// deopt:
+	//  mov [rdi+Reason], rax
+	//  mov qword [rdi+Offset], 42
+	//  mov rax, deoptStatus
+	//  ret
+	var a Assembler
+	deopt := a.NewLabel()
+	a.CallHelper(check, 0)
+	var x [5]X86_64
+	x[0].CmpRegImm(RAX, 0)
+	a.Emit(x[0])
+	a.Jcc(CondNE, deopt)
+	x[1].MovRegImm(RAX, deoptDone)
+	a.Emit(x[1], ret())
+	a.Bind(deopt)
+	x[2].MovMemReg(RDI, int32(unsafe.Offsetof(deoptContext{}.Reason)), RAX)
+	x[3].MovMemImm(RDI, int32(unsafe.Offsetof(deoptContext{}.Offset)), 42)
+	x[4].MovRegImm(RAX, deoptStatus)
+	a.Emit(x[2], x[3], x[4], ret())
+	entry := addCode(t, &cache, &a)
+
+	var context deoptContext
+	if got := entry.Call(0, unsafe.Pointer(&context), 50, 0); got != deoptDone {
+		t.Errorf("got %d, want %d", got, deoptDone)
+	}
+	if context != (deoptContext{}) {
+		t.Errorf("context set to %+v without a deopt", context)
+	}
+	for _, reason := range []uint64{1, 2, 3} {
+		context = deoptContext{}
+		if got := entry.Call(0, unsafe.Pointer(&context), uintptr(100+reason), 0); got != deoptStatus {
+			t.Errorf("got %d, want %d", got, deoptStatus)
+		}
+		if want := (deoptContext{Reason: reason, Offset: 42}); context != want {
+			t.Errorf("got %+v, want %+v", context, want)
+		}
+	}
+}
+
+func TestRelease(t *testing.T) {
+	var cache CodeCache
+	defer cache.Free()
+
+	released := RegisterHelper(add)
+	released.Release()
+	if helpers.funcs[released] != nil {
+		t.Fatal("a released helper is still registered")
+	}
+
+	// the id is given to the next helper registered, which code calling
+	// it then runs
+	double := RegisterHelper(func(context unsafe.Pointer, sp uintptr, base uintptr, arg int64) int64 {
+		return 2 * int64(sp)
+	})
+	defer double.Release()
+	if double != released {
+		t.Errorf("got id %d, want the released %d", double, released)
+	}
+	var a Assembler
+	a.CallHelper(double, 0)
+	a.Emit(ret())
+	if got := addCode(t, &cache, &a).Call(0, nil, 21, 0); got != 42 {
+		t.Errorf("got %d, want 42", got)
+	}
+}
@@ -0,0 +1,190 @@
+package asm
+
+/*
+#include <sys/mman.h>
+#include <stdint.h>
+#include <string.h>
+
+void* map_pages(size_t length) {
+	void* mem = mmap(0, length, PROT_READ | PROT_WRITE, MAP_ANON | MAP_PRIVATE, -1, 0);
+	return mem == MAP_FAILED ? NULL : mem;
+}
+
+int64_t call_entry(void* entry, void* context, uintptr_t sp, uintptr_t base) {
+	int64_t (*f)(void*, uintptr_t, uintptr_t) = entry;
+	return f(context, sp, base);
+}
+*/
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"unsafe"
+)
+
+// CACHE_PAGE_SIZE is the size of the regions the code cache maps at a
+// time. Code bigger than that gets a region of its own.
+const CACHE_PAGE_SIZE = 1 << 20
+
+// codeAlign is the alignment of each piece of code in a region.
+const codeAlign = 16
+
+var (
+	ErrNoMemory  = errors.New("asm: can't map memory for code")
+	ErrEmptyCode = errors.New("asm: no code to add")
+)
+
+// region is memory mapped for code. It's either writable or executable,
+// never both: code is copied in while it's writable, and it's executable
+// again before any of it runs.
+type region struct {
+	mem  unsafe.Pointer
+	size int
+	used int // bytes handed out, from the start
+	live int // bytes handed out and not invalidated since
+}
+
+// CodeCache hands out executable memory for code that's called many
+// times, packing it into a few large regions.
+type CodeCache struct {
+	regions []*region
+}
+
+// Entry is code in a CodeCache. Its address doesn't change until it's
+// invalidated.
+type Entry struct {
+	cache  *CodeCache
+	region *region
+	offset int
+	size   int
+}
+
+// protect changes what the region's memory can be used for.
+func (region *region) protect(prot C.int) error {
+	if res, err := C.mprotect(region.mem, C.size_t(region.size), prot); res != 0 {
+		return fmt.Errorf("asm: can't change the protection of code memory: %w", err)
+	}
+	return nil
+}
+
+// Add copies code into the cache. If the region it goes in can't be made
+// executable again afterwards, its code can't be called anymore, but it
+// is never writable and executable at once.
+func (cache *CodeCache) Add(code []uint8) (*Entry, error) {
+	if len(code) == 0 {
+		return nil, ErrEmptyCode
+	}
+	size := (len(code) + codeAlign - 1) &^ (codeAlign - 1)
+
+	var target *region
+	for _, region := range cache.regions {
+		if region.size-region.used >= size {
+			target = region
+			break
+		}
+	}
+	if target == nil {
+		regionSize := CACHE_PAGE_SIZE
+		if size > regionSize {
+			regionSize = (size + CACHE_PAGE_SIZE - 1) &^ (CACHE_PAGE_SIZE - 1)
+		}
+		mem := C.map_pages(C.size_t(regionSize))
+		if mem == nil {
+			return nil, ErrNoMemory
+		}
+		target = &region{mem: mem, size: regionSize}
+		if err := target.protect(C.PROT_READ | C.PROT_EXEC); err != nil {
+			C.munmap(mem, C.size_t(regionSize))
+			return nil, err
+		}
+		cache.regions = append(cache.regions, target)
+	}
+
+	// no code runs while the cache is written to, so the region can be
+	// writable for a moment
+	if err := target.protect(C.PROT_READ | C.PROT_WRITE); err != nil {
+		return nil, err
+	}
+	C.memcpy(unsafe.Add(target.mem, target.used), unsafe.Pointer(&code[0]), C.size_t(len(code)))
+	if err := target.protect(C.PROT_READ | C.PROT_EXEC); err != nil {
+		return nil, err
+	}
+
+	entry := &Entry{cache: cache, region: target, offset: target.used, size: size}
+	target.used += size
+	target.live += size
+	return entry, nil
+}
+
+// Used is how many bytes of code the cache holds that haven't been
+// invalidated.
+func (cache *CodeCache) Used() int {
+	used := 0
+	for _, region := range cache.regions {
+		used += region.live
+	}
+	return used
+}
+
+// Mapped is how many bytes the cache has mapped.
+func (cache *CodeCache) Mapped() int {
+	mapped := 0
+	for _, region := range cache.regions {
+		mapped += region.size
+	}
+	return mapped
+}
+
+// Free unmaps all of the cache's memory. None of its entries may be
+// called afterwards.
+func (cache *CodeCache) Free() {
+	for _, region := range cache.regions {
+		C.munmap(region.mem, C.size_t(region.size))
+	}
+	cache.regions = nil
+}
+
+// Invalidate gives back the entry's memory. A region whose code has all
+// been invalidated is unmapped.
+func (entry *Entry) Invalidate() {
+	if entry.region == nil {
+		return
+	}
+	region := entry.region
+	entry.region = nil
+	region.live -= entry.size
+	if region.live > 0 {
+		return
+	}
+
+	cache := entry.cache
+	for i, r := range cache.regions {
+		if r == region {
+			cache.regions = append(cache.regions[:i], cache.regions[i+1:]...)
+			break
+		}
+	}
+	C.munmap(region.mem, C.size_t(region.size))
+}
+
+// Valid reports whether the entry hasn't been invalidated.
+func (entry *Entry) Valid() bool {
+	return entry.region != nil
+}
+
+// Addr is the address of the entry's code at offset.
+func (entry *Entry) Addr(offset int) uintptr {
+	return uintptr(entry.region.mem) + uintptr(entry.offset+offset)
+}
+
+// Call runs the entry's code from offset as a C function taking a
+// context, a stack pointer and a frame base, and returns the status it
+// leaves in RAX.
+func (entry *Entry) Call(offset int, context unsafe.Pointer, sp uintptr, base uintptr) int64 {
+	if entry.region == nil {
+		panic("asm: call to invalidated code")
+	}
+	code := unsafe.Add(entry.region.mem, entry.offset+offset)
+	return int64(C.call_entry(code, context, C.uintptr_t(sp), C.uintptr_t(base)))
+}
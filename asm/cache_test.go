@@ -0,0 +1,151 @@
+package asm
+
+import (
+	"errors"
+	"testing"
+)
+
+// returning is code returning n, padded with nops up to size bytes.
+func returning(n int, size int) []uint8 {
+	var mov X86_64
+	mov.MovRegImm(RAX, n)
+	code := ExtendCode(nil, []X86_64{mov})
+	for len(code) < size-1 {
+		code = append(code, 0x90)
+	}
+	return ExtendCode(code, []X86_64{ret()})
+}
+
+func TestAdd(t *testing.T) {
+	var cache CodeCache
+	defer cache.Free()
+
+	first, err := cache.Add(returning(1, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := cache.Add(returning(2, 20))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := first.Call(0, nil, 0, 0); got != 1 {
+		t.Errorf("first returned %d, want 1", got)
+	}
+	if got := second.Call(0, nil, 0, 0); got != 2 {
+		t.Errorf("second returned %d, want 2", got)
+	}
+
+	// both share a region, each aligned
+	if second.Addr(0) != first.Addr(codeAlign) {
+		t.Errorf("second at %#x, want %#x", second.Addr(0), first.Addr(codeAlign))
+	}
+	if got := cache.Used(); got != 3*codeAlign {
+		t.Errorf("used %d bytes, want %d", got, 3*codeAlign)
+	}
+	if got := cache.Mapped(); got != CACHE_PAGE_SIZE {
+		t.Errorf("mapped %d bytes, want %d", got, CACHE_PAGE_SIZE)
+	}
+}
+
+func TestAddEmpty(t *testing.T) {
+	var cache CodeCache
+	defer cache.Free()
+
+	for _, code := range [][]uint8{nil, {}} {
+		if _, err := cache.Add(code); !errors.Is(err, ErrEmptyCode) {
+			t.Errorf("got %v, want ErrEmptyCode", err)
+		}
+	}
+	if got := cache.Mapped(); got != 0 {
+		t.Errorf("mapped %d bytes for no code", got)
+	}
+}
+
+func TestAddLarge(t *testing.T) {
+	var cache CodeCache
+	defer cache.Free()
+
+	small, err := cache.Add(returning(1, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// too big for what's left of the first region, and for a region of
+	// the usual size
+	large, err := cache.Add(returning(2, CACHE_PAGE_SIZE+1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := large.Call(0, nil, 0, 0); got != 2 {
+		t.Errorf("large returned %d, want 2", got)
+	}
+	if got := cache.Mapped(); got != 3*CACHE_PAGE_SIZE {
+		t.Errorf("mapped %d bytes, want %d", got, 3*CACHE_PAGE_SIZE)
+	}
+	if got := cache.Used(); got != codeAlign+CACHE_PAGE_SIZE+codeAlign {
+		t.Errorf("used %d bytes, want %d", got, codeAlign+CACHE_PAGE_SIZE+codeAlign)
+	}
+
+	large.Invalidate()
+	if got := cache.Mapped(); got != CACHE_PAGE_SIZE {
+		t.Errorf("mapped %d bytes once the large code is invalidated, want %d", got, CACHE_PAGE_SIZE)
+	}
+	if got := small.Call(0, nil, 0, 0); got != 1 {
+		t.Errorf("small returned %d, want 1", got)
+	}
+}
+
+func TestInvalidate(t *testing.T) {
+	var cache CodeCache
+	defer cache.Free()
+
+	first, err := cache.Add(returning(1, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := cache.Add(returning(2, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first.Invalidate()
+	if first.Valid() || !second.Valid() {
+		t.Fatalf("valid %t and %t, want false and true", first.Valid(), second.Valid())
+	}
+	if got := cache.Used(); got != codeAlign {
+		t.Errorf("used %d bytes, want %d", got, codeAlign)
+	}
+	// the region still has live code
+	if got := cache.Mapped(); got != CACHE_PAGE_SIZE {
+		t.Errorf("mapped %d bytes, want %d", got, CACHE_PAGE_SIZE)
+	}
+	if got := second.Call(0, nil, 0, 0); got != 2 {
+		t.Errorf("second returned %d, want 2", got)
+	}
+
+	// invalidating again changes nothing
+	first.Invalidate()
+	if got := cache.Used(); got != codeAlign {
+		t.Errorf("used %d bytes after invalidating twice, want %d", got, codeAlign)
+	}
+
+	// with no live entries left the region is unmapped
+	second.Invalidate()
+	if got := cache.Mapped(); got != 0 {
+		t.Errorf("mapped %d bytes with no live code, want 0", got)
+	}
+	if got := cache.Used(); got != 0 {
+		t.Errorf("used %d bytes with no live code, want 0", got)
+	}
+
+	// and code added afterwards gets a new one
+	third, err := cache.Add(returning(3, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := third.Call(0, nil, 0, 0); got != 3 {
+		t.Errorf("third returned %d, want 3", got)
+	}
+	if got := cache.Mapped(); got != CACHE_PAGE_SIZE {
+		t.Errorf("mapped %d bytes, want %d", got, CACHE_PAGE_SIZE)
+	}
+}
@@ -0,0 +1,411 @@
+// Package ast declares the syntax tree the parser builds from lox source
+// and the compiler walks to generate bytecode.
+package ast
+
+import (
+	"golox/ast/patternkind"
+	"golox/scanner/token"
+	"golox/value"
+	"strings"
+)
+
+// Span is the part of the source a node was parsed from.
+type Span struct {
+	Start   int // offset of the first byte
+	End     int // offset just after the last byte
+	Line    int
+	EndLine int
+}
+
+func (span Span) Position() Span {
+	return span
+}
+
+// To returns the span from the start of span to the end of other.
+func (span Span) To(other Span) Span {
+	return Span{Start: span.Start, End: other.End, Line: span.Line, EndLine: other.EndLine}
+}
+
+// TokenSpan is the span of a single token.
+func TokenSpan(tok token.Token) Span {
+	return Span{Start: tok.Start, End: tok.Start + len(tok.Lexeme), Line: tok.Line, EndLine: tok.Line}
+}
+
+type Node interface {
+	Position() Span
+}
+
+type Expr interface {
+	Node
+	exprNode()
+}
+
+type Stmt interface {
+	Node
+	stmtNode()
+}
+
+// Program is a whole source file.
+type Program struct {
+	Span
+	Stmts []Stmt
+}
+
+// expressions
+
+// BadExpr stands in for an expression with a syntax error.
+type BadExpr struct {
+	Span
+}
+
+// LiteralExpr is a number, string, true, false or nil.
+type LiteralExpr struct {
+	Span
+	Token token.Token
+	Value value.Value
+}
+
+type VariableExpr struct {
+	Span
+	Name token.Token
+}
+
+// AssignExpr is `target = value` or a compound assignment like
+// `target += value`. The target is a variable, an index or a slice, or a
+// list pattern for `[a, b] = [b, a]`.
+type AssignExpr struct {
+	Span
+	Target Expr
+	Op     token.Token
+	Value  Expr
+}
+
+// IncrementExpr is `++target`, `--target`, `target++` or `target--` on a
+// variable or an index.
+type IncrementExpr struct {
+	Span
+	Target Expr
+	Op     token.Token
+	Prefix bool
+}
+
+type UnaryExpr struct {
+	Span
+	Op      token.Token
+	Operand Expr
+}
+
+type BinaryExpr struct {
+	Span
+	Op    token.Token
+	Left  Expr
+	Right Expr
+}
+
+// LogicalExpr is `and`, `or` or `??`, which don't always evaluate Right.
+type LogicalExpr struct {
+	Span
+	Op    token.Token
+	Left  Expr
+	Right Expr
+}
+
+// ConditionalExpr is `condition ? then : else`.
+type ConditionalExpr struct {
+	Span
+	Condition Expr
+	Then      Expr
+	Else      Expr
+}
+
+type GroupingExpr struct {
+	Span
+	Expr Expr
+}
+
+// CallExpr is a call, Optional when it's `callee?.(args)`.
+type CallExpr struct {
+	Span
+	Callee   Expr
+	Args     []*Argument
+	Optional bool
+}
+
+// Argument is a positional argument, a spread argument `...list` or a
+// keyword argument `name: value`.
+type Argument struct {
+	Span
+	Spread bool
+	Name   *token.Token
+	Value  Expr
+}
+
+// IndexExpr is `object[index]`, Optional when it's `object?.[index]`.
+type IndexExpr struct {
+	Span
+	Object   Expr
+	Index    Expr
+	Optional bool
+}
+
+// SliceExpr is `object[start:end:step]`, where the parts left out are nil.
+type SliceExpr struct {
+	Span
+	Object   Expr
+	Start    Expr
+	End      Expr
+	Step     Expr
+	Optional bool
+}
+
+// PropertyExpr is `object.name`, Optional when it's `object?.name`.
+type PropertyExpr struct {
+	Span
+	Object   Expr
+	Name     token.Token
+	Optional bool
+}
+
+type ListExpr struct {
+	Span
+	Items []Expr
+}
+
+type MapExpr struct {
+	Span
+	Entries []*MapEntry
+}
+
+// MapEntry is `key: value` in a map literal, a bare name as the key being
+// a string literal.
+type MapEntry struct {
+	Span
+	Key   Expr
+	Value Expr
+}
+
+// FunctionExpr is a function declaration's function, a `fun (params) {}`
+// lambda or an arrow function, whose expression body is a return
+// statement. Lambdas have no name.
+type FunctionExpr struct {
+	Span
+	Name   token.Token
+	Params []*Param
+	Body   []Stmt
+	Arrow  bool
+}
+
+// Param is a parameter, which may have a default value, or the rest
+// parameter collecting the extra arguments.
+type Param struct {
+	Span
+	Binding *Binding
+	Default Expr
+	Rest    bool
+}
+
+type YieldExpr struct {
+	Span
+	Keyword token.Token
+	Value   Expr
+}
+
+// Destructure is a `[a, b, ...rest]` or `{x, y: alias}` pattern. Names
+// are in the order the values are unpacked, Keys are the map keys read
+// into them and with Rest the last name takes the remaining list items.
+type Destructure struct {
+	Span
+	IsMap bool
+	Names []token.Token
+	Keys  []token.Token
+	Rest  bool
+}
+
+// Binding is what a declaration, parameter or for-in loop binds: a name
+// or a destructuring pattern.
+type Binding struct {
+	Span
+	Name    token.Token
+	Pattern *Destructure
+}
+
+// statements
+
+// BadStmt stands in for a statement with a syntax error.
+type BadStmt struct {
+	Span
+}
+
+type ExprStmt struct {
+	Span
+	Expr Expr
+}
+
+type PrintStmt struct {
+	Span
+	Expr Expr
+}
+
+type BlockStmt struct {
+	Span
+	Stmts []Stmt
+}
+
+type IfStmt struct {
+	Span
+	Condition Expr
+	Then      Stmt
+	Else      Stmt
+}
+
+type WhileStmt struct {
+	Span
+	Condition Expr
+	Body      Stmt
+}
+
+// ForStmt is `for (init; condition; increment) body`, any of the clauses
+// can be left out.
+type ForStmt struct {
+	Span
+	Init      Stmt
+	Condition Expr
+	Increment Expr
+	Body      Stmt
+}
+
+// ForInStmt is `for (x in iterable)` or `for (i, x in iterable)`.
+type ForInStmt struct {
+	Span
+	Vars     []*Binding
+	Iterable Expr
+	Body     Stmt
+}
+
+// ReturnStmt returns one value, nil when there are none, or a list of
+// them for `return a, b;`.
+type ReturnStmt struct {
+	Span
+	Keyword token.Token
+	Values  []Expr
+}
+
+type MatchStmt struct {
+	Span
+	Keyword token.Token
+	Value   Expr
+	Arms    []*MatchArm
+}
+
+// MatchArm is `patterns [if guard] => body`.
+type MatchArm struct {
+	Span
+	Patterns []*MatchPattern
+	Guard    Expr
+	Body     Stmt
+}
+
+// MatchPattern is a literal, `_`, a name bound to the value or a list of
+// patterns optionally ending with `...rest`.
+type MatchPattern struct {
+	Span
+	Kind     patternkind.PatternKind
+	Literal  value.Value
+	Name     token.Token
+	Elements []*MatchPattern
+	Rest     *token.Token
+}
+
+// VarDecl is a `var` or `const` declaration.
+type VarDecl struct {
+	Span
+	Const   bool
+	Binding *Binding
+	Init    Expr
+}
+
+type FunDecl struct {
+	Span
+	Function *FunctionExpr
+}
+
+// ImportDecl is `import "path" as name;`.
+type ImportDecl struct {
+	Span
+	Path token.Token
+	Name token.Token
+}
+
+// FromDecl is `from "path" import a, b;`.
+type FromDecl struct {
+	Span
+	Path  token.Token
+	Names []token.Token
+}
+
+func (*BadExpr) exprNode()         {}
+func (*LiteralExpr) exprNode()     {}
+func (*VariableExpr) exprNode()    {}
+func (*AssignExpr) exprNode()      {}
+func (*IncrementExpr) exprNode()   {}
+func (*UnaryExpr) exprNode()       {}
+func (*BinaryExpr) exprNode()      {}
+func (*LogicalExpr) exprNode()     {}
+func (*ConditionalExpr) exprNode() {}
+func (*GroupingExpr) exprNode()    {}
+func (*CallExpr) exprNode()        {}
+func (*IndexExpr) exprNode()       {}
+func (*SliceExpr) exprNode()       {}
+func (*PropertyExpr) exprNode()    {}
+func (*ListExpr) exprNode()        {}
+func (*MapExpr) exprNode()         {}
+func (*FunctionExpr) exprNode()    {}
+func (*YieldExpr) exprNode()       {}
+func (*Destructure) exprNode()     {}
+
+func (*BadStmt) stmtNode()    {}
+func (*ExprStmt) stmtNode()   {}
+func (*PrintStmt) stmtNode()  {}
+func (*BlockStmt) stmtNode()  {}
+func (*IfStmt) stmtNode()     {}
+func (*WhileStmt) stmtNode()  {}
+func (*ForStmt) stmtNode()    {}
+func (*ForInStmt) stmtNode()  {}
+func (*ReturnStmt) stmtNode() {}
+func (*MatchStmt) stmtNode()  {}
+func (*VarDecl) stmtNode()    {}
+func (*FunDecl) stmtNode()    {}
+func (*ImportDecl) stmtNode() {}
+func (*FromDecl) stmtNode()   {}
+
+// Binds reports whether the pattern binds any names.
+func (pattern *MatchPattern) Binds() bool {
+	if pattern.Kind == patternkind.PATTERN_BINDING || pattern.Rest != nil && pattern.Rest.Lexeme != "_" {
+		return true
+	}
+	for _, element := range pattern.Elements {
+		if element.Binds() {
+			return true
+		}
+	}
+	return false
+}
+
+// String gives the pattern as written, for error messages.
+func (d *Destructure) String() string {
+	var parts []string
+	for i, name := range d.Names {
+		switch {
+		case d.Rest && i == len(d.Names)-1:
+			parts = append(parts, "..."+name.Lexeme)
+		case d.IsMap && d.Keys[i].Lexeme != name.Lexeme:
+			parts = append(parts, d.Keys[i].Lexeme+": "+name.Lexeme)
+		default:
+			parts = append(parts, name.Lexeme)
+		}
+	}
+	if d.IsMap {
+		return "{" + strings.Join(parts, ", ") + "}"
+	}
+	return "[" + strings.Join(parts, ", ") + "]"
+}
@@ -0,0 +1,145 @@
+package ast
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"golox/ast/patternkind"
+	"golox/scanner/token"
+	"golox/value"
+	"golox/value/valuetype"
+	"io"
+	"math"
+	"reflect"
+	"unicode"
+	"unicode/utf8"
+)
+
+var (
+	spanType        = reflect.TypeOf(Span{})
+	tokenType       = reflect.TypeOf(token.Token{})
+	valueType       = reflect.TypeOf(value.Value{})
+	patternKindType = reflect.TypeOf(patternkind.PatternKind(0))
+)
+
+var patternKindNames = map[patternkind.PatternKind]string{
+	patternkind.PATTERN_LITERAL:  "literal",
+	patternkind.PATTERN_WILDCARD: "wildcard",
+	patternkind.PATTERN_BINDING:  "binding",
+	patternkind.PATTERN_LIST:     "list",
+}
+
+// Dump writes the tree under node as indented JSON. Every node is an
+// object naming its type under "node" followed by its span and fields,
+// in declaration order. Tokens are written as their lexemes. Numbers JSON
+// has no form for, from literals 400 digits long say, are written as
+// {"number": "Infinity"}, "-Infinity" or "NaN".
+func Dump(w io.Writer, node Node) error {
+	var buf bytes.Buffer
+	if err := encode(&buf, reflect.ValueOf(node)); err != nil {
+		return err
+	}
+
+	var out bytes.Buffer
+	if err := json.Indent(&out, buf.Bytes(), "", "  "); err != nil {
+		return err
+	}
+	out.WriteByte('\n')
+	_, err := out.WriteTo(w)
+	return err
+}
+
+func encode(buf *bytes.Buffer, v reflect.Value) error {
+	switch {
+	case v.Kind() == reflect.Interface || v.Kind() == reflect.Pointer:
+		if v.IsNil() {
+			buf.WriteString("null")
+			return nil
+		}
+		return encode(buf, v.Elem())
+
+	case v.Type() == spanType:
+		span := v.Interface().(Span)
+		fmt.Fprintf(buf, `{"start":%d,"end":%d,"line":%d,"endLine":%d}`, span.Start, span.End, span.Line, span.EndLine)
+
+	case v.Type() == tokenType:
+		return encodeScalar(buf, v.Interface().(token.Token).Lexeme)
+
+	case v.Type() == valueType:
+		return encodeScalar(buf, literal(v.Interface().(value.Value)))
+
+	case v.Type() == patternKindType:
+		return encodeScalar(buf, patternKindNames[v.Interface().(patternkind.PatternKind)])
+
+	case v.Kind() == reflect.Struct:
+		fmt.Fprintf(buf, `{"node":%q`, v.Type().Name())
+		for i := 0; i < v.NumField(); i++ {
+			fmt.Fprintf(buf, ",%q:", fieldKey(v.Type().Field(i).Name))
+			if err := encode(buf, v.Field(i)); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('}')
+
+	case v.Kind() == reflect.Slice:
+		buf.WriteByte('[')
+		for i := 0; i < v.Len(); i++ {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			if err := encode(buf, v.Index(i)); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte(']')
+
+	default:
+		return encodeScalar(buf, v.Interface())
+	}
+	return nil
+}
+
+func encodeScalar(buf *bytes.Buffer, val interface{}) error {
+	bytes, err := json.Marshal(val)
+	if err != nil {
+		return err
+	}
+	buf.Write(bytes)
+	return nil
+}
+
+// nonFinite is how a literal JSON has no number for is written.
+type nonFinite struct {
+	Number string `json:"number"`
+}
+
+// fieldKey turns a Go field name into a JSON key, Span into span.
+func fieldKey(name string) string {
+	first, size := utf8.DecodeRuneInString(name)
+	return string(unicode.ToLower(first)) + name[size:]
+}
+
+// literal is the Go value of a literal's value.
+func literal(val value.Value) interface{} {
+	switch {
+	case val.Type == valuetype.VAL_NIL:
+		return nil
+	case val.IsBool():
+		return val.AsBool()
+	case val.IsInt():
+		return val.AsInt()
+	case val.IsNumber():
+		switch number := val.AsNumber(); {
+		case math.IsInf(number, 1):
+			return nonFinite{"Infinity"}
+		case math.IsInf(number, -1):
+			return nonFinite{"-Infinity"}
+		case math.IsNaN(number):
+			return nonFinite{"NaN"}
+		}
+		return val.AsNumber()
+	case val.IsString():
+		return val.AsGoString()
+	}
+	return val.Stringify()
+}
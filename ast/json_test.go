@@ -0,0 +1,63 @@
+package ast
+
+import (
+	"bytes"
+	"encoding/json"
+	"golox/value"
+	"math"
+	"testing"
+)
+
+// decodeLiteral reads back the value a literal was written as.
+func decodeLiteral(t *testing.T, written interface{}) interface{} {
+	t.Helper()
+	tagged, ok := written.(map[string]interface{})
+	if !ok {
+		return written
+	}
+	switch tagged["number"] {
+	case "Infinity":
+		return math.Inf(1)
+	case "-Infinity":
+		return math.Inf(-1)
+	case "NaN":
+		return math.NaN()
+	}
+	t.Fatalf("unknown literal %v", written)
+	return nil
+}
+
+func TestDumpLiterals(t *testing.T) {
+	literals := []value.Value{
+		value.ValNumber(math.Inf(1)),
+		value.ValNumber(math.Inf(-1)),
+		value.ValNumber(math.NaN()),
+		value.ValNumber(1.5),
+		value.ValInt(-3),
+		value.ValObjString("Infinity"),
+	}
+	for _, literal := range literals {
+		var out bytes.Buffer
+		if err := Dump(&out, &LiteralExpr{Value: literal}); err != nil {
+			t.Fatalf("%v: %v", literal, err)
+		}
+		var node struct{ Value interface{} }
+		if err := json.Unmarshal(out.Bytes(), &node); err != nil {
+			t.Fatalf("%v: %v in %s", literal, err, out.String())
+		}
+
+		got := decodeLiteral(t, node.Value)
+		switch {
+		case literal.IsString():
+			if got != literal.AsGoString() {
+				t.Errorf("got %v, want the string %q", got, literal.AsGoString())
+			}
+		case math.IsNaN(literal.AsFloat()):
+			if f, ok := got.(float64); !ok || !math.IsNaN(f) {
+				t.Errorf("got %v, want NaN", got)
+			}
+		case got != literal.AsFloat():
+			t.Errorf("got %v, want %v", got, literal.AsFloat())
+		}
+	}
+}
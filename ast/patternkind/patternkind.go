@@ -0,0 +1,10 @@
+package patternkind
+
+type PatternKind uint8
+
+const (
+	PATTERN_LITERAL  PatternKind = iota
+	PATTERN_WILDCARD PatternKind = iota // _
+	PATTERN_BINDING  PatternKind = iota // a name bound to the value
+	PATTERN_LIST     PatternKind = iota // [p1, p2, ...rest]
+)
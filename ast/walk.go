@@ -0,0 +1,147 @@
+package ast
+
+// Inspect calls f for node and then, if f returns true, for each node
+// under it in source order, depth first. Nil children are skipped.
+func Inspect(node Node, f func(Node) bool) {
+	if node == nil || !f(node) {
+		return
+	}
+
+	expr := func(e Expr) {
+		if e != nil {
+			Inspect(e, f)
+		}
+	}
+	stmt := func(s Stmt) {
+		if s != nil {
+			Inspect(s, f)
+		}
+	}
+	binding := func(b *Binding) {
+		if b != nil {
+			Inspect(b, f)
+		}
+	}
+
+	switch node := node.(type) {
+	case *Program:
+		for _, s := range node.Stmts {
+			stmt(s)
+		}
+
+	case *AssignExpr:
+		expr(node.Target)
+		expr(node.Value)
+	case *IncrementExpr:
+		expr(node.Target)
+	case *UnaryExpr:
+		expr(node.Operand)
+	case *BinaryExpr:
+		expr(node.Left)
+		expr(node.Right)
+	case *LogicalExpr:
+		expr(node.Left)
+		expr(node.Right)
+	case *ConditionalExpr:
+		expr(node.Condition)
+		expr(node.Then)
+		expr(node.Else)
+	case *GroupingExpr:
+		expr(node.Expr)
+	case *CallExpr:
+		expr(node.Callee)
+		for _, arg := range node.Args {
+			Inspect(arg, f)
+		}
+	case *Argument:
+		expr(node.Value)
+	case *IndexExpr:
+		expr(node.Object)
+		expr(node.Index)
+	case *SliceExpr:
+		expr(node.Object)
+		expr(node.Start)
+		expr(node.End)
+		expr(node.Step)
+	case *PropertyExpr:
+		expr(node.Object)
+	case *ListExpr:
+		for _, item := range node.Items {
+			expr(item)
+		}
+	case *MapExpr:
+		for _, entry := range node.Entries {
+			Inspect(entry, f)
+		}
+	case *MapEntry:
+		expr(node.Key)
+		expr(node.Value)
+	case *FunctionExpr:
+		for _, param := range node.Params {
+			Inspect(param, f)
+		}
+		for _, s := range node.Body {
+			stmt(s)
+		}
+	case *Param:
+		binding(node.Binding)
+		expr(node.Default)
+	case *YieldExpr:
+		expr(node.Value)
+	case *Binding:
+		if node.Pattern != nil {
+			Inspect(node.Pattern, f)
+		}
+
+	case *ExprStmt:
+		expr(node.Expr)
+	case *PrintStmt:
+		expr(node.Expr)
+	case *BlockStmt:
+		for _, s := range node.Stmts {
+			stmt(s)
+		}
+	case *IfStmt:
+		expr(node.Condition)
+		stmt(node.Then)
+		stmt(node.Else)
+	case *WhileStmt:
+		expr(node.Condition)
+		stmt(node.Body)
+	case *ForStmt:
+		stmt(node.Init)
+		expr(node.Condition)
+		expr(node.Increment)
+		stmt(node.Body)
+	case *ForInStmt:
+		for _, b := range node.Vars {
+			binding(b)
+		}
+		expr(node.Iterable)
+		stmt(node.Body)
+	case *ReturnStmt:
+		for _, v := range node.Values {
+			expr(v)
+		}
+	case *MatchStmt:
+		expr(node.Value)
+		for _, arm := range node.Arms {
+			Inspect(arm, f)
+		}
+	case *MatchArm:
+		for _, pattern := range node.Patterns {
+			Inspect(pattern, f)
+		}
+		expr(node.Guard)
+		stmt(node.Body)
+	case *MatchPattern:
+		for _, element := range node.Elements {
+			Inspect(element, f)
+		}
+	case *VarDecl:
+		binding(node.Binding)
+		expr(node.Init)
+	case *FunDecl:
+		Inspect(node.Function, f)
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"golox/register"
+	"golox/vm"
+	"golox/vm/interpretresult"
+	"os"
+	"time"
+)
+
+// benchRuns is the number of times bench runs each file each way.
+const benchRuns = 5
+
+// bench runs each file with the optimizer on and off, through the SSA IR
+// (-O2), with the baseline JIT, and on the register machine if it
+// supports the file, and prints how long a run took on average each way,
+// leaving out compiling, and how many instructions it dispatched. What
+// the files print is discarded.
+func bench(paths []string) {
+	devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "an error occurred while opening %s: %s\n", os.DevNull, err.Error())
+		os.Exit(74)
+	}
+	defer devNull.Close()
+
+	for _, path := range paths {
+		source, err := os.ReadFile(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "an error occurred while reading the file: %s\n", err.Error())
+			os.Exit(74)
+		}
+
+		var elapsed [5]time.Duration
+		var dispatches [5]int
+		codeSize := 0
+		supported := true
+		for run := 0; run < benchRuns; run++ {
+			for i, optimize := range []bool{false, true, true, true} {
+				machine := new(vm.VM)
+				machine.Init()
+				machine.Optimize = optimize
+				machine.IR = i == 3
+				if i == 2 {
+					machine.EnableJIT()
+				}
+
+				silenced(devNull, func() { machine.InterpretFile(path, string(source)+"\x00") })
+				elapsed[i] += machine.Elapsed
+				dispatches[i] = machine.Dispatches
+				if i == 2 {
+					codeSize = machine.JITCodeSize()
+					machine.DisableJIT()
+				}
+			}
+
+			// the register machine reports what it doesn't support on
+			// stderr, which is discarded as well
+			machine := new(register.VM)
+			machine.Init()
+			var result interpretresult.InterpretResult
+			silenced(devNull, func() { result = machine.InterpretFile(path, string(source)+"\x00") })
+			elapsed[4] += machine.Elapsed
+			dispatches[4] = machine.Dispatches
+			supported = supported && result != interpretresult.INTERPRET_COMPILE_ERROR
+		}
+
+		unoptimized, optimized := elapsed[0]/benchRuns, elapsed[1]/benchRuns
+		fmt.Printf("%-24s -O0 %10s  optimized %10s  %.2fx\n", path, unoptimized.Round(time.Microsecond),
+			optimized.Round(time.Microsecond), float64(unoptimized)/float64(optimized))
+		fmt.Printf("%-24s dispatches -O0 %10d  optimized %10d\n", "", dispatches[0], dispatches[1])
+		ir := elapsed[3] / benchRuns
+		fmt.Printf("%-24s -O2        %10s  %.2fx  dispatches %10d\n", "", ir.Round(time.Microsecond),
+			float64(unoptimized)/float64(ir), dispatches[3])
+		compiled := elapsed[2] / benchRuns
+		fmt.Printf("%-24s jit        %10s  %.2fx  dispatches %10d  code %d bytes", "", compiled.Round(time.Microsecond),
+			float64(unoptimized)/float64(compiled), dispatches[2], codeSize)
+		if compiled > unoptimized {
+			// every call and global exits to the vm through cgo
+			fmt.Print("  slower: exits to the vm for calls and globals")
+		}
+		fmt.Println()
+		if !supported {
+			fmt.Printf("%-24s register   unsupported\n", "")
+			continue
+		}
+		registers := elapsed[4] / benchRuns
+		fmt.Printf("%-24s register   %10s  %.2fx  dispatches %10d\n", "", registers.Round(time.Microsecond),
+			float64(unoptimized)/float64(registers), dispatches[4])
+	}
+}
+
+// silenced runs run with stdout and stderr going to devNull.
+func silenced(devNull *os.File, run func()) {
+	stdout, stderr := os.Stdout, os.Stderr
+	os.Stdout, os.Stderr = devNull, devNull
+	defer func() { os.Stdout, os.Stderr = stdout, stderr }()
+
+	run()
+}
@@ -3,51 +3,64 @@ package builtins
 import (
 	"fmt"
 	"golox/value"
+	"golox/value/genstate"
 	"golox/value/objtype"
 	"golox/value/valuetype"
+	"math"
 	"time"
+	"unicode/utf8"
 )
 
-func Clock(argCount int, args []value.Value) (value.Value, string) {
+func Clock(_ value.Caller, argCount int, args []value.Value) (value.Value, string) {
 	return value.ValNumber(float64(time.Now().UnixMicro()) / 1000), ""
 }
 
-func Mod(argCount int, args []value.Value) (value.Value, string) {
+func Mod(_ value.Caller, argCount int, args []value.Value) (value.Value, string) {
 	if argCount != 2 {
 		return value.ValNil(), fmt.Sprintf("Required 2 arguments but got %d", argCount)
 	}
 	a := args[0]
 	b := args[1]
 
-	if a.Type != valuetype.VAL_NUMBER {
+	if !a.IsNumeric() {
 		return value.ValNil(), "Required 1st argument to be of type number."
 	}
-	if b.Type != valuetype.VAL_NUMBER {
+	if !b.IsNumeric() {
 		return value.ValNil(), "Required 2nd argument to be of type number."
 	}
 
-	result := value.ValNumber(float64(int(a.AsNumber()) % int(b.AsNumber())))
+	if a.IsInt() && b.IsInt() {
+		if b.AsInt() == 0 {
+			return value.ValNil(), "Modulo by zero."
+		}
+		if b.AsInt() == -1 {
+			return value.ValInt(0), ""
+		}
+		return value.ValInt(a.AsInt() % b.AsInt()), ""
+	}
+
+	result := value.ValNumber(math.Mod(a.AsFloat(), b.AsFloat()))
 
 	return result, ""
 }
 
-func List(argCount int, args []value.Value) (value.Value, string) {
+func List(_ value.Caller, argCount int, args []value.Value) (value.Value, string) {
 	if argCount != 1 {
 		return value.ValNil(), fmt.Sprintf("Required 2 arguments but got %d", argCount)
 	}
 
 	a := args[0]
 
-	if a.Type != valuetype.VAL_NUMBER {
+	if !a.IsNumeric() {
 		return value.ValNil(), "Required 1st argument to be of type number."
 	}
 
-	list := make([]value.Value, int(a.AsNumber()))
+	list := make([]value.Value, int(a.AsFloat()))
 
 	return value.ValObjList(list), ""
 }
 
-func Append(argCount int, args []value.Value) (value.Value, string) {
+func Append(_ value.Caller, argCount int, args []value.Value) (value.Value, string) {
 	if argCount != 2 {
 		return value.ValNil(), fmt.Sprintf("Required 2 arguments but got %d", argCount)
 	}
@@ -65,7 +78,7 @@ func Append(argCount int, args []value.Value) (value.Value, string) {
 	return a, ""
 }
 
-func Pop(argCount int, args []value.Value) (value.Value, string) {
+func Pop(_ value.Caller, argCount int, args []value.Value) (value.Value, string) {
 	if argCount != 1 {
 		return value.ValNil(), fmt.Sprintf("Required 2 arguments but got %d", argCount)
 	}
@@ -83,19 +96,88 @@ func Pop(argCount int, args []value.Value) (value.Value, string) {
 	return result, ""
 }
 
-func Len(argCount int, args []value.Value) (value.Value, string) {
+func Len(_ value.Caller, argCount int, args []value.Value) (value.Value, string) {
 	if argCount != 1 {
-		return value.ValNil(), fmt.Sprintf("Required 2 arguments but got %d", argCount)
+		return value.ValNil(), fmt.Sprintf("Required 1 argument but got %d", argCount)
 	}
 
 	a := args[0]
 
-	if a.Type != valuetype.VAL_OBJ && a.AsObj().Type != objtype.OBJ_LIST {
-		return value.ValNil(), "Required 1st argument to be of type list."
+	switch {
+	case a.IsOBjType(objtype.OBJ_LIST):
+		return value.ValInt(int64(len(a.AsObjList().List))), ""
+	case a.IsString():
+		return value.ValInt(int64(utf8.RuneCountInString(a.AsGoString()))), ""
+	case a.IsOBjType(objtype.OBJ_MAP):
+		return value.ValInt(int64(len(a.AsObjMap().Keys))), ""
 	}
 
-	objList := a.AsObjList()
-	result := value.ValNumber(float64(len(objList.List)))
+	return value.ValNil(), "Required 1st argument to be of type list, string or map."
+}
 
-	return result, ""
+func Done(_ value.Caller, argCount int, args []value.Value) (value.Value, string) {
+	if argCount != 1 {
+		return value.ValNil(), fmt.Sprintf("Required 1 argument but got %d", argCount)
+	}
+
+	if !args[0].IsOBjType(objtype.OBJ_GENERATOR) {
+		return value.ValNil(), "Required 1st argument to be of type generator."
+	}
+
+	return value.ValBool(args[0].AsObjGenerator().State == genstate.GEN_DONE), ""
+}
+
+func Range(_ value.Caller, argCount int, args []value.Value) (value.Value, string) {
+	if argCount < 1 || argCount > 3 {
+		return value.ValNil(), fmt.Sprintf("Required 1-3 arguments but got %d", argCount)
+	}
+
+	for _, arg := range args[:argCount] {
+		if !arg.IsInt() {
+			return value.ValNil(), "Required arguments to be of type int."
+		}
+	}
+
+	start, end, step := int64(0), args[0].AsInt(), int64(1)
+	if argCount > 1 {
+		start, end = args[0].AsInt(), args[1].AsInt()
+	}
+	if argCount > 2 {
+		step = args[2].AsInt()
+	}
+
+	if step == 0 {
+		return value.ValNil(), "Range step must not be zero."
+	}
+
+	return value.ValObjRange(start, end, step), ""
+}
+
+func Keys(_ value.Caller, argCount int, args []value.Value) (value.Value, string) {
+	if argCount != 1 {
+		return value.ValNil(), fmt.Sprintf("Required 1 argument but got %d", argCount)
+	}
+
+	if !args[0].IsOBjType(objtype.OBJ_MAP) {
+		return value.ValNil(), "Required 1st argument to be of type map."
+	}
+
+	keys := make([]value.Value, len(args[0].AsObjMap().Keys))
+	copy(keys, args[0].AsObjMap().Keys)
+
+	return value.ValObjList(keys), ""
+}
+
+func Has(_ value.Caller, argCount int, args []value.Value) (value.Value, string) {
+	if argCount != 2 {
+		return value.ValNil(), fmt.Sprintf("Required 2 arguments but got %d", argCount)
+	}
+
+	if !args[0].IsOBjType(objtype.OBJ_MAP) {
+		return value.ValNil(), "Required 1st argument to be of type map."
+	}
+
+	_, ok := args[0].AsObjMap().Get(args[1])
+
+	return value.ValBool(ok), ""
 }
@@ -0,0 +1,143 @@
+package builtins
+
+import (
+	"fmt"
+	"golox/arith"
+	"golox/value"
+	"golox/value/objtype"
+	"sort"
+)
+
+// Map returns a new list of fn applied to each item of a list.
+func Map(vm value.Caller, argCount int, args []value.Value) (value.Value, string) {
+	if argCount != 2 {
+		return value.ValNil(), fmt.Sprintf("Required 2 arguments but got %d", argCount)
+	}
+
+	if !args[0].IsOBjType(objtype.OBJ_LIST) {
+		return value.ValNil(), "Required 1st argument to be of type list."
+	}
+
+	list, fn := args[0].AsObjList(), args[1]
+	result := make([]value.Value, 0, len(list.List))
+	for i := 0; i < len(list.List); i++ {
+		item, ok := vm.Call(fn, list.List[i])
+		if !ok {
+			return value.ValNil(), ""
+		}
+		result = append(result, item)
+	}
+
+	return value.ValObjList(result), ""
+}
+
+// Filter returns a new list of the items of a list fn is truthy for.
+func Filter(vm value.Caller, argCount int, args []value.Value) (value.Value, string) {
+	if argCount != 2 {
+		return value.ValNil(), fmt.Sprintf("Required 2 arguments but got %d", argCount)
+	}
+
+	if !args[0].IsOBjType(objtype.OBJ_LIST) {
+		return value.ValNil(), "Required 1st argument to be of type list."
+	}
+
+	list, fn := args[0].AsObjList(), args[1]
+	var result []value.Value
+	for i := 0; i < len(list.List); i++ {
+		item := list.List[i]
+		keep, ok := vm.Call(fn, item)
+		if !ok {
+			return value.ValNil(), ""
+		}
+		if keep.IsTruey() {
+			result = append(result, item)
+		}
+	}
+
+	return value.ValObjList(result), ""
+}
+
+// Reduce folds a list with fn(accumulator, item), starting from initial or
+// from the first item when there's no initial value.
+func Reduce(vm value.Caller, argCount int, args []value.Value) (value.Value, string) {
+	if argCount != 2 && argCount != 3 {
+		return value.ValNil(), fmt.Sprintf("Required 2-3 arguments but got %d", argCount)
+	}
+
+	if !args[0].IsOBjType(objtype.OBJ_LIST) {
+		return value.ValNil(), "Required 1st argument to be of type list."
+	}
+
+	list, fn := args[0].AsObjList(), args[1]
+	start := 0
+	var accumulator value.Value
+	if argCount == 3 {
+		accumulator = args[2]
+	} else {
+		if len(list.List) == 0 {
+			return value.ValNil(), "Reduce of an empty list with no initial value."
+		}
+		accumulator = list.List[0]
+		start = 1
+	}
+
+	for i := start; i < len(list.List); i++ {
+		var ok bool
+		accumulator, ok = vm.Call(fn, accumulator, list.List[i])
+		if !ok {
+			return value.ValNil(), ""
+		}
+	}
+
+	return accumulator, ""
+}
+
+// Sort sorts a list in place and returns it. Without a comparator the list
+// must hold only numbers or only strings; less(a, b) is called otherwise.
+func Sort(vm value.Caller, argCount int, args []value.Value) (value.Value, string) {
+	if argCount != 1 && argCount != 2 {
+		return value.ValNil(), fmt.Sprintf("Required 1-2 arguments but got %d", argCount)
+	}
+
+	if !args[0].IsOBjType(objtype.OBJ_LIST) {
+		return value.ValNil(), "Required 1st argument to be of type list."
+	}
+
+	objList := args[0].AsObjList()
+	// the comparator may change the list, so a copy is sorted
+	items := make([]value.Value, len(objList.List))
+	copy(items, objList.List)
+
+	if argCount == 1 {
+		numeric := len(items) > 0 && items[0].IsNumeric()
+		for _, item := range items {
+			if numeric != item.IsNumeric() || !numeric && !item.IsString() {
+				return value.ValNil(), "Can only sort numbers or strings without a comparator."
+			}
+		}
+		sort.SliceStable(items, func(i, j int) bool {
+			if items[i].IsString() {
+				return items[i].AsGoString() < items[j].AsGoString()
+			}
+			// as `<` compares them, so big ints keep their order
+			return arith.LessNumbers(items[i], items[j])
+		})
+	} else {
+		less, failed := args[1], false
+		sort.SliceStable(items, func(i, j int) bool {
+			if failed {
+				return false
+			}
+			result, ok := vm.Call(less, items[i], items[j])
+			failed = !ok
+			return ok && result.IsTruey()
+		})
+		if failed {
+			return value.ValNil(), ""
+		}
+	}
+
+	objList.List = items
+
+	return args[0], ""
+}
@@ -1,11 +1,74 @@
 package chunk
 
-import "golox/value"
+import (
+	"golox/value"
+	"golox/value/valuetype"
+	"math"
+)
 
 type Chunk struct {
 	Code      []uint8
 	Lines     []int
 	Constants []value.Value
+
+	// Feedback has an entry for every byte of Code once the vm has
+	// recorded any, and is nil until then.
+	Feedback []Feedback
+
+	// Locals names the local variables of the function for the debugger.
+	// The offsets are those of the code as compiled, so the optimizer
+	// drops them when it rewrites the code.
+	Locals []Local
+	// Upvalues names the variables the function captures, by index.
+	Upvalues []string
+	// Inlined has the calls whose callee's body was compiled in their
+	// place, in the order of the code.
+	Inlined []Inline
+}
+
+// Local is a local variable held in slot Slot of the frame while the code
+// from Start up to End runs.
+type Local struct {
+	Name       string
+	Slot       int
+	Start, End int
+}
+
+// Inline is the code from Start up to End running the body of Function
+// for a call inlined there, which is at line Line of the function.
+type Inline struct {
+	Function   string
+	Line       int
+	Start, End int
+}
+
+// InlinedAt returns the inlined call the code at offset runs the body
+// of, or nil if it's not part of one.
+func (chunk *Chunk) InlinedAt(offset int) *Inline {
+	for i := range chunk.Inlined {
+		if inlined := &chunk.Inlined[i]; offset >= inlined.Start && offset < inlined.End {
+			return inlined
+		}
+	}
+	return nil
+}
+
+// AddInlined records that the code from start up to the end of the chunk
+// runs the body of inlined, joining it to the last call recorded when
+// that's the same one and ends at start.
+func (chunk *Chunk) AddInlined(inlined *Inline, start int) {
+	end := len(chunk.Code)
+	if inlined == nil || start == end {
+		return
+	}
+	if n := len(chunk.Inlined); n > 0 {
+		last := &chunk.Inlined[n-1]
+		if last.End == start && last.Function == inlined.Function && last.Line == inlined.Line {
+			last.End = end
+			return
+		}
+	}
+	chunk.Inlined = append(chunk.Inlined, Inline{Function: inlined.Function, Line: inlined.Line, Start: start, End: end})
 }
 
 func (chunk *Chunk) Write(bits uint8, lines int) {
@@ -17,3 +80,35 @@ func (chunk *Chunk) AddConstant(constant value.Value) int {
 	chunk.Constants = append(chunk.Constants, constant)
 	return len(chunk.Constants) - 1
 }
+
+// FindConstant returns the index of a constant that's the same as val, or
+// -1 if there isn't one. Only nil, bools, numbers and strings can be
+// shared; numbers are the same when their bits are, so 0 and -0 differ.
+func (chunk *Chunk) FindConstant(val value.Value) int {
+	for i, constant := range chunk.Constants {
+		if SameConstant(constant, val) {
+			return i
+		}
+	}
+	return -1
+}
+
+// SameConstant reports whether a and b can share a constant pool slot.
+func SameConstant(a value.Value, b value.Value) bool {
+	if a.Type != b.Type {
+		return false
+	}
+	switch {
+	case a.Type == valuetype.VAL_NIL:
+		return true
+	case a.IsBool():
+		return a.AsBool() == b.AsBool()
+	case a.IsInt():
+		return a.AsInt() == b.AsInt()
+	case a.IsNumber():
+		return math.Float64bits(a.AsNumber()) == math.Float64bits(b.AsNumber())
+	case a.IsString():
+		return b.IsString() && a.AsGoString() == b.AsGoString()
+	}
+	return false
+}
@@ -0,0 +1,26 @@
+package chunk
+
+// The kinds of operands recorded in Feedback.Seen.
+const (
+	SEEN_NUMBERS uint8 = 1 << iota // both operands numbers
+	SEEN_STRINGS uint8 = 1 << iota // both operands strings
+	SEEN_OTHER   uint8 = 1 << iota // anything else
+)
+
+// Feedback is what the vm has observed at one instruction. It's kept
+// for the generic instructions that can be quickened into specialized
+// ones, and can be read by anything else deciding what code to generate.
+type Feedback struct {
+	Count  uint32 // times the generic instruction ran since it was last specialized
+	Seen   uint8  // the kinds of operands it ran on since then
+	Deopts uint32 // times a specialized instruction here fell back to the generic one
+}
+
+// FeedbackAt returns the feedback of the instruction at offset, making
+// room for the chunk's feedback the first time any is recorded.
+func (chunk *Chunk) FeedbackAt(offset int) *Feedback {
+	if chunk.Feedback == nil {
+		chunk.Feedback = make([]Feedback, len(chunk.Code))
+	}
+	return &chunk.Feedback[offset]
+}
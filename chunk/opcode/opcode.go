@@ -1,37 +1,85 @@
 package opcode
 
 const (
-	OP_CONSTANT      uint8 = iota
-	OP_NEGATE        uint8 = iota
-	OP_ADD           uint8 = iota
-	OP_SUBTRACT      uint8 = iota
-	OP_MULTIPLY      uint8 = iota
-	OP_DIVIDE        uint8 = iota
-	OP_RETURN        uint8 = iota
-	OP_NIL           uint8 = iota
-	OP_TRUE          uint8 = iota
-	OP_FALSE         uint8 = iota
-	OP_PRINT         uint8 = iota
-	OP_NOT           uint8 = iota
-	OP_POP           uint8 = iota
-	OP_EQUAL         uint8 = iota
-	OP_GREATER       uint8 = iota
-	OP_LESS          uint8 = iota
-	OP_DEFINE_GLOBAL uint8 = iota
-	OP_GET_GLOBAL    uint8 = iota
-	OP_SET_GLOBAL    uint8 = iota
-	OP_GET_LOCAL     uint8 = iota
-	OP_SET_LOCAL     uint8 = iota
-	OP_GET_LOCAL_2   uint8 = iota
-	OP_SET_LOCAL_2   uint8 = iota
-	OP_JUMP          uint8 = iota
-	OP_JUMP_IF_FALSE uint8 = iota
-	OP_LOOP          uint8 = iota
-	OP_CALL          uint8 = iota
-	OP_LIST          uint8 = iota
-	OP_STORE         uint8 = iota
-	OP_INDEX         uint8 = iota
-	OP_CLOSURE       uint8 = iota
-	OP_GET_UPVALUE   uint8 = iota
-	OP_SET_UPVALUE   uint8 = iota
+	OP_CONSTANT        uint8 = iota
+	OP_NEGATE          uint8 = iota
+	OP_ADD             uint8 = iota
+	OP_SUBTRACT        uint8 = iota
+	OP_MULTIPLY        uint8 = iota
+	OP_DIVIDE          uint8 = iota
+	OP_RETURN          uint8 = iota
+	OP_NIL             uint8 = iota
+	OP_TRUE            uint8 = iota
+	OP_FALSE           uint8 = iota
+	OP_PRINT           uint8 = iota
+	OP_NOT             uint8 = iota
+	OP_POP             uint8 = iota
+	OP_EQUAL           uint8 = iota
+	OP_GREATER         uint8 = iota
+	OP_LESS            uint8 = iota
+	OP_DEFINE_GLOBAL   uint8 = iota
+	OP_GET_GLOBAL      uint8 = iota
+	OP_SET_GLOBAL      uint8 = iota
+	OP_GET_LOCAL       uint8 = iota
+	OP_SET_LOCAL       uint8 = iota
+	OP_GET_LOCAL_LONG  uint8 = iota
+	OP_SET_LOCAL_LONG  uint8 = iota
+	OP_JUMP            uint8 = iota
+	OP_JUMP_IF_FALSE   uint8 = iota
+	OP_LOOP            uint8 = iota
+	OP_CALL            uint8 = iota
+	OP_LIST            uint8 = iota
+	OP_STORE           uint8 = iota
+	OP_INDEX           uint8 = iota
+	OP_CLOSURE         uint8 = iota
+	OP_GET_UPVALUE     uint8 = iota
+	OP_SET_UPVALUE     uint8 = iota
+	OP_BIT_AND         uint8 = iota
+	OP_BIT_OR          uint8 = iota
+	OP_BIT_XOR         uint8 = iota
+	OP_BIT_NOT         uint8 = iota
+	OP_SHIFT_LEFT      uint8 = iota
+	OP_SHIFT_RIGHT     uint8 = iota
+	OP_MODULO          uint8 = iota
+	OP_DUP             uint8 = iota
+	OP_DUP2            uint8 = iota
+	OP_STORE_POSTFIX   uint8 = iota
+	OP_IMPORT          uint8 = iota
+	OP_GET_PROPERTY    uint8 = iota
+	OP_CLOSE_UPVALUE   uint8 = iota
+	OP_DEFAULT_ARG     uint8 = iota
+	OP_LIST_APPEND     uint8 = iota
+	OP_LIST_EXTEND     uint8 = iota
+	OP_CALL_EX         uint8 = iota
+	OP_YIELD           uint8 = iota
+	OP_MAP             uint8 = iota
+	OP_ITER            uint8 = iota
+	OP_FOR_ITER        uint8 = iota
+	OP_SLICE           uint8 = iota
+	OP_STORE_SLICE     uint8 = iota
+	OP_DEFINE_CONST    uint8 = iota
+	OP_MATCH_LIST      uint8 = iota
+	OP_JUMP_TABLE      uint8 = iota
+	OP_JUMP_IF_NIL     uint8 = iota
+	OP_JUMP_IF_NOT_NIL uint8 = iota
+	OP_UNPACK_LIST     uint8 = iota
+	OP_UNPACK_MAP      uint8 = iota
+	OP_JUMP_IF_TRUE    uint8 = iota
+	OP_PEEK            uint8 = iota
+	OP_CHECK_INLINE    uint8 = iota
+	OP_INLINE_RETURN   uint8 = iota
+
+	// superinstructions the optimizer fuses common sequences into
+	OP_GET_LOCAL_0        uint8 = iota
+	OP_GET_LOCAL_1        uint8 = iota
+	OP_GET_LOCAL_2        uint8 = iota
+	OP_GET_LOCAL_3        uint8 = iota
+	OP_ADD_CONST          uint8 = iota
+	OP_LESS_JUMP_IF_FALSE uint8 = iota
+	OP_INCR_LOCAL         uint8 = iota
+
+	// specialized instructions the vm quickens generic ones into
+	OP_ADD_NUM  uint8 = iota
+	OP_ADD_STR  uint8 = iota
+	OP_LESS_NUM uint8 = iota
 )
@@ -1,29 +1,39 @@
+// Package compiler generates bytecode from the syntax tree the parser
+// builds, one function at a time.
 package compiler
 
 import (
 	"encoding/binary"
 	"fmt"
+	"golox/ast"
 	"golox/chunk"
 	"golox/chunk/opcode"
 	"golox/config"
 	"golox/debug"
-	"golox/scanner"
+	"golox/optimizer"
+	"golox/parser"
 	"golox/scanner/token"
 	"golox/scanner/token/tokentype"
 	"golox/value"
 	"golox/value/functype"
+	"golox/value/valuetype"
 	"math"
 	"os"
-	"strconv"
 )
 
-type Parser struct {
-	panicMode bool
-	hadError  bool
-	compiler  *Compiler
-	previous  token.Token
-	current   token.Token
-	tokens    chan token.Token
+type Generator struct {
+	hadError bool
+	compiler *Compiler
+	line     int // the line the instructions being emitted come from
+
+	// literal values of the global constants declared so far, which
+	// are emitted in place of reading the global
+	globalConsts map[string]value.Value
+
+	optimize bool // whether to run the optimizer over each function
+
+	// the global functions whose calls are inlined, by name
+	inlined map[string]*inlinable
 }
 
 type Compiler struct {
@@ -40,131 +50,100 @@ type Upvalue struct {
 	isLocal bool
 }
 
-type Precedence uint8
-
-const (
-	PREC_NONE       Precedence = iota
-	PREC_ASSIGNMENT Precedence = iota // =
-	PREC_OR         Precedence = iota // or
-	PREC_AND        Precedence = iota // and
-	PREC_EQUALITY   Precedence = iota // == !=
-	PREC_COMPARISON Precedence = iota // < > <= >=
-	PREC_TERM       Precedence = iota // + -
-	PREC_FACTOR     Precedence = iota // * /
-	PREC_UNARY      Precedence = iota // ! -
-	PREC_CALL       Precedence = iota // . ()
-	PREC_SUBSR      Precedence = iota // []
-	PREC_PRIMARY    Precedence = iota
-)
+type Local struct {
+	name       token.Token
+	depth      int
+	isCaptured bool
+	isConst    bool
+	constant   *value.Value // the value of a constant initialised with a literal
+	info       int          // its entry in the chunk's Locals, -1 if it has none
+}
+
+// Compile parses source and generates the script function running it. It
+// returns nil if there were errors, which have been printed to stderr.
+func Compile(source *string, optimize bool) *value.ObjFunction {
+	program, ok := parser.Parse(source)
+	if !ok {
+		return nil
+	}
 
-type ParseRule struct {
-	prefix     ParseFn
-	infix      ParseFn
-	precedence Precedence
+	return Generate(program, optimize)
 }
 
-type ParseFn func(receiver *Parser, canAssign bool)
+// Generate generates the script function running program. It returns nil
+// if there were errors, such as assigning to a constant, which have been
+// printed to stderr. The bytecode is optimized unless optimize is false.
+func Generate(program *ast.Program, optimize bool) *value.ObjFunction {
+	generator := new(Generator)
+	generator.optimize = optimize
+	generator.globalConsts = make(map[string]value.Value)
+	if optimize {
+		generator.inlined = findInlinable(program)
+	}
+	generator.initCompiler(functype.TYPE_SCRIPT)
 
-type Local struct {
-	name  token.Token
-	depth int
-}
-
-var rules map[tokentype.TokenType]ParseRule
-
-func initRules() {
-	rules = make(map[tokentype.TokenType]ParseRule)
-	rules[tokentype.TOKEN_LEFT_BRACKET] = ParseRule{(*Parser).list, (*Parser).subscr, PREC_SUBSR}
-	rules[tokentype.TOKEN_RIGHT_BRACKET] = ParseRule{nil, nil, PREC_NONE}
-	rules[tokentype.TOKEN_LEFT_PAREN] = ParseRule{(*Parser).grouping, (*Parser).call, PREC_CALL}
-	rules[tokentype.TOKEN_RIGHT_PAREN] = ParseRule{nil, nil, PREC_NONE}
-	rules[tokentype.TOKEN_LEFT_BRACE] = ParseRule{nil, nil, PREC_NONE}
-	rules[tokentype.TOKEN_RIGHT_BRACE] = ParseRule{nil, nil, PREC_NONE}
-	rules[tokentype.TOKEN_COMMA] = ParseRule{nil, nil, PREC_NONE}
-	rules[tokentype.TOKEN_DOT] = ParseRule{nil, nil, PREC_NONE}
-	rules[tokentype.TOKEN_MINUS] = ParseRule{(*Parser).unary, (*Parser).binary, PREC_TERM}
-	rules[tokentype.TOKEN_MINUS_MINUS] = ParseRule{nil, nil, PREC_NONE}
-	rules[tokentype.TOKEN_PLUS] = ParseRule{nil, (*Parser).binary, PREC_TERM}
-	rules[tokentype.TOKEN_PLUS_PLUS] = ParseRule{(*Parser).unary, nil, PREC_TERM}
-	rules[tokentype.TOKEN_SEMICOLON] = ParseRule{nil, nil, PREC_NONE}
-	rules[tokentype.TOKEN_SLASH] = ParseRule{nil, (*Parser).binary, PREC_FACTOR}
-	rules[tokentype.TOKEN_STAR] = ParseRule{nil, (*Parser).binary, PREC_FACTOR}
-	rules[tokentype.TOKEN_BANG] = ParseRule{(*Parser).unary, nil, PREC_NONE}
-	rules[tokentype.TOKEN_BANG_EQUAL] = ParseRule{(*Parser).binary, (*Parser).binary, PREC_EQUALITY}
-	rules[tokentype.TOKEN_EQUAL] = ParseRule{(*Parser).binary, nil, PREC_EQUALITY}
-	rules[tokentype.TOKEN_EQUAL_EQUAL] = ParseRule{(*Parser).binary, (*Parser).binary, PREC_COMPARISON}
-	rules[tokentype.TOKEN_GREATER] = ParseRule{(*Parser).binary, (*Parser).binary, PREC_COMPARISON}
-	rules[tokentype.TOKEN_GREATER_EQUAL] = ParseRule{(*Parser).binary, (*Parser).binary, PREC_COMPARISON}
-	rules[tokentype.TOKEN_VAR] = ParseRule{nil, nil, PREC_NONE}
-	rules[tokentype.TOKEN_LESS] = ParseRule{nil, (*Parser).binary, PREC_COMPARISON}
-	rules[tokentype.TOKEN_LESS_EQUAL] = ParseRule{nil, (*Parser).binary, PREC_COMPARISON}
-	rules[tokentype.TOKEN_IDENTIFIER] = ParseRule{(*Parser).variable, nil, PREC_NONE}
-	rules[tokentype.TOKEN_STRING] = ParseRule{(*Parser).stringg, nil, PREC_NONE}
-	rules[tokentype.TOKEN_NUMBER] = ParseRule{(*Parser).number, nil, PREC_NONE}
-	rules[tokentype.TOKEN_AND] = ParseRule{nil, (*Parser).and, PREC_AND}
-	rules[tokentype.TOKEN_ELSE] = ParseRule{nil, nil, PREC_NONE}
-	rules[tokentype.TOKEN_FALSE] = ParseRule{(*Parser).literal, nil, PREC_NONE}
-	rules[tokentype.TOKEN_FOR] = ParseRule{nil, nil, PREC_NONE}
-	rules[tokentype.TOKEN_FUN] = ParseRule{nil, nil, PREC_NONE}
-	rules[tokentype.TOKEN_IF] = ParseRule{nil, nil, PREC_NONE}
-	rules[tokentype.TOKEN_NIL] = ParseRule{(*Parser).literal, nil, PREC_NONE}
-	rules[tokentype.TOKEN_OR] = ParseRule{nil, (*Parser).or, PREC_OR}
-	rules[tokentype.TOKEN_PRINT] = ParseRule{nil, nil, PREC_NONE}
-	rules[tokentype.TOKEN_RETURN] = ParseRule{nil, nil, PREC_NONE}
-	rules[tokentype.TOKEN_THIS] = ParseRule{nil, nil, PREC_NONE}
-	rules[tokentype.TOKEN_TRUE] = ParseRule{(*Parser).literal, nil, PREC_NONE}
-	rules[tokentype.TOKEN_WHILE] = ParseRule{nil, nil, PREC_NONE}
-	rules[tokentype.TOKEN_ERROR] = ParseRule{nil, nil, PREC_NONE}
-	rules[tokentype.TOKEN_EOF] = ParseRule{nil, nil, PREC_NONE}
-}
-
-func (parser *Parser) errorAtCurrent(msg string) {
-	parser.errorAt(&parser.current, msg)
-}
-
-func (parser *Parser) advance() {
-	parser.previous = parser.current
-
-	for {
-		parser.current = <-parser.tokens
-		if parser.current.Type != tokentype.TOKEN_ERROR {
-			break
-		}
+	for _, stmt := range program.Stmts {
+		generator.statement(stmt)
+	}
 
-		parser.errorAtCurrent(parser.current.Lexeme)
+	generator.line = program.EndLine
+	function := generator.endCompiler()
+
+	if generator.hadError {
+		return nil
 	}
+
+	return function
 }
 
-func (parser *Parser) consume(typee tokentype.TokenType, msg string) {
-	if parser.current.Type == typee {
-		parser.advance()
-		return
+// CompileEval compiles source, a single expression, as a function taking
+// the variables called names, for the debugger to evaluate it in a paused
+// frame. The function returns a list of the expression's value followed by
+// the values the variables are left with, as it may assign to them.
+func CompileEval(source *string, names []string) *value.ObjFunction {
+	program, ok := parser.Parse(source)
+	if !ok {
+		return nil
 	}
 
-	parser.errorAtCurrent(msg)
-}
+	generator := new(Generator)
+	generator.globalConsts = make(map[string]value.Value)
+	generator.line = 1
+	var stmt *ast.ExprStmt
+	if len(program.Stmts) == 1 {
+		stmt, _ = program.Stmts[0].(*ast.ExprStmt)
+	}
+	if stmt == nil {
+		generator.error("Expect an expression.")
+		return nil
+	}
 
-func (parser *Parser) check(typee tokentype.TokenType) bool {
-	return parser.current.Type == typee
-}
+	compiler := generator.initCompiler(functype.TYPE_FUNCTION)
+	compiler.function.Name = value.NewObjString("<eval>")
+	generator.beginScope()
+	for _, name := range names {
+		generator.addLocal(token.Token{Type: tokentype.TOKEN_IDENTIFIER, Lexeme: name, Line: 1})
+		generator.markInitialized()
+		compiler.function.Arity++
+	}
+	compiler.function.RequiredArity = compiler.function.Arity
 
-func (parser *Parser) match(typee tokentype.TokenType) bool {
-	if !parser.check(typee) {
-		return false
+	generator.expression(stmt.Expr)
+	for i := range names {
+		generator.emitBytes(opcode.OP_GET_LOCAL, uint8(i+1))
 	}
-	parser.advance()
-	return true
-}
+	generator.emitBytes(opcode.OP_LIST, uint8(len(names)+1))
+	generator.emitByte(opcode.OP_RETURN)
+	function := generator.endCompiler()
 
-func (parser *Parser) error(msg string) {
-	parser.errorAt(&parser.previous, msg)
+	if generator.hadError {
+		return nil
+	}
+	return function
 }
 
-func (parser *Parser) errorAt(token *token.Token, msg string) {
-	if parser.panicMode {
-		return
-	}
-	parser.panicMode = true
+func (generator *Generator) errorAt(token *token.Token, msg string) {
+	generator.hadError = true
 
 	fmt.Fprintf(os.Stderr, "[line %d] Error", token.Line)
 
@@ -179,472 +158,220 @@ func (parser *Parser) errorAt(token *token.Token, msg string) {
 	fmt.Fprintf(os.Stderr, ": %s\n", msg)
 }
 
-func (parser *Parser) currentChunk() *chunk.Chunk {
-	return parser.compiler.function.Chunk.(*chunk.Chunk)
-}
-
-func (parser *Parser) emitByte(b uint8) {
-	parser.currentChunk().Write(b, parser.previous.Line)
-}
-
-func (parser *Parser) emitBytes(b1 uint8, b2 uint8) {
-	parser.emitByte(b1)
-	parser.emitByte(b2)
-}
-
-func (parser *Parser) emitReturn() {
-	parser.emitByte(opcode.OP_NIL)
-	parser.emitByte(opcode.OP_RETURN)
+// error reports an error that isn't about any one token, like a chunk
+// growing too large.
+func (generator *Generator) error(msg string) {
+	generator.hadError = true
+	fmt.Fprintf(os.Stderr, "[line %d] Error: %s\n", generator.line, msg)
 }
 
-func (parser *Parser) makeConstant(val value.Value) uint8 {
-	constIndex := parser.currentChunk().AddConstant(val)
-	if constIndex > 256 {
-		parser.error("Too many constants in one chunk.")
-		return 0
-	}
-
-	return uint8(constIndex)
+// at makes the instructions emitted next come from the end of node.
+func (generator *Generator) at(node ast.Node) {
+	generator.line = node.Position().EndLine
 }
 
-func (parser *Parser) emitConstant(val value.Value) {
-	parser.emitBytes(opcode.OP_CONSTANT, parser.makeConstant(val))
+func (generator *Generator) currentChunk() *chunk.Chunk {
+	return generator.compiler.function.Chunk.(*chunk.Chunk)
 }
 
-func (parser *Parser) endCompiler() *value.ObjFunction {
-	parser.emitReturn()
-
-	funcName := parser.compiler.function.Name.String
-
-	if len(funcName) == 0 {
-		funcName = "script"
-	}
-
-	if config.DEBUG_PRINT_CODE {
-		debug.DisassembleChunk(parser.compiler.function.Chunk.(*chunk.Chunk), funcName)
-	}
-
-	function := parser.compiler.function
-	parser.compiler = parser.compiler.enclosing
-	return function
+func (generator *Generator) emitByte(b uint8) {
+	generator.currentChunk().Write(b, generator.line)
 }
 
-func (parser *Parser) or(_ bool) {
-	elseJump := parser.emitJump(opcode.OP_JUMP_IF_FALSE)
-	endJump := parser.emitJump(opcode.OP_JUMP)
-
-	parser.patchJump(elseJump)
-	parser.emitByte(opcode.OP_POP)
-
-	parser.parsePrecedence(PREC_OR)
-	parser.patchJump(endJump)
+func (generator *Generator) emitBytes(b1 uint8, b2 uint8) {
+	generator.emitByte(b1)
+	generator.emitByte(b2)
 }
 
-func (parser *Parser) and(_ bool) {
-	endJump := parser.emitJump(opcode.OP_JUMP_IF_FALSE)
-	parser.emitByte(opcode.OP_POP)
-	parser.parsePrecedence(PREC_AND)
-	parser.patchJump(endJump)
+func (generator *Generator) emitReturn() {
+	generator.emitByte(opcode.OP_NIL)
+	generator.emitByte(opcode.OP_RETURN)
 }
 
-func (parser *Parser) number(_ bool) {
-	numStr := parser.previous.Lexeme
-	val, _ := strconv.ParseFloat(numStr, len(numStr))
-	parser.emitConstant(value.ValNumber(val))
-}
-
-func (parser *Parser) stringg(_ bool) {
-	lexeme := parser.previous.Lexeme
-	parser.emitConstant(value.ValObjString(lexeme[1 : len(lexeme)-1]))
-}
-
-func (parser *Parser) variable(canAssign bool) {
-	parser.namedVariable(&parser.previous, canAssign)
-
-}
-
-func (parser *Parser) literal(_ bool) {
-	switch parser.previous.Type {
-	case tokentype.TOKEN_FALSE:
-		parser.emitByte(opcode.OP_FALSE)
-	case tokentype.TOKEN_TRUE:
-		parser.emitByte(opcode.OP_TRUE)
-	case tokentype.TOKEN_NIL:
-		parser.emitByte(opcode.OP_NIL)
-	}
-}
-
-func (parser *Parser) grouping(_ bool) {
-	parser.expression()
-	parser.consume(tokentype.TOKEN_RIGHT_PAREN, "Expect ')' after expression.")
-}
-
-func (parser *Parser) call(_ bool) {
-	argCount := parser.argumentList()
-	parser.emitBytes(opcode.OP_CALL, argCount)
-}
-
-func (parser *Parser) unary(_ bool) {
-	operatorType := parser.previous.Type
-
-	parser.expression()
-
-	switch operatorType {
-	case tokentype.TOKEN_BANG:
-		parser.emitByte(opcode.OP_NOT)
-	case tokentype.TOKEN_MINUS:
-		parser.emitByte(opcode.OP_NEGATE)
-	}
-}
-
-func (parser *Parser) binary(_ bool) {
-	operatorType := parser.previous.Type
-	rule := rules[operatorType]
-	parser.parsePrecedence(rule.precedence + 1)
-
-	switch operatorType {
-	case tokentype.TOKEN_PLUS:
-		parser.emitByte(opcode.OP_ADD)
-	case tokentype.TOKEN_MINUS:
-		parser.emitByte(opcode.OP_SUBTRACT)
-	case tokentype.TOKEN_STAR:
-		parser.emitByte(opcode.OP_MULTIPLY)
-	case tokentype.TOKEN_SLASH:
-		parser.emitByte(opcode.OP_DIVIDE)
-	case tokentype.TOKEN_EQUAL_EQUAL:
-		parser.emitByte(opcode.OP_EQUAL)
-	case tokentype.TOKEN_BANG_EQUAL:
-		parser.emitBytes(opcode.OP_EQUAL, opcode.OP_NOT)
-	case tokentype.TOKEN_GREATER:
-		parser.emitByte(opcode.OP_GREATER)
-	case tokentype.TOKEN_GREATER_EQUAL:
-		parser.emitBytes(opcode.OP_LESS, opcode.OP_NOT)
-	case tokentype.TOKEN_LESS:
-		parser.emitByte(opcode.OP_LESS)
-	case tokentype.TOKEN_LESS_EQUAL:
-		parser.emitBytes(opcode.OP_GREATER, opcode.OP_NOT)
-	}
-}
-
-func (parser *Parser) list(_ bool) {
-	count := 0
-	if !parser.check(tokentype.TOKEN_RIGHT_BRACKET) {
-		for ok := true; ok; ok = parser.match(tokentype.TOKEN_COMMA) {
-			if parser.check(tokentype.TOKEN_RIGHT_BRACKET) {
-				break // trailing comma case
-			}
-
-			parser.parsePrecedence(PREC_OR)
-
-			if count == 256 {
-				parser.error("Cannot have more than 256 items in a list literal.")
-			}
-
-			count++
+func (generator *Generator) makeConstant(val value.Value) uint8 {
+	if generator.optimize {
+		if constIndex := generator.currentChunk().FindConstant(val); constIndex >= 0 {
+			return uint8(constIndex)
 		}
 	}
 
-	parser.consume(tokentype.TOKEN_RIGHT_BRACKET, "Expect ']' after list literal.")
-
-	parser.emitBytes(opcode.OP_LIST, uint8(count))
-}
-
-func (parser *Parser) subscr(canAssign bool) {
-	parser.parsePrecedence(PREC_OR)
-	parser.consume(tokentype.TOKEN_RIGHT_BRACKET, "Expect ']' after index.")
-
-	if canAssign && parser.match(tokentype.TOKEN_EQUAL) {
-		parser.expression()
-		parser.emitByte(opcode.OP_STORE)
-	} else {
-		parser.emitByte(opcode.OP_INDEX)
-	}
-}
-
-func (parser *Parser) argumentList() uint8 {
-	argCount := 0
-	if !parser.check(tokentype.TOKEN_RIGHT_PAREN) {
-		for ok := true; ok; ok = parser.match(tokentype.TOKEN_COMMA) {
-			parser.expression()
-			if argCount == 255 {
-				parser.error("Can't have more than 255 arguments.")
-			}
-			argCount++
-		}
-	}
-
-	parser.consume(tokentype.TOKEN_RIGHT_PAREN, "Expect ')' after arguments.")
-	return uint8(argCount)
-}
-
-func (parser *Parser) parsePrecedence(prec Precedence) {
-	parser.advance()
-	prefixRule := rules[parser.previous.Type].prefix
-
-	if prefixRule == nil {
-		parser.error("Expect expression.")
-		return
+	constIndex := generator.currentChunk().AddConstant(val)
+	if constIndex > 256 {
+		generator.error("Too many constants in one chunk.")
+		return 0
 	}
 
-	canAssign := prec <= PREC_ASSIGNMENT
-	prefixRule(parser, canAssign)
-
-	for prec <= rules[parser.current.Type].precedence {
-		parser.advance()
-		infixRule := rules[parser.previous.Type].infix
-		infixRule(parser, canAssign)
-	}
+	return uint8(constIndex)
 }
 
-func (parser *Parser) expression() {
-	parser.parsePrecedence(PREC_ASSIGNMENT)
+func (generator *Generator) emitConstant(val value.Value) {
+	generator.emitBytes(opcode.OP_CONSTANT, generator.makeConstant(val))
 }
 
-func (parser *Parser) block() {
-	for !parser.check(tokentype.TOKEN_RIGHT_BRACE) && !parser.check(tokentype.TOKEN_EOF) {
-		parser.declaration()
+// emitValue emits the instruction pushing a literal value.
+func (generator *Generator) emitValue(val value.Value) {
+	switch {
+	case val.Type == valuetype.VAL_NIL:
+		generator.emitByte(opcode.OP_NIL)
+	case val.IsBool() && val.AsBool():
+		generator.emitByte(opcode.OP_TRUE)
+	case val.IsBool():
+		generator.emitByte(opcode.OP_FALSE)
+	default:
+		generator.emitConstant(val)
 	}
-
-	parser.consume(tokentype.TOKEN_RIGHT_BRACE, "Expect '}' after block.")
-}
-
-func (parser *Parser) expressionStatement() {
-	parser.expression()
-	parser.consume(tokentype.TOKEN_SEMICOLON, "Expect ';' after expression.")
-	parser.emitByte(opcode.OP_POP)
 }
 
-func (parser *Parser) printStatement() {
-	parser.expression()
-	parser.consume(tokentype.TOKEN_SEMICOLON, "Expect ';' after value.")
-	parser.emitByte(opcode.OP_PRINT)
+func (generator *Generator) emitJump(instruction uint8) int {
+	generator.emitByte(instruction)
+	return generator.emitJumpOffset()
 }
 
-func (parser *Parser) emitJump(instruction uint8) int {
-	parser.emitByte(instruction)
-	parser.emitByte(0xff)
-	parser.emitByte(0xff)
-	return len(parser.currentChunk().Code) - 2
+// emitJumpOffset emits a placeholder jump offset for patchJump to fill in.
+func (generator *Generator) emitJumpOffset() int {
+	generator.emitByte(0xff)
+	generator.emitByte(0xff)
+	return len(generator.currentChunk().Code) - 2
 }
 
-func (parser *Parser) patchJump(offset int) {
-	jump := len(parser.currentChunk().Code) - offset - 2
+func (generator *Generator) patchJump(offset int) {
+	jump := len(generator.currentChunk().Code) - offset - 2
 
 	if jump > math.MaxUint16 {
-		parser.error("Too much code to jump over.")
+		generator.error("Too much code to jump over.")
 	}
 
 	bytes := make([]byte, 2)
 	binary.LittleEndian.PutUint16(bytes, uint16(jump))
-	parser.currentChunk().Code[offset] = bytes[0]
-	parser.currentChunk().Code[offset+1] = bytes[1]
+	generator.currentChunk().Code[offset] = bytes[0]
+	generator.currentChunk().Code[offset+1] = bytes[1]
 }
 
-func (parser *Parser) ifStatement() {
-	parser.consume(tokentype.TOKEN_LEFT_PAREN, "Expect '(' after 'if'.")
-	parser.expression()
-	parser.consume(tokentype.TOKEN_RIGHT_PAREN, "Expect ')' after condition.")
+func (generator *Generator) emitLoop(loopStart int) {
+	generator.emitByte(opcode.OP_LOOP)
 
-	thenJump := parser.emitJump(opcode.OP_JUMP_IF_FALSE)
-	parser.emitByte(opcode.OP_POP)
-
-	//then branch
-	parser.statement()
-
-	elseJump := parser.emitJump(opcode.OP_JUMP)
-	parser.patchJump(thenJump)
-
-	//else branch
-	parser.emitByte(opcode.OP_POP)
-	if parser.match(tokentype.TOKEN_ELSE) {
-		parser.statement()
-	}
-
-	parser.patchJump(elseJump)
-}
-
-func (parser *Parser) emitLoop(loopStart int) {
-	parser.emitByte(opcode.OP_LOOP)
-
-	offset := len(parser.currentChunk().Code) - loopStart + 2
+	offset := len(generator.currentChunk().Code) - loopStart + 2
 	if offset > math.MaxUint16 {
-		parser.error("Loop body too large.")
+		generator.error("Loop body too large.")
 	}
 
 	bytes := make([]byte, 2)
 	binary.LittleEndian.PutUint16(bytes, uint16(offset))
-	parser.emitBytes(bytes[0], bytes[1])
-}
-
-func (parser *Parser) whileStatement() {
-	loopStart := len(parser.currentChunk().Code)
-	parser.consume(tokentype.TOKEN_LEFT_PAREN, "Expect '(' after while.")
-	parser.expression()
-	parser.consume(tokentype.TOKEN_RIGHT_PAREN, "Expect ')' after while.")
-
-	exitJump := parser.emitJump(opcode.OP_JUMP_IF_FALSE)
-	parser.emitByte(opcode.OP_POP)
-	parser.statement()
-	parser.emitLoop(loopStart)
-
-	parser.patchJump(exitJump)
-	parser.emitByte(opcode.OP_POP)
+	generator.emitBytes(bytes[0], bytes[1])
 }
 
-func (parser *Parser) forStatement() {
-	parser.beginScope()
-	parser.consume(tokentype.TOKEN_LEFT_PAREN, "Expect '(' after 'for'.")
+func (generator *Generator) initCompiler(funcType functype.FuncType) *Compiler {
+	compiler := new(Compiler)
+	compiler.enclosing = generator.compiler
+	compiler.function = value.NewObjFunction(new(chunk.Chunk))
+	compiler.funcType = funcType
+	compiler.scopeDepth = 0
+	compiler.locals = make([]Local, 0)
 
-	if parser.match(tokentype.TOKEN_VAR) {
-		parser.varDeclaration()
-	} else {
-		if parser.match(tokentype.TOKEN_IDENTIFIER) {
-			parser.variable(true)
-		}
-		parser.consume(tokentype.TOKEN_SEMICOLON, "Expect ';' after loop initializer.")
+	if compiler.funcType == functype.TYPE_SCRIPT {
+		compiler.function.Name = value.ValObjString("<script>").AsString()
 	}
 
-	loopStart := len(parser.currentChunk().Code)
-	exitJump := -1
-
-	if !parser.match(tokentype.TOKEN_SEMICOLON) {
-		parser.expression()
-		parser.consume(tokentype.TOKEN_SEMICOLON, "Expect ';' after loop condition.")
+	generator.compiler = compiler
 
-		exitJump = parser.emitJump(opcode.OP_JUMP_IF_FALSE)
-		parser.emitByte(opcode.OP_POP)
-	}
+	local := Local{depth: 0, name: token.Token{Lexeme: ""}, info: -1}
+	compiler.locals = append(compiler.locals, local)
 
-	if !parser.match(tokentype.TOKEN_RIGHT_PAREN) {
-		bodyJump := parser.emitJump(opcode.OP_JUMP)
-		incrementStart := len(parser.currentChunk().Code)
-		parser.expression()
-		parser.emitByte(opcode.OP_POP)
-		parser.consume(tokentype.TOKEN_RIGHT_PAREN, "Expect ')' after for clauses.")
+	return compiler
+}
 
-		parser.emitLoop(loopStart)
-		loopStart = incrementStart
-		parser.patchJump(bodyJump)
+func (generator *Generator) endCompiler() *value.ObjFunction {
+	generator.emitReturn()
+	for _, local := range generator.compiler.locals {
+		generator.endLocal(local)
 	}
 
-	parser.statement()
-	parser.emitLoop(loopStart)
+	funcName := generator.compiler.function.Name.String
 
-	if exitJump != -1 {
-		parser.patchJump(exitJump)
-		parser.emitByte(opcode.OP_POP)
+	if len(funcName) == 0 {
+		funcName = "script"
 	}
 
-	parser.endScope()
-}
-
-func (parser *Parser) returnStatement() {
-	if parser.compiler.funcType == functype.TYPE_SCRIPT {
-		parser.error("Can't return from top-level code.")
+	if generator.optimize {
+		optimizer.Optimize(generator.compiler.function.Chunk.(*chunk.Chunk))
 	}
 
-	if parser.match(tokentype.TOKEN_SEMICOLON) {
-		parser.emitReturn()
-	} else {
-		parser.expression()
-		parser.consume(tokentype.TOKEN_SEMICOLON, "Expect ';' after return value.")
-		parser.emitByte(opcode.OP_RETURN)
-	}
-}
-
-func (parser *Parser) statement() (breakJump, continueJump int) {
-	breakJump, continueJump = -1, -1
-
-	if parser.match(tokentype.TOKEN_PRINT) {
-		parser.printStatement()
-	} else if parser.match(tokentype.TOKEN_LEFT_BRACE) {
-		parser.beginScope()
-		parser.block()
-		parser.endScope()
-	} else if parser.match(tokentype.TOKEN_IF) {
-		parser.ifStatement()
-	} else if parser.match(tokentype.TOKEN_WHILE) {
-		parser.whileStatement()
-	} else if parser.match(tokentype.TOKEN_FOR) {
-		parser.forStatement()
-	} else if parser.match(tokentype.TOKEN_RETURN) {
-		parser.returnStatement()
-	} else {
-		parser.expressionStatement()
+	if config.DEBUG_PRINT_CODE {
+		debug.DisassembleChunk(generator.compiler.function.Chunk.(*chunk.Chunk), funcName)
 	}
 
-	return
+	function := generator.compiler.function
+	generator.compiler = generator.compiler.enclosing
+	return function
 }
 
-func (parser *Parser) function() {
-	compiler := parser.initCompiler(functype.TYPE_FUNCTION)
-	parser.beginScope()
-
-	compiler.function.Name = value.ValObjString(parser.previous.Lexeme).AsString()
-
-	parser.consume(tokentype.TOKEN_LEFT_PAREN, "Expect '(' after function name.")
-
-	if !parser.check(tokentype.TOKEN_RIGHT_PAREN) {
-		for ok := true; ok; ok = parser.match(tokentype.TOKEN_COMMA) {
-			compiler.function.Arity++
-			if compiler.function.Arity > 255 {
-				parser.errorAtCurrent("Can't have more than 255 parameters.")
-			}
-			arg := parser.parseVariable("Expect parameter name.")
-			parser.defineVaraible(arg)
-		}
-	}
-
-	parser.consume(tokentype.TOKEN_RIGHT_PAREN, "Expect ')' after parameters.")
-	parser.consume(tokentype.TOKEN_LEFT_BRACE, "Expect '{' before function body.")
-	parser.block()
+func (generator *Generator) beginScope() {
+	generator.compiler.scopeDepth++
+}
 
-	function := parser.endCompiler()
-	funcConstIndex := parser.makeConstant(value.ValObjFunction(function))
-	parser.emitBytes(opcode.OP_CLOSURE, funcConstIndex)
+func (generator *Generator) endScope() {
+	generator.compiler.scopeDepth--
 
-	for i := 0; i < function.UpvalueCount; i++ {
-		if compiler.upvalues[i].isLocal {
-			parser.emitByte(1)
+	localCount := len(generator.compiler.locals)
+	for localCount > 0 && generator.compiler.locals[localCount-1].depth > generator.compiler.scopeDepth {
+		generator.endLocal(generator.compiler.locals[localCount-1])
+		if generator.compiler.locals[localCount-1].isCaptured {
+			generator.emitByte(opcode.OP_CLOSE_UPVALUE)
 		} else {
-			fmt.Println("emiting upvalue")
-			parser.emitByte(0)
+			generator.emitByte(opcode.OP_POP)
 		}
-		parser.emitByte(compiler.upvalues[i].index)
+		generator.compiler.locals = generator.compiler.locals[:localCount-1]
+		localCount = len(generator.compiler.locals)
 	}
 }
 
-func (parser *Parser) beginScope() {
-	parser.compiler.scopeDepth++
-}
+func (generator *Generator) addLocal(name token.Token) {
+	if len(generator.compiler.locals) > math.MaxUint8 {
+		generator.errorAt(&name, "Too many local variables in function.")
+	}
 
-func (parser *Parser) endScope() {
-	parser.compiler.scopeDepth--
+	local := Local{name: name, depth: -1, info: -1}
+	generator.compiler.locals = append(generator.compiler.locals, local)
+}
 
-	localCount := len(parser.compiler.locals)
-	for localCount > 0 && parser.compiler.locals[localCount-1].depth > parser.compiler.scopeDepth {
-		parser.emitByte(opcode.OP_POP)
-		parser.compiler.locals = parser.compiler.locals[:localCount-1]
-		localCount = len(parser.compiler.locals)
+// endLocal ends the range of code local is named over, which is the code
+// emitted since it was initialised.
+func (generator *Generator) endLocal(local Local) {
+	if local.info >= 0 {
+		generator.currentChunk().Locals[local.info].End = len(generator.currentChunk().Code)
 	}
 }
 
-func (parser *Parser) addLocal(name token.Token) {
-	if len(parser.compiler.locals) > math.MaxUint8 {
-		parser.error("Too many local variables in function.")
+// hiddenLocal adds a local the program can't name, such as the iterator of
+// a for-in loop, for the value on top of the stack.
+func (generator *Generator) hiddenLocal(name string) uint8 {
+	generator.addLocal(token.Token{Type: tokentype.TOKEN_IDENTIFIER, Lexeme: name, Line: generator.line})
+	return uint8(len(generator.compiler.locals) - 1)
+}
+
+// declarePushedLocal declares a local for the value on top of the stack.
+func (generator *Generator) declarePushedLocal(name token.Token) {
+	for i := len(generator.compiler.locals) - 1; i >= 0; i-- {
+		local := generator.compiler.locals[i]
+		if local.depth < generator.compiler.scopeDepth {
+			break
+		}
+		if local.name.Lexeme == name.Lexeme {
+			generator.errorAt(&name, "Already a variable with this name in this scope.")
+		}
 	}
 
-	local := Local{name: name, depth: -1}
-	parser.compiler.locals = append(parser.compiler.locals, local)
+	generator.addLocal(name)
+	generator.markInitialized()
 }
 
-func (parser *Parser) resolveLocal(compiler *Compiler, name *token.Token) int {
+func (generator *Generator) resolveLocal(compiler *Compiler, name *token.Token) int {
 	localCount := len(compiler.locals)
 	for i := localCount - 1; i >= 0; i-- {
 		local := &compiler.locals[i]
 		if local.name.Lexeme == name.Lexeme {
 			if local.depth == -1 {
-				parser.error("Can't read local variable in its own initializer.")
+				generator.errorAt(name, "Can't read local variable in its own initializer.")
 			}
 			return i
 		}
@@ -653,7 +380,7 @@ func (parser *Parser) resolveLocal(compiler *Compiler, name *token.Token) int {
 	return -1
 }
 
-func (parser *Parser) addUpvalue(compiler *Compiler, index uint8, isLocal bool) int {
+func (generator *Generator) addUpvalue(compiler *Compiler, index uint8, isLocal bool, name string) int {
 	upvalueCount := compiler.function.UpvalueCount
 
 	for i := 0; i < upvalueCount; i++ {
@@ -664,241 +391,530 @@ func (parser *Parser) addUpvalue(compiler *Compiler, index uint8, isLocal bool)
 	}
 
 	if upvalueCount == 256 {
-		parser.error("Too many closure variables in function.")
+		generator.error("Too many closure variables in function.")
 		return 0
 	}
 
 	compiler.upvalues[upvalueCount].isLocal = isLocal
 	compiler.upvalues[upvalueCount].index = index
+	c := compiler.function.Chunk.(*chunk.Chunk)
+	c.Upvalues = append(c.Upvalues, name)
 
 	compiler.function.UpvalueCount++
 	return compiler.function.UpvalueCount - 1
 }
 
-func (parser *Parser) resolveUpvalue(compiler *Compiler, name *token.Token) int {
+func (generator *Generator) resolveUpvalue(compiler *Compiler, name *token.Token) int {
 	if compiler.enclosing == nil {
 		return -1
 	}
 
 	resolved := -1
 
-	local := parser.resolveLocal(compiler.enclosing, name)
+	local := generator.resolveLocal(compiler.enclosing, name)
 	if local != -1 {
-		resolved = parser.addUpvalue(compiler, uint8(local), true)
+		compiler.enclosing.locals[local].isCaptured = true
+		return generator.addUpvalue(compiler, uint8(local), true, name.Lexeme)
 	}
 
-	upvalue := parser.resolveUpvalue(compiler.enclosing, name)
+	upvalue := generator.resolveUpvalue(compiler.enclosing, name)
 	if upvalue != -1 {
-		resolved = parser.addUpvalue(compiler, uint8(upvalue), false)
+		resolved = generator.addUpvalue(compiler, uint8(upvalue), false, name.Lexeme)
 	}
 
 	return resolved
 }
 
-func (parser *Parser) namedVariable(name *token.Token, canAssign bool) {
-	var getOp, setOp uint8
+// resolveVariable returns the instructions and operand used to read and
+// write the variable called name.
+func (generator *Generator) resolveVariable(name *token.Token) (getOp uint8, setOp uint8, arg uint8) {
+	if local := generator.resolveLocal(generator.compiler, name); local != -1 {
+		return opcode.OP_GET_LOCAL, opcode.OP_SET_LOCAL, uint8(local)
+	}
 
-	arg := parser.resolveLocal(parser.compiler, name)
-	if arg != -1 {
-		getOp = opcode.OP_GET_LOCAL
-		setOp = opcode.OP_SET_LOCAL
-	} else {
-		arg = parser.resolveUpvalue(parser.compiler, name)
-		if arg != -1 {
-			getOp = opcode.OP_GET_UPVALUE
-			setOp = opcode.OP_SET_UPVALUE
-		} else {
-			arg = int(parser.identifierConstant(name))
-			getOp = opcode.OP_GET_GLOBAL
-			setOp = opcode.OP_SET_GLOBAL
+	if upvalue := generator.resolveUpvalue(generator.compiler, name); upvalue != -1 {
+		return opcode.OP_GET_UPVALUE, opcode.OP_SET_UPVALUE, uint8(upvalue)
+	}
+
+	return opcode.OP_GET_GLOBAL, opcode.OP_SET_GLOBAL, generator.identifierConstant(name)
+}
+
+// constantVariable looks name up the way resolveVariable does, without
+// capturing it, and tells whether it's a local or upvalue constant and the
+// literal value of a constant if it has one. Global constants are only
+// checked at runtime.
+func (generator *Generator) constantVariable(name *token.Token) (isConst bool, constant *value.Value) {
+	for compiler := generator.compiler; compiler != nil; compiler = compiler.enclosing {
+		for i := len(compiler.locals) - 1; i >= 0; i-- {
+			local := &compiler.locals[i]
+			if local.name.Lexeme == name.Lexeme {
+				if local.depth == -1 {
+					return false, nil
+				}
+				return local.isConst, local.constant
+			}
 		}
 	}
 
-	if canAssign && parser.match(tokentype.TOKEN_EQUAL) {
-		parser.expression()
-		parser.emitBytes(setOp, uint8(arg))
-	} else if canAssign && parser.match(tokentype.TOKEN_MINUS_MINUS) {
-		parser.emitBytes(getOp, uint8(arg))
-		parser.emitBytes(getOp, uint8(arg))
-		one := parser.makeConstant(value.ValNumber(1))
-		parser.emitBytes(opcode.OP_CONSTANT, one)
-		parser.emitByte(opcode.OP_SUBTRACT)
-		parser.emitBytes(setOp, uint8(arg))
-		parser.emitByte(opcode.OP_POP)
-	} else if canAssign && parser.match(tokentype.TOKEN_PLUS_PLUS) {
-		parser.emitBytes(getOp, uint8(arg))
-		parser.emitBytes(getOp, uint8(arg))
-		one := parser.makeConstant(value.ValNumber(1))
-		parser.emitBytes(opcode.OP_CONSTANT, one)
-		parser.emitByte(opcode.OP_ADD)
-		parser.emitBytes(setOp, uint8(arg))
-		parser.emitByte(opcode.OP_POP)
-	} else {
-		parser.emitBytes(getOp, uint8(arg))
+	if val, ok := generator.globalConsts[name.Lexeme]; ok {
+		return false, &val
 	}
+	return false, nil
 }
 
-func (parser *Parser) markInitialized() {
-	if parser.compiler.scopeDepth == 0 {
-		return
+// checkAssignable reports assigning to the local constant called name,
+// the error pointing at where.
+func (generator *Generator) checkAssignable(name *token.Token, where *token.Token) {
+	if isConst, _ := generator.constantVariable(name); isConst {
+		generator.errorAt(where, fmt.Sprintf("Can't assign to constant '%s'.", name.Lexeme))
 	}
-
-	localCount := len(parser.compiler.locals)
-	parser.compiler.locals[localCount-1].depth = parser.compiler.scopeDepth
 }
 
-func (parser *Parser) defineVaraible(global uint8) {
-	if parser.compiler.scopeDepth > 0 {
-		parser.markInitialized()
+func (generator *Generator) markInitialized() {
+	if generator.compiler.scopeDepth == 0 {
 		return
 	}
 
-	parser.emitBytes(opcode.OP_DEFINE_GLOBAL, global)
+	localCount := len(generator.compiler.locals)
+	local := &generator.compiler.locals[localCount-1]
+	local.depth = generator.compiler.scopeDepth
+
+	// hidden locals such as "(iterator)" aren't shown, and a function's
+	// own name is marked twice
+	if local.info >= 0 || local.name.Lexeme == "" || local.name.Lexeme[0] == '(' {
+		return
+	}
+	local.info = len(generator.currentChunk().Locals)
+	generator.currentChunk().Locals = append(generator.currentChunk().Locals, chunk.Local{
+		Name:  local.name.Lexeme,
+		Slot:  localCount - 1,
+		Start: len(generator.currentChunk().Code),
+	})
 }
 
-func (parser *Parser) declareVariable() {
-	if parser.compiler.scopeDepth == 0 {
+func (generator *Generator) defineVaraible(global uint8) {
+	if generator.compiler.scopeDepth > 0 {
+		generator.markInitialized()
 		return
 	}
 
-	name := &parser.previous
+	generator.emitBytes(opcode.OP_DEFINE_GLOBAL, global)
+}
 
-	for i := len(parser.compiler.locals) - 1; i >= 0; i-- {
-		local := parser.compiler.locals[i]
-		if local.depth != -1 && local.depth > parser.compiler.scopeDepth {
+// declareVariable declares name as a local in a block and returns the
+// constant holding it for a global at the top level.
+func (generator *Generator) declareVariable(name *token.Token) uint8 {
+	if generator.compiler.scopeDepth == 0 {
+		return generator.identifierConstant(name)
+	}
+
+	for i := len(generator.compiler.locals) - 1; i >= 0; i-- {
+		local := generator.compiler.locals[i]
+		if local.depth != -1 && local.depth > generator.compiler.scopeDepth {
 			break
 		}
 
 		if local.name.Lexeme == name.Lexeme {
-			parser.error("Already a variable with this name in this scope.")
+			generator.errorAt(name, "Already a variable with this name in this scope.")
 		}
 	}
 
-	parser.addLocal(*name)
+	generator.addLocal(*name)
+	return 0
 }
 
-func (parser *Parser) identifierConstant(name *token.Token) uint8 {
-	return parser.makeConstant(value.ValObjString(name.Lexeme))
+func (generator *Generator) identifierConstant(name *token.Token) uint8 {
+	return generator.makeConstant(value.ValObjString(name.Lexeme))
 }
 
-func (parser *Parser) parseVariable(err string) uint8 {
-	parser.consume(tokentype.TOKEN_IDENTIFIER, err)
+func (generator *Generator) statement(stmt ast.Stmt) {
+	generator.line = stmt.Position().Line
 
-	parser.declareVariable()
-	if parser.compiler.scopeDepth > 0 {
-		return 0
+	switch stmt := stmt.(type) {
+	case *ast.ExprStmt:
+		generator.expression(stmt.Expr)
+		generator.at(stmt)
+		generator.emitByte(opcode.OP_POP)
+	case *ast.PrintStmt:
+		generator.expression(stmt.Expr)
+		generator.at(stmt)
+		generator.emitByte(opcode.OP_PRINT)
+	case *ast.BlockStmt:
+		generator.beginScope()
+		for _, inner := range stmt.Stmts {
+			generator.statement(inner)
+		}
+		generator.at(stmt)
+		generator.endScope()
+	case *ast.IfStmt:
+		generator.ifStatement(stmt)
+	case *ast.WhileStmt:
+		generator.whileStatement(stmt)
+	case *ast.ForStmt:
+		generator.forStatement(stmt)
+	case *ast.ForInStmt:
+		generator.forInStatement(stmt)
+	case *ast.ReturnStmt:
+		generator.returnStatement(stmt)
+	case *ast.MatchStmt:
+		generator.matchStatement(stmt)
+	case *ast.VarDecl:
+		generator.varDeclaration(stmt)
+	case *ast.FunDecl:
+		generator.funDeclaration(stmt)
+	case *ast.ImportDecl:
+		generator.importDeclaration(stmt)
+	case *ast.FromDecl:
+		generator.fromDeclaration(stmt)
+	}
+}
+
+func (generator *Generator) ifStatement(stmt *ast.IfStmt) {
+	generator.expression(stmt.Condition)
+
+	thenJump := generator.emitJump(opcode.OP_JUMP_IF_FALSE)
+	generator.emitByte(opcode.OP_POP)
+
+	//then branch
+	generator.statement(stmt.Then)
+
+	elseJump := generator.emitJump(opcode.OP_JUMP)
+	generator.patchJump(thenJump)
+
+	//else branch
+	generator.emitByte(opcode.OP_POP)
+	if stmt.Else != nil {
+		generator.statement(stmt.Else)
 	}
 
-	return parser.identifierConstant(&parser.previous)
+	generator.patchJump(elseJump)
 }
 
-func (parser *Parser) varDeclaration() {
-	global := parser.parseVariable("Expect variable name.")
+func (generator *Generator) whileStatement(stmt *ast.WhileStmt) {
+	loopStart := len(generator.currentChunk().Code)
+	generator.expression(stmt.Condition)
 
-	if parser.match(tokentype.TOKEN_EQUAL) {
-		parser.expression()
-	} else {
-		parser.emitByte(opcode.OP_NIL)
+	exitJump := generator.emitJump(opcode.OP_JUMP_IF_FALSE)
+	generator.emitByte(opcode.OP_POP)
+	generator.statement(stmt.Body)
+	generator.emitLoop(loopStart)
+
+	generator.patchJump(exitJump)
+	generator.emitByte(opcode.OP_POP)
+}
+
+func (generator *Generator) forStatement(stmt *ast.ForStmt) {
+	generator.beginScope()
+
+	if stmt.Init != nil {
+		generator.statement(stmt.Init)
+	}
+
+	loopStart := len(generator.currentChunk().Code)
+	exitJump := -1
+
+	if stmt.Condition != nil {
+		generator.expression(stmt.Condition)
+
+		exitJump = generator.emitJump(opcode.OP_JUMP_IF_FALSE)
+		generator.emitByte(opcode.OP_POP)
+	}
+
+	if stmt.Increment != nil {
+		bodyJump := generator.emitJump(opcode.OP_JUMP)
+		incrementStart := len(generator.currentChunk().Code)
+		generator.expression(stmt.Increment)
+		generator.emitByte(opcode.OP_POP)
+
+		generator.emitLoop(loopStart)
+		loopStart = incrementStart
+		generator.patchJump(bodyJump)
+	}
+
+	generator.statement(stmt.Body)
+	generator.emitLoop(loopStart)
+
+	if exitJump != -1 {
+		generator.patchJump(exitJump)
+		generator.emitByte(opcode.OP_POP)
+	}
+
+	generator.at(stmt)
+	generator.endScope()
+}
+
+// forInStatement compiles `for (x in iterable)` and `for (i, x in
+// iterable)`. The iterator lives in a hidden local and each iteration's
+// variables are in a scope of their own, so closures capture a fresh
+// binding every time round.
+func (generator *Generator) forInStatement(stmt *ast.ForInStmt) {
+	generator.beginScope()
+
+	generator.expression(stmt.Iterable)
+	generator.emitByte(opcode.OP_ITER)
+	generator.hiddenLocal("(iterator)")
+	generator.markInitialized()
+
+	loopStart := len(generator.currentChunk().Code)
+	withIndex := uint8(0)
+	if len(stmt.Vars) == 2 {
+		withIndex = 1
+	}
+	generator.emitBytes(opcode.OP_FOR_ITER, withIndex)
+	exitJump := generator.emitJumpOffset()
+
+	generator.beginScope()
+	base := len(generator.compiler.locals)
+	for _, binding := range stmt.Vars {
+		if binding.Pattern != nil {
+			generator.hiddenLocal("(pattern)")
+			generator.markInitialized()
+		} else {
+			generator.declarePushedLocal(binding.Name)
+		}
+	}
+	for i, binding := range stmt.Vars {
+		if binding.Pattern != nil {
+			generator.unpackLocal(binding.Pattern, uint8(base+i))
+		}
 	}
+	generator.statement(stmt.Body)
+	generator.at(stmt)
+	generator.endScope()
 
-	parser.consume(tokentype.TOKEN_SEMICOLON, "Expect ; after variable declaration")
-	parser.defineVaraible(global)
+	generator.emitLoop(loopStart)
+	generator.patchJump(exitJump)
+
+	generator.endScope()
 }
 
-func (parser *Parser) funDeclaration() {
-	global := parser.parseVariable("Expect function name.")
-	parser.markInitialized()
-	parser.function()
-	parser.defineVaraible(global)
+func (generator *Generator) returnStatement(stmt *ast.ReturnStmt) {
+	if generator.compiler.funcType == functype.TYPE_SCRIPT {
+		generator.errorAt(&stmt.Keyword, "Can't return from top-level code.")
+	}
+
+	if len(stmt.Values) == 0 {
+		generator.at(stmt)
+		generator.emitReturn()
+		return
+	}
+
+	for _, val := range stmt.Values {
+		generator.expression(val)
+	}
+	generator.at(stmt)
+	if len(stmt.Values) > 1 {
+		generator.emitBytes(opcode.OP_LIST, uint8(len(stmt.Values)))
+	}
+	generator.emitByte(opcode.OP_RETURN)
 }
 
-func (parser *Parser) declaration() {
-	if parser.match(tokentype.TOKEN_VAR) {
-		parser.varDeclaration()
-	} else if parser.match(tokentype.TOKEN_FUN) {
-		parser.funDeclaration()
-	} else {
-		parser.statement()
-	}
-
-	if parser.panicMode {
-		parser.synchronize()
-	}
-}
-
-func (parser *Parser) synchronize() {
-	parser.panicMode = false
-	for parser.current.Type != tokentype.TOKEN_EOF {
-		switch parser.current.Type {
-		case tokentype.TOKEN_FUN:
-			return
-		case tokentype.TOKEN_VAR:
-			return
-		case tokentype.TOKEN_FOR:
-			return
-		case tokentype.TOKEN_IF:
-			return
-		case tokentype.TOKEN_WHILE:
-			return
-		case tokentype.TOKEN_PRINT:
-			return
-		case tokentype.TOKEN_RETURN:
-			return
+// parameters compiles a parameter list. Default values are evaluated in
+// the function's prologue, skipped by OP_DEFAULT_ARG when the argument
+// was passed.
+func (generator *Generator) parameters(compiler *Compiler, params []*ast.Param) {
+	function := compiler.function
+	// parameters given by patterns are unpacked once they're all known
+	var patterns []*ast.Destructure
+	var patternSlots []uint8
+
+	for _, param := range params {
+		generator.at(param)
+
+		if param.Rest {
+			generator.declareVariable(&param.Binding.Name)
+			generator.markInitialized()
+			function.Variadic = true
+			continue
+		}
+
+		if param.Binding.Pattern != nil {
+			patterns = append(patterns, param.Binding.Pattern)
+			patternSlots = append(patternSlots, generator.hiddenLocal("(pattern)"))
+			// can't be passed by keyword
+			function.ParamNames = append(function.ParamNames, "")
+		} else {
+			generator.declareVariable(&param.Binding.Name)
+			function.ParamNames = append(function.ParamNames, param.Binding.Name.Lexeme)
 		}
+		function.Arity++
+
+		if param.Default != nil {
+			slot := uint8(len(compiler.locals) - 1)
+			generator.emitBytes(opcode.OP_DEFAULT_ARG, slot)
+			skip := generator.emitJumpOffset()
+			generator.expression(param.Default)
+			generator.at(param)
+			generator.emitBytes(opcode.OP_SET_LOCAL, slot)
+			generator.emitByte(opcode.OP_POP)
+			generator.patchJump(skip)
+		} else {
+			function.RequiredArity = function.Arity
+		}
+
+		generator.markInitialized()
+	}
 
-		parser.advance()
+	for i := range patterns {
+		generator.unpackLocal(patterns[i], patternSlots[i])
 	}
 }
 
-func (parser *Parser) initCompiler(funcType functype.FuncType) *Compiler {
-	compiler := new(Compiler)
-	compiler.enclosing = parser.compiler
-	compiler.function = value.NewObjFunction(new(chunk.Chunk))
-	compiler.funcType = funcType
-	compiler.scopeDepth = 0
-	compiler.locals = make([]Local, 0)
+// emitClosure finishes the function being compiled and emits the
+// OP_CLOSURE creating it in the enclosing function.
+func (generator *Generator) emitClosure(compiler *Compiler) {
+	function := generator.endCompiler()
+	funcConstIndex := generator.makeConstant(value.ValObjFunction(function))
+	generator.emitBytes(opcode.OP_CLOSURE, funcConstIndex)
 
-	if compiler.funcType == functype.TYPE_SCRIPT {
-		compiler.function.Name = value.ValObjString("<script>").AsString()
+	for i := 0; i < function.UpvalueCount; i++ {
+		if compiler.upvalues[i].isLocal {
+			generator.emitByte(1)
+		} else {
+			generator.emitByte(0)
+		}
+		generator.emitByte(compiler.upvalues[i].index)
 	}
+}
 
-	parser.compiler = compiler
+func lambdaName(line int) string {
+	return fmt.Sprintf("lambda@%d", line)
+}
 
-	if funcType != functype.TYPE_SCRIPT {
-		compiler.function.Name = value.ValObjString(parser.previous.Lexeme).AsString()
+// function compiles a function declaration's function, a lambda or an
+// arrow function and emits the closure creating it.
+func (generator *Generator) function(fn *ast.FunctionExpr) {
+	compiler := generator.initCompiler(functype.TYPE_FUNCTION)
+	if candidate, ok := generator.inlined[fn.Name.Lexeme]; ok && candidate.decl == fn {
+		// the inlined calls check for this very function
+		compiler.function = candidate.function
 	}
+	generator.beginScope()
 
-	local := Local{depth: 0, name: token.Token{Lexeme: ""}}
-	compiler.locals = append(compiler.locals, local)
+	name := fn.Name.Lexeme
+	if len(name) == 0 {
+		name = lambdaName(fn.Line)
+	}
+	compiler.function.Name = value.NewObjString(name)
 
-	return compiler
+	generator.parameters(compiler, fn.Params)
+	for _, stmt := range fn.Body {
+		generator.statement(stmt)
+	}
+
+	generator.at(fn)
+	generator.emitClosure(compiler)
 }
 
-func Compile(source *string) *value.ObjFunction {
-	var scanner scanner.Scanner
-	scanner.Init(source)
-	tokens := make(chan token.Token, 1024)
-	go scanner.Scan(tokens)
+func (generator *Generator) varDeclaration(decl *ast.VarDecl) {
+	if decl.Binding.Pattern != nil {
+		generator.expression(decl.Init)
+		generator.at(decl)
+		generator.emitUnpack(decl.Binding.Pattern)
+		generator.defineUnpacked(decl.Binding.Pattern, decl.Const)
+		return
+	}
 
-	parser := new(Parser)
-	parser.hadError = false
-	parser.panicMode = false
-	parser.tokens = tokens
-	parser.compiler = parser.initCompiler(functype.TYPE_SCRIPT)
+	name := &decl.Binding.Name
+	global := generator.declareVariable(name)
 
-	initRules()
+	if decl.Init != nil {
+		generator.expression(decl.Init)
+	} else {
+		generator.emitByte(opcode.OP_NIL)
+	}
+	generator.at(decl)
 
-	parser.advance()
+	if !decl.Const {
+		generator.defineVaraible(global)
+		return
+	}
 
-	for !parser.match(tokentype.TOKEN_EOF) {
-		parser.declaration()
+	// constants initialised with a literal are also remembered so uses
+	// can push the value directly
+	constant := generator.literalValue(decl.Init)
+	if generator.compiler.scopeDepth > 0 {
+		generator.markInitialized()
+		local := &generator.compiler.locals[len(generator.compiler.locals)-1]
+		local.isConst = true
+		local.constant = constant
+		return
 	}
 
-	function := parser.endCompiler()
+	generator.emitBytes(opcode.OP_DEFINE_CONST, global)
+	if constant != nil {
+		generator.globalConsts[name.Lexeme] = *constant
+	}
+}
 
-	if parser.hadError {
+// literalValue returns the value of expr when it just pushes a literal,
+// possibly negated.
+func (generator *Generator) literalValue(expr ast.Expr) *value.Value {
+	if unary, ok := expr.(*ast.UnaryExpr); ok && unary.Op.Type == tokentype.TOKEN_MINUS {
+		val := generator.pushedValue(unary.Operand)
+		switch {
+		case val == nil:
+			return nil
+		case val.IsInt():
+			negated := value.ValInt(-val.AsInt())
+			return &negated
+		case val.IsNumber():
+			negated := value.ValNumber(-val.AsNumber())
+			return &negated
+		}
 		return nil
 	}
 
-	return function
+	return generator.pushedValue(expr)
+}
+
+// pushedValue returns the value expr pushes when it's a literal, a
+// constant with a literal value, or one of those in parentheses.
+func (generator *Generator) pushedValue(expr ast.Expr) *value.Value {
+	switch expr := expr.(type) {
+	case *ast.LiteralExpr:
+		return &expr.Value
+	case *ast.GroupingExpr:
+		return generator.pushedValue(expr.Expr)
+	case *ast.VariableExpr:
+		_, constant := generator.constantVariable(&expr.Name)
+		return constant
+	}
+	return nil
+}
+
+func modulePath(path token.Token) value.Value {
+	return value.ValObjString(path.Lexeme[1 : len(path.Lexeme)-1])
+}
+
+// importDeclaration compiles `import "path" as name;`, binding the module
+// itself to name.
+func (generator *Generator) importDeclaration(decl *ast.ImportDecl) {
+	generator.at(decl)
+	path := generator.makeConstant(modulePath(decl.Path))
+	global := generator.declareVariable(&decl.Name)
+	generator.emitBytes(opcode.OP_IMPORT, path)
+	generator.defineVaraible(global)
+}
+
+// fromDeclaration compiles `from "path" import a, b;`. Every name imports
+// the module again, which is only a cache lookup after the first one.
+func (generator *Generator) fromDeclaration(decl *ast.FromDecl) {
+	generator.at(decl)
+	path := generator.makeConstant(modulePath(decl.Path))
+
+	for i := range decl.Names {
+		global := generator.declareVariable(&decl.Names[i])
+		name := generator.identifierConstant(&decl.Names[i])
+		generator.emitBytes(opcode.OP_IMPORT, path)
+		generator.emitBytes(opcode.OP_GET_PROPERTY, name)
+		generator.defineVaraible(global)
+	}
+}
+
+func (generator *Generator) funDeclaration(decl *ast.FunDecl) {
+	global := generator.declareVariable(&decl.Function.Name)
+	generator.markInitialized()
+	generator.function(decl.Function)
+	generator.defineVaraible(global)
 }
@@ -0,0 +1,80 @@
+package compiler
+
+import (
+	"golox/ast"
+	"golox/chunk/opcode"
+	"golox/value"
+)
+
+// emitUnpack replaces the value on top of the stack with the values the
+// pattern binds, in order.
+func (generator *Generator) emitUnpack(d *ast.Destructure) {
+	text := generator.makeConstant(value.ValObjString(d.String()))
+
+	if d.IsMap {
+		generator.emitBytes(opcode.OP_UNPACK_MAP, uint8(len(d.Names)))
+		generator.emitByte(text)
+		for i := range d.Keys {
+			generator.emitByte(generator.identifierConstant(&d.Keys[i]))
+		}
+		return
+	}
+
+	count, hasRest := len(d.Names), uint8(0)
+	if d.Rest {
+		count, hasRest = count-1, 1
+	}
+	generator.emitBytes(opcode.OP_UNPACK_LIST, uint8(count))
+	generator.emitBytes(hasRest, text)
+}
+
+// defineUnpacked turns the values emitUnpack pushed into variables: locals
+// in a block, globals at the top level.
+func (generator *Generator) defineUnpacked(d *ast.Destructure, isConst bool) {
+	if generator.compiler.scopeDepth > 0 {
+		for _, name := range d.Names {
+			generator.declarePushedLocal(name)
+			generator.compiler.locals[len(generator.compiler.locals)-1].isConst = isConst
+		}
+		return
+	}
+
+	defineOp := opcode.OP_DEFINE_GLOBAL
+	if isConst {
+		defineOp = opcode.OP_DEFINE_CONST
+	}
+	// the last value is on top
+	for i := len(d.Names) - 1; i >= 0; i-- {
+		generator.emitBytes(defineOp, generator.identifierConstant(&d.Names[i]))
+	}
+}
+
+// unpackLocal binds the pattern's variables from a hidden local holding
+// the value, such as a parameter or a for-in variable.
+func (generator *Generator) unpackLocal(d *ast.Destructure, slot uint8) {
+	generator.at(d)
+	generator.emitBytes(opcode.OP_GET_LOCAL, slot)
+	generator.emitUnpack(d)
+	for _, name := range d.Names {
+		generator.declarePushedLocal(name)
+	}
+}
+
+// destructuringAssignment compiles `[a, b, ...rest] = list`. Like any
+// assignment it evaluates to the value assigned.
+func (generator *Generator) destructuringAssignment(d *ast.Destructure, val ast.Expr) {
+	for i := range d.Names {
+		generator.checkAssignable(&d.Names[i], &d.Names[i])
+	}
+
+	generator.expression(val)
+	generator.line = val.Position().EndLine
+	generator.emitByte(opcode.OP_DUP)
+	generator.emitUnpack(d)
+
+	for i := len(d.Names) - 1; i >= 0; i-- {
+		_, setOp, arg := generator.resolveVariable(&d.Names[i])
+		generator.emitBytes(setOp, arg)
+		generator.emitByte(opcode.OP_POP)
+	}
+}
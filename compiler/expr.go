@@ -0,0 +1,409 @@
+package compiler
+
+import (
+	"golox/ast"
+	"golox/chunk/opcode"
+	"golox/scanner/token/tokentype"
+	"golox/value"
+	"golox/value/functype"
+)
+
+// compoundOps maps compound assignment operators to the opcode combining
+// the old value with the right hand side.
+var compoundOps = map[tokentype.TokenType]uint8{
+	tokentype.TOKEN_PLUS_EQUAL:    opcode.OP_ADD,
+	tokentype.TOKEN_MINUS_EQUAL:   opcode.OP_SUBTRACT,
+	tokentype.TOKEN_STAR_EQUAL:    opcode.OP_MULTIPLY,
+	tokentype.TOKEN_SLASH_EQUAL:   opcode.OP_DIVIDE,
+	tokentype.TOKEN_PERCENT_EQUAL: opcode.OP_MODULO,
+}
+
+// binaryOps are the instructions for each binary operator, some of them
+// a comparison followed by OP_NOT.
+var binaryOps = map[tokentype.TokenType][]uint8{
+	tokentype.TOKEN_PLUS:            {opcode.OP_ADD},
+	tokentype.TOKEN_MINUS:           {opcode.OP_SUBTRACT},
+	tokentype.TOKEN_STAR:            {opcode.OP_MULTIPLY},
+	tokentype.TOKEN_SLASH:           {opcode.OP_DIVIDE},
+	tokentype.TOKEN_PERCENT:         {opcode.OP_MODULO},
+	tokentype.TOKEN_EQUAL_EQUAL:     {opcode.OP_EQUAL},
+	tokentype.TOKEN_BANG_EQUAL:      {opcode.OP_EQUAL, opcode.OP_NOT},
+	tokentype.TOKEN_GREATER:         {opcode.OP_GREATER},
+	tokentype.TOKEN_GREATER_EQUAL:   {opcode.OP_LESS, opcode.OP_NOT},
+	tokentype.TOKEN_LESS:            {opcode.OP_LESS},
+	tokentype.TOKEN_LESS_EQUAL:      {opcode.OP_GREATER, opcode.OP_NOT},
+	tokentype.TOKEN_AMPERSAND:       {opcode.OP_BIT_AND},
+	tokentype.TOKEN_PIPE:            {opcode.OP_BIT_OR},
+	tokentype.TOKEN_CARET:           {opcode.OP_BIT_XOR},
+	tokentype.TOKEN_LESS_LESS:       {opcode.OP_SHIFT_LEFT},
+	tokentype.TOKEN_GREATER_GREATER: {opcode.OP_SHIFT_RIGHT},
+}
+
+// unaryOps are the instructions for each unary operator.
+var unaryOps = map[tokentype.TokenType]uint8{
+	tokentype.TOKEN_BANG:  opcode.OP_NOT,
+	tokentype.TOKEN_MINUS: opcode.OP_NEGATE,
+	tokentype.TOKEN_TILDE: opcode.OP_BIT_NOT,
+}
+
+func (generator *Generator) expression(expr ast.Expr) {
+	generator.line = expr.Position().Line
+
+	switch expr := expr.(type) {
+	case *ast.LiteralExpr:
+		generator.emitValue(expr.Value)
+	case *ast.VariableExpr:
+		generator.variable(expr)
+	case *ast.AssignExpr:
+		generator.assignment(expr)
+	case *ast.IncrementExpr:
+		generator.increment(expr)
+	case *ast.UnaryExpr:
+		generator.unary(expr)
+	case *ast.BinaryExpr:
+		generator.expression(expr.Left)
+		generator.expression(expr.Right)
+		generator.at(expr)
+		for _, op := range binaryOps[expr.Op.Type] {
+			generator.emitByte(op)
+		}
+	case *ast.LogicalExpr:
+		generator.logical(expr)
+	case *ast.ConditionalExpr:
+		generator.conditional(expr)
+	case *ast.GroupingExpr:
+		generator.expression(expr.Expr)
+	case *ast.CallExpr, *ast.IndexExpr, *ast.SliceExpr, *ast.PropertyExpr:
+		var nilJumps []int
+		generator.chainLink(expr, &nilJumps)
+		for _, jump := range nilJumps {
+			generator.patchJump(jump)
+		}
+	case *ast.ListExpr:
+		for _, item := range expr.Items {
+			generator.expression(item)
+		}
+		generator.at(expr)
+		generator.emitBytes(opcode.OP_LIST, uint8(len(expr.Items)))
+	case *ast.MapExpr:
+		for _, entry := range expr.Entries {
+			generator.expression(entry.Key)
+			generator.expression(entry.Value)
+		}
+		generator.at(expr)
+		generator.emitBytes(opcode.OP_MAP, uint8(len(expr.Entries)))
+	case *ast.FunctionExpr:
+		generator.function(expr)
+	case *ast.YieldExpr:
+		generator.yield(expr)
+	}
+}
+
+func (generator *Generator) variable(expr *ast.VariableExpr) {
+	if _, constant := generator.constantVariable(&expr.Name); constant != nil {
+		generator.emitValue(*constant)
+		return
+	}
+
+	getOp, _, arg := generator.resolveVariable(&expr.Name)
+	generator.emitBytes(getOp, arg)
+}
+
+// assignment compiles `target = value` and the compound assignments. Like
+// any expression an assignment evaluates to the value assigned.
+func (generator *Generator) assignment(expr *ast.AssignExpr) {
+	op, compound := compoundOps[expr.Op.Type]
+
+	switch target := expr.Target.(type) {
+	case *ast.VariableExpr:
+		generator.checkAssignable(&target.Name, &expr.Op)
+		getOp, setOp, arg := generator.resolveVariable(&target.Name)
+		if compound {
+			generator.emitBytes(getOp, arg)
+		}
+		generator.expression(expr.Value)
+		generator.at(expr)
+		if compound {
+			generator.emitByte(op)
+		}
+		generator.emitBytes(setOp, arg)
+
+	case *ast.IndexExpr:
+		generator.expression(target.Object)
+		generator.expression(target.Index)
+		if compound {
+			// the list and index are kept on the stack so both are evaluated once
+			generator.at(target)
+			generator.emitByte(opcode.OP_DUP2)
+			generator.emitByte(opcode.OP_INDEX)
+		}
+		generator.expression(expr.Value)
+		generator.at(expr)
+		if compound {
+			generator.emitByte(op)
+		}
+		generator.emitByte(opcode.OP_STORE)
+
+	case *ast.SliceExpr:
+		generator.sliceBounds(target)
+		generator.expression(expr.Value)
+		generator.at(expr)
+		generator.emitByte(opcode.OP_STORE_SLICE)
+
+	case *ast.Destructure:
+		generator.destructuringAssignment(target, expr.Value)
+	}
+}
+
+// emitIncrement adds or subtracts one from the value on top of the stack.
+func (generator *Generator) emitIncrement(operatorType tokentype.TokenType) {
+	generator.emitConstant(value.ValInt(1))
+	if operatorType == tokentype.TOKEN_PLUS_PLUS {
+		generator.emitByte(opcode.OP_ADD)
+	} else {
+		generator.emitByte(opcode.OP_SUBTRACT)
+	}
+}
+
+// increment compiles `++target` and `--target`, which leave the new value
+// on the stack, and `target++` and `target--`, which leave the old one.
+func (generator *Generator) increment(expr *ast.IncrementExpr) {
+	switch target := expr.Target.(type) {
+	case *ast.VariableExpr:
+		if expr.Prefix {
+			generator.checkAssignable(&target.Name, &target.Name)
+		} else {
+			generator.checkAssignable(&target.Name, &expr.Op)
+		}
+		getOp, setOp, arg := generator.resolveVariable(&target.Name)
+		generator.at(expr)
+		generator.emitBytes(getOp, arg)
+		if expr.Prefix {
+			generator.emitIncrement(expr.Op.Type)
+			generator.emitBytes(setOp, arg)
+			return
+		}
+		generator.emitByte(opcode.OP_DUP)
+		generator.emitIncrement(expr.Op.Type)
+		generator.emitBytes(setOp, arg)
+		generator.emitByte(opcode.OP_POP)
+
+	case *ast.IndexExpr:
+		if expr.Prefix {
+			generator.incrementTarget(target.Object)
+		} else {
+			generator.expression(target.Object)
+		}
+		generator.expression(target.Index)
+		generator.at(expr)
+		generator.emitByte(opcode.OP_DUP2)
+		generator.emitByte(opcode.OP_INDEX)
+		if expr.Prefix {
+			generator.emitIncrement(expr.Op.Type)
+			generator.emitByte(opcode.OP_STORE)
+			return
+		}
+		generator.emitByte(opcode.OP_DUP)
+		generator.emitIncrement(expr.Op.Type)
+		generator.emitByte(opcode.OP_STORE_POSTFIX)
+	}
+}
+
+// incrementTarget pushes the list indexed by a prefix increment, a
+// variable read as it is rather than as a constant's value.
+func (generator *Generator) incrementTarget(expr ast.Expr) {
+	switch expr := expr.(type) {
+	case *ast.VariableExpr:
+		getOp, _, arg := generator.resolveVariable(&expr.Name)
+		generator.emitBytes(getOp, arg)
+	case *ast.IndexExpr:
+		generator.incrementTarget(expr.Object)
+		generator.expression(expr.Index)
+		generator.at(expr)
+		generator.emitByte(opcode.OP_INDEX)
+	}
+}
+
+func (generator *Generator) unary(expr *ast.UnaryExpr) {
+	generator.expression(expr.Operand)
+	generator.at(expr)
+	generator.emitByte(unaryOps[expr.Op.Type])
+}
+
+// logical compiles `and`, `or` and `a ?? b`, which is b only when a is
+// nil.
+func (generator *Generator) logical(expr *ast.LogicalExpr) {
+	generator.expression(expr.Left)
+	generator.line = expr.Op.Line
+
+	var endJump int
+	switch expr.Op.Type {
+	case tokentype.TOKEN_AND:
+		endJump = generator.emitJump(opcode.OP_JUMP_IF_FALSE)
+	case tokentype.TOKEN_OR:
+		elseJump := generator.emitJump(opcode.OP_JUMP_IF_FALSE)
+		endJump = generator.emitJump(opcode.OP_JUMP)
+		generator.patchJump(elseJump)
+	default:
+		endJump = generator.emitJump(opcode.OP_JUMP_IF_NOT_NIL)
+	}
+	generator.emitByte(opcode.OP_POP)
+
+	generator.expression(expr.Right)
+	generator.patchJump(endJump)
+}
+
+// conditional compiles `cond ? a : b`.
+func (generator *Generator) conditional(expr *ast.ConditionalExpr) {
+	generator.expression(expr.Condition)
+	elseJump := generator.emitJump(opcode.OP_JUMP_IF_FALSE)
+	generator.emitByte(opcode.OP_POP)
+	generator.expression(expr.Then)
+	endJump := generator.emitJump(opcode.OP_JUMP)
+
+	generator.patchJump(elseJump)
+	generator.emitByte(opcode.OP_POP)
+	generator.expression(expr.Else)
+	generator.patchJump(endJump)
+}
+
+// chainLink compiles a call, subscript, slice or property and the chain of
+// them it's applied to. After an optional link's object is pushed, a nil
+// object jumps past the rest of the chain, leaving nil as its value; the
+// jumps are added to nilJumps for the end of the chain to patch.
+func (generator *Generator) chainLink(expr ast.Expr, nilJumps *[]int) {
+	if call, ok := expr.(*ast.CallExpr); ok {
+		if candidate := generator.inlineTarget(call); candidate != nil {
+			generator.inlineCall(call, candidate)
+			return
+		}
+	}
+
+	var object ast.Expr
+	var optional bool
+	switch expr := expr.(type) {
+	case *ast.CallExpr:
+		object, optional = expr.Callee, expr.Optional
+	case *ast.IndexExpr:
+		object, optional = expr.Object, expr.Optional
+	case *ast.SliceExpr:
+		object, optional = expr.Object, expr.Optional
+	case *ast.PropertyExpr:
+		object, optional = expr.Object, expr.Optional
+	default:
+		generator.expression(expr)
+		return
+	}
+
+	generator.chainLink(object, nilJumps)
+	if optional {
+		generator.line = object.Position().EndLine
+		*nilJumps = append(*nilJumps, generator.emitJump(opcode.OP_JUMP_IF_NIL))
+	}
+
+	switch expr := expr.(type) {
+	case *ast.CallExpr:
+		generator.call(expr)
+	case *ast.IndexExpr:
+		generator.expression(expr.Index)
+		generator.at(expr)
+		generator.emitByte(opcode.OP_INDEX)
+	case *ast.SliceExpr:
+		generator.sliceParts(expr)
+		generator.at(expr)
+		generator.emitByte(opcode.OP_SLICE)
+	case *ast.PropertyExpr:
+		generator.at(expr)
+		name := generator.identifierConstant(&expr.Name)
+		generator.emitBytes(opcode.OP_GET_PROPERTY, name)
+	}
+}
+
+// sliceBounds pushes the object being sliced and the slice's start, end
+// and step.
+func (generator *Generator) sliceBounds(slice *ast.SliceExpr) {
+	generator.expression(slice.Object)
+	generator.sliceParts(slice)
+}
+
+// sliceParts pushes a slice's start, end and step, nil for those left
+// out.
+func (generator *Generator) sliceParts(slice *ast.SliceExpr) {
+	for _, bound := range []ast.Expr{slice.Start, slice.End, slice.Step} {
+		if bound == nil {
+			generator.at(slice)
+			generator.emitByte(opcode.OP_NIL)
+		} else {
+			generator.expression(bound)
+		}
+	}
+}
+
+// call compiles the arguments of a call. Plain positional arguments go
+// straight onto the stack for OP_CALL. Once a spread or keyword argument
+// shows up, the positional arguments so far are gathered into a list and
+// the call becomes an OP_CALL_EX taking that list and the keyword values.
+func (generator *Generator) call(expr *ast.CallExpr) {
+	argCount := 0
+	collected := false
+	var keywords []uint8
+
+	collect := func() {
+		if !collected {
+			generator.emitBytes(opcode.OP_LIST, uint8(argCount))
+			collected = true
+		}
+	}
+
+	for _, arg := range expr.Args {
+		generator.at(arg)
+		switch {
+		case arg.Spread:
+			collect()
+			generator.expression(arg.Value)
+			generator.at(arg)
+			generator.emitByte(opcode.OP_LIST_EXTEND)
+		case arg.Name != nil:
+			collect()
+			keywords = append(keywords, generator.identifierConstant(arg.Name))
+			generator.expression(arg.Value)
+		default:
+			generator.expression(arg.Value)
+			if collected {
+				generator.at(arg)
+				generator.emitByte(opcode.OP_LIST_APPEND)
+			} else {
+				argCount++
+			}
+		}
+	}
+
+	generator.at(expr)
+	if !collected {
+		generator.emitBytes(opcode.OP_CALL, uint8(argCount))
+		return
+	}
+
+	generator.emitBytes(opcode.OP_CALL_EX, uint8(len(keywords)))
+	for _, name := range keywords {
+		generator.emitByte(name)
+	}
+}
+
+// yield compiles `yield value`, which evaluates to whatever the generator
+// is resumed with. Any function containing it becomes a generator.
+func (generator *Generator) yield(expr *ast.YieldExpr) {
+	if generator.compiler.funcType == functype.TYPE_SCRIPT {
+		generator.errorAt(&expr.Keyword, "Can't yield from top-level code.")
+	}
+	generator.compiler.function.IsGenerator = true
+
+	if expr.Value != nil {
+		generator.expression(expr.Value)
+	} else {
+		generator.emitByte(opcode.OP_NIL)
+	}
+
+	generator.at(expr)
+	generator.emitByte(opcode.OP_YIELD)
+}
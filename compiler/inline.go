@@ -0,0 +1,228 @@
+package compiler
+
+import (
+	"golox/ast"
+	"golox/chunk"
+	"golox/chunk/opcode"
+	"golox/value"
+)
+
+// maxInlineNodes is the size of the largest expression an inlined
+// function can return, counting every literal, parameter and operator.
+const maxInlineNodes = 16
+
+// inlinable is a global function whose calls have its body emitted in
+// their place.
+type inlinable struct {
+	decl *ast.FunctionExpr
+	// made before the declaration is compiled, so that calls before it
+	// can check they call it
+	function *value.ObjFunction
+	params   map[string]int // the index of each parameter
+	body     ast.Expr       // the expression it returns
+}
+
+// findInlinable finds the functions of program worth inlining: global
+// functions declared once and never assigned to that only return an
+// expression of literals, parameters and operators, so they don't call
+// anything or capture any variable.
+func findInlinable(program *ast.Program) map[string]*inlinable {
+	declared := make(map[string]int)
+	declare := func(b *ast.Binding) {
+		if b.Pattern == nil {
+			declared[b.Name.Lexeme]++
+			return
+		}
+		for _, name := range b.Pattern.Names {
+			declared[name.Lexeme]++
+		}
+	}
+	for _, stmt := range program.Stmts {
+		switch stmt := stmt.(type) {
+		case *ast.VarDecl:
+			declare(stmt.Binding)
+		case *ast.FunDecl:
+			declared[stmt.Function.Name.Lexeme]++
+		case *ast.ImportDecl:
+			declared[stmt.Name.Lexeme]++
+		case *ast.FromDecl:
+			for _, name := range stmt.Names {
+				declared[name.Lexeme]++
+			}
+		}
+	}
+
+	// any assignment to the name disqualifies it, even one to a local
+	// shadowing the global
+	assigned := make(map[string]bool)
+	ast.Inspect(program, func(node ast.Node) bool {
+		var target ast.Expr
+		switch node := node.(type) {
+		case *ast.AssignExpr:
+			target = node.Target
+		case *ast.IncrementExpr:
+			target = node.Target
+		}
+		switch target := target.(type) {
+		case *ast.VariableExpr:
+			assigned[target.Name.Lexeme] = true
+		case *ast.Destructure:
+			for _, name := range target.Names {
+				assigned[name.Lexeme] = true
+			}
+		}
+		return true
+	})
+
+	inlined := make(map[string]*inlinable)
+	for _, stmt := range program.Stmts {
+		decl, ok := stmt.(*ast.FunDecl)
+		if !ok {
+			continue
+		}
+		name := decl.Function.Name.Lexeme
+		if declared[name] != 1 || assigned[name] {
+			continue
+		}
+		if candidate := inlineCandidate(decl.Function); candidate != nil {
+			inlined[name] = candidate
+		}
+	}
+	return inlined
+}
+
+// inlineCandidate returns fn as an inlinable function if it's one.
+func inlineCandidate(fn *ast.FunctionExpr) *inlinable {
+	if len(fn.Body) != 1 {
+		return nil
+	}
+	ret, ok := fn.Body[0].(*ast.ReturnStmt)
+	if !ok || len(ret.Values) != 1 {
+		return nil
+	}
+
+	params := make(map[string]int)
+	for i, param := range fn.Params {
+		if param.Rest || param.Default != nil || param.Binding.Pattern != nil {
+			return nil
+		}
+		params[param.Binding.Name.Lexeme] = i
+	}
+
+	nodes := 0
+	if !inlinableExpr(ret.Values[0], params, &nodes) || nodes > maxInlineNodes {
+		return nil
+	}
+	function := value.NewObjFunction(new(chunk.Chunk))
+	function.Name = value.NewObjString(fn.Name.Lexeme)
+	return &inlinable{
+		decl:     fn,
+		function: function,
+		params:   params,
+		body:     ret.Values[0],
+	}
+}
+
+// inlinableExpr reports whether expr only uses literals, the parameters
+// and operators, counting its nodes.
+func inlinableExpr(expr ast.Expr, params map[string]int, nodes *int) bool {
+	*nodes++
+	switch expr := expr.(type) {
+	case *ast.LiteralExpr:
+		return true
+	case *ast.VariableExpr:
+		_, ok := params[expr.Name.Lexeme]
+		return ok
+	case *ast.GroupingExpr:
+		return inlinableExpr(expr.Expr, params, nodes)
+	case *ast.UnaryExpr:
+		_, ok := unaryOps[expr.Op.Type]
+		return ok && inlinableExpr(expr.Operand, params, nodes)
+	case *ast.BinaryExpr:
+		_, ok := binaryOps[expr.Op.Type]
+		return ok && inlinableExpr(expr.Left, params, nodes) && inlinableExpr(expr.Right, params, nodes)
+	}
+	return false
+}
+
+// inlineTarget returns the function expr calls if the call can be
+// inlined: a plain call of an inlinable function, with an argument for
+// each parameter, where its name isn't shadowed by a local.
+func (generator *Generator) inlineTarget(expr *ast.CallExpr) *inlinable {
+	callee, ok := expr.Callee.(*ast.VariableExpr)
+	if !ok || expr.Optional {
+		return nil
+	}
+	candidate, ok := generator.inlined[callee.Name.Lexeme]
+	if !ok || len(expr.Args) != len(candidate.params) {
+		return nil
+	}
+	for _, arg := range expr.Args {
+		if arg.Spread || arg.Name != nil {
+			return nil
+		}
+	}
+	for compiler := generator.compiler; compiler != nil; compiler = compiler.enclosing {
+		for _, local := range compiler.locals {
+			if local.name.Lexeme == callee.Name.Lexeme {
+				return nil
+			}
+		}
+	}
+	return candidate
+}
+
+// inlineCall compiles a call of an inlinable function. The callee and
+// arguments are pushed as for a call; OP_CHECK_INLINE goes on to the
+// body, which reads the arguments with OP_PEEK, when the callee is still
+// the function, and to a real call when the global has been redefined.
+func (generator *Generator) inlineCall(expr *ast.CallExpr, candidate *inlinable) {
+	generator.expression(expr.Callee)
+	for _, arg := range expr.Args {
+		generator.at(arg)
+		generator.expression(arg.Value)
+	}
+
+	generator.at(expr)
+	argCount := uint8(len(expr.Args))
+	generator.emitBytes(opcode.OP_CHECK_INLINE, generator.makeConstant(value.ValObjFunction(candidate.function)))
+	generator.emitByte(argCount)
+	callJump := generator.emitJumpOffset()
+
+	start := len(generator.currentChunk().Code)
+	generator.inlineExpression(candidate.body, candidate.params, len(expr.Args), 0)
+	// a runtime error in the body still shows the function it's in
+	generator.currentChunk().AddInlined(&chunk.Inline{
+		Function: candidate.decl.Name.Lexeme,
+		Line:     candidate.body.Position().Line,
+	}, start)
+	generator.emitBytes(opcode.OP_INLINE_RETURN, argCount)
+	endJump := generator.emitJump(opcode.OP_JUMP)
+
+	generator.patchJump(callJump)
+	generator.emitBytes(opcode.OP_CALL, argCount)
+	generator.patchJump(endJump)
+}
+
+// inlineExpression emits the body of an inlined function, depth being
+// the number of values it has pushed above the arguments so far. The
+// instructions keep the line of the call.
+func (generator *Generator) inlineExpression(expr ast.Expr, params map[string]int, argCount int, depth int) {
+	switch expr := expr.(type) {
+	case *ast.LiteralExpr:
+		generator.emitValue(expr.Value)
+	case *ast.VariableExpr:
+		generator.emitBytes(opcode.OP_PEEK, uint8(argCount-1-params[expr.Name.Lexeme]+depth))
+	case *ast.GroupingExpr:
+		generator.inlineExpression(expr.Expr, params, argCount, depth)
+	case *ast.UnaryExpr:
+		generator.inlineExpression(expr.Operand, params, argCount, depth)
+		generator.emitByte(unaryOps[expr.Op.Type])
+	case *ast.BinaryExpr:
+		generator.inlineExpression(expr.Left, params, argCount, depth)
+		generator.inlineExpression(expr.Right, params, argCount, depth+1)
+		for _, op := range binaryOps[expr.Op.Type] {
+			generator.emitByte(op)
+		}
+	}
+}
@@ -0,0 +1,315 @@
+package compiler
+
+import (
+	"encoding/binary"
+	"fmt"
+	"golox/ast"
+	"golox/ast/patternkind"
+	"golox/chunk/opcode"
+	"golox/value"
+	"math"
+	"os"
+)
+
+// a match over at least this many int literals that are close enough
+// together is dispatched with a jump table
+const MIN_JUMP_TABLE_CASES int = 4
+
+// matchArmInfo is what a jump table needs to know about an arm.
+type matchArmInfo struct {
+	cases     []int64 // the int literals the arm matches, nil if it's not just that
+	wildcard  bool    // matches anything
+	bodyStart int
+}
+
+// emitPath pushes the part of the matched value at path, a list of
+// indices into nested lists.
+func (generator *Generator) emitPath(slot uint8, path []int) {
+	generator.emitBytes(opcode.OP_GET_LOCAL, slot)
+	for _, index := range path {
+		generator.emitConstant(value.ValInt(int64(index)))
+		generator.emitByte(opcode.OP_INDEX)
+	}
+}
+
+// appendPath returns path extended by index without sharing its array.
+func appendPath(path []int, index int) []int {
+	extended := make([]int, len(path), len(path)+1)
+	copy(extended, path)
+	return append(extended, index)
+}
+
+// patternTest emits the checks that the value at path matches p. Each
+// failing check jumps to one of fails with false on the stack; when they
+// all pass the stack is as before.
+func (generator *Generator) patternTest(p *ast.MatchPattern, slot uint8, path []int, fails *[]int) {
+	generator.at(p)
+
+	switch p.Kind {
+	case patternkind.PATTERN_LITERAL:
+		generator.emitPath(slot, path)
+		generator.emitValue(p.Literal)
+		generator.emitByte(opcode.OP_EQUAL)
+		*fails = append(*fails, generator.emitJump(opcode.OP_JUMP_IF_FALSE))
+		generator.emitByte(opcode.OP_POP)
+
+	case patternkind.PATTERN_LIST:
+		generator.emitPath(slot, path)
+		hasRest := uint8(0)
+		if p.Rest != nil {
+			hasRest = 1
+		}
+		generator.emitBytes(opcode.OP_MATCH_LIST, uint8(len(p.Elements)))
+		generator.emitByte(hasRest)
+		*fails = append(*fails, generator.emitJump(opcode.OP_JUMP_IF_FALSE))
+		generator.emitByte(opcode.OP_POP)
+
+		for i, element := range p.Elements {
+			generator.patternTest(element, slot, appendPath(path, i), fails)
+		}
+	}
+}
+
+// patternBindings declares the names p binds as locals, once it's known
+// to match.
+func (generator *Generator) patternBindings(p *ast.MatchPattern, slot uint8, path []int) {
+	generator.at(p)
+
+	switch p.Kind {
+	case patternkind.PATTERN_BINDING:
+		generator.emitPath(slot, path)
+		generator.declarePushedLocal(p.Name)
+
+	case patternkind.PATTERN_LIST:
+		for i, element := range p.Elements {
+			generator.patternBindings(element, slot, appendPath(path, i))
+		}
+		if p.Rest != nil && p.Rest.Lexeme != "_" {
+			generator.at(p)
+			generator.emitPath(slot, path)
+			generator.emitConstant(value.ValInt(int64(len(p.Elements))))
+			generator.emitByte(opcode.OP_NIL)
+			generator.emitByte(opcode.OP_NIL)
+			generator.emitByte(opcode.OP_SLICE)
+			generator.declarePushedLocal(*p.Rest)
+		}
+	}
+}
+
+// matchArm compiles `patterns [if guard] => statement` and returns the
+// jump to the end of the match taken after the statement.
+func (generator *Generator) matchArm(arm *ast.MatchArm, slot uint8) (int, matchArmInfo) {
+	alternatives := arm.Patterns
+
+	info := matchArmInfo{}
+	for _, p := range alternatives {
+		if p.Kind == patternkind.PATTERN_LITERAL && p.Literal.IsInt() {
+			info.cases = append(info.cases, p.Literal.AsInt())
+		} else {
+			info.cases = nil
+			break
+		}
+	}
+
+	// every alternative but the last jumps to the body when it matches
+	var fails, matched []int
+	for i := range alternatives {
+		if i == len(alternatives)-1 {
+			generator.patternTest(alternatives[i], slot, nil, &fails)
+			break
+		}
+		var altFails []int
+		generator.patternTest(alternatives[i], slot, nil, &altFails)
+		matched = append(matched, generator.emitJump(opcode.OP_JUMP))
+		for _, fail := range altFails {
+			generator.patchJump(fail)
+		}
+		if len(altFails) > 0 {
+			generator.emitByte(opcode.OP_POP)
+		}
+	}
+	for _, jump := range matched {
+		generator.patchJump(jump)
+	}
+	info.bodyStart = len(generator.currentChunk().Code)
+
+	generator.beginScope()
+	if len(alternatives) == 1 {
+		generator.patternBindings(alternatives[0], slot, nil)
+	}
+
+	guardJump := -1
+	if arm.Guard != nil {
+		generator.expression(arm.Guard)
+		guardJump = generator.emitJump(opcode.OP_JUMP_IF_FALSE)
+		generator.emitByte(opcode.OP_POP)
+		info.cases = nil
+	} else if len(alternatives) == 1 && (alternatives[0].Kind == patternkind.PATTERN_WILDCARD || alternatives[0].Kind == patternkind.PATTERN_BINDING) {
+		info.wildcard = true
+	}
+
+	generator.statement(arm.Body)
+
+	var bindings []Local
+	for _, local := range generator.compiler.locals {
+		if local.depth == generator.compiler.scopeDepth {
+			bindings = append(bindings, local)
+		}
+	}
+	generator.at(arm)
+	generator.endScope()
+	endJump := generator.emitJump(opcode.OP_JUMP)
+
+	// a failed guard drops the bindings and carries on with the next arm
+	nextJump := -1
+	if guardJump != -1 {
+		generator.patchJump(guardJump)
+		generator.emitByte(opcode.OP_POP)
+		for i := len(bindings) - 1; i >= 0; i-- {
+			if bindings[i].isCaptured {
+				generator.emitByte(opcode.OP_CLOSE_UPVALUE)
+			} else {
+				generator.emitByte(opcode.OP_POP)
+			}
+		}
+		nextJump = generator.emitJump(opcode.OP_JUMP)
+	}
+
+	for _, fail := range fails {
+		generator.patchJump(fail)
+	}
+	if len(fails) > 0 {
+		generator.emitByte(opcode.OP_POP)
+	}
+	if nextJump != -1 {
+		generator.patchJump(nextJump)
+	}
+
+	return endJump, info
+}
+
+// jumpTable works out a table for dispatching on ints when every arm
+// matches int literals, except maybe a final wildcard, and the ints are
+// dense enough. It returns the smallest int and the body to jump to for it
+// and each int after it, -1 where no arm matches.
+func jumpTable(arms []matchArmInfo) (int64, []int, bool) {
+	targets := make(map[int64]int)
+	var low, high int64 = math.MaxInt64, math.MinInt64
+	for i, arm := range arms {
+		if arm.wildcard && i == len(arms)-1 {
+			break
+		}
+		if arm.cases == nil || arm.bodyStart > math.MaxUint16 {
+			return 0, nil, false
+		}
+		for _, c := range arm.cases {
+			if _, ok := targets[c]; !ok {
+				// the first arm to mention a value wins, as when testing in order
+				targets[c] = arm.bodyStart
+			}
+			if c < low {
+				low = c
+			}
+			if c > high {
+				high = c
+			}
+		}
+	}
+
+	// the span can be over math.MaxInt64 when the ints are far apart
+	span := uint64(high) - uint64(low)
+	if len(targets) < MIN_JUMP_TABLE_CASES || span >= uint64(2*len(targets)) || span > math.MaxUint8 {
+		return 0, nil, false
+	}
+
+	table := make([]int, span+1)
+	for i := range table {
+		target, ok := targets[low+int64(i)]
+		if !ok {
+			target = -1
+		}
+		table[i] = target
+	}
+
+	return low, table, true
+}
+
+func (generator *Generator) emitUint16(n int) {
+	bytes := make([]byte, 2)
+	binary.LittleEndian.PutUint16(bytes, uint16(n))
+	generator.emitBytes(bytes[0], bytes[1])
+}
+
+// matchStatement compiles
+//
+//	match (value) { pattern, ... [if guard] => statement ... }
+//
+// The arms are tried in order and the first one that matches runs. When
+// the arms are dense int literals the value is looked up in a jump table
+// instead.
+func (generator *Generator) matchStatement(stmt *ast.MatchStmt) {
+	line := stmt.Keyword.Line
+	generator.beginScope()
+
+	generator.expression(stmt.Value)
+	generator.line = line
+	generator.hiddenLocal("(match)")
+	generator.markInitialized()
+	slot := uint8(len(generator.compiler.locals) - 1)
+
+	// taken when a jump table is used, removed otherwise
+	dispatchJump := generator.emitJump(opcode.OP_JUMP)
+
+	var arms []matchArmInfo
+	var endJumps []int
+	exhaustive := false
+	for _, arm := range stmt.Arms {
+		endJump, info := generator.matchArm(arm, slot)
+		endJumps = append(endJumps, endJump)
+		arms = append(arms, info)
+		exhaustive = exhaustive || info.wildcard
+	}
+
+	if !exhaustive && !generator.hadError {
+		fmt.Fprintf(os.Stderr, "[line %d] Warning: match has no '_' arm, values no pattern matches are ignored.\n", line)
+	}
+
+	low, table, ok := jumpTable(arms)
+
+	generator.at(stmt)
+	// the code after the table, where the match ends
+	end := len(generator.currentChunk().Code) + 2 + 6 + 2*len(table)
+	if ok && end <= math.MaxUint16 {
+		// the arms' tests are never run, so nothing falls through to here
+		defaultTarget := end
+		if arms[len(arms)-1].wildcard {
+			defaultTarget = arms[len(arms)-1].bodyStart
+		}
+
+		generator.patchJump(dispatchJump)
+		generator.emitBytes(opcode.OP_GET_LOCAL, slot)
+		generator.emitBytes(opcode.OP_JUMP_TABLE, generator.makeConstant(value.ValInt(low)))
+		generator.emitUint16(len(table))
+		generator.emitUint16(defaultTarget)
+		for _, target := range table {
+			if target == -1 {
+				target = defaultTarget
+			}
+			generator.emitUint16(target)
+		}
+	} else {
+		chunk := generator.currentChunk()
+		start := dispatchJump - 1
+		chunk.Code = append(chunk.Code[:start], chunk.Code[start+3:]...)
+		chunk.Lines = append(chunk.Lines[:start], chunk.Lines[start+3:]...)
+		for i := range endJumps {
+			endJumps[i] -= 3
+		}
+	}
+
+	for _, jump := range endJumps {
+		generator.patchJump(jump)
+	}
+
+	generator.endScope()
+}
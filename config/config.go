@@ -2,3 +2,14 @@ package config
 
 const DEBUG_TRACE_EXECUTION = false
 const DEBUG_PRINT_CODE = true
+
+// QUICKEN_THRESHOLD is how many times a generic instruction runs on one
+// kind of operands before the vm specializes it for them, and
+// QUICKEN_MAX_DEOPTS how many times a site can fall back to the generic
+// instruction before it's left generic.
+const QUICKEN_THRESHOLD = 8
+const QUICKEN_MAX_DEOPTS = 4
+
+// JIT_THRESHOLD is how many calls of a function the vm interprets before
+// the baseline JIT compiles it, when it's on.
+const JIT_THRESHOLD = 10
@@ -97,10 +97,10 @@ func DisassembleInstruction(chunk *chunk.Chunk, offset int) int {
 		return byteInstruction("OP_GET_LOCAL", chunk, offset)
 	case opcode.OP_SET_LOCAL:
 		return byteInstruction("OP_SET_LOCAL", chunk, offset)
-	case opcode.OP_GET_LOCAL_2:
-		return byteInstruction("OP_GET_LOCAL_2", chunk, offset)
-	case opcode.OP_SET_LOCAL_2:
-		return byteInstruction("OP_SET_LOCAL_2", chunk, offset)
+	case opcode.OP_GET_LOCAL_LONG:
+		return byteInstruction("OP_GET_LOCAL_LONG", chunk, offset)
+	case opcode.OP_SET_LOCAL_LONG:
+		return byteInstruction("OP_SET_LOCAL_LONG", chunk, offset)
 	case opcode.OP_LIST:
 		return byteInstruction("OP_LIST", chunk, offset)
 	case opcode.OP_STORE:
@@ -138,6 +138,127 @@ func DisassembleInstruction(chunk *chunk.Chunk, offset int) int {
 		return byteInstruction("OP_GET_UPVALUE", chunk, offset)
 	case opcode.OP_SET_UPVALUE:
 		return byteInstruction("OP_SET_UPVALUE", chunk, offset)
+	case opcode.OP_BIT_AND:
+		return simpleInstruction("OP_BIT_AND", offset)
+	case opcode.OP_BIT_OR:
+		return simpleInstruction("OP_BIT_OR", offset)
+	case opcode.OP_BIT_XOR:
+		return simpleInstruction("OP_BIT_XOR", offset)
+	case opcode.OP_BIT_NOT:
+		return simpleInstruction("OP_BIT_NOT", offset)
+	case opcode.OP_SHIFT_LEFT:
+		return simpleInstruction("OP_SHIFT_LEFT", offset)
+	case opcode.OP_SHIFT_RIGHT:
+		return simpleInstruction("OP_SHIFT_RIGHT", offset)
+	case opcode.OP_MODULO:
+		return simpleInstruction("OP_MODULO", offset)
+	case opcode.OP_DUP:
+		return simpleInstruction("OP_DUP", offset)
+	case opcode.OP_DUP2:
+		return simpleInstruction("OP_DUP2", offset)
+	case opcode.OP_STORE_POSTFIX:
+		return simpleInstruction("OP_STORE_POSTFIX", offset)
+	case opcode.OP_IMPORT:
+		return constantInstruction("OP_IMPORT", chunk, offset)
+	case opcode.OP_GET_PROPERTY:
+		return constantInstruction("OP_GET_PROPERTY", chunk, offset)
+	case opcode.OP_CLOSE_UPVALUE:
+		return simpleInstruction("OP_CLOSE_UPVALUE", offset)
+	case opcode.OP_DEFAULT_ARG:
+		slot := chunk.Code[offset+1]
+		jump := binary.LittleEndian.Uint16(chunk.Code[offset+2 : offset+4])
+		fmt.Printf("%-16s %4d -> %d\n", "OP_DEFAULT_ARG", slot, offset+4+int(jump))
+		return offset + 4
+	case opcode.OP_LIST_APPEND:
+		return simpleInstruction("OP_LIST_APPEND", offset)
+	case opcode.OP_LIST_EXTEND:
+		return simpleInstruction("OP_LIST_EXTEND", offset)
+	case opcode.OP_YIELD:
+		return simpleInstruction("OP_YIELD", offset)
+	case opcode.OP_MAP:
+		return byteInstruction("OP_MAP", chunk, offset)
+	case opcode.OP_DEFINE_CONST:
+		return constantInstruction("OP_DEFINE_CONST", chunk, offset)
+	case opcode.OP_JUMP_IF_NIL:
+		return jumpInstruction("OP_JUMP_IF_NIL", 1, chunk, offset)
+	case opcode.OP_JUMP_IF_NOT_NIL:
+		return jumpInstruction("OP_JUMP_IF_NOT_NIL", 1, chunk, offset)
+	case opcode.OP_JUMP_IF_TRUE:
+		return jumpInstruction("OP_JUMP_IF_TRUE", 1, chunk, offset)
+	case opcode.OP_PEEK:
+		return byteInstruction("OP_PEEK", chunk, offset)
+	case opcode.OP_CHECK_INLINE:
+		argCount := chunk.Code[offset+2]
+		jump := binary.LittleEndian.Uint16(chunk.Code[offset+3 : offset+5])
+		fmt.Printf("%-16s %4d ", "OP_CHECK_INLINE", argCount)
+		chunk.Constants[chunk.Code[offset+1]].Print()
+		fmt.Printf(" -> %d\n", offset+5+int(jump))
+		return offset + 5
+	case opcode.OP_INLINE_RETURN:
+		return byteInstruction("OP_INLINE_RETURN", chunk, offset)
+	case opcode.OP_GET_LOCAL_0:
+		return simpleInstruction("OP_GET_LOCAL_0", offset)
+	case opcode.OP_GET_LOCAL_1:
+		return simpleInstruction("OP_GET_LOCAL_1", offset)
+	case opcode.OP_GET_LOCAL_2:
+		return simpleInstruction("OP_GET_LOCAL_2", offset)
+	case opcode.OP_GET_LOCAL_3:
+		return simpleInstruction("OP_GET_LOCAL_3", offset)
+	case opcode.OP_ADD_CONST:
+		return constantInstruction("OP_ADD_CONST", chunk, offset)
+	case opcode.OP_LESS_JUMP_IF_FALSE:
+		return jumpInstruction("OP_LESS_JUMP_IF_FALSE", 1, chunk, offset)
+	case opcode.OP_INCR_LOCAL:
+		return byteInstruction("OP_INCR_LOCAL", chunk, offset)
+	case opcode.OP_ADD_NUM:
+		return simpleInstruction("OP_ADD_NUM", offset)
+	case opcode.OP_ADD_STR:
+		return simpleInstruction("OP_ADD_STR", offset)
+	case opcode.OP_LESS_NUM:
+		return simpleInstruction("OP_LESS_NUM", offset)
+	case opcode.OP_MATCH_LIST:
+		fmt.Printf("%-16s %4d %d\n", "OP_MATCH_LIST", chunk.Code[offset+1], chunk.Code[offset+2])
+		return offset + 3
+	case opcode.OP_UNPACK_LIST:
+		fmt.Printf("%-16s %4d %d ", "OP_UNPACK_LIST", chunk.Code[offset+1], chunk.Code[offset+2])
+		chunk.Constants[chunk.Code[offset+3]].Print()
+		fmt.Println()
+		return offset + 4
+	case opcode.OP_UNPACK_MAP:
+		count := int(chunk.Code[offset+1])
+		fmt.Printf("%-16s %4d ", "OP_UNPACK_MAP", count)
+		chunk.Constants[chunk.Code[offset+2]].Print()
+		fmt.Println()
+		return offset + 3 + count
+	case opcode.OP_JUMP_TABLE:
+		low := chunk.Constants[chunk.Code[offset+1]].AsInt()
+		count := int(binary.LittleEndian.Uint16(chunk.Code[offset+2 : offset+4]))
+		defaultTarget := binary.LittleEndian.Uint16(chunk.Code[offset+4 : offset+6])
+		fmt.Printf("%-16s %4d default -> %d\n", "OP_JUMP_TABLE", count, defaultTarget)
+		for i := 0; i < count; i++ {
+			target := binary.LittleEndian.Uint16(chunk.Code[offset+6+2*i : offset+8+2*i])
+			fmt.Printf("%04d    |   %20d -> %d\n", offset+6+2*i, low+int64(i), target)
+		}
+		return offset + 6 + 2*count
+	case opcode.OP_SLICE:
+		return simpleInstruction("OP_SLICE", offset)
+	case opcode.OP_STORE_SLICE:
+		return simpleInstruction("OP_STORE_SLICE", offset)
+	case opcode.OP_ITER:
+		return simpleInstruction("OP_ITER", offset)
+	case opcode.OP_FOR_ITER:
+		withIndex := chunk.Code[offset+1]
+		jump := binary.LittleEndian.Uint16(chunk.Code[offset+2 : offset+4])
+		fmt.Printf("%-16s %4d -> %d\n", "OP_FOR_ITER", withIndex, offset+4+int(jump))
+		return offset + 4
+	case opcode.OP_CALL_EX:
+		kwCount := int(chunk.Code[offset+1])
+		fmt.Printf("%-16s %4d", "OP_CALL_EX", kwCount)
+		for i := 0; i < kwCount; i++ {
+			fmt.Printf(" %s:", chunk.Constants[chunk.Code[offset+2+i]].Stringify())
+		}
+		fmt.Println()
+		return offset + 2 + kwCount
 	}
 
 	fmt.Printf("Unknown opcode %d\n", instruction)
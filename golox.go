@@ -3,12 +3,27 @@ package main
 import (
 	"bufio"
 	"fmt"
+	"golox/ast"
+	"golox/compiler"
+	"golox/debug"
+	"golox/ir"
+	"golox/parser"
+	"golox/register"
 	"golox/vm"
 	"golox/vm/interpretresult"
 	"os"
+	"path/filepath"
+	"strings"
 )
 
-func repl(vm *vm.VM) {
+// interpreter is a backend running lox source: the stack vm or the
+// register machine.
+type interpreter interface {
+	Interpret(source string) interpretresult.InterpretResult
+	InterpretFile(path string, source string) interpretresult.InterpretResult
+}
+
+func repl(vm interpreter) {
 	reader := bufio.NewReader(os.Stdin)
 	for {
 		fmt.Print("> ")
@@ -24,13 +39,13 @@ func repl(vm *vm.VM) {
 	}
 }
 
-func runFile(path string, vm *vm.VM) {
+func runFile(path string, vm interpreter) {
 	source, err := os.ReadFile(path)
 	if err != nil {
 		fmt.Printf("an error occurred while reading the file: %s", err.Error())
 		os.Exit(74)
 	}
-	result := vm.Interpret(string(source) + "\x00")
+	result := vm.InterpretFile(path, string(source)+"\x00")
 	if result == interpretresult.INTERPRET_COMPILE_ERROR {
 		os.Exit(65)
 	}
@@ -39,16 +54,129 @@ func runFile(path string, vm *vm.VM) {
 	}
 }
 
+// debugFile runs the file at path under the debugger, with commands read
+// from stdin.
+func debugFile(path string, stack *vm.VM) {
+	source, err := os.ReadFile(path)
+	if err != nil {
+		fmt.Printf("an error occurred while reading the file: %s", err.Error())
+		os.Exit(74)
+	}
+	result := stack.Debug(path, string(source)+"\x00", os.Stdin)
+	if result == interpretresult.INTERPRET_STOPPED {
+		os.Exit(0)
+	}
+	if result == interpretresult.INTERPRET_COMPILE_ERROR {
+		os.Exit(65)
+	}
+	if result == interpretresult.INTERPRET_RUNTIME_ERROR {
+		os.Exit(75)
+	}
+}
+
+// dumpAst prints the syntax tree of the file at path as JSON.
+func dumpAst(path string) {
+	source, err := os.ReadFile(path)
+	if err != nil {
+		fmt.Printf("an error occurred while reading the file: %s", err.Error())
+		os.Exit(74)
+	}
+	src := string(source) + "\x00"
+	program, ok := parser.Parse(&src)
+	if !ok {
+		os.Exit(65)
+	}
+	if err := ast.Dump(os.Stdout, program); err != nil {
+		fmt.Fprintf(os.Stderr, "an error occurred while writing the tree: %s\n", err.Error())
+		os.Exit(74)
+	}
+}
+
+// dumpIr prints the SSA form of the functions of the file at path, or of
+// those named name, before and after the passes, and the bytecode they're
+// lowered to.
+func dumpIr(path string, name string) {
+	source, err := os.ReadFile(path)
+	if err != nil {
+		fmt.Printf("an error occurred while reading the file: %s", err.Error())
+		os.Exit(74)
+	}
+	src := string(source) + "\x00"
+	script := compiler.Compile(&src, true)
+	if script == nil {
+		os.Exit(65)
+	}
+
+	for _, function := range ir.Functions(script) {
+		if name != "" && function.Name.String != name {
+			continue
+		}
+		f, err := ir.Lift(function)
+		if err != nil {
+			fmt.Printf("\n==== %s ====\n\ncan't lift: %s\n", function.Name.String, err.Error())
+			continue
+		}
+		f.Print("before passes")
+		f.Optimize()
+		f.Print("after passes")
+		c, err := f.Lower()
+		if err != nil {
+			fmt.Printf("\ncan't lower: %s\n", err.Error())
+			continue
+		}
+		debug.DisassembleChunk(c, function.Name.String+" (lowered)")
+	}
+}
+
+func usage() {
+	fmt.Fprint(os.Stderr, "Usage: clox [-O0|-O2] [--jit=baseline] [--backend=stack|register] [path]\n       clox debug [path]\n       clox ast [path]\n       clox ir [path] [function]\n       clox bench [path...]\n")
+	os.Exit(64)
+}
+
 func main() {
-	vm := new(vm.VM)
-	vm.Init()
+	stack := new(vm.VM)
+	stack.Init()
+	stack.SearchPath = filepath.SplitList(os.Getenv("GOLOX_PATH"))
+	var machine interpreter = stack
+
+	args := os.Args[1:]
+	for len(args) > 0 && strings.HasPrefix(args[0], "-") {
+		switch args[0] {
+		case "-O0":
+			stack.Optimize = false
+		case "-O2":
+			stack.IR = true
+		case "--backend=stack":
+			machine = stack
+		case "--jit=baseline":
+			stack.EnableJIT()
+		case "--backend=register":
+			registers := new(register.VM)
+			registers.Init()
+			machine = registers
+		default:
+			usage()
+		}
+		args = args[1:]
+	}
 
-	if len(os.Args) == 1 {
-		repl(vm)
-	} else if len(os.Args) == 2 {
-		runFile(os.Args[1], vm)
+	if len(args) == 0 {
+		repl(machine)
+	} else if len(args) == 1 {
+		runFile(args[0], machine)
+	} else if len(args) == 2 && args[0] == "debug" {
+		debugFile(args[1], stack)
+	} else if len(args) == 2 && args[0] == "ast" {
+		dumpAst(args[1])
+	} else if (len(args) == 2 || len(args) == 3) && args[0] == "ir" {
+		name := ""
+		if len(args) == 3 {
+			name = args[2]
+		}
+		dumpIr(args[1], name)
+	} else if len(args) >= 2 && args[0] == "bench" {
+		bench(args[1:])
 	} else {
-		fmt.Fprint(os.Stderr, "Usage: clox [path]\n")
-		os.Exit(64)
+		usage()
 	}
 }
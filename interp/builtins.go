@@ -0,0 +1,36 @@
+// Package interp holds what the stack vm and the register machine share
+// so that programs behave the same on both: the builtins they define and
+// how runtime errors are worded and reported.
+package interp
+
+import (
+	"golox/builtins"
+	"golox/value"
+)
+
+// Native is a builtin function every program sees as a global.
+type Native struct {
+	Name     string
+	Function value.NativeFn
+}
+
+// Natives are the builtins both backends define. The stack vm adds those
+// for generators, which need its internals, after them.
+var Natives = []Native{
+	{"clock", builtins.Clock},
+
+	{"mod", builtins.Mod},
+
+	{"list", builtins.List},
+	{"append", builtins.Append},
+	{"len", builtins.Len},
+	{"pop", builtins.Pop},
+	{"range", builtins.Range},
+	{"map", builtins.Map},
+	{"filter", builtins.Filter},
+	{"reduce", builtins.Reduce},
+	{"sort", builtins.Sort},
+
+	{"keys", builtins.Keys},
+	{"has", builtins.Has},
+}
@@ -0,0 +1,44 @@
+package interp
+
+import (
+	"fmt"
+	"golox/value"
+	"os"
+)
+
+// Frame is a call in progress when a runtime error is reported: the name
+// of its function, empty for code outside any, and the line it's at.
+type Frame struct {
+	Function string
+	Line     int
+}
+
+// PrintTraceback prints where a runtime error happened on stderr, after
+// its message has gone to stdout: the frames, innermost first.
+func PrintTraceback(frames []Frame) {
+	for _, frame := range frames {
+		if frame.Function == "" {
+			fmt.Fprintf(os.Stderr, "[line %d] in script\n", frame.Line)
+		} else {
+			fmt.Fprintf(os.Stderr, "[line %d] in %s()\n", frame.Line, frame.Function)
+		}
+	}
+}
+
+// UndefinedVariable is the error for reading or assigning a global that
+// hasn't been defined.
+func UndefinedVariable(name string) string {
+	return fmt.Sprintf("Undefined variable '%s'.", name)
+}
+
+// ArityError is the error for calling function with argCount arguments,
+// which it doesn't take.
+func ArityError(function *value.ObjFunction, argCount int) string {
+	if function.Variadic {
+		return fmt.Sprintf("Expected at least %d arguments but got %d.", function.RequiredArity, argCount)
+	}
+	if function.RequiredArity == function.Arity {
+		return fmt.Sprintf("Expected %d arguments but got %d.", function.Arity, argCount)
+	}
+	return fmt.Sprintf("Expected %d-%d arguments but got %d.", function.RequiredArity, function.Arity, argCount)
+}
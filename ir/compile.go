@@ -0,0 +1,47 @@
+package ir
+
+import (
+	"golox/chunk"
+	"golox/optimizer"
+	"golox/value"
+)
+
+// Recompile replaces the bytecode of function with that of its SSA form,
+// once the passes have run over it, and optimizes that. It fails, leaving
+// the function as it was, if the bytecode can't be lifted or lowered.
+func Recompile(function *value.ObjFunction) error {
+	f, err := Lift(function)
+	if err != nil {
+		return err
+	}
+	f.Optimize()
+	c, err := f.Lower()
+	if err != nil {
+		return err
+	}
+	optimizer.Optimize(c)
+	function.Chunk = c
+	return nil
+}
+
+// Functions lists function and the functions declared in it, at any
+// depth, once each even when inlined calls refer to them too.
+func Functions(function *value.ObjFunction) []*value.ObjFunction {
+	var functions []*value.ObjFunction
+	seen := make(map[*value.ObjFunction]bool)
+	var visit func(function *value.ObjFunction)
+	visit = func(function *value.ObjFunction) {
+		if seen[function] {
+			return
+		}
+		seen[function] = true
+		functions = append(functions, function)
+		for _, constant := range function.Chunk.(*chunk.Chunk).Constants {
+			if constant.IsFunction() {
+				visit(constant.AsObjFunction())
+			}
+		}
+	}
+	visit(function)
+	return functions
+}
@@ -0,0 +1,79 @@
+package ir
+
+// postorder lists the blocks after all the blocks reachable from them,
+// loops aside.
+func (f *Func) postorder() []*Block {
+	var order []*Block
+	seen := make(map[*Block]bool)
+	var visit func(block *Block)
+	visit = func(block *Block) {
+		seen[block] = true
+		for _, succ := range block.Succs {
+			if !seen[succ] {
+				visit(succ)
+			}
+		}
+		order = append(order, block)
+	}
+	visit(f.Blocks[0])
+	return order
+}
+
+// dominators maps each block to its immediate dominator, the entry to
+// itself, with the algorithm of Cooper, Harvey and Kennedy.
+func (f *Func) dominators() map[*Block]*Block {
+	postorder := f.postorder()
+	number := make(map[*Block]int)
+	for i, block := range postorder {
+		number[block] = i
+	}
+
+	idom := map[*Block]*Block{f.Blocks[0]: f.Blocks[0]}
+	intersect := func(a *Block, b *Block) *Block {
+		for a != b {
+			for number[a] < number[b] {
+				a = idom[a]
+			}
+			for number[b] < number[a] {
+				b = idom[b]
+			}
+		}
+		return a
+	}
+
+	for changed := true; changed; {
+		changed = false
+		for i := len(postorder) - 2; i >= 0; i-- {
+			block := postorder[i]
+			var dom *Block
+			for _, pred := range block.Preds {
+				if _, ok := idom[pred]; !ok {
+					continue
+				}
+				if dom == nil {
+					dom = pred
+				} else {
+					dom = intersect(pred, dom)
+				}
+			}
+			if idom[block] != dom {
+				idom[block] = dom
+				changed = true
+			}
+		}
+	}
+	return idom
+}
+
+// dominates reports whether every path to b goes through a.
+func dominates(idom map[*Block]*Block, a *Block, b *Block) bool {
+	for {
+		if b == a {
+			return true
+		}
+		if idom[b] == b {
+			return false
+		}
+		b = idom[b]
+	}
+}
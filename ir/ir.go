@@ -0,0 +1,210 @@
+// Package ir is an SSA form of a function's bytecode.
+//
+// Lift turns the bytecode into basic blocks, split at jumps and their
+// targets, of values that each compute one thing once. Every slot of the
+// frame, the locals and the temporaries the stack holds, is followed
+// through the blocks, with a phi wherever different values of a slot
+// meet. The passes rewrite the values, and Lower turns them back into
+// bytecode, giving each value that needs one a slot of the frame.
+package ir
+
+import (
+	"golox/chunk"
+	"golox/ir/irop"
+	"golox/value"
+)
+
+// Kind is how a block ends.
+type Kind uint8
+
+const (
+	JUMP   Kind = iota // goes on to Succs[0]
+	IF     Kind = iota // goes to Succs[0] if Control is truthy, to Succs[1] if not
+	RETURN Kind = iota // returns Control
+)
+
+type Value struct {
+	ID    int
+	Op    uint8
+	Args  []*Value
+	Aux   int
+	Block *Block
+	Line  int
+
+	Inlined *chunk.Inline // the inlined call whose body it's part of
+}
+
+type Block struct {
+	ID      int
+	Values  []*Value // phis first
+	Kind    Kind
+	Control *Value
+	Line    int // the line of the jump or return ending the block
+	Succs   []*Block
+	Preds   []*Block // in the order of the arguments of the phis
+}
+
+// Func is a function in SSA form. Blocks[0] is where it starts.
+type Func struct {
+	Name      string
+	Params    int // the slots set when the function is called, the function itself included
+	Blocks    []*Block
+	Constants []value.Value
+
+	nextID int
+}
+
+func (f *Func) newValue(block *Block, op uint8, aux int, line int, args ...*Value) *Value {
+	v := &Value{ID: f.nextID, Op: op, Args: args, Aux: aux, Block: block, Line: line}
+	f.nextID++
+	return v
+}
+
+// uses counts the arguments and controls each value is used as.
+func (f *Func) uses() map[*Value]int {
+	uses := make(map[*Value]int)
+	for _, block := range f.Blocks {
+		for _, v := range block.Values {
+			for _, arg := range v.Args {
+				uses[arg]++
+			}
+		}
+		if block.Control != nil {
+			uses[block.Control]++
+		}
+	}
+	return uses
+}
+
+// replace makes every use of the values in replacements use what they map
+// to instead, following chains of replacements.
+func (f *Func) replace(replacements map[*Value]*Value) {
+	resolve := func(v *Value) *Value {
+		for {
+			to, ok := replacements[v]
+			if !ok {
+				return v
+			}
+			v = to
+		}
+	}
+	for _, block := range f.Blocks {
+		for _, v := range block.Values {
+			for i, arg := range v.Args {
+				v.Args[i] = resolve(arg)
+			}
+		}
+		if block.Control != nil {
+			block.Control = resolve(block.Control)
+		}
+	}
+}
+
+// removeValues drops the values for which remove is true.
+func (f *Func) removeValues(remove func(v *Value) bool) bool {
+	removed := false
+	for _, block := range f.Blocks {
+		kept := block.Values[:0]
+		for _, v := range block.Values {
+			if remove(v) {
+				removed = true
+			} else {
+				kept = append(kept, v)
+			}
+		}
+		block.Values = kept
+	}
+	return removed
+}
+
+// predIndex is the index of pred among block's predecessors.
+func (block *Block) predIndex(pred *Block) int {
+	for i, p := range block.Preds {
+		if p == pred {
+			return i
+		}
+	}
+	return -1
+}
+
+// hasResult reports whether op gives a value, which the bytecode pushes.
+func hasResult(op uint8) bool {
+	switch op {
+	case irop.OP_DEFINE_GLOBAL, irop.OP_DEFINE_CONST, irop.OP_PRINT:
+		return false
+	}
+	return true
+}
+
+// effects reports whether op does more than compute its value, so it
+// must run where and when the bytecode ran it.
+func effects(op uint8) bool {
+	switch op {
+	case irop.OP_GET_GLOBAL, irop.OP_SET_GLOBAL, irop.OP_DEFINE_GLOBAL, irop.OP_DEFINE_CONST, irop.OP_CALL,
+		irop.OP_INDEX, irop.OP_STORE, irop.OP_PRINT:
+		return true
+	}
+	return false
+}
+
+// allocates reports whether op makes a new object each time, so that two
+// of them can never be the same value.
+func allocates(op uint8) bool {
+	return op == irop.OP_LIST || op == irop.OP_CLOSURE
+}
+
+// numeric finds the values that are numbers whenever they're computed:
+// numeric constants and arithmetic on them, and the phis of those. It
+// starts from every candidate being numeric and takes back those that
+// can't be until nothing changes, so loops counting up stay numeric.
+func (f *Func) numeric() map[*Value]bool {
+	numeric := make(map[*Value]bool)
+	for _, block := range f.Blocks {
+		for _, v := range block.Values {
+			switch v.Op {
+			case irop.OP_CONST:
+				numeric[v] = f.Constants[v.Aux].IsNumeric()
+			case irop.OP_PHI, irop.OP_COPY, irop.OP_ADD, irop.OP_SUBTRACT, irop.OP_MULTIPLY, irop.OP_DIVIDE,
+				irop.OP_NEGATE:
+				numeric[v] = true
+			}
+		}
+	}
+
+	for changed := true; changed; {
+		changed = false
+		for v, ok := range numeric {
+			if !ok || v.Op == irop.OP_CONST {
+				continue
+			}
+			for _, arg := range v.Args {
+				if !numeric[arg] {
+					numeric[v] = false
+					changed = true
+					break
+				}
+			}
+		}
+	}
+	return numeric
+}
+
+// safe reports whether v can't fail and has no effects, so that it can
+// be computed anywhere, or not at all.
+func safe(v *Value, numeric map[*Value]bool) bool {
+	switch v.Op {
+	case irop.OP_PARAM, irop.OP_CONST, irop.OP_NIL, irop.OP_TRUE, irop.OP_FALSE, irop.OP_PHI, irop.OP_COPY,
+		irop.OP_NOT, irop.OP_EQUAL, irop.OP_LIST, irop.OP_CLOSURE, irop.OP_GUARD:
+		return true
+	case irop.OP_ADD, irop.OP_SUBTRACT, irop.OP_MULTIPLY, irop.OP_DIVIDE, irop.OP_NEGATE, irop.OP_LESS,
+		irop.OP_GREATER:
+		// arithmetic on numbers only fails for % and the bitwise operators
+		for _, arg := range v.Args {
+			if !numeric[arg] {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
@@ -0,0 +1,41 @@
+// Package irop lists the operations of the SSA form. Most are the
+// bytecode instruction of the same name, taking the values it pops as
+// arguments; Aux is the operand of those that have one.
+package irop
+
+const (
+	OP_PARAM         uint8 = iota // the value in frame slot Aux when the function is called
+	OP_CONST         uint8 = iota // constant Aux
+	OP_NIL           uint8 = iota // nil
+	OP_TRUE          uint8 = iota // true
+	OP_FALSE         uint8 = iota // false
+	OP_PHI           uint8 = iota // the argument for the predecessor control came from, for slot Aux
+	OP_COPY          uint8 = iota // the argument, assigned to slot Aux
+	OP_ADD           uint8 = iota // a + b
+	OP_SUBTRACT      uint8 = iota // a - b
+	OP_MULTIPLY      uint8 = iota // a * b
+	OP_DIVIDE        uint8 = iota // a / b
+	OP_MODULO        uint8 = iota // a % b
+	OP_NEGATE        uint8 = iota // -a
+	OP_NOT           uint8 = iota // !a
+	OP_EQUAL         uint8 = iota // a == b
+	OP_LESS          uint8 = iota // a < b
+	OP_GREATER       uint8 = iota // a > b
+	OP_BIT_AND       uint8 = iota // a & b
+	OP_BIT_OR        uint8 = iota // a | b
+	OP_BIT_XOR       uint8 = iota // a ^ b
+	OP_BIT_NOT       uint8 = iota // ~a
+	OP_SHIFT_LEFT    uint8 = iota // a << b
+	OP_SHIFT_RIGHT   uint8 = iota // a >> b
+	OP_GET_GLOBAL    uint8 = iota // the global named by constant Aux
+	OP_SET_GLOBAL    uint8 = iota // assigns a to the global named by constant Aux, giving a
+	OP_DEFINE_GLOBAL uint8 = iota // defines the global named by constant Aux as a
+	OP_DEFINE_CONST  uint8 = iota // defines the global constant named by constant Aux as a
+	OP_CALL          uint8 = iota // calls the first argument with the others
+	OP_LIST          uint8 = iota // a list of the arguments
+	OP_INDEX         uint8 = iota // a[b]
+	OP_STORE         uint8 = iota // a[b] = c, giving c
+	OP_CLOSURE       uint8 = iota // a closure of the function constant Aux, which has no upvalues
+	OP_PRINT         uint8 = iota // prints a
+	OP_GUARD         uint8 = iota // whether a is a closure of the function constant Aux, inlined where it's called
+)
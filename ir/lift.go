@@ -0,0 +1,468 @@
+package ir
+
+import (
+	"encoding/binary"
+	"fmt"
+	"golox/chunk"
+	"golox/chunk/opcode"
+	"golox/ir/irop"
+	"golox/value"
+)
+
+// lengths are the sizes of the instructions Lift knows.
+var lengths = map[uint8]int{
+	opcode.OP_CONSTANT:           2,
+	opcode.OP_NIL:                1,
+	opcode.OP_TRUE:               1,
+	opcode.OP_FALSE:              1,
+	opcode.OP_POP:                1,
+	opcode.OP_DUP:                1,
+	opcode.OP_PEEK:               2,
+	opcode.OP_GET_LOCAL:          2,
+	opcode.OP_SET_LOCAL:          2,
+	opcode.OP_GET_LOCAL_0:        1,
+	opcode.OP_GET_LOCAL_1:        1,
+	opcode.OP_GET_LOCAL_2:        1,
+	opcode.OP_GET_LOCAL_3:        1,
+	opcode.OP_INCR_LOCAL:         2,
+	opcode.OP_GET_GLOBAL:         2,
+	opcode.OP_SET_GLOBAL:         2,
+	opcode.OP_DEFINE_GLOBAL:      2,
+	opcode.OP_DEFINE_CONST:       2,
+	opcode.OP_ADD:                1,
+	opcode.OP_ADD_NUM:            1,
+	opcode.OP_ADD_STR:            1,
+	opcode.OP_ADD_CONST:          2,
+	opcode.OP_SUBTRACT:           1,
+	opcode.OP_MULTIPLY:           1,
+	opcode.OP_DIVIDE:             1,
+	opcode.OP_MODULO:             1,
+	opcode.OP_NEGATE:             1,
+	opcode.OP_NOT:                1,
+	opcode.OP_EQUAL:              1,
+	opcode.OP_LESS:               1,
+	opcode.OP_LESS_NUM:           1,
+	opcode.OP_GREATER:            1,
+	opcode.OP_BIT_AND:            1,
+	opcode.OP_BIT_OR:             1,
+	opcode.OP_BIT_XOR:            1,
+	opcode.OP_BIT_NOT:            1,
+	opcode.OP_SHIFT_LEFT:         1,
+	opcode.OP_SHIFT_RIGHT:        1,
+	opcode.OP_JUMP:               3,
+	opcode.OP_LOOP:               3,
+	opcode.OP_JUMP_IF_FALSE:      3,
+	opcode.OP_JUMP_IF_TRUE:       3,
+	opcode.OP_LESS_JUMP_IF_FALSE: 3,
+	opcode.OP_CHECK_INLINE:       5,
+	opcode.OP_CALL:               2,
+	opcode.OP_INLINE_RETURN:      2,
+	opcode.OP_LIST:               2,
+	opcode.OP_INDEX:              1,
+	opcode.OP_STORE:              1,
+	opcode.OP_CLOSURE:            2,
+	opcode.OP_PRINT:              1,
+	opcode.OP_RETURN:             1,
+}
+
+// binaries and unaries are the operations of the instructions popping two
+// values and one and pushing the result.
+var (
+	binaries = map[uint8]uint8{
+		opcode.OP_ADD:         irop.OP_ADD,
+		opcode.OP_ADD_NUM:     irop.OP_ADD,
+		opcode.OP_ADD_STR:     irop.OP_ADD,
+		opcode.OP_SUBTRACT:    irop.OP_SUBTRACT,
+		opcode.OP_MULTIPLY:    irop.OP_MULTIPLY,
+		opcode.OP_DIVIDE:      irop.OP_DIVIDE,
+		opcode.OP_MODULO:      irop.OP_MODULO,
+		opcode.OP_EQUAL:       irop.OP_EQUAL,
+		opcode.OP_LESS:        irop.OP_LESS,
+		opcode.OP_LESS_NUM:    irop.OP_LESS,
+		opcode.OP_GREATER:     irop.OP_GREATER,
+		opcode.OP_BIT_AND:     irop.OP_BIT_AND,
+		opcode.OP_BIT_OR:      irop.OP_BIT_OR,
+		opcode.OP_BIT_XOR:     irop.OP_BIT_XOR,
+		opcode.OP_SHIFT_LEFT:  irop.OP_SHIFT_LEFT,
+		opcode.OP_SHIFT_RIGHT: irop.OP_SHIFT_RIGHT,
+		opcode.OP_INDEX:       irop.OP_INDEX,
+	}
+	unaries = map[uint8]uint8{
+		opcode.OP_NEGATE:  irop.OP_NEGATE,
+		opcode.OP_NOT:     irop.OP_NOT,
+		opcode.OP_BIT_NOT: irop.OP_BIT_NOT,
+	}
+)
+
+// lifter keeps the bytecode block each block of the Func comes from.
+type lifter struct {
+	f      *Func
+	c      *chunk.Chunk
+	starts map[*Block]int
+	ends   map[*Block]int
+}
+
+// Lift translates the bytecode of function into SSA form. It fails,
+// saying why, if function uses an instruction it doesn't know, such as
+// those of generators and closures capturing variables.
+func Lift(function *value.ObjFunction) (*Func, error) {
+	c := function.Chunk.(*chunk.Chunk)
+	if function.IsGenerator {
+		return nil, fmt.Errorf("generators aren't supported")
+	}
+
+	params := 1 + function.Arity
+	if function.Variadic {
+		params++
+	}
+	f := &Func{
+		Name:      function.Name.String,
+		Params:    params,
+		Constants: append([]value.Value(nil), c.Constants...),
+	}
+	lifter := &lifter{f: f, c: c, starts: make(map[*Block]int), ends: make(map[*Block]int)}
+
+	// blocks start at jump targets and after jumps and returns
+	leaders := map[int]bool{0: true}
+	for offset := 0; offset < len(c.Code); {
+		op := c.Code[offset]
+		length := lengths[op]
+		if length == 0 {
+			return nil, fmt.Errorf("opcode %d at offset %d isn't supported", op, offset)
+		}
+		if op == opcode.OP_CLOSURE && c.Constants[c.Code[offset+1]].AsObjFunction().UpvalueCount > 0 {
+			return nil, fmt.Errorf("closures with upvalues aren't supported")
+		}
+		if target, ok := jumpTarget(c, offset); ok {
+			leaders[target] = true
+		}
+		if isJump(op) || op == opcode.OP_RETURN {
+			leaders[offset+length] = true
+		}
+		offset += length
+	}
+
+	// the entry block sets up the parameters, so that the code can loop
+	// back to its start
+	entry := &Block{Kind: JUMP, Line: c.Lines[0]}
+	blocks := map[int]*Block{}
+	var starts []int
+	for offset := 0; offset < len(c.Code); offset += lengths[c.Code[offset]] {
+		if leaders[offset] {
+			blocks[offset] = &Block{Line: c.Lines[offset]}
+			starts = append(starts, offset)
+		}
+	}
+	for i, start := range starts {
+		end := len(c.Code)
+		if i+1 < len(starts) {
+			end = starts[i+1]
+		}
+		block := blocks[start]
+		lifter.starts[block], lifter.ends[block] = start, end
+	}
+	entry.Succs = []*Block{blocks[0]}
+
+	for _, start := range starts {
+		block := blocks[start]
+		last := lifter.last(block)
+		op := c.Code[last]
+		block.Line = c.Lines[last]
+		if target, ok := jumpTarget(c, last); ok {
+			if op == opcode.OP_JUMP || op == opcode.OP_LOOP {
+				block.Kind = JUMP
+				block.Succs = []*Block{blocks[target]}
+				continue
+			}
+			block.Kind = IF
+			next := blocks[lifter.ends[block]]
+			if op == opcode.OP_JUMP_IF_TRUE {
+				block.Succs = []*Block{blocks[target], next}
+			} else {
+				block.Succs = []*Block{next, blocks[target]}
+			}
+			continue
+		}
+		if op == opcode.OP_RETURN {
+			block.Kind = RETURN
+			continue
+		}
+		next, ok := blocks[lifter.ends[block]]
+		if !ok {
+			return nil, fmt.Errorf("the code runs off the end")
+		}
+		block.Kind = JUMP
+		block.Succs = []*Block{next}
+	}
+
+	// only the blocks reachable from the entry are kept, in the order of
+	// their code
+	reachable := map[*Block]bool{entry: true}
+	var visit func(block *Block)
+	visit = func(block *Block) {
+		for _, succ := range block.Succs {
+			if !reachable[succ] {
+				reachable[succ] = true
+				visit(succ)
+			}
+		}
+	}
+	visit(entry)
+	f.Blocks = append(f.Blocks, entry)
+	for _, start := range starts {
+		if block := blocks[start]; reachable[block] {
+			block.ID = len(f.Blocks)
+			f.Blocks = append(f.Blocks, block)
+		}
+	}
+	for _, block := range f.Blocks {
+		for _, succ := range block.Succs {
+			succ.Preds = append(succ.Preds, block)
+		}
+	}
+
+	// each block runs with the slots its first predecessor run leaves,
+	// through phis if it has more than one
+	exits := make(map[*Block][]*Value)
+	for slot := 0; slot < params; slot++ {
+		param := f.newValue(entry, irop.OP_PARAM, slot, c.Lines[0])
+		entry.Values = append(entry.Values, param)
+		exits[entry] = append(exits[entry], param)
+	}
+	var run func(block *Block, slots []*Value) error
+	run = func(block *Block, slots []*Value) error {
+		if len(block.Preds) > 1 {
+			phis := make([]*Value, len(slots))
+			for slot := range slots {
+				phis[slot] = f.newValue(block, irop.OP_PHI, slot, block.Line)
+				block.Values = append(block.Values, phis[slot])
+			}
+			slots = phis
+		} else {
+			slots = append([]*Value(nil), slots...)
+		}
+		exit, err := lifter.run(block, slots)
+		if err != nil {
+			return err
+		}
+		exits[block] = exit
+		for _, succ := range block.Succs {
+			if _, done := exits[succ]; !done {
+				if err := run(succ, exit); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	if err := run(entry.Succs[0], exits[entry]); err != nil {
+		return nil, err
+	}
+
+	for _, block := range f.Blocks {
+		if len(block.Preds) < 2 {
+			continue
+		}
+		phis := block.Values
+		for i, v := range phis {
+			if v.Op != irop.OP_PHI {
+				phis = phis[:i]
+				break
+			}
+		}
+		for _, pred := range block.Preds {
+			if len(exits[pred]) != len(phis) {
+				return nil, fmt.Errorf("the stack differs between the jumps to offset %d", lifter.starts[block])
+			}
+		}
+		for _, phi := range phis {
+			phi.Args = make([]*Value, len(block.Preds))
+			for i, pred := range block.Preds {
+				phi.Args[i] = exits[pred][phi.Aux]
+			}
+		}
+	}
+	return f, nil
+}
+
+func isJump(op uint8) bool {
+	switch op {
+	case opcode.OP_JUMP, opcode.OP_LOOP, opcode.OP_JUMP_IF_FALSE, opcode.OP_JUMP_IF_TRUE,
+		opcode.OP_LESS_JUMP_IF_FALSE, opcode.OP_CHECK_INLINE:
+		return true
+	}
+	return false
+}
+
+// jumpTarget is the offset the instruction at offset jumps to, if it's a
+// jump.
+func jumpTarget(c *chunk.Chunk, offset int) (int, bool) {
+	op := c.Code[offset]
+	if !isJump(op) {
+		return 0, false
+	}
+	length := lengths[op]
+	distance := int(binary.LittleEndian.Uint16(c.Code[offset+length-2:]))
+	if op == opcode.OP_LOOP {
+		distance = -distance
+	}
+	return offset + length + distance, true
+}
+
+// last is the offset of the last instruction of block.
+func (lifter *lifter) last(block *Block) int {
+	offset := lifter.starts[block]
+	for offset+lengths[lifter.c.Code[offset]] < lifter.ends[block] {
+		offset += lengths[lifter.c.Code[offset]]
+	}
+	return offset
+}
+
+// constant is the index of a constant in f that's the same as val, added
+// if there isn't one.
+func (lifter *lifter) constant(val value.Value) int {
+	for i, constant := range lifter.f.Constants {
+		if chunk.SameConstant(constant, val) {
+			return i
+		}
+	}
+	lifter.f.Constants = append(lifter.f.Constants, val)
+	return len(lifter.f.Constants) - 1
+}
+
+// run follows the code of block from the slots it starts with to those it
+// ends with, adding the values it computes and its control.
+func (lifter *lifter) run(block *Block, slots []*Value) ([]*Value, error) {
+	f, code := lifter.f, lifter.c.Code
+	var err error
+
+	pop := func() *Value {
+		if len(slots) == 0 {
+			err = fmt.Errorf("the stack underflows in block %s", block)
+			return nil
+		}
+		v := slots[len(slots)-1]
+		slots = slots[:len(slots)-1]
+		return v
+	}
+	popN := func(n int) []*Value {
+		if n > len(slots) {
+			err = fmt.Errorf("the stack underflows in block %s", block)
+			return nil
+		}
+		values := append([]*Value(nil), slots[len(slots)-n:]...)
+		slots = slots[:len(slots)-n]
+		return values
+	}
+	var inlined *chunk.Inline
+	add := func(op uint8, aux int, line int, args ...*Value) *Value {
+		v := f.newValue(block, op, aux, line, args...)
+		v.Inlined = inlined
+		block.Values = append(block.Values, v)
+		return v
+	}
+	local := func(slot int) *Value {
+		if slot < 0 || slot >= len(slots) {
+			err = fmt.Errorf("slot %d isn't on the stack in block %s", slot, block)
+			return nil
+		}
+		return slots[slot]
+	}
+
+	for offset := lifter.starts[block]; offset < lifter.ends[block] && err == nil; offset += lengths[code[offset]] {
+		op, line := code[offset], lifter.c.Lines[offset]
+		inlined = lifter.c.InlinedAt(offset)
+		var operand int
+		if lengths[op] > 1 {
+			operand = int(code[offset+1])
+		}
+
+		if result, ok := binaries[op]; ok {
+			b, a := pop(), pop()
+			slots = append(slots, add(result, 0, line, a, b))
+			continue
+		}
+		if result, ok := unaries[op]; ok {
+			slots = append(slots, add(result, 0, line, pop()))
+			continue
+		}
+
+		switch op {
+		case opcode.OP_CONSTANT:
+			slots = append(slots, add(irop.OP_CONST, operand, line))
+		case opcode.OP_NIL:
+			slots = append(slots, add(irop.OP_NIL, 0, line))
+		case opcode.OP_TRUE:
+			slots = append(slots, add(irop.OP_TRUE, 0, line))
+		case opcode.OP_FALSE:
+			slots = append(slots, add(irop.OP_FALSE, 0, line))
+		case opcode.OP_POP:
+			pop()
+		case opcode.OP_DUP:
+			top := pop()
+			slots = append(slots, top, top)
+		case opcode.OP_PEEK:
+			slots = append(slots, local(len(slots)-1-operand))
+		case opcode.OP_INLINE_RETURN:
+			result := pop()
+			popN(operand + 1)
+			slots = append(slots, result)
+
+		case opcode.OP_GET_LOCAL_0, opcode.OP_GET_LOCAL_1, opcode.OP_GET_LOCAL_2, opcode.OP_GET_LOCAL_3:
+			slots = append(slots, local(int(op-opcode.OP_GET_LOCAL_0)))
+		case opcode.OP_GET_LOCAL:
+			slots = append(slots, local(operand))
+		case opcode.OP_SET_LOCAL:
+			top := pop()
+			if local(operand) != nil {
+				slots[operand] = add(irop.OP_COPY, operand, line, top)
+			}
+			slots = append(slots, top)
+		case opcode.OP_INCR_LOCAL:
+			if old := local(operand); old != nil {
+				one := add(irop.OP_CONST, lifter.constant(value.ValInt(1)), line)
+				slots[operand] = add(irop.OP_COPY, operand, line, add(irop.OP_ADD, 0, line, old, one))
+			}
+		case opcode.OP_ADD_CONST:
+			a := pop()
+			slots = append(slots, add(irop.OP_ADD, 0, line, a, add(irop.OP_CONST, operand, line)))
+
+		case opcode.OP_GET_GLOBAL:
+			slots = append(slots, add(irop.OP_GET_GLOBAL, operand, line))
+		case opcode.OP_SET_GLOBAL:
+			slots = append(slots, add(irop.OP_SET_GLOBAL, operand, line, pop()))
+		case opcode.OP_DEFINE_GLOBAL:
+			add(irop.OP_DEFINE_GLOBAL, operand, line, pop())
+		case opcode.OP_DEFINE_CONST:
+			add(irop.OP_DEFINE_CONST, operand, line, pop())
+
+		case opcode.OP_CALL:
+			args := popN(operand + 1)
+			slots = append(slots, add(irop.OP_CALL, 0, line, args...))
+		case opcode.OP_LIST:
+			items := popN(operand)
+			slots = append(slots, add(irop.OP_LIST, 0, line, items...))
+		case opcode.OP_STORE:
+			args := popN(3)
+			slots = append(slots, add(irop.OP_STORE, 0, line, args...))
+		case opcode.OP_CLOSURE:
+			slots = append(slots, add(irop.OP_CLOSURE, operand, line))
+		case opcode.OP_PRINT:
+			add(irop.OP_PRINT, 0, line, pop())
+
+		case opcode.OP_JUMP, opcode.OP_LOOP:
+		case opcode.OP_JUMP_IF_FALSE, opcode.OP_JUMP_IF_TRUE:
+			// the condition stays on the stack either way
+			block.Control = local(len(slots) - 1)
+		case opcode.OP_LESS_JUMP_IF_FALSE:
+			b, a := pop(), pop()
+			block.Control = add(irop.OP_LESS, 0, line, a, b)
+		case opcode.OP_CHECK_INLINE:
+			callee := local(len(slots) - 1 - int(code[offset+2]))
+			block.Control = add(irop.OP_GUARD, operand, line, callee)
+		case opcode.OP_RETURN:
+			block.Control = pop()
+		}
+	}
+	return slots, err
+}
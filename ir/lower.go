@@ -0,0 +1,747 @@
+package ir
+
+import (
+	"encoding/binary"
+	"fmt"
+	"golox/chunk"
+	"golox/chunk/opcode"
+	"golox/ir/irop"
+	"math"
+	"sort"
+)
+
+// instructions are the bytecode instructions of the operations lowered to
+// one instruction, taking their arguments from the stack.
+var instructions = map[uint8]uint8{
+	irop.OP_ADD:           opcode.OP_ADD,
+	irop.OP_SUBTRACT:      opcode.OP_SUBTRACT,
+	irop.OP_MULTIPLY:      opcode.OP_MULTIPLY,
+	irop.OP_DIVIDE:        opcode.OP_DIVIDE,
+	irop.OP_MODULO:        opcode.OP_MODULO,
+	irop.OP_NEGATE:        opcode.OP_NEGATE,
+	irop.OP_NOT:           opcode.OP_NOT,
+	irop.OP_EQUAL:         opcode.OP_EQUAL,
+	irop.OP_LESS:          opcode.OP_LESS,
+	irop.OP_GREATER:       opcode.OP_GREATER,
+	irop.OP_BIT_AND:       opcode.OP_BIT_AND,
+	irop.OP_BIT_OR:        opcode.OP_BIT_OR,
+	irop.OP_BIT_XOR:       opcode.OP_BIT_XOR,
+	irop.OP_BIT_NOT:       opcode.OP_BIT_NOT,
+	irop.OP_SHIFT_LEFT:    opcode.OP_SHIFT_LEFT,
+	irop.OP_SHIFT_RIGHT:   opcode.OP_SHIFT_RIGHT,
+	irop.OP_GET_GLOBAL:    opcode.OP_GET_GLOBAL,
+	irop.OP_SET_GLOBAL:    opcode.OP_SET_GLOBAL,
+	irop.OP_DEFINE_GLOBAL: opcode.OP_DEFINE_GLOBAL,
+	irop.OP_DEFINE_CONST:  opcode.OP_DEFINE_CONST,
+	irop.OP_CALL:          opcode.OP_CALL,
+	irop.OP_LIST:          opcode.OP_LIST,
+	irop.OP_INDEX:         opcode.OP_INDEX,
+	irop.OP_STORE:         opcode.OP_STORE,
+	irop.OP_CLOSURE:       opcode.OP_CLOSURE,
+	irop.OP_PRINT:         opcode.OP_PRINT,
+}
+
+// rematerialized reports whether values of op are pushed again where
+// they're used rather than kept in a slot.
+func rematerialized(op uint8) bool {
+	switch op {
+	case irop.OP_CONST, irop.OP_NIL, irop.OP_TRUE, irop.OP_FALSE:
+		return true
+	}
+	return false
+}
+
+// interval is the span of positions, numbering the values and block ends
+// in the order they're lowered, over which a value needs its slot.
+type interval struct {
+	v          *Value
+	start, end int
+}
+
+type lowerer struct {
+	f        *Func
+	c        *chunk.Chunk
+	slots    map[*Value]int
+	stacked  map[*Value]bool     // left on the stack for their use
+	preloads map[*Value][]*Value // loaded before the code of each value
+	labels   map[*Block]int      // offset of each block's code
+	fixups   []fixup
+	stubs    []stub
+	err      error
+
+	// the blocks whose code starts by popping the condition their only
+	// predecessor branched to them on
+	landings map[*Block]bool
+}
+
+// stub is the way out of block when its condition is false, whose jump
+// is at offset at.
+type stub struct {
+	at    int
+	block *Block
+}
+
+// fixup is a jump at offset to a block, or to an offset when block is nil.
+type fixup struct {
+	at     int
+	block  *Block
+	target int
+}
+
+// Lower generates bytecode running f. Values used once, by the value
+// computed next in their block, stay on the stack the way the compiler
+// leaves them; the others that are used get a slot of the frame each,
+// above the parameters, shared by values that don't need theirs at the
+// same time, and constants are pushed again where they're used. It fails
+// if the code needs more slots, constants or jump distance than
+// instructions can name.
+func (f *Func) Lower() (*chunk.Chunk, error) {
+	lowerer := &lowerer{
+		f:        f,
+		c:        &chunk.Chunk{Constants: f.Constants},
+		labels:   make(map[*Block]int),
+		landings: make(map[*Block]bool),
+	}
+	f.Blocks = f.layout()
+	lowerer.stacked, lowerer.preloads = f.stacked()
+	slots, err := f.allocate(lowerer.stacked)
+	if err != nil {
+		return nil, err
+	}
+	lowerer.slots = slots
+
+	// the slots above the parameters are reserved when the function
+	// starts
+	frame := f.Params
+	for _, slot := range slots {
+		if slot+1 > frame {
+			frame = slot + 1
+		}
+	}
+	for i := f.Params; i < frame; i++ {
+		lowerer.emit(f.Blocks[0].Line, opcode.OP_NIL)
+	}
+
+	for i, block := range f.Blocks {
+		var next *Block
+		if i+1 < len(f.Blocks) {
+			next = f.Blocks[i+1]
+		}
+		lowerer.block(block, next)
+	}
+	for _, stub := range lowerer.stubs {
+		lowerer.fixups = append(lowerer.fixups, fixup{at: stub.at, target: len(lowerer.c.Code)})
+		lowerer.emit(stub.block.Line, opcode.OP_POP)
+		lowerer.copies(stub.block, stub.block.Succs[1])
+		lowerer.jump(opcode.OP_JUMP, stub.block.Succs[1], stub.block.Line)
+	}
+	if lowerer.err != nil {
+		return nil, lowerer.err
+	}
+
+	for _, fixup := range lowerer.fixups {
+		target := fixup.target
+		if fixup.block != nil {
+			target = lowerer.labels[fixup.block]
+		}
+		// the jump offset ends an instruction
+		end := fixup.at + 3
+		if lowerer.c.Code[fixup.at] == opcode.OP_CHECK_INLINE {
+			end = fixup.at + 5
+		}
+		distance := target - end
+		if distance < 0 {
+			lowerer.c.Code[fixup.at] = opcode.OP_LOOP
+			distance = -distance
+		}
+		if distance > math.MaxUint16 {
+			return nil, fmt.Errorf("a jump is too long")
+		}
+		binary.LittleEndian.PutUint16(lowerer.c.Code[end-2:], uint16(distance))
+	}
+	return lowerer.c, nil
+}
+
+// layout orders the blocks the way they're lowered: after a block comes
+// the first of its successors where that's possible, so that jumps and
+// the way an `if` goes when its condition holds fall through. Blocks no
+// way leads to are dropped.
+func (f *Func) layout() []*Block {
+	var order []*Block
+	seen := make(map[*Block]bool)
+	var visit func(block *Block)
+	visit = func(block *Block) {
+		seen[block] = true
+		for i := len(block.Succs) - 1; i >= 0; i-- {
+			if succ := block.Succs[i]; !seen[succ] {
+				visit(succ)
+			}
+		}
+		order = append(order, block)
+	}
+	visit(f.Blocks[0])
+	for i, j := 0, len(order)-1; i < j; i, j = i+1, j-1 {
+		order[i], order[j] = order[j], order[i]
+	}
+	return order
+}
+
+// stacked finds the values that can stay on the stack until their only
+// use, later in their block, as the compiler leaves the operands of an
+// expression, and the loads each value needs before its code for that:
+// the arguments that come before one on the stack are loaded where the
+// code computing that one starts, so that they're under it. Values that
+// would leave the stack out of order are given a slot after all.
+func (f *Func) stacked() (map[*Value]bool, map[*Value][]*Value) {
+	uses := f.uses()
+	stacked := make(map[*Value]bool)
+	preloads := make(map[*Value][]*Value)
+	for _, block := range f.Blocks {
+		usedHere := make(map[*Value]bool)
+		for _, v := range block.Values {
+			if v.Op != irop.OP_PHI && v.Op != irop.OP_GUARD {
+				for _, arg := range v.Args {
+					usedHere[arg] = true
+				}
+			}
+		}
+		if block.Control != nil && block.Control.Op != irop.OP_GUARD {
+			usedHere[block.Control] = true
+		}
+		for _, v := range block.Values {
+			if lowered(v) && hasResult(v.Op) && uses[v] == 1 && usedHere[v] {
+				stacked[v] = true
+			}
+		}
+
+		for {
+			loads, misplaced := block.schedule(stacked)
+			if misplaced == nil {
+				for v, values := range loads {
+					preloads[v] = values
+				}
+				break
+			}
+			delete(stacked, misplaced)
+		}
+	}
+	return stacked, preloads
+}
+
+// lastStacked is the index of the last argument of v that's on the stack
+// when it's computed, or -1. The arguments after it are loaded then.
+func lastStacked(v *Value, stacked map[*Value]bool) int {
+	for i := len(v.Args) - 1; i >= 0; i-- {
+		if stacked[v.Args[i]] {
+			return i
+		}
+	}
+	return -1
+}
+
+// schedule works out the loads each value of block needs before its code
+// and follows the stack through the block, returning a value left on it
+// that isn't where it's used, or nil if there's none.
+func (block *Block) schedule(stacked map[*Value]bool) (map[*Value][]*Value, *Value) {
+	index := make(map[*Value]int)
+	for i, v := range block.Values {
+		index[v] = i
+	}
+	// available reports whether v can be loaded before the code of at
+	available := func(v *Value, at *Value) bool {
+		return v.Block != block || !lowered(v) || index[v] < index[at]
+	}
+
+	start := make(map[*Value]*Value) // the value whose code comes first in that of each
+	preloads := make(map[*Value][]*Value)
+	for _, v := range block.Values {
+		if !lowered(v) {
+			continue
+		}
+		start[v] = v
+		var pending []*Value
+		for i, arg := range v.Args[:lastStacked(v, stacked)+1] {
+			if !stacked[arg] {
+				pending = append(pending, arg)
+				continue
+			}
+			if i == len(pending) {
+				start[v] = start[arg]
+			}
+			if len(pending) > 0 {
+				at := start[arg]
+				for _, load := range pending {
+					if !available(load, at) {
+						return nil, arg
+					}
+				}
+				preloads[at] = append(pending, preloads[at]...)
+				pending = nil
+			}
+		}
+	}
+
+	var stack []*Value
+	for _, v := range block.Values {
+		if !lowered(v) {
+			continue
+		}
+		stack = append(stack, preloads[v]...)
+		n := lastStacked(v, stacked) + 1
+		if n > len(stack) {
+			return nil, v.Args[n-1]
+		}
+		for i, arg := range v.Args[:n] {
+			if stack[len(stack)-n+i] != arg {
+				return nil, v.Args[n-1]
+			}
+		}
+		stack = stack[:len(stack)-n]
+		if stacked[v] {
+			stack = append(stack, v)
+		}
+	}
+	for _, v := range stack {
+		if v != block.Control || len(stack) > 1 {
+			return nil, v
+		}
+	}
+	return preloads, nil
+}
+
+// lowered reports whether v is computed where it is in its block. The
+// parameters and phis are set before, constants pushed where they're
+// used, and guards checked by the jump ending their block.
+func lowered(v *Value) bool {
+	return v.Op != irop.OP_PARAM && v.Op != irop.OP_PHI && v.Op != irop.OP_GUARD && !rematerialized(v.Op)
+}
+
+// allocate gives a slot to each value that needs one. The parameters keep
+// theirs; the others get the lowest slot free for their interval.
+func (f *Func) allocate(stacked map[*Value]bool) (map[*Value]int, error) {
+	uses := f.uses()
+	needsSlot := func(v *Value) bool {
+		return v.Op == irop.OP_PARAM ||
+			(uses[v] > 0 && hasResult(v.Op) && v.Op != irop.OP_GUARD && !rematerialized(v.Op) && !stacked[v])
+	}
+
+	// positions
+	position := make(map[*Value]int)
+	starts := make(map[*Block]int)
+	ends := make(map[*Block]int)
+	pos := 0
+	for _, block := range f.Blocks {
+		starts[block] = pos
+		for _, v := range block.Values {
+			position[v] = pos
+			pos++
+		}
+		ends[block] = pos
+		pos++
+	}
+
+	// liveness: a phi's arguments are used at the end of the predecessor
+	// they come from, and the phi is written there too
+	liveIn := make(map[*Block]map[*Value]bool)
+	liveOut := make(map[*Block]map[*Value]bool)
+	for _, block := range f.Blocks {
+		liveIn[block] = make(map[*Value]bool)
+		liveOut[block] = make(map[*Value]bool)
+	}
+	for changed := true; changed; {
+		changed = false
+		for i := len(f.Blocks) - 1; i >= 0; i-- {
+			block := f.Blocks[i]
+			out := liveOut[block]
+			for _, succ := range block.Succs {
+				index := succ.predIndex(block)
+				for v := range liveIn[succ] {
+					if v.Block != succ || v.Op != irop.OP_PHI {
+						if !out[v] {
+							out[v] = true
+							changed = true
+						}
+					}
+				}
+				for _, phi := range succ.Values {
+					if phi.Op == irop.OP_PHI && needsSlot(phi) {
+						if arg := phi.Args[index]; needsSlot(arg) && !out[arg] {
+							out[arg] = true
+							changed = true
+						}
+					}
+				}
+			}
+
+			in := liveIn[block]
+			live := make(map[*Value]bool)
+			for v := range out {
+				live[v] = true
+			}
+			for _, w := range loaded(block) {
+				if needsSlot(w) {
+					live[w] = true
+				}
+			}
+			for j := len(block.Values) - 1; j >= 0; j-- {
+				v := block.Values[j]
+				if v.Op != irop.OP_PHI {
+					delete(live, v)
+					for _, arg := range v.Args {
+						if needsSlot(arg) {
+							live[arg] = true
+						}
+					}
+				}
+			}
+			for v := range live {
+				if !in[v] {
+					in[v] = true
+					changed = true
+				}
+			}
+		}
+	}
+
+	intervals := make(map[*Value]*interval)
+	extend := func(v *Value, at int) {
+		if !needsSlot(v) {
+			return
+		}
+		span, ok := intervals[v]
+		if !ok {
+			span = &interval{v: v, start: at, end: at}
+			intervals[v] = span
+		}
+		if at < span.start {
+			span.start = at
+		}
+		if at > span.end {
+			span.end = at
+		}
+	}
+	for _, block := range f.Blocks {
+		for v := range liveIn[block] {
+			extend(v, starts[block])
+		}
+		for v := range liveOut[block] {
+			extend(v, ends[block])
+		}
+		for _, v := range block.Values {
+			extend(v, position[v])
+			if v.Op == irop.OP_PHI {
+				extend(v, starts[block])
+				for _, pred := range block.Preds {
+					extend(v, ends[pred])
+				}
+				continue
+			}
+			for _, arg := range v.Args {
+				extend(arg, position[v])
+			}
+		}
+		for _, v := range loaded(block) {
+			extend(v, ends[block])
+		}
+	}
+
+	// a phi shares its slot with the arguments that are never live at
+	// the same time as it, or as each other, so that the copies to it
+	// go away
+	liveAt := func(v *Value) map[*Value]bool {
+		block := v.Block
+		live := make(map[*Value]bool)
+		if v.Op == irop.OP_PHI {
+			for w := range liveIn[block] {
+				live[w] = true
+			}
+			for _, w := range block.Values {
+				if w.Op == irop.OP_PHI && needsSlot(w) {
+					live[w] = true
+				}
+			}
+			for i, pred := range block.Preds {
+				args := make(map[*Value]bool)
+				for _, w := range block.Values {
+					if w.Op == irop.OP_PHI {
+						args[w.Args[i]] = true
+					}
+				}
+				for w := range liveOut[pred] {
+					if !args[w] {
+						live[w] = true
+					}
+				}
+			}
+		} else {
+			for w := range liveOut[block] {
+				live[w] = true
+			}
+			for _, w := range loaded(block) {
+				if needsSlot(w) {
+					live[w] = true
+				}
+			}
+			for j := len(block.Values) - 1; j >= 0 && block.Values[j] != v; j-- {
+				w := block.Values[j]
+				delete(live, w)
+				for _, arg := range w.Args {
+					if needsSlot(arg) {
+						live[arg] = true
+					}
+				}
+			}
+		}
+		delete(live, v)
+		return live
+	}
+	leaders := make(map[*Value]*Value)
+	for _, block := range f.Blocks {
+		for _, phi := range block.Values {
+			if phi.Op != irop.OP_PHI || !needsSlot(phi) || leaders[phi] != nil {
+				continue
+			}
+			group := []*Value{phi}
+			live := []map[*Value]bool{liveAt(phi)}
+			for _, arg := range phi.Args {
+				if !needsSlot(arg) || arg.Op == irop.OP_PARAM || leaders[arg] != nil {
+					continue
+				}
+				argLive := liveAt(arg)
+				interferes := false
+				for i, member := range group {
+					if member == arg || live[i][arg] || argLive[member] {
+						interferes = true
+						break
+					}
+				}
+				if !interferes {
+					group = append(group, arg)
+					live = append(live, argLive)
+				}
+			}
+			span := intervals[phi]
+			for _, member := range group {
+				leaders[member] = phi
+				if member != phi {
+					other := intervals[member]
+					if other.start < span.start {
+						span.start = other.start
+					}
+					if other.end > span.end {
+						span.end = other.end
+					}
+					delete(intervals, member)
+				}
+			}
+		}
+	}
+
+	sorted := make([]*interval, 0, len(intervals))
+	for _, span := range intervals {
+		sorted = append(sorted, span)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].start != sorted[j].start {
+			return sorted[i].start < sorted[j].start
+		}
+		return sorted[i].v.ID < sorted[j].v.ID
+	})
+
+	slots := make(map[*Value]int)
+	var taken []*interval // by slot, nil when free
+	for slot := 0; slot < f.Params; slot++ {
+		taken = append(taken, &interval{start: 0, end: math.MaxInt32})
+	}
+	for _, span := range sorted {
+		if span.v.Op == irop.OP_PARAM {
+			slots[span.v] = span.v.Aux
+			continue
+		}
+		slot := -1
+		for i := f.Params; i < len(taken); i++ {
+			if taken[i] == nil || taken[i].end < span.start {
+				slot = i
+				break
+			}
+		}
+		if slot < 0 {
+			slot = len(taken)
+			taken = append(taken, nil)
+		}
+		taken[slot] = span
+		slots[span.v] = slot
+	}
+	for member, leader := range leaders {
+		slots[member] = slots[leader]
+	}
+	if len(taken) > math.MaxUint8+1 {
+		return nil, fmt.Errorf("the function needs %d slots", len(taken))
+	}
+	return slots, nil
+}
+
+// loaded are the values the end of block pushes: its control, or the
+// callee a guard checks.
+func loaded(block *Block) []*Value {
+	switch {
+	case block.Control == nil:
+		return nil
+	case block.Control.Op == irop.OP_GUARD:
+		return block.Control.Args
+	}
+	return []*Value{block.Control}
+}
+
+func (lowerer *lowerer) emit(line int, bytes ...uint8) {
+	for _, b := range bytes {
+		lowerer.c.Write(b, line)
+	}
+}
+
+// operand checks that n fits in a one-byte operand.
+func (lowerer *lowerer) operand(n int) uint8 {
+	if n > math.MaxUint8 && lowerer.err == nil {
+		lowerer.err = fmt.Errorf("operand %d doesn't fit in a byte", n)
+	}
+	return uint8(n)
+}
+
+// load pushes v.
+func (lowerer *lowerer) load(v *Value, line int) {
+	switch v.Op {
+	case irop.OP_CONST:
+		lowerer.emit(line, opcode.OP_CONSTANT, lowerer.operand(v.Aux))
+	case irop.OP_NIL:
+		lowerer.emit(line, opcode.OP_NIL)
+	case irop.OP_TRUE:
+		lowerer.emit(line, opcode.OP_TRUE)
+	case irop.OP_FALSE:
+		lowerer.emit(line, opcode.OP_FALSE)
+	default:
+		slot, ok := lowerer.slots[v]
+		if !ok && lowerer.err == nil {
+			lowerer.err = fmt.Errorf("%s has no slot", v)
+		}
+		lowerer.emit(line, opcode.OP_GET_LOCAL, lowerer.operand(slot))
+	}
+}
+
+// store pops the value on top of the stack into the slot of v, or drops
+// it if v has none.
+func (lowerer *lowerer) store(v *Value, line int) {
+	if slot, ok := lowerer.slots[v]; ok {
+		lowerer.emit(line, opcode.OP_SET_LOCAL, lowerer.operand(slot))
+	}
+	lowerer.emit(line, opcode.OP_POP)
+}
+
+func (lowerer *lowerer) block(block *Block, next *Block) {
+	lowerer.labels[block] = len(lowerer.c.Code)
+	if lowerer.landings[block] {
+		pred := block.Preds[0]
+		lowerer.emit(pred.Line, opcode.OP_POP)
+		lowerer.copies(pred, block)
+	}
+
+	for _, v := range block.Values {
+		if !lowered(v) {
+			continue
+		}
+		for _, load := range lowerer.preloads[v] {
+			lowerer.load(load, v.Line)
+		}
+		for _, arg := range v.Args[lastStacked(v, lowerer.stacked)+1:] {
+			lowerer.load(arg, v.Line)
+		}
+		start := len(lowerer.c.Code)
+		switch v.Op {
+		case irop.OP_COPY:
+		case irop.OP_GET_GLOBAL, irop.OP_SET_GLOBAL, irop.OP_DEFINE_GLOBAL, irop.OP_DEFINE_CONST,
+			irop.OP_CLOSURE:
+			lowerer.emit(v.Line, instructions[v.Op], lowerer.operand(v.Aux))
+		case irop.OP_CALL:
+			lowerer.emit(v.Line, opcode.OP_CALL, lowerer.operand(len(v.Args)-1))
+		case irop.OP_LIST:
+			lowerer.emit(v.Line, opcode.OP_LIST, lowerer.operand(len(v.Args)))
+		default:
+			lowerer.emit(v.Line, instructions[v.Op])
+		}
+		lowerer.c.AddInlined(v.Inlined, start)
+		if hasResult(v.Op) && !lowerer.stacked[v] {
+			lowerer.store(v, v.Line)
+		}
+	}
+
+	switch block.Kind {
+	case JUMP:
+		lowerer.copies(block, block.Succs[0])
+		if block.Succs[0] != next {
+			lowerer.jump(opcode.OP_JUMP, block.Succs[0], block.Line)
+		}
+	case IF:
+		// the condition stays on the stack for both ways. The way out when
+		// it's false pops it at the start of the block it goes to when
+		// that's only reached from here and comes later, and otherwise in
+		// a stub after the blocks, so that the way when it's true can fall
+		// through. A guard leaves the callee it checks there instead
+		control := block.Control
+		if control.Op == irop.OP_GUARD {
+			lowerer.load(control.Args[0], block.Line)
+		} else if !lowerer.stacked[control] {
+			lowerer.load(control, block.Line)
+		}
+		otherwise := block.Succs[1]
+		if _, placed := lowerer.labels[otherwise]; !placed && len(otherwise.Preds) == 1 {
+			lowerer.landings[otherwise] = true
+			lowerer.fixups = append(lowerer.fixups, fixup{at: len(lowerer.c.Code), block: otherwise})
+		} else {
+			lowerer.stubs = append(lowerer.stubs, stub{at: len(lowerer.c.Code), block: block})
+		}
+		if control.Op == irop.OP_GUARD {
+			lowerer.emit(block.Line, opcode.OP_CHECK_INLINE, lowerer.operand(control.Aux), 0, 0, 0)
+		} else {
+			lowerer.emit(block.Line, opcode.OP_JUMP_IF_FALSE, 0, 0)
+		}
+		lowerer.emit(block.Line, opcode.OP_POP)
+		lowerer.copies(block, block.Succs[0])
+		if block.Succs[0] != next {
+			lowerer.jump(opcode.OP_JUMP, block.Succs[0], block.Line)
+		}
+	case RETURN:
+		if !lowerer.stacked[block.Control] {
+			lowerer.load(block.Control, block.Line)
+		}
+		lowerer.emit(block.Line, opcode.OP_RETURN)
+	}
+}
+
+func (lowerer *lowerer) jump(op uint8, to *Block, line int) {
+	lowerer.fixups = append(lowerer.fixups, fixup{at: len(lowerer.c.Code), block: to})
+	lowerer.emit(line, op, 0, 0)
+}
+
+// copies sets the slots of the phis of to to their arguments for the way
+// from block, all at once: the arguments are all pushed before any slot
+// is set.
+func (lowerer *lowerer) copies(block *Block, to *Block) {
+	index := to.predIndex(block)
+	var phis []*Value
+	for _, phi := range to.Values {
+		if phi.Op != irop.OP_PHI {
+			break
+		}
+		slot, ok := lowerer.slots[phi]
+		if !ok {
+			continue
+		}
+		if from, ok := lowerer.slots[phi.Args[index]]; ok && from == slot {
+			continue
+		}
+		phis = append(phis, phi)
+		lowerer.load(phi.Args[index], block.Line)
+	}
+	for i := len(phis) - 1; i >= 0; i-- {
+		lowerer.store(phis[i], block.Line)
+	}
+}
@@ -0,0 +1,323 @@
+package ir
+
+import (
+	"fmt"
+	"golox/ir/irop"
+	"strings"
+)
+
+// A pass rewrites f, reporting whether it changed anything.
+type pass func(f *Func) bool
+
+var passes = []pass{
+	propagateCopies,
+	mergeBlocks,
+	numberValues,
+	hoistInvariants,
+	eliminateDeadCode,
+}
+
+// Optimize runs the passes over f until none of them changes anything.
+func (f *Func) Optimize() {
+	for changed := true; changed; {
+		changed = false
+		for _, pass := range passes {
+			if pass(f) {
+				changed = true
+			}
+		}
+	}
+}
+
+// propagateCopies makes the uses of a copy use what it copies, and those
+// of a phi whose arguments are all the same value, or the phi itself,
+// use that value.
+func propagateCopies(f *Func) bool {
+	replacements := make(map[*Value]*Value)
+	resolve := func(v *Value) *Value {
+		for {
+			to, ok := replacements[v]
+			if !ok {
+				return v
+			}
+			v = to
+		}
+	}
+
+	for changed := true; changed; {
+		changed = false
+		for _, block := range f.Blocks {
+			for _, v := range block.Values {
+				if _, ok := replacements[v]; ok {
+					continue
+				}
+				switch v.Op {
+				case irop.OP_COPY:
+					replacements[v] = v.Args[0]
+					changed = true
+				case irop.OP_PHI:
+					var same *Value
+					trivial := true
+					for _, arg := range v.Args {
+						arg = resolve(arg)
+						if arg == v || arg == same {
+							continue
+						}
+						if same != nil {
+							trivial = false
+							break
+						}
+						same = arg
+					}
+					if trivial && same != nil {
+						replacements[v] = same
+						changed = true
+					}
+				}
+			}
+		}
+	}
+
+	if len(replacements) == 0 {
+		return false
+	}
+	f.replace(replacements)
+	f.removeValues(func(v *Value) bool {
+		_, ok := replacements[v]
+		return ok
+	})
+	return true
+}
+
+// mergeBlocks appends to each block that jumps to a block only it goes
+// to that block's code.
+func mergeBlocks(f *Func) bool {
+	merged := make(map[*Block]bool)
+	for _, block := range f.Blocks {
+		if merged[block] {
+			continue
+		}
+		for block.Kind == JUMP {
+			succ := block.Succs[0]
+			if succ == block || succ == f.Blocks[0] || len(succ.Preds) != 1 {
+				break
+			}
+			if len(succ.Values) > 0 && succ.Values[0].Op == irop.OP_PHI {
+				break
+			}
+			for _, v := range succ.Values {
+				v.Block = block
+			}
+			block.Values = append(block.Values, succ.Values...)
+			block.Kind, block.Control, block.Line, block.Succs = succ.Kind, succ.Control, succ.Line, succ.Succs
+			for _, next := range succ.Succs {
+				for i, pred := range next.Preds {
+					if pred == succ {
+						next.Preds[i] = block
+					}
+				}
+			}
+			merged[succ] = true
+		}
+	}
+	if len(merged) == 0 {
+		return false
+	}
+	kept := f.Blocks[:0]
+	for _, block := range f.Blocks {
+		if !merged[block] {
+			kept = append(kept, block)
+		}
+	}
+	f.Blocks = kept
+	return true
+}
+
+// numberValues finds the values computing what a value in a block
+// dominating theirs computed already, and uses that one instead.
+func numberValues(f *Func) bool {
+	idom := f.dominators()
+	children := make(map[*Block][]*Block)
+	for _, block := range f.Blocks {
+		if dom, ok := idom[block]; ok && dom != block {
+			children[dom] = append(children[dom], block)
+		}
+	}
+
+	replacements := make(map[*Value]*Value)
+	available := make(map[string]*Value)
+	var walk func(block *Block)
+	walk = func(block *Block) {
+		var added []string
+		for _, v := range block.Values {
+			if !numberable(v.Op) {
+				continue
+			}
+			key := valueKey(v)
+			if same, ok := available[key]; ok {
+				replacements[v] = same
+				continue
+			}
+			available[key] = v
+			added = append(added, key)
+		}
+		for _, child := range children[block] {
+			walk(child)
+		}
+		for _, key := range added {
+			delete(available, key)
+		}
+	}
+	walk(f.Blocks[0])
+
+	if len(replacements) == 0 {
+		return false
+	}
+	f.replace(replacements)
+	f.removeValues(func(v *Value) bool {
+		_, ok := replacements[v]
+		return ok
+	})
+	return true
+}
+
+// numberable reports whether two values of op with the same arguments
+// are always the same value.
+func numberable(op uint8) bool {
+	switch op {
+	case irop.OP_PARAM, irop.OP_PHI, irop.OP_COPY:
+		return false
+	}
+	return !effects(op) && !allocates(op)
+}
+
+func valueKey(v *Value) string {
+	var key strings.Builder
+	fmt.Fprintf(&key, "%d/%d", v.Op, v.Aux)
+	for _, arg := range v.Args {
+		fmt.Fprintf(&key, "/%d", arg.ID)
+	}
+	return key.String()
+}
+
+// hoistInvariants moves the values of a loop that compute the same thing
+// on every iteration to the block before the loop, when the loop has a
+// single one that only goes on to it. Only values that are safe to
+// compute whether or not the loop would have are moved.
+func hoistInvariants(f *Func) bool {
+	idom := f.dominators()
+	numeric := f.numeric()
+
+	// the body of each loop, by its header, made of the blocks reaching
+	// a jump back to the header without going through it
+	loops := make(map[*Block]map[*Block]bool)
+	for _, header := range f.Blocks {
+		for _, pred := range header.Preds {
+			if !dominates(idom, header, pred) {
+				continue
+			}
+			body := loops[header]
+			if body == nil {
+				body = map[*Block]bool{header: true}
+				loops[header] = body
+			}
+			work := []*Block{pred}
+			for len(work) > 0 {
+				block := work[len(work)-1]
+				work = work[:len(work)-1]
+				if body[block] {
+					continue
+				}
+				body[block] = true
+				work = append(work, block.Preds...)
+			}
+		}
+	}
+
+	postorder := f.postorder()
+	changed := false
+	for _, header := range f.Blocks {
+		body := loops[header]
+		if body == nil {
+			continue
+		}
+		var preheader *Block
+		for _, pred := range header.Preds {
+			if body[pred] {
+				continue
+			}
+			if preheader != nil {
+				preheader = nil
+				break
+			}
+			preheader = pred
+		}
+		if preheader == nil || len(preheader.Succs) != 1 {
+			continue
+		}
+
+		for i := len(postorder) - 1; i >= 0; i-- {
+			block := postorder[i]
+			if !body[block] {
+				continue
+			}
+			kept := block.Values[:0]
+			for _, v := range block.Values {
+				if invariant(v, body, numeric) {
+					v.Block = preheader
+					preheader.Values = append(preheader.Values, v)
+					changed = true
+				} else {
+					kept = append(kept, v)
+				}
+			}
+			block.Values = kept
+		}
+	}
+	return changed
+}
+
+// invariant reports whether v can be computed before the loop made of
+// body.
+func invariant(v *Value, body map[*Block]bool, numeric map[*Value]bool) bool {
+	if v.Op == irop.OP_PARAM || v.Op == irop.OP_PHI || allocates(v.Op) || !safe(v, numeric) {
+		return false
+	}
+	for _, arg := range v.Args {
+		if body[arg.Block] {
+			return false
+		}
+	}
+	return true
+}
+
+// eliminateDeadCode removes the values nothing uses that are safe not to
+// compute.
+func eliminateDeadCode(f *Func) bool {
+	numeric := f.numeric()
+	live := make(map[*Value]bool)
+	var mark func(v *Value)
+	mark = func(v *Value) {
+		if live[v] {
+			return
+		}
+		live[v] = true
+		for _, arg := range v.Args {
+			mark(arg)
+		}
+	}
+
+	for _, block := range f.Blocks {
+		for _, v := range block.Values {
+			if v.Op == irop.OP_PARAM || !safe(v, numeric) {
+				mark(v)
+			}
+		}
+		if block.Control != nil {
+			mark(block.Control)
+		}
+	}
+	return f.removeValues(func(v *Value) bool {
+		return !live[v]
+	})
+}
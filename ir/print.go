@@ -0,0 +1,118 @@
+package ir
+
+import (
+	"fmt"
+	"golox/ir/irop"
+	"strings"
+)
+
+var names = map[uint8]string{
+	irop.OP_PARAM:         "param",
+	irop.OP_CONST:         "const",
+	irop.OP_NIL:           "nil",
+	irop.OP_TRUE:          "true",
+	irop.OP_FALSE:         "false",
+	irop.OP_PHI:           "phi",
+	irop.OP_COPY:          "copy",
+	irop.OP_ADD:           "add",
+	irop.OP_SUBTRACT:      "subtract",
+	irop.OP_MULTIPLY:      "multiply",
+	irop.OP_DIVIDE:        "divide",
+	irop.OP_MODULO:        "modulo",
+	irop.OP_NEGATE:        "negate",
+	irop.OP_NOT:           "not",
+	irop.OP_EQUAL:         "equal",
+	irop.OP_LESS:          "less",
+	irop.OP_GREATER:       "greater",
+	irop.OP_BIT_AND:       "bit_and",
+	irop.OP_BIT_OR:        "bit_or",
+	irop.OP_BIT_XOR:       "bit_xor",
+	irop.OP_BIT_NOT:       "bit_not",
+	irop.OP_SHIFT_LEFT:    "shift_left",
+	irop.OP_SHIFT_RIGHT:   "shift_right",
+	irop.OP_GET_GLOBAL:    "get_global",
+	irop.OP_SET_GLOBAL:    "set_global",
+	irop.OP_DEFINE_GLOBAL: "define_global",
+	irop.OP_DEFINE_CONST:  "define_const",
+	irop.OP_CALL:          "call",
+	irop.OP_LIST:          "list",
+	irop.OP_INDEX:         "index",
+	irop.OP_STORE:         "store",
+	irop.OP_CLOSURE:       "closure",
+	irop.OP_PRINT:         "print",
+	irop.OP_GUARD:         "guard",
+}
+
+func (v *Value) String() string {
+	return fmt.Sprintf("v%d", v.ID)
+}
+
+func (block *Block) String() string {
+	return fmt.Sprintf("b%d", block.ID)
+}
+
+// Print prints the blocks of f under a header naming it with title.
+func (f *Func) Print(title string) {
+	fmt.Printf("\n==== %s (%s) ====\n\n", f.Name, title)
+
+	for _, block := range f.Blocks {
+		fmt.Printf("%s:", block)
+		if len(block.Preds) > 0 {
+			fmt.Printf(" <- %s", blockList(block.Preds))
+		}
+		fmt.Println()
+
+		for _, v := range block.Values {
+			fmt.Printf("    %s\n", f.format(v))
+		}
+
+		switch block.Kind {
+		case JUMP:
+			fmt.Printf("    jump %s\n", block.Succs[0])
+		case IF:
+			fmt.Printf("    if %s -> %s\n", block.Control, blockList(block.Succs))
+		case RETURN:
+			fmt.Printf("    return %s\n", block.Control)
+		}
+	}
+}
+
+func (f *Func) format(v *Value) string {
+	var text strings.Builder
+	if hasResult(v.Op) {
+		fmt.Fprintf(&text, "%s = ", v)
+	}
+	text.WriteString(names[v.Op])
+
+	switch v.Op {
+	case irop.OP_PHI:
+		for i, arg := range v.Args {
+			fmt.Fprintf(&text, " %s %s", arg, v.Block.Preds[i])
+			if i < len(v.Args)-1 {
+				text.WriteString(",")
+			}
+		}
+		fmt.Fprintf(&text, " ; slot %d", v.Aux)
+		return text.String()
+	case irop.OP_PARAM:
+		fmt.Fprintf(&text, " %d", v.Aux)
+	case irop.OP_CONST, irop.OP_GET_GLOBAL, irop.OP_SET_GLOBAL, irop.OP_DEFINE_GLOBAL, irop.OP_DEFINE_CONST,
+		irop.OP_CLOSURE, irop.OP_GUARD:
+		fmt.Fprintf(&text, " %s", f.Constants[v.Aux].Stringify())
+	}
+	for _, arg := range v.Args {
+		fmt.Fprintf(&text, " %s", arg)
+	}
+	if v.Op == irop.OP_COPY {
+		fmt.Fprintf(&text, " ; slot %d", v.Aux)
+	}
+	return text.String()
+}
+
+func blockList(blocks []*Block) string {
+	names := make([]string, len(blocks))
+	for i, block := range blocks {
+		names[i] = block.String()
+	}
+	return strings.Join(names, ", ")
+}
@@ -0,0 +1,458 @@
+package jit
+
+import (
+	"encoding/binary"
+	"fmt"
+	"golox/asm"
+	"golox/chunk"
+	"golox/chunk/opcode"
+	"golox/value/valuetype"
+	"math"
+)
+
+// sizes are the lengths of the instructions the compiler knows: those it
+// handles, itself or with a helper, and those it deoptimizes at.
+var sizes = map[uint8]int{
+	opcode.OP_CONSTANT:           2,
+	opcode.OP_NIL:                1,
+	opcode.OP_TRUE:               1,
+	opcode.OP_FALSE:              1,
+	opcode.OP_POP:                1,
+	opcode.OP_DUP:                1,
+	opcode.OP_GET_LOCAL:          2,
+	opcode.OP_SET_LOCAL:          2,
+	opcode.OP_GET_LOCAL_0:        1,
+	opcode.OP_GET_LOCAL_1:        1,
+	opcode.OP_GET_LOCAL_2:        1,
+	opcode.OP_GET_LOCAL_3:        1,
+	opcode.OP_INCR_LOCAL:         2,
+	opcode.OP_GET_GLOBAL:         2,
+	opcode.OP_SET_GLOBAL:         2,
+	opcode.OP_ADD:                1,
+	opcode.OP_ADD_NUM:            1,
+	opcode.OP_ADD_STR:            1,
+	opcode.OP_ADD_CONST:          2,
+	opcode.OP_SUBTRACT:           1,
+	opcode.OP_MULTIPLY:           1,
+	opcode.OP_DIVIDE:             1,
+	opcode.OP_MODULO:             1,
+	opcode.OP_NEGATE:             1,
+	opcode.OP_BIT_AND:            1,
+	opcode.OP_BIT_OR:             1,
+	opcode.OP_BIT_XOR:            1,
+	opcode.OP_BIT_NOT:            1,
+	opcode.OP_SHIFT_LEFT:         1,
+	opcode.OP_SHIFT_RIGHT:        1,
+	opcode.OP_EQUAL:              1,
+	opcode.OP_LESS:               1,
+	opcode.OP_LESS_NUM:           1,
+	opcode.OP_GREATER:            1,
+	opcode.OP_NOT:                1,
+	opcode.OP_JUMP:               3,
+	opcode.OP_JUMP_IF_FALSE:      3,
+	opcode.OP_JUMP_IF_TRUE:       3,
+	opcode.OP_LOOP:               3,
+	opcode.OP_LESS_JUMP_IF_FALSE: 3,
+	opcode.OP_CALL:               2,
+	opcode.OP_PEEK:               2,
+	opcode.OP_CHECK_INLINE:       5,
+	opcode.OP_INLINE_RETURN:      2,
+	opcode.OP_LIST:               2,
+	opcode.OP_INDEX:              1,
+	opcode.OP_STORE:              1,
+	opcode.OP_PRINT:              1,
+	opcode.OP_RETURN:             1,
+
+	opcode.OP_DUP2:            1,
+	opcode.OP_GET_UPVALUE:     2,
+	opcode.OP_SET_UPVALUE:     2,
+	opcode.OP_GET_PROPERTY:    2,
+	opcode.OP_MAP:             2,
+	opcode.OP_STORE_POSTFIX:   1,
+	opcode.OP_SLICE:           1,
+	opcode.OP_JUMP_IF_NIL:     3,
+	opcode.OP_JUMP_IF_NOT_NIL: 3,
+}
+
+// deoptimized are the instructions in sizes that compiled code leaves to
+// the interpreter, deoptimizing.
+var deoptimized = map[uint8]bool{
+	opcode.OP_DUP2:            true,
+	opcode.OP_GET_UPVALUE:     true,
+	opcode.OP_SET_UPVALUE:     true,
+	opcode.OP_GET_PROPERTY:    true,
+	opcode.OP_MAP:             true,
+	opcode.OP_STORE_POSTFIX:   true,
+	opcode.OP_SLICE:           true,
+	opcode.OP_JUMP_IF_NIL:     true,
+	opcode.OP_JUMP_IF_NOT_NIL: true,
+}
+
+// exited are the common instructions compiled code returns to the vm
+// for, which runs the helper itself and enters the code again: two calls
+// from Go into C cost less than the cgo callback of the bridge.
+var exited = map[uint8]bool{
+	opcode.OP_GET_GLOBAL: true,
+	opcode.OP_SET_GLOBAL: true,
+	opcode.OP_CALL:       true,
+}
+
+// Size is the length of the instruction op, or 0 if the compiler doesn't
+// know it.
+func Size(op uint8) int {
+	return sizes[op]
+}
+
+// slowPath is the exit to the vm running the instruction at offset, taken
+// when its fast path doesn't apply.
+type slowPath struct {
+	label  asm.Label
+	offset int
+}
+
+type compiler struct {
+	assembler asm.Assembler
+	chunk     *chunk.Chunk
+	labels    []asm.Label // the label of each instruction, by offset
+	slowPaths []slowPath
+	helper    asm.HelperID
+	leave     asm.Label // returns the status in RAX
+}
+
+// Compile translates c to machine code in cache, calling helper for the
+// instructions it doesn't run itself. It fails, saying why, if c uses an
+// instruction the compiler doesn't know.
+func Compile(c *chunk.Chunk, cache *asm.CodeCache, helper asm.HelperID) (*Function, error) {
+	compiler := &compiler{chunk: c, labels: make([]asm.Label, len(c.Code)), helper: helper}
+	for offset := 0; offset < len(c.Code); offset += sizes[c.Code[offset]] {
+		if sizes[c.Code[offset]] == 0 {
+			return nil, fmt.Errorf("opcode %d at offset %d isn't supported", c.Code[offset], offset)
+		}
+		compiler.labels[offset] = compiler.assembler.NewLabel()
+	}
+
+	// the entry gets the stack pointer and frame base as arguments, in
+	// RTOP and RBASE already, and jumps to where the function starts or
+	// resumes
+	compiler.emit(jmpMem(RCTX, contextResume))
+	compiler.leave = compiler.assembler.NewLabel()
+	compiler.assembler.Bind(compiler.leave)
+	compiler.emit(ret())
+
+	for offset := 0; offset < len(c.Code); offset += sizes[c.Code[offset]] {
+		compiler.assembler.Bind(compiler.labels[offset])
+		compiler.instruction(offset)
+	}
+	for _, slow := range compiler.slowPaths {
+		compiler.assembler.Bind(slow.label)
+		compiler.exit(slow.offset)
+	}
+
+	entry, err := cache.Add(compiler.assembler.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	function := &Function{
+		entry:    entry,
+		offsets:  make([]int, len(c.Code)),
+		MaxCells: len(c.Code),
+	}
+	for offset := 0; offset < len(c.Code); offset += sizes[c.Code[offset]] {
+		function.offsets[offset] = compiler.assembler.LabelOffset(compiler.labels[offset])
+	}
+	return function, nil
+}
+
+func (compiler *compiler) emit(insns ...asm.X86_64) {
+	compiler.assembler.Emit(insns...)
+}
+
+func (compiler *compiler) uint16At(offset int) int {
+	return int(binary.LittleEndian.Uint16(compiler.chunk.Code[offset:]))
+}
+
+// slow returns the label of a new slow path for the instruction at
+// offset.
+func (compiler *compiler) slow(offset int) asm.Label {
+	label := compiler.assembler.NewLabel()
+	compiler.slowPaths = append(compiler.slowPaths, slowPath{label: label, offset: offset})
+	return label
+}
+
+// runHelper has the helper run the instruction at offset on the cells.
+// The code carries on after the instruction, unless the helper failed or
+// says to resume at another one.
+func (compiler *compiler) runHelper(offset int) {
+	next := offset + sizes[compiler.chunk.Code[offset]]
+	compiler.emit(movMemReg(RCTX, contextSP, RTOP))
+	compiler.assembler.CallHelper(compiler.helper, int64(offset))
+	compiler.emit(
+		movRegMem(RTOP, RCTX, contextSP),
+		cmpRegImm(asm.RAX, next),
+	)
+	compiler.assembler.Jcc(asm.CondNE, compiler.leave)
+}
+
+// exit saves the stack pointer and returns to the vm for it to run the
+// instruction at offset and resume the code.
+func (compiler *compiler) exit(offset int) {
+	compiler.emit(
+		movMemReg(RCTX, contextSP, RTOP),
+		movMemImm(RCTX, contextOffset, offset),
+		movRegImm(asm.RAX, EXIT),
+		ret(),
+	)
+}
+
+// deopt saves the stack pointer and gives the frame back to the
+// interpreter at the instruction at offset.
+func (compiler *compiler) deopt(offset int, reason Reason) {
+	compiler.emit(
+		movMemReg(RCTX, contextSP, RTOP),
+		movMemImm(RCTX, contextReason, int(reason)),
+		movMemImm(RCTX, contextOffset, offset),
+		movRegImm(asm.RAX, DEOPT),
+		ret(),
+	)
+}
+
+// push pushes the cell in tag and bits.
+func (compiler *compiler) push(tag asm.Reg, bits asm.Reg) {
+	compiler.emit(
+		movMemReg(RTOP, 0, tag),
+		movMemReg(RTOP, 8, bits),
+		addRegImm(RTOP, int(cellSize)),
+	)
+}
+
+// pushConstant pushes a cell with a tag and bits known when compiling.
+func (compiler *compiler) pushConstant(tag int, bits uint64) {
+	compiler.emit(
+		movMemImm(RTOP, 0, tag),
+		movRegImm64(asm.RAX, bits),
+		movMemReg(RTOP, 8, asm.RAX),
+		addRegImm(RTOP, int(cellSize)),
+	)
+}
+
+// load loads the cell at [base+disp] into tag and bits.
+func (compiler *compiler) load(base asm.Reg, disp int32, tag asm.Reg, bits asm.Reg) {
+	compiler.emit(
+		movRegMem(tag, base, disp),
+		movRegMem(bits, base, disp+8),
+	)
+}
+
+// slot is the displacement of local slot from the frame base.
+func slot(slot int) int32 {
+	return int32(slot) * cellSize
+}
+
+// peek is the displacement of the cell distance below the top of the
+// stack.
+func peek(distance int) int32 {
+	return -int32(distance+1) * cellSize
+}
+
+// checkInt jumps to slow unless the cell at [base+disp] holds an int.
+func (compiler *compiler) checkInt(base asm.Reg, disp int32, slow asm.Label) {
+	compiler.emit(cmpMemImm(base, disp, valuetype.VAL_INT))
+	compiler.assembler.Jcc(asm.CondNE, slow)
+}
+
+// truthy leaves a value in RAX that isn't 0 exactly when the cell on top
+// of the stack is truthy: the bits, less the sign of a float so that -0
+// is falsy too.
+func (compiler *compiler) truthy() {
+	notFloat := compiler.assembler.NewLabel()
+	compiler.emit(
+		movRegMem(asm.RAX, RTOP, peek(0)+8),
+		cmpMemImm(RTOP, peek(0), valuetype.VAL_NUMBER),
+	)
+	compiler.assembler.Jcc(asm.CondNE, notFloat)
+	compiler.emit(shlRegImm(asm.RAX, 1))
+	compiler.assembler.Bind(notFloat)
+	compiler.emit(testRegReg(asm.RAX, asm.RAX))
+}
+
+// jumpTarget is the label of the instruction the jump at offset goes to,
+// forwards or back.
+func (compiler *compiler) jumpTarget(offset int, forwards bool) asm.Label {
+	distance := compiler.uint16At(offset + 1)
+	if !forwards {
+		distance = -distance
+	}
+	return compiler.labels[offset+3+distance]
+}
+
+func (compiler *compiler) instruction(offset int) {
+	code := compiler.chunk.Code
+	op := code[offset]
+
+	if deoptimized[op] {
+		compiler.deopt(offset, DEOPT_UNSUPPORTED)
+		return
+	}
+
+	switch op {
+	case opcode.OP_CONSTANT:
+		constant := compiler.chunk.Constants[code[offset+1]]
+		switch {
+		case constant.IsInt():
+			compiler.pushConstant(valuetype.VAL_INT, uint64(constant.AsInt()))
+		case constant.IsNumber():
+			compiler.pushConstant(valuetype.VAL_NUMBER, math.Float64bits(constant.AsNumber()))
+		default:
+			compiler.runHelper(offset)
+		}
+	case opcode.OP_NIL:
+		compiler.pushConstant(valuetype.VAL_NIL, 0)
+	case opcode.OP_TRUE:
+		compiler.pushConstant(valuetype.VAL_BOOL, 1)
+	case opcode.OP_FALSE:
+		compiler.pushConstant(valuetype.VAL_BOOL, 0)
+	case opcode.OP_POP:
+		compiler.emit(subRegImm(RTOP, int(cellSize)))
+	case opcode.OP_DUP:
+		compiler.load(RTOP, peek(0), asm.RAX, asm.RCX)
+		compiler.push(asm.RAX, asm.RCX)
+	case opcode.OP_PEEK:
+		compiler.load(RTOP, peek(int(code[offset+1])), asm.RAX, asm.RCX)
+		compiler.push(asm.RAX, asm.RCX)
+	case opcode.OP_INLINE_RETURN:
+		// the result moves down over the callee
+		compiler.load(RTOP, peek(0), asm.RAX, asm.RCX)
+		compiler.emit(subRegImm(RTOP, (int(code[offset+1])+2)*int(cellSize)))
+		compiler.push(asm.RAX, asm.RCX)
+
+	case opcode.OP_GET_LOCAL, opcode.OP_GET_LOCAL_0, opcode.OP_GET_LOCAL_1, opcode.OP_GET_LOCAL_2, opcode.OP_GET_LOCAL_3:
+		local := int(op - opcode.OP_GET_LOCAL_0)
+		if op == opcode.OP_GET_LOCAL {
+			local = int(code[offset+1])
+		}
+		compiler.load(RBASE, slot(local), asm.RAX, asm.RCX)
+		compiler.push(asm.RAX, asm.RCX)
+	case opcode.OP_SET_LOCAL:
+		compiler.load(RTOP, peek(0), asm.RAX, asm.RCX)
+		compiler.emit(
+			movMemReg(RBASE, slot(int(code[offset+1])), asm.RAX),
+			movMemReg(RBASE, slot(int(code[offset+1]))+8, asm.RCX),
+		)
+	case opcode.OP_INCR_LOCAL:
+		slow := compiler.slow(offset)
+		disp := slot(int(code[offset+1]))
+		compiler.checkInt(RBASE, disp, slow)
+		compiler.emit(
+			movRegMem(asm.RAX, RBASE, disp+8),
+			addRegImm(asm.RAX, 1),
+		)
+		compiler.assembler.Jcc(asm.CondO, slow)
+		compiler.emit(movMemReg(RBASE, disp+8, asm.RAX))
+
+	case opcode.OP_ADD, opcode.OP_ADD_NUM, opcode.OP_ADD_STR, opcode.OP_SUBTRACT, opcode.OP_MULTIPLY:
+		slow := compiler.slow(offset)
+		compiler.checkInt(RTOP, peek(1), slow)
+		compiler.checkInt(RTOP, peek(0), slow)
+		compiler.emit(
+			movRegMem(asm.RAX, RTOP, peek(1)+8),
+			movRegMem(asm.RCX, RTOP, peek(0)+8),
+		)
+		switch op {
+		case opcode.OP_SUBTRACT:
+			compiler.emit(subRegReg(asm.RAX, asm.RCX))
+		case opcode.OP_MULTIPLY:
+			compiler.emit(imulRegReg(asm.RAX, asm.RCX))
+		default:
+			compiler.emit(addRegReg(asm.RAX, asm.RCX))
+		}
+		compiler.assembler.Jcc(asm.CondO, slow)
+		compiler.emit(
+			movMemReg(RTOP, peek(1)+8, asm.RAX),
+			subRegImm(RTOP, int(cellSize)),
+		)
+	case opcode.OP_ADD_CONST:
+		constant := compiler.chunk.Constants[code[offset+1]]
+		if !constant.IsInt() {
+			compiler.runHelper(offset)
+			break
+		}
+		slow := compiler.slow(offset)
+		compiler.checkInt(RTOP, peek(0), slow)
+		compiler.emit(
+			movRegMem(asm.RAX, RTOP, peek(0)+8),
+			movRegImm64(asm.RCX, uint64(constant.AsInt())),
+			addRegReg(asm.RAX, asm.RCX),
+		)
+		compiler.assembler.Jcc(asm.CondO, slow)
+		compiler.emit(movMemReg(RTOP, peek(0)+8, asm.RAX))
+
+	case opcode.OP_LESS, opcode.OP_LESS_NUM, opcode.OP_GREATER, opcode.OP_EQUAL:
+		cond := asm.CondL
+		switch op {
+		case opcode.OP_GREATER:
+			cond = asm.CondG
+		case opcode.OP_EQUAL:
+			cond = asm.CondE
+		}
+		slow := compiler.slow(offset)
+		compiler.checkInt(RTOP, peek(1), slow)
+		compiler.checkInt(RTOP, peek(0), slow)
+		compiler.emit(
+			movRegMem(asm.RAX, RTOP, peek(1)+8),
+			movRegMem(asm.RCX, RTOP, peek(0)+8),
+			xorRegReg(asm.R8, asm.R8),
+			cmpRegReg(asm.RAX, asm.RCX),
+			setcc(cond, asm.R8),
+			movMemImm(RTOP, peek(1), valuetype.VAL_BOOL),
+			movMemReg(RTOP, peek(1)+8, asm.R8),
+			subRegImm(RTOP, int(cellSize)),
+		)
+	case opcode.OP_NOT:
+		compiler.emit(xorRegReg(asm.R8, asm.R8))
+		compiler.truthy()
+		compiler.emit(
+			setcc(asm.CondE, asm.R8),
+			movMemImm(RTOP, peek(0), valuetype.VAL_BOOL),
+			movMemReg(RTOP, peek(0)+8, asm.R8),
+		)
+
+	case opcode.OP_JUMP:
+		compiler.assembler.Jmp(compiler.jumpTarget(offset, true))
+	case opcode.OP_LOOP:
+		compiler.assembler.Jmp(compiler.jumpTarget(offset, false))
+	case opcode.OP_JUMP_IF_FALSE:
+		compiler.truthy()
+		compiler.assembler.Jcc(asm.CondE, compiler.jumpTarget(offset, true))
+	case opcode.OP_JUMP_IF_TRUE:
+		compiler.truthy()
+		compiler.assembler.Jcc(asm.CondNE, compiler.jumpTarget(offset, true))
+	case opcode.OP_LESS_JUMP_IF_FALSE:
+		slow := compiler.slow(offset)
+		compiler.checkInt(RTOP, peek(1), slow)
+		compiler.checkInt(RTOP, peek(0), slow)
+		compiler.emit(
+			movRegMem(asm.RAX, RTOP, peek(1)+8),
+			movRegMem(asm.RCX, RTOP, peek(0)+8),
+			subRegImm(RTOP, 2*int(cellSize)),
+			cmpRegReg(asm.RAX, asm.RCX),
+		)
+		compiler.assembler.Jcc(asm.CondGE, compiler.jumpTarget(offset, true))
+
+	case opcode.OP_RETURN:
+		compiler.load(RTOP, peek(0), asm.RAX, asm.RCX)
+		compiler.emit(
+			movMemReg(RCTX, contextResult, asm.RAX),
+			movMemReg(RCTX, contextResult+8, asm.RCX),
+			movRegImm(asm.RAX, DONE),
+			ret(),
+		)
+
+	default:
+		// globals, calls, division and the rest are left to the helpers
+		if exited[op] {
+			compiler.exit(offset)
+		} else {
+			compiler.runHelper(offset)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package jit
+
+import "golox/asm"
+
+// The registers compiled code keeps its state in. They're all caller
+// saved, so the code needs no prologue.
+const (
+	RCTX  = asm.RDI // the Context, passed as the first argument
+	RTOP  = asm.RSI // the stack pointer
+	RBASE = asm.RDX // the frame base
+)
+
+// These build single instructions for the assembler.
+
+func movRegMem(dst asm.Reg, base asm.Reg, disp int32) (x asm.X86_64) {
+	x.MovRegMem(dst, base, disp)
+	return
+}
+
+func movMemReg(base asm.Reg, disp int32, src asm.Reg) (x asm.X86_64) {
+	x.MovMemReg(base, disp, src)
+	return
+}
+
+func movMemImm(base asm.Reg, disp int32, imm int) (x asm.X86_64) {
+	x.MovMemImm(base, disp, imm)
+	return
+}
+
+func movRegImm(dst asm.Reg, imm int) (x asm.X86_64) {
+	x.MovRegImm(dst, imm)
+	return
+}
+
+func movRegImm64(dst asm.Reg, imm uint64) (x asm.X86_64) {
+	x.MovRegImm64(dst, imm)
+	return
+}
+
+func addRegReg(dst asm.Reg, src asm.Reg) (x asm.X86_64) {
+	x.AddRegReg(dst, src)
+	return
+}
+
+func subRegReg(dst asm.Reg, src asm.Reg) (x asm.X86_64) {
+	x.SubRegReg(dst, src)
+	return
+}
+
+func imulRegReg(dst asm.Reg, src asm.Reg) (x asm.X86_64) {
+	x.ImulRegReg(dst, src)
+	return
+}
+
+func xorRegReg(dst asm.Reg, src asm.Reg) (x asm.X86_64) {
+	x.XorRegReg(dst, src)
+	return
+}
+
+func addRegImm(dst asm.Reg, imm int) (x asm.X86_64) {
+	x.AddRegImm(dst, imm)
+	return
+}
+
+func subRegImm(dst asm.Reg, imm int) (x asm.X86_64) {
+	x.SubRegImm(dst, imm)
+	return
+}
+
+func shlRegImm(dst asm.Reg, imm int8) (x asm.X86_64) {
+	x.ShlRegImm(dst, imm)
+	return
+}
+
+func cmpRegReg(a asm.Reg, b asm.Reg) (x asm.X86_64) {
+	x.CmpRegReg(a, b)
+	return
+}
+
+func cmpRegImm(reg asm.Reg, imm int) (x asm.X86_64) {
+	x.CmpRegImm(reg, imm)
+	return
+}
+
+func cmpMemImm(base asm.Reg, disp int32, imm int) (x asm.X86_64) {
+	x.CmpMemImm(base, disp, imm)
+	return
+}
+
+func testRegReg(a asm.Reg, b asm.Reg) (x asm.X86_64) {
+	x.TestRegReg(a, b)
+	return
+}
+
+func setcc(cond asm.Cond, dst asm.Reg) (x asm.X86_64) {
+	x.Setcc(cond, dst)
+	return
+}
+
+func jmpMem(base asm.Reg, disp int32) (x asm.X86_64) {
+	x.JmpMem(base, disp)
+	return
+}
+
+func ret() (x asm.X86_64) {
+	x.Ret()
+	return
+}
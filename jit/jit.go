@@ -0,0 +1,144 @@
+// Package jit is a baseline compiler translating the bytecode of a
+// function one instruction at a time into x86-64 machine code.
+//
+// Compiled code keeps the Lox stack in memory as Cells, a value type tag
+// and its bits, and runs the int fast paths of arithmetic, comparisons,
+// locals and jumps itself. Everything else calls the vm's helper through
+// the asm bridge with the offset of the instruction to run; the vm runs
+// it on the cells and the code carries on. Globals, calls and the slow
+// paths, which are run most, exit to the vm instead, which runs the
+// helper and enters the code again after the instruction. A few
+// instructions the compiler knows but doesn't handle deoptimize: the
+// code gives the frame back to the interpreter, which finishes the call.
+// Functions using instructions the compiler doesn't know at all aren't
+// compiled and stay interpreted.
+//
+// Each exit and helper call goes through cgo, which costs far more than
+// the interpreter dispatching the instruction. Code that spends its time
+// on arithmetic and locals runs faster compiled, but code calling
+// functions or using globals a lot, like a recursive fib, runs several
+// times slower than interpreted.
+package jit
+
+/*
+#include <stdlib.h>
+*/
+import "C"
+
+import (
+	"golox/asm"
+	"unsafe"
+)
+
+// Cell is a value on the stack of compiled code. Bits holds an int, the
+// bits of a float, 0 or 1 for a bool, or for an object one more than its
+// index in the vm's table of objects in use, so that it's never 0.
+type Cell struct {
+	Tag  uint64
+	Bits uint64
+}
+
+const cellSize = int32(unsafe.Sizeof(Cell{}))
+
+// Context is how compiled code and the vm talk: the stack pointer and
+// frame base the code runs with, where it resumes, and what it returns.
+// It lives outside the Go heap, as machine code reads and writes it.
+type Context struct {
+	SP     uintptr // the cell after the top of the stack, saved when the code exits
+	Base   uintptr // slot 0 of the frame, holding the function called
+	Resume uintptr // the address Enter jumps to
+	Result Cell
+	Reason Reason // why the code deoptimized
+	Offset uint64 // the instruction the vm runs after an exit, or carries on at after a deopt
+}
+
+const (
+	contextSP     = int32(unsafe.Offsetof(Context{}.SP))
+	contextResume = int32(unsafe.Offsetof(Context{}.Resume))
+	contextResult = int32(unsafe.Offsetof(Context{}.Result))
+	contextReason = int32(unsafe.Offsetof(Context{}.Reason))
+	contextOffset = int32(unsafe.Offsetof(Context{}.Offset))
+)
+
+// What Enter returns when it isn't the offset of an instruction to resume
+// at.
+const (
+	DONE   = -1 // the function returned
+	FAILED = -2 // a helper had a runtime error
+	DEOPT  = -3 // the code deoptimized, for Reason, at Offset
+	EXIT   = -4 // the vm is to run the instruction at Offset and resume the code after it
+)
+
+// Reason is why compiled code deoptimized.
+type Reason uint64
+
+const (
+	DEOPT_UNSUPPORTED Reason = iota // an instruction the compiler doesn't handle
+)
+
+// Stack is the memory the cells of compiled functions live in, allocated
+// outside the Go heap.
+type Stack struct {
+	Cells []Cell
+}
+
+func NewStack(size int) *Stack {
+	cells := (*Cell)(C.calloc(C.size_t(size), C.size_t(cellSize)))
+	return &Stack{Cells: unsafe.Slice(cells, size)}
+}
+
+func (stack *Stack) Free() {
+	C.free(unsafe.Pointer(&stack.Cells[0]))
+	stack.Cells = nil
+}
+
+// Addr is the address of cell i.
+func (stack *Stack) Addr(i int) uintptr {
+	return uintptr(unsafe.Pointer(&stack.Cells[0])) + uintptr(i)*uintptr(cellSize)
+}
+
+// Index is the index of the cell at addr.
+func (stack *Stack) Index(addr uintptr) int {
+	return int((addr - uintptr(unsafe.Pointer(&stack.Cells[0]))) / uintptr(cellSize))
+}
+
+func NewContext() *Context {
+	return (*Context)(C.calloc(1, C.size_t(unsafe.Sizeof(Context{}))))
+}
+
+func (context *Context) Free() {
+	C.free(unsafe.Pointer(context))
+}
+
+// Function is the machine code of a function's chunk.
+type Function struct {
+	entry   *asm.Entry
+	offsets []int // the code of each instruction, by its offset in the chunk
+
+	// MaxCells is how many cells above the frame's arguments the
+	// function can use at most.
+	MaxCells int
+}
+
+// Start makes Enter run the function from its first instruction.
+func (function *Function) Start(context *Context) {
+	function.ResumeAt(context, 0)
+}
+
+// ResumeAt makes Enter carry on at the instruction at offset.
+func (function *Function) ResumeAt(context *Context, offset int) {
+	context.Resume = function.entry.Addr(function.offsets[offset])
+}
+
+// Enter runs the function, with the stack pointer and frame base in
+// context, until it returns, fails, deoptimizes or exits, or a helper has
+// it resume at the instruction at the offset it gives back.
+func (function *Function) Enter(context *Context) int {
+	return int(function.entry.Call(0, unsafe.Pointer(context), context.SP, context.Base))
+}
+
+// Invalidate frees the function's machine code, which mustn't be entered
+// again.
+func (function *Function) Invalidate() {
+	function.entry.Invalidate()
+}
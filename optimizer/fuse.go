@@ -0,0 +1,98 @@
+package optimizer
+
+import (
+	"golox/chunk"
+	"golox/chunk/opcode"
+)
+
+// incrementSequences are what `i++;`, `++i;` and `i = i + 1;` on a local
+// compile to.
+var incrementSequences = [][]uint8{
+	{opcode.OP_GET_LOCAL, opcode.OP_DUP, opcode.OP_CONSTANT, opcode.OP_ADD, opcode.OP_SET_LOCAL, opcode.OP_POP, opcode.OP_POP},
+	{opcode.OP_GET_LOCAL, opcode.OP_CONSTANT, opcode.OP_ADD, opcode.OP_SET_LOCAL, opcode.OP_POP},
+}
+
+// matches reports whether the instructions from i on are ops, with no
+// jump going to any of them but the first.
+func matches(code []*instruction, i int, ops []uint8, targets map[*instruction]bool) bool {
+	if i+len(ops) > len(code) {
+		return false
+	}
+	for j, op := range ops {
+		if code[i+j].op != op || (j > 0 && targets[code[i+j]]) {
+			return false
+		}
+	}
+	return true
+}
+
+// fuse replaces common sequences with superinstructions doing the work of
+// all of them in one dispatch. It runs once the passes are done, as they
+// don't know about the superinstructions.
+func fuse(code []*instruction, c *chunk.Chunk) {
+	targets := jumpedTo(code)
+	index := make(map[*instruction]int)
+	for i, ins := range code {
+		index[ins] = i
+	}
+
+	for i := 0; i < len(code); i++ {
+		ins := code[i]
+		if ins.dead {
+			continue
+		}
+
+		if sequence := incrementSequence(code, i, c, targets); sequence != nil {
+			ins.op = opcode.OP_INCR_LOCAL
+			for _, fused := range code[i+1 : i+len(sequence)] {
+				fused.dead = true
+			}
+			continue
+		}
+
+		switch {
+		case matches(code, i, []uint8{opcode.OP_CONSTANT, opcode.OP_ADD}, targets):
+			ins.op = opcode.OP_ADD_CONST
+			ins.line = code[i+1].line
+			code[i+1].dead = true
+
+		// the condition of an `if` or a loop, whose value is popped either way
+		case matches(code, i, []uint8{opcode.OP_LESS, opcode.OP_JUMP_IF_FALSE, opcode.OP_POP}, targets) &&
+			code[i+1].target.op == opcode.OP_POP:
+			ins.op = opcode.OP_LESS_JUMP_IF_FALSE
+			ins.target = code[index[code[i+1].target]+1]
+			code[i+1].dead, code[i+2].dead = true, true
+		}
+	}
+
+	for _, ins := range code {
+		if ins.op == opcode.OP_GET_LOCAL && !ins.dead && ins.args[0] <= 3 {
+			ins.op = opcode.OP_GET_LOCAL_0 + ins.args[0]
+			ins.args = nil
+		}
+	}
+}
+
+// incrementSequence is the sequence of incrementSequences adding 1 to a
+// local starting at i, if there's one.
+func incrementSequence(code []*instruction, i int, c *chunk.Chunk, targets map[*instruction]bool) []uint8 {
+	for _, sequence := range incrementSequences {
+		if !matches(code, i, sequence, targets) {
+			continue
+		}
+		var one, set *instruction
+		for j, op := range sequence {
+			switch op {
+			case opcode.OP_CONSTANT:
+				one = code[i+j]
+			case opcode.OP_SET_LOCAL:
+				set = code[i+j]
+			}
+		}
+		constant := c.Constants[one.args[0]]
+		if constant.IsInt() && constant.AsInt() == 1 && set.args[0] == code[i].args[0] {
+			return sequence
+		}
+	}
+	return nil
+}
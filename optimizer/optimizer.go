@@ -0,0 +1,320 @@
+// Package optimizer rewrites a function's bytecode once it's been
+// generated. It folds constant expressions, drops code that can't run,
+// fuses some instruction sequences and shortens chains of jumps, then
+// replaces common sequences with superinstructions and removes the
+// constants no longer used.
+//
+// The chunk is decoded into a list of instructions whose jumps point at
+// other instructions rather than offsets, so instructions can be removed
+// and replaced freely, and encoded again at the end.
+package optimizer
+
+import (
+	"encoding/binary"
+	"golox/chunk"
+	"golox/chunk/opcode"
+	"math"
+)
+
+type instruction struct {
+	op   uint8
+	args []byte // operands other than jump offsets
+	line int
+
+	target *instruction   // where a jump goes
+	table  []*instruction // a jump table's default target followed by its cases
+
+	dead   bool // removed by a pass
+	offset int  // where it's encoded
+
+	inlined *chunk.Inline // the inlined call whose body it's part of
+}
+
+// Optimize rewrites the code of c in place. Code it can't make sense of,
+// or whose jumps would no longer fit once rewritten, is left as it is.
+func Optimize(c *chunk.Chunk) {
+	code, ok := decode(c)
+	if !ok {
+		return
+	}
+
+	for changed := true; changed; {
+		changed = false
+		for _, pass := range passes {
+			if pass(code, c) {
+				changed = true
+				code = compact(code)
+			}
+		}
+	}
+	// fusing a branch leaves the OP_POP its other side started with behind
+	// a return or jump, which needs the fused instructions gone to be seen
+	fuse(code, c)
+	code = compact(code)
+	removeUnreachable(code, c)
+	code = compact(code)
+
+	encoded := new(chunk.Chunk)
+	if !encode(code, encoded) {
+		return
+	}
+	c.Code, c.Lines, c.Inlined = encoded.Code, encoded.Lines, encoded.Inlined
+	c.Locals = nil
+	removeUnusedConstants(code, c)
+}
+
+// isGoto reports whether op always jumps. Backward OP_LOOPs are decoded as
+// OP_JUMPs too and encode picks which one each jump needs.
+func isGoto(op uint8) bool {
+	return op == opcode.OP_JUMP || op == opcode.OP_LOOP
+}
+
+// isBranch reports whether op jumps forward depending on the value on
+// top of the stack, which it leaves there.
+func isBranch(op uint8) bool {
+	switch op {
+	case opcode.OP_JUMP_IF_FALSE, opcode.OP_JUMP_IF_TRUE, opcode.OP_JUMP_IF_NIL, opcode.OP_JUMP_IF_NOT_NIL:
+		return true
+	}
+	return false
+}
+
+// argCount is the number of operand bytes of the instruction at offset,
+// not counting jump offsets, or -1 for an unknown instruction.
+func argCount(c *chunk.Chunk, offset int) int {
+	switch c.Code[offset] {
+	case opcode.OP_CONSTANT, opcode.OP_DEFINE_GLOBAL, opcode.OP_GET_GLOBAL, opcode.OP_SET_GLOBAL,
+		opcode.OP_GET_LOCAL, opcode.OP_SET_LOCAL, opcode.OP_GET_LOCAL_LONG, opcode.OP_SET_LOCAL_LONG,
+		opcode.OP_CALL, opcode.OP_LIST, opcode.OP_GET_UPVALUE, opcode.OP_SET_UPVALUE,
+		opcode.OP_IMPORT, opcode.OP_GET_PROPERTY, opcode.OP_MAP, opcode.OP_DEFINE_CONST,
+		opcode.OP_DEFAULT_ARG, opcode.OP_FOR_ITER, opcode.OP_JUMP_TABLE, opcode.OP_ADD_CONST,
+		opcode.OP_INCR_LOCAL, opcode.OP_PEEK, opcode.OP_INLINE_RETURN:
+		return 1
+	case opcode.OP_MATCH_LIST, opcode.OP_CHECK_INLINE:
+		return 2
+	case opcode.OP_UNPACK_LIST:
+		return 3
+	case opcode.OP_UNPACK_MAP:
+		return 2 + int(c.Code[offset+1])
+	case opcode.OP_CALL_EX:
+		return 1 + int(c.Code[offset+1])
+	case opcode.OP_CLOSURE:
+		function := c.Constants[c.Code[offset+1]].AsObjFunction()
+		return 1 + 2*function.UpvalueCount
+	case opcode.OP_NEGATE, opcode.OP_ADD, opcode.OP_SUBTRACT, opcode.OP_MULTIPLY, opcode.OP_DIVIDE,
+		opcode.OP_RETURN, opcode.OP_NIL, opcode.OP_TRUE, opcode.OP_FALSE, opcode.OP_PRINT, opcode.OP_NOT,
+		opcode.OP_POP, opcode.OP_EQUAL, opcode.OP_GREATER, opcode.OP_LESS, opcode.OP_STORE, opcode.OP_INDEX,
+		opcode.OP_BIT_AND, opcode.OP_BIT_OR, opcode.OP_BIT_XOR, opcode.OP_BIT_NOT, opcode.OP_SHIFT_LEFT,
+		opcode.OP_SHIFT_RIGHT, opcode.OP_MODULO, opcode.OP_DUP, opcode.OP_DUP2, opcode.OP_STORE_POSTFIX,
+		opcode.OP_CLOSE_UPVALUE, opcode.OP_LIST_APPEND, opcode.OP_LIST_EXTEND, opcode.OP_YIELD,
+		opcode.OP_ITER, opcode.OP_SLICE, opcode.OP_STORE_SLICE,
+		opcode.OP_JUMP, opcode.OP_JUMP_IF_FALSE, opcode.OP_JUMP_IF_TRUE, opcode.OP_JUMP_IF_NIL,
+		opcode.OP_JUMP_IF_NOT_NIL, opcode.OP_LOOP, opcode.OP_GET_LOCAL_0, opcode.OP_GET_LOCAL_1,
+		opcode.OP_GET_LOCAL_2, opcode.OP_GET_LOCAL_3, opcode.OP_LESS_JUMP_IF_FALSE,
+		opcode.OP_ADD_NUM, opcode.OP_ADD_STR, opcode.OP_LESS_NUM:
+		return 0
+	}
+	return -1
+}
+
+func readUint16(code []byte, offset int) int {
+	return int(binary.LittleEndian.Uint16(code[offset : offset+2]))
+}
+
+// decode turns c's code into instructions with their jump targets
+// resolved.
+func decode(c *chunk.Chunk) ([]*instruction, bool) {
+	var code []*instruction
+	at := make(map[int]*instruction)
+	// the offsets each jump goes to, resolved once every instruction is known
+	targets := make(map[*instruction][]int)
+
+	for offset := 0; offset < len(c.Code); {
+		count := argCount(c, offset)
+		if count < 0 {
+			return nil, false
+		}
+		ins := &instruction{op: c.Code[offset], line: c.Lines[offset], inlined: c.InlinedAt(offset)}
+		ins.args = append([]byte(nil), c.Code[offset+1:offset+1+count]...)
+		at[offset] = ins
+		code = append(code, ins)
+
+		next := offset + 1 + count
+		switch {
+		case ins.op == opcode.OP_LOOP:
+			next += 2
+			targets[ins] = []int{next - readUint16(c.Code, offset+1)}
+			ins.op = opcode.OP_JUMP
+		case ins.op == opcode.OP_JUMP || isBranch(ins.op) || ins.op == opcode.OP_LESS_JUMP_IF_FALSE ||
+			ins.op == opcode.OP_DEFAULT_ARG || ins.op == opcode.OP_FOR_ITER || ins.op == opcode.OP_CHECK_INLINE:
+			next += 2
+			targets[ins] = []int{next + readUint16(c.Code, next-2)}
+		case ins.op == opcode.OP_JUMP_TABLE:
+			cases := readUint16(c.Code, next)
+			for i := 0; i <= cases; i++ {
+				targets[ins] = append(targets[ins], readUint16(c.Code, next+2+2*i))
+			}
+			next += 4 + 2*cases
+		}
+		offset = next
+	}
+
+	for ins, offsets := range targets {
+		for _, offset := range offsets {
+			target, ok := at[offset]
+			if !ok {
+				return nil, false
+			}
+			if ins.op == opcode.OP_JUMP_TABLE {
+				ins.table = append(ins.table, target)
+			} else {
+				ins.target = target
+			}
+		}
+	}
+
+	return code, true
+}
+
+// size is the number of bytes ins is encoded in.
+func size(ins *instruction) int {
+	switch {
+	case ins.op == opcode.OP_JUMP_TABLE:
+		return 3 + len(ins.args) + 2*len(ins.table)
+	case ins.target != nil:
+		return 3 + len(ins.args)
+	}
+	return 1 + len(ins.args)
+}
+
+// encode writes code into c, reporting false when a jump no longer fits.
+func encode(code []*instruction, c *chunk.Chunk) bool {
+	offset := 0
+	for _, ins := range code {
+		ins.offset = offset
+		offset += size(ins)
+	}
+	if offset > math.MaxUint16+1 {
+		return false
+	}
+
+	writeUint16 := func(n int, line int) {
+		bytes := make([]byte, 2)
+		binary.LittleEndian.PutUint16(bytes, uint16(n))
+		c.Write(bytes[0], line)
+		c.Write(bytes[1], line)
+	}
+
+	for _, ins := range code {
+		op := ins.op
+		if op == opcode.OP_JUMP && ins.target.offset <= ins.offset {
+			op = opcode.OP_LOOP
+		}
+		c.Write(op, ins.line)
+		for _, arg := range ins.args {
+			c.Write(arg, ins.line)
+		}
+
+		switch {
+		case op == opcode.OP_JUMP_TABLE:
+			writeUint16(len(ins.table)-1, ins.line)
+			for _, target := range ins.table {
+				writeUint16(target.offset, ins.line)
+			}
+		case op == opcode.OP_LOOP:
+			jump := ins.offset + 3 - ins.target.offset
+			if jump > math.MaxUint16 {
+				return false
+			}
+			writeUint16(jump, ins.line)
+		case ins.target != nil:
+			jump := ins.target.offset - (ins.offset + size(ins))
+			if jump < 0 || jump > math.MaxUint16 {
+				return false
+			}
+			writeUint16(jump, ins.line)
+		}
+		c.AddInlined(ins.inlined, ins.offset)
+	}
+
+	return true
+}
+
+// compact drops the dead instructions, moving jumps to one of them on to
+// the next instruction still there.
+func compact(code []*instruction) []*instruction {
+	next := make(map[*instruction]*instruction)
+	var following *instruction
+	for i := len(code) - 1; i >= 0; i-- {
+		if !code[i].dead {
+			following = code[i]
+		}
+		next[code[i]] = following
+	}
+
+	live := code[:0]
+	for _, ins := range code {
+		if ins.dead {
+			continue
+		}
+		if ins.target != nil {
+			ins.target = next[ins.target]
+		}
+		for i, target := range ins.table {
+			ins.table[i] = next[target]
+		}
+		live = append(live, ins)
+	}
+	return live
+}
+
+// constantArgs are the indices of the operands of ins that are constants.
+func constantArgs(ins *instruction) []int {
+	switch ins.op {
+	case opcode.OP_CONSTANT, opcode.OP_DEFINE_GLOBAL, opcode.OP_GET_GLOBAL, opcode.OP_SET_GLOBAL,
+		opcode.OP_IMPORT, opcode.OP_GET_PROPERTY, opcode.OP_DEFINE_CONST, opcode.OP_CLOSURE,
+		opcode.OP_JUMP_TABLE, opcode.OP_ADD_CONST, opcode.OP_CHECK_INLINE:
+		return []int{0}
+	case opcode.OP_UNPACK_LIST:
+		return []int{2}
+	case opcode.OP_UNPACK_MAP, opcode.OP_CALL_EX:
+		indices := make([]int, len(ins.args)-1)
+		for i := range indices {
+			indices[i] = i + 1
+		}
+		return indices
+	}
+	return nil
+}
+
+// removeUnusedConstants drops the constants nothing refers to any more,
+// such as the operands of folded expressions, renumbering the rest.
+func removeUnusedConstants(code []*instruction, c *chunk.Chunk) {
+	used := make([]bool, len(c.Constants))
+	for _, ins := range code {
+		for _, i := range constantArgs(ins) {
+			used[ins.args[i]] = true
+		}
+	}
+
+	renumbered := make([]uint8, len(c.Constants))
+	constants := c.Constants[:0]
+	for i, constant := range c.Constants {
+		if used[i] {
+			renumbered[i] = uint8(len(constants))
+			constants = append(constants, constant)
+		}
+	}
+	if len(constants) == len(c.Constants) {
+		return
+	}
+	c.Constants = constants
+
+	for _, ins := range code {
+		for _, i := range constantArgs(ins) {
+			ins.args[i] = renumbered[ins.args[i]]
+		}
+	}
+	c.Code, c.Lines, c.Inlined = nil, nil, nil
+	encode(code, c)
+}
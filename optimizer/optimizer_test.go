@@ -0,0 +1,80 @@
+package optimizer_test
+
+import (
+	"bytes"
+	"golox/chunk"
+	"golox/compiler"
+	"golox/debug"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// compile optimizes source and returns the chunk of the function called
+// name declared at its top level.
+func compile(t *testing.T, source string, name string) *chunk.Chunk {
+	t.Helper()
+	source += "\x00"
+	script := compiler.Compile(&source, true)
+	if script == nil {
+		t.Fatal("compile error")
+	}
+	for _, constant := range script.Chunk.(*chunk.Chunk).Constants {
+		if constant.IsFunction() && constant.AsObjFunction().Name.String == name {
+			return constant.AsObjFunction().Chunk.(*chunk.Chunk)
+		}
+	}
+	t.Fatalf("no function %s", name)
+	return nil
+}
+
+var opName = regexp.MustCompile(`OP_\w+`)
+
+// ops disassembles c, giving the name of each instruction.
+func ops(t *testing.T, c *chunk.Chunk) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	debug.DisassembleChunk(c, "test")
+	os.Stdout = stdout
+	w.Close()
+
+	var out bytes.Buffer
+	io.Copy(&out, r)
+	return strings.Join(opName.FindAllString(out.String(), -1), " ")
+}
+
+func TestFusedBranch(t *testing.T) {
+	c := compile(t, `
+fun f(n) {
+    if (n < 2) return 1;
+    return n;
+}`, "f")
+
+	// the OP_POP the false branch jumped to is gone with the branch
+	want := "OP_GET_LOCAL_1 OP_CONSTANT OP_LESS_JUMP_IF_FALSE OP_CONSTANT OP_RETURN OP_GET_LOCAL_1 OP_RETURN"
+	if got := ops(t, c); got != want {
+		t.Errorf("got %s\nwant %s", got, want)
+	}
+}
+
+func TestInlinedOnce(t *testing.T) {
+	c := compile(t, `
+fun square(x) { return x * x; }
+fun f(a) { return square(a) + (1 + 2); }`, "f")
+
+	// folding 1 + 2 leaves constants unused, and dropping them encodes the
+	// code again
+	if !strings.Contains(ops(t, c), "OP_INLINE_RETURN") {
+		t.Fatal("square wasn't inlined")
+	}
+	if len(c.Inlined) != 1 {
+		t.Errorf("got %d inlined calls, want 1: %+v", len(c.Inlined), c.Inlined)
+	}
+}
@@ -0,0 +1,340 @@
+package optimizer
+
+import (
+	"golox/arith"
+	"golox/chunk"
+	"golox/chunk/opcode"
+	"golox/value"
+	"golox/value/valuetype"
+)
+
+// Each pass marks the instructions it removes as dead and reports whether
+// it changed anything. Optimize runs them until none of them does.
+var passes = []func(code []*instruction, c *chunk.Chunk) bool{
+	foldConstants,
+	foldBranches,
+	fuseNotBranches,
+	removePushPops,
+	shortenJumps,
+	removeUnreachable,
+}
+
+// jumpedTo is the set of instructions some jump goes to. An instruction
+// in it can't be merged with the one before it.
+func jumpedTo(code []*instruction) map[*instruction]bool {
+	targets := make(map[*instruction]bool)
+	for _, ins := range code {
+		if ins.target != nil {
+			targets[ins.target] = true
+		}
+		for _, target := range ins.table {
+			targets[target] = true
+		}
+	}
+	return targets
+}
+
+// pushedValue is the value ins pushes when it's known at compile time.
+func pushedValue(ins *instruction, c *chunk.Chunk) (value.Value, bool) {
+	switch ins.op {
+	case opcode.OP_NIL:
+		return value.ValNil(), true
+	case opcode.OP_TRUE:
+		return value.ValBool(true), true
+	case opcode.OP_FALSE:
+		return value.ValBool(false), true
+	case opcode.OP_CONSTANT:
+		constant := c.Constants[ins.args[0]]
+		if constant.Type != valuetype.VAL_OBJ || constant.IsString() {
+			return constant, true
+		}
+	}
+	return value.Value{}, false
+}
+
+// push turns ins into an instruction pushing val, unless val needs a
+// constant and the pool is full.
+func push(ins *instruction, val value.Value, c *chunk.Chunk) bool {
+	switch {
+	case val.Type == valuetype.VAL_NIL:
+		ins.op, ins.args = opcode.OP_NIL, nil
+	case val.IsBool() && val.AsBool():
+		ins.op, ins.args = opcode.OP_TRUE, nil
+	case val.IsBool():
+		ins.op, ins.args = opcode.OP_FALSE, nil
+	default:
+		index := c.FindConstant(val)
+		if index < 0 {
+			if len(c.Constants) > 255 {
+				return false
+			}
+			index = c.AddConstant(val)
+		}
+		ins.op, ins.args = opcode.OP_CONSTANT, []byte{uint8(index)}
+	}
+	return true
+}
+
+func unaryOp(op uint8, a value.Value) (value.Value, string, bool) {
+	switch op {
+	case opcode.OP_NEGATE:
+		result, err := arith.Negate(a)
+		return result, err, true
+	case opcode.OP_BIT_NOT:
+		result, err := arith.BitNot(a)
+		return result, err, true
+	case opcode.OP_NOT:
+		return value.ValBool(!a.IsTruey()), "", true
+	}
+	return value.Value{}, "", false
+}
+
+func binaryOp(op uint8, a value.Value, b value.Value) (value.Value, string, bool) {
+	switch op {
+	case opcode.OP_ADD:
+		result, err := arith.Add(a, b)
+		return result, err, true
+	case opcode.OP_SUBTRACT, opcode.OP_MULTIPLY, opcode.OP_DIVIDE, opcode.OP_MODULO,
+		opcode.OP_GREATER, opcode.OP_LESS:
+		result, err := arith.Binary(op, a, b)
+		return result, err, true
+	case opcode.OP_BIT_AND, opcode.OP_BIT_OR, opcode.OP_BIT_XOR, opcode.OP_SHIFT_LEFT, opcode.OP_SHIFT_RIGHT:
+		result, err := arith.Bitwise(op, a, b)
+		return result, err, true
+	case opcode.OP_EQUAL:
+		return value.ValBool(value.AreEqual(a, b)), "", true
+	}
+	return value.Value{}, "", false
+}
+
+// foldConstants replaces operators applied to known values with their
+// result, so `1 + 2` pushes 3. Operations that would fail are left for
+// the vm to report when they run.
+func foldConstants(code []*instruction, c *chunk.Chunk) bool {
+	targets := jumpedTo(code)
+	changed := false
+
+	for i := 0; i+1 < len(code); i++ {
+		a, ok := pushedValue(code[i], c)
+		if !ok {
+			continue
+		}
+
+		if op := code[i+1]; !targets[op] {
+			if result, err, ok := unaryOp(op.op, a); ok {
+				if err == "" && push(code[i], result, c) {
+					code[i].line = op.line
+					op.dead = true
+					changed = true
+					i++
+				}
+				continue
+			}
+		}
+
+		if i+2 >= len(code) || targets[code[i+1]] || targets[code[i+2]] {
+			continue
+		}
+		b, ok := pushedValue(code[i+1], c)
+		if !ok {
+			continue
+		}
+		op := code[i+2]
+		if result, err, ok := binaryOp(op.op, a, b); ok && err == "" && push(code[i], result, c) {
+			code[i].line = op.line
+			code[i+1].dead, op.dead = true, true
+			changed = true
+			i += 2
+		}
+	}
+
+	return changed
+}
+
+// foldBranches decides the branches on a known value, making them
+// unconditional jumps or removing them.
+func foldBranches(code []*instruction, c *chunk.Chunk) bool {
+	targets := jumpedTo(code)
+	changed := false
+
+	for i := 0; i+1 < len(code); i++ {
+		branch := code[i+1]
+		if !isBranch(branch.op) || targets[branch] {
+			continue
+		}
+		val, ok := pushedValue(code[i], c)
+		if !ok {
+			continue
+		}
+
+		var taken bool
+		switch branch.op {
+		case opcode.OP_JUMP_IF_FALSE:
+			taken = !val.IsTruey()
+		case opcode.OP_JUMP_IF_TRUE:
+			taken = val.IsTruey()
+		case opcode.OP_JUMP_IF_NIL:
+			taken = val.Type == valuetype.VAL_NIL
+		case opcode.OP_JUMP_IF_NOT_NIL:
+			taken = val.Type != valuetype.VAL_NIL
+		}
+		if taken {
+			branch.op = opcode.OP_JUMP
+		} else {
+			branch.dead = true
+		}
+		changed = true
+	}
+
+	return changed
+}
+
+// fuseNotBranches turns `OP_NOT OP_JUMP_IF_FALSE` into OP_JUMP_IF_TRUE and
+// the other way around, which is what `!=`, `<=` and `>=` compile to in a
+// condition. That's only possible when both ways pop the condition, as
+// the value left on the stack is no longer negated.
+func fuseNotBranches(code []*instruction, c *chunk.Chunk) bool {
+	targets := jumpedTo(code)
+	changed := false
+
+	for i := 0; i+2 < len(code); i++ {
+		not, branch := code[i], code[i+1]
+		if not.op != opcode.OP_NOT || targets[branch] {
+			continue
+		}
+		if branch.op != opcode.OP_JUMP_IF_FALSE && branch.op != opcode.OP_JUMP_IF_TRUE {
+			continue
+		}
+		if code[i+2].op != opcode.OP_POP || branch.target.op != opcode.OP_POP {
+			continue
+		}
+
+		if branch.op == opcode.OP_JUMP_IF_FALSE {
+			branch.op = opcode.OP_JUMP_IF_TRUE
+		} else {
+			branch.op = opcode.OP_JUMP_IF_FALSE
+		}
+		not.dead = true
+		changed = true
+	}
+
+	return changed
+}
+
+// removePushPops removes values pushed only to be popped again, as left
+// by folded branches.
+func removePushPops(code []*instruction, c *chunk.Chunk) bool {
+	targets := jumpedTo(code)
+	changed := false
+
+	for i := 0; i+1 < len(code); i++ {
+		if code[i+1].op != opcode.OP_POP || targets[code[i+1]] {
+			continue
+		}
+		switch code[i].op {
+		case opcode.OP_CONSTANT, opcode.OP_NIL, opcode.OP_TRUE, opcode.OP_FALSE,
+			opcode.OP_GET_LOCAL, opcode.OP_GET_UPVALUE, opcode.OP_DUP, opcode.OP_PEEK:
+			code[i].dead, code[i+1].dead = true, true
+			changed = true
+			i++
+		}
+	}
+
+	return changed
+}
+
+// follow is where a jump to target ends up once it's gone through the
+// unconditional jumps there. Branches can't jump backward, so forward
+// only limits it to the ones after from.
+func follow(target *instruction, from int, index map[*instruction]int, forwardOnly bool) *instruction {
+	seen := make(map[*instruction]bool)
+	for isGoto(target.op) && !seen[target] {
+		seen[target] = true
+		if forwardOnly && index[target.target] <= from {
+			break
+		}
+		target = target.target
+	}
+	return target
+}
+
+// shortenJumps makes jumps to jumps go straight to where those lead, and
+// removes jumps to the next instruction.
+func shortenJumps(code []*instruction, c *chunk.Chunk) bool {
+	index := make(map[*instruction]int)
+	for i, ins := range code {
+		index[ins] = i
+	}
+	changed := false
+
+	for i, ins := range code {
+		for j, target := range ins.table {
+			if next := follow(target, i, index, false); next != target {
+				ins.table[j] = next
+				changed = true
+			}
+		}
+		if ins.target == nil {
+			continue
+		}
+
+		target := follow(ins.target, i, index, !isGoto(ins.op))
+		if isBranch(ins.op) {
+			// a branch that leads to the same branch would be taken again
+			for target.op == ins.op && index[target.target] > i && target != ins {
+				target = follow(target.target, i, index, true)
+			}
+		}
+		if target != ins.target {
+			ins.target = target
+			changed = true
+		}
+
+		if (isGoto(ins.op) || isBranch(ins.op)) && i+1 < len(code) && code[i+1] == ins.target {
+			ins.dead = true
+			changed = true
+		}
+	}
+
+	return changed
+}
+
+// removeUnreachable removes the instructions no path from the start of
+// the function leads to, such as those after a return.
+func removeUnreachable(code []*instruction, c *chunk.Chunk) bool {
+	index := make(map[*instruction]int)
+	for i, ins := range code {
+		index[ins] = i
+	}
+
+	reached := make([]bool, len(code))
+	work := []int{0}
+	for len(work) > 0 {
+		i := work[len(work)-1]
+		work = work[:len(work)-1]
+		if i >= len(code) || reached[i] {
+			continue
+		}
+		reached[i] = true
+
+		ins := code[i]
+		if ins.target != nil {
+			work = append(work, index[ins.target])
+		}
+		for _, target := range ins.table {
+			work = append(work, index[target])
+		}
+		if !isGoto(ins.op) && ins.op != opcode.OP_RETURN && ins.op != opcode.OP_JUMP_TABLE {
+			work = append(work, i+1)
+		}
+	}
+
+	changed := false
+	for i, ins := range code {
+		if !reached[i] {
+			ins.dead = true
+			changed = true
+		}
+	}
+	return changed
+}
@@ -0,0 +1,561 @@
+package parser
+
+import (
+	"fmt"
+	"golox/ast"
+	"golox/scanner/token"
+	"golox/scanner/token/tokentype"
+	"golox/value"
+	"strconv"
+)
+
+type Precedence uint8
+
+const (
+	PREC_NONE        Precedence = iota
+	PREC_ASSIGNMENT  Precedence = iota // =
+	PREC_CONDITIONAL Precedence = iota // ?:
+	PREC_NULLISH     Precedence = iota // ??
+	PREC_OR          Precedence = iota // or
+	PREC_AND         Precedence = iota // and
+	PREC_EQUALITY    Precedence = iota // == !=
+	PREC_COMPARISON  Precedence = iota // < > <= >=
+	PREC_BIT_OR      Precedence = iota // |
+	PREC_BIT_XOR     Precedence = iota // ^
+	PREC_BIT_AND     Precedence = iota // &
+	PREC_SHIFT       Precedence = iota // << >>
+	PREC_TERM        Precedence = iota // + -
+	PREC_FACTOR      Precedence = iota // * / %
+	PREC_UNARY       Precedence = iota // ! - ~
+	PREC_CALL        Precedence = iota // . ()
+	PREC_SUBSR       Precedence = iota // []
+	PREC_PRIMARY     Precedence = iota
+)
+
+type ParseRule struct {
+	prefix     PrefixFn
+	infix      InfixFn
+	precedence Precedence
+}
+
+type PrefixFn func(receiver *Parser, canAssign bool) ast.Expr
+
+type InfixFn func(receiver *Parser, left ast.Expr, canAssign bool) ast.Expr
+
+var rules map[tokentype.TokenType]ParseRule
+
+// compoundOps are the compound assignment operators.
+var compoundOps = map[tokentype.TokenType]bool{
+	tokentype.TOKEN_PLUS_EQUAL:    true,
+	tokentype.TOKEN_MINUS_EQUAL:   true,
+	tokentype.TOKEN_STAR_EQUAL:    true,
+	tokentype.TOKEN_SLASH_EQUAL:   true,
+	tokentype.TOKEN_PERCENT_EQUAL: true,
+}
+
+func initRules() {
+	rules = make(map[tokentype.TokenType]ParseRule)
+	rules[tokentype.TOKEN_LEFT_BRACKET] = ParseRule{(*Parser).list, (*Parser).subscr, PREC_SUBSR}
+	rules[tokentype.TOKEN_RIGHT_BRACKET] = ParseRule{nil, nil, PREC_NONE}
+	rules[tokentype.TOKEN_LEFT_PAREN] = ParseRule{(*Parser).grouping, (*Parser).call, PREC_CALL}
+	rules[tokentype.TOKEN_RIGHT_PAREN] = ParseRule{nil, nil, PREC_NONE}
+	rules[tokentype.TOKEN_LEFT_BRACE] = ParseRule{(*Parser).mapLiteral, nil, PREC_NONE}
+	rules[tokentype.TOKEN_RIGHT_BRACE] = ParseRule{nil, nil, PREC_NONE}
+	rules[tokentype.TOKEN_COMMA] = ParseRule{nil, nil, PREC_NONE}
+	rules[tokentype.TOKEN_DOT] = ParseRule{nil, (*Parser).dot, PREC_CALL}
+	rules[tokentype.TOKEN_MINUS] = ParseRule{(*Parser).unary, (*Parser).binary, PREC_TERM}
+	rules[tokentype.TOKEN_MINUS_MINUS] = ParseRule{(*Parser).prefixIncrement, (*Parser).postfixIncrement, PREC_CALL}
+	rules[tokentype.TOKEN_PLUS] = ParseRule{nil, (*Parser).binary, PREC_TERM}
+	rules[tokentype.TOKEN_PLUS_PLUS] = ParseRule{(*Parser).prefixIncrement, (*Parser).postfixIncrement, PREC_CALL}
+	rules[tokentype.TOKEN_MINUS_EQUAL] = ParseRule{nil, nil, PREC_NONE}
+	rules[tokentype.TOKEN_PLUS_EQUAL] = ParseRule{nil, nil, PREC_NONE}
+	rules[tokentype.TOKEN_STAR_EQUAL] = ParseRule{nil, nil, PREC_NONE}
+	rules[tokentype.TOKEN_SLASH_EQUAL] = ParseRule{nil, nil, PREC_NONE}
+	rules[tokentype.TOKEN_PERCENT_EQUAL] = ParseRule{nil, nil, PREC_NONE}
+	rules[tokentype.TOKEN_SEMICOLON] = ParseRule{nil, nil, PREC_NONE}
+	rules[tokentype.TOKEN_SLASH] = ParseRule{nil, (*Parser).binary, PREC_FACTOR}
+	rules[tokentype.TOKEN_STAR] = ParseRule{nil, (*Parser).binary, PREC_FACTOR}
+	rules[tokentype.TOKEN_PERCENT] = ParseRule{nil, (*Parser).binary, PREC_FACTOR}
+	rules[tokentype.TOKEN_AMPERSAND] = ParseRule{nil, (*Parser).binary, PREC_BIT_AND}
+	rules[tokentype.TOKEN_PIPE] = ParseRule{nil, (*Parser).binary, PREC_BIT_OR}
+	rules[tokentype.TOKEN_CARET] = ParseRule{nil, (*Parser).binary, PREC_BIT_XOR}
+	rules[tokentype.TOKEN_TILDE] = ParseRule{(*Parser).unary, nil, PREC_NONE}
+	rules[tokentype.TOKEN_BANG] = ParseRule{(*Parser).unary, nil, PREC_NONE}
+	rules[tokentype.TOKEN_BANG_EQUAL] = ParseRule{nil, (*Parser).binary, PREC_EQUALITY}
+	rules[tokentype.TOKEN_EQUAL] = ParseRule{nil, nil, PREC_NONE}
+	rules[tokentype.TOKEN_EQUAL_EQUAL] = ParseRule{nil, (*Parser).binary, PREC_COMPARISON}
+	rules[tokentype.TOKEN_GREATER] = ParseRule{nil, (*Parser).binary, PREC_COMPARISON}
+	rules[tokentype.TOKEN_GREATER_EQUAL] = ParseRule{nil, (*Parser).binary, PREC_COMPARISON}
+	rules[tokentype.TOKEN_VAR] = ParseRule{nil, nil, PREC_NONE}
+	rules[tokentype.TOKEN_LESS] = ParseRule{nil, (*Parser).binary, PREC_COMPARISON}
+	rules[tokentype.TOKEN_LESS_EQUAL] = ParseRule{nil, (*Parser).binary, PREC_COMPARISON}
+	rules[tokentype.TOKEN_LESS_LESS] = ParseRule{nil, (*Parser).binary, PREC_SHIFT}
+	rules[tokentype.TOKEN_GREATER_GREATER] = ParseRule{nil, (*Parser).binary, PREC_SHIFT}
+	rules[tokentype.TOKEN_IDENTIFIER] = ParseRule{(*Parser).variable, nil, PREC_NONE}
+	rules[tokentype.TOKEN_STRING] = ParseRule{(*Parser).stringg, nil, PREC_NONE}
+	rules[tokentype.TOKEN_NUMBER] = ParseRule{(*Parser).number, nil, PREC_NONE}
+	rules[tokentype.TOKEN_INTEGER] = ParseRule{(*Parser).integer, nil, PREC_NONE}
+	rules[tokentype.TOKEN_AND] = ParseRule{nil, (*Parser).logical, PREC_AND}
+	rules[tokentype.TOKEN_ELSE] = ParseRule{nil, nil, PREC_NONE}
+	rules[tokentype.TOKEN_FALSE] = ParseRule{(*Parser).literal, nil, PREC_NONE}
+	rules[tokentype.TOKEN_FOR] = ParseRule{nil, nil, PREC_NONE}
+	rules[tokentype.TOKEN_FUN] = ParseRule{(*Parser).lambda, nil, PREC_NONE}
+	rules[tokentype.TOKEN_ARROW] = ParseRule{nil, nil, PREC_NONE}
+	rules[tokentype.TOKEN_ELLIPSIS] = ParseRule{nil, nil, PREC_NONE}
+	rules[tokentype.TOKEN_COLON] = ParseRule{nil, nil, PREC_NONE}
+	rules[tokentype.TOKEN_QUESTION] = ParseRule{nil, (*Parser).conditional, PREC_CONDITIONAL}
+	rules[tokentype.TOKEN_QUESTION_QUESTION] = ParseRule{nil, (*Parser).logical, PREC_NULLISH}
+	rules[tokentype.TOKEN_QUESTION_DOT] = ParseRule{nil, (*Parser).optionalChain, PREC_CALL}
+	rules[tokentype.TOKEN_IF] = ParseRule{nil, nil, PREC_NONE}
+	rules[tokentype.TOKEN_NIL] = ParseRule{(*Parser).literal, nil, PREC_NONE}
+	rules[tokentype.TOKEN_OR] = ParseRule{nil, (*Parser).logical, PREC_OR}
+	rules[tokentype.TOKEN_PRINT] = ParseRule{nil, nil, PREC_NONE}
+	rules[tokentype.TOKEN_RETURN] = ParseRule{nil, nil, PREC_NONE}
+	rules[tokentype.TOKEN_THIS] = ParseRule{nil, nil, PREC_NONE}
+	rules[tokentype.TOKEN_TRUE] = ParseRule{(*Parser).literal, nil, PREC_NONE}
+	rules[tokentype.TOKEN_WHILE] = ParseRule{nil, nil, PREC_NONE}
+	rules[tokentype.TOKEN_IMPORT] = ParseRule{nil, nil, PREC_NONE}
+	rules[tokentype.TOKEN_FROM] = ParseRule{nil, nil, PREC_NONE}
+	rules[tokentype.TOKEN_AS] = ParseRule{nil, nil, PREC_NONE}
+	rules[tokentype.TOKEN_YIELD] = ParseRule{(*Parser).yield, nil, PREC_NONE}
+	rules[tokentype.TOKEN_IN] = ParseRule{nil, nil, PREC_NONE}
+	rules[tokentype.TOKEN_CONST] = ParseRule{nil, nil, PREC_NONE}
+	rules[tokentype.TOKEN_MATCH] = ParseRule{nil, nil, PREC_NONE}
+	rules[tokentype.TOKEN_ERROR] = ParseRule{nil, nil, PREC_NONE}
+	rules[tokentype.TOKEN_EOF] = ParseRule{nil, nil, PREC_NONE}
+}
+
+func (parser *Parser) parsePrecedence(prec Precedence) ast.Expr {
+	parser.advance()
+	prefixRule := rules[parser.previous.Type].prefix
+
+	if prefixRule == nil {
+		parser.error("Expect expression.")
+		return &ast.BadExpr{Span: ast.TokenSpan(parser.previous)}
+	}
+
+	canAssign := prec <= PREC_ASSIGNMENT
+	expr := prefixRule(parser, canAssign)
+
+	for prec <= rules[parser.current.Type].precedence {
+		parser.advance()
+		infixRule := rules[parser.previous.Type].infix
+		expr = infixRule(parser, expr, canAssign)
+	}
+
+	if canAssign && (compoundOps[parser.current.Type] || parser.check(tokentype.TOKEN_EQUAL)) {
+		parser.errorAtCurrent("Invalid assignment target.")
+	}
+
+	return expr
+}
+
+func (parser *Parser) expression() ast.Expr {
+	return parser.parsePrecedence(PREC_ASSIGNMENT)
+}
+
+// assignment parses what can follow a variable or index: `=` or a compound
+// assignment operator when canAssign, or a postfix `++` or `--`.
+func (parser *Parser) assignment(target ast.Expr, canAssign bool) ast.Expr {
+	if canAssign && (parser.match(tokentype.TOKEN_EQUAL) || compoundOps[parser.current.Type] && parser.match(parser.current.Type)) {
+		op := parser.previous
+		val := parser.expression()
+		return &ast.AssignExpr{Span: target.Position().To(val.Position()), Target: target, Op: op, Value: val}
+	}
+
+	if parser.match(tokentype.TOKEN_PLUS_PLUS) || parser.match(tokentype.TOKEN_MINUS_MINUS) {
+		if inOptionalChain(target) {
+			parser.error("Invalid increment target.")
+		}
+		return &ast.IncrementExpr{Span: parser.extend(target), Target: target, Op: parser.previous}
+	}
+
+	return target
+}
+
+func (parser *Parser) logical(left ast.Expr, _ bool) ast.Expr {
+	op := parser.previous
+	prec := PREC_AND
+	if op.Type != tokentype.TOKEN_AND {
+		// `a ?? b ?? c` groups to the left like `or`
+		prec = PREC_OR
+	}
+
+	right := parser.parsePrecedence(prec)
+	return &ast.LogicalExpr{Span: left.Position().To(right.Position()), Op: op, Left: left, Right: right}
+}
+
+// conditional parses `cond ? a : b`, which groups to the right.
+func (parser *Parser) conditional(condition ast.Expr, _ bool) ast.Expr {
+	then := parser.parsePrecedence(PREC_CONDITIONAL)
+	parser.consume(tokentype.TOKEN_COLON, "Expect ':' after then branch of conditional.")
+	elseExpr := parser.parsePrecedence(PREC_CONDITIONAL)
+
+	return &ast.ConditionalExpr{Span: condition.Position().To(elseExpr.Position()), Condition: condition, Then: then, Else: elseExpr}
+}
+
+// optionalChain parses `a?.[i]`, `a?.(x)` and `a?.name` along with the
+// rest of the chain of calls, subscripts and properties after it, which
+// is skipped when a is nil.
+func (parser *Parser) optionalChain(object ast.Expr, _ bool) ast.Expr {
+	var link ast.Expr
+	if parser.match(tokentype.TOKEN_LEFT_BRACKET) {
+		link = parser.subscr(object, false)
+	} else if parser.match(tokentype.TOKEN_LEFT_PAREN) {
+		link = parser.call(object, false)
+	} else {
+		link = parser.dot(object, false)
+	}
+
+	switch link := link.(type) {
+	case *ast.IndexExpr:
+		link.Optional = true
+	case *ast.SliceExpr:
+		link.Optional = true
+	case *ast.CallExpr:
+		link.Optional = true
+	case *ast.PropertyExpr:
+		link.Optional = true
+	case *ast.IncrementExpr:
+		// like assignments, which aren't parsed here, as the target may
+		// have been skipped
+		parser.error("Invalid increment target.")
+	}
+
+	for rules[parser.current.Type].precedence >= PREC_CALL {
+		parser.advance()
+		link = rules[parser.previous.Type].infix(parser, link, false)
+	}
+
+	return link
+}
+
+// inOptionalChain reports whether expr comes after a `?.` in a chain of
+// calls, subscripts and properties.
+func inOptionalChain(expr ast.Expr) bool {
+	for {
+		switch link := expr.(type) {
+		case *ast.IndexExpr:
+			if link.Optional {
+				return true
+			}
+			expr = link.Object
+		case *ast.SliceExpr:
+			if link.Optional {
+				return true
+			}
+			expr = link.Object
+		case *ast.CallExpr:
+			if link.Optional {
+				return true
+			}
+			expr = link.Callee
+		case *ast.PropertyExpr:
+			if link.Optional {
+				return true
+			}
+			expr = link.Object
+		default:
+			return false
+		}
+	}
+}
+
+func (parser *Parser) literalExpr(val value.Value) ast.Expr {
+	return &ast.LiteralExpr{Span: ast.TokenSpan(parser.previous), Token: parser.previous, Value: val}
+}
+
+func (parser *Parser) number(_ bool) ast.Expr {
+	return parser.literalExpr(parser.numberValue())
+}
+
+// numberValue is the value of the number literal just consumed.
+func (parser *Parser) numberValue() value.Value {
+	numStr := parser.previous.Lexeme
+	val, _ := strconv.ParseFloat(numStr, len(numStr))
+	return value.ValNumber(val)
+}
+
+func (parser *Parser) integer(_ bool) ast.Expr {
+	return parser.literalExpr(parser.integerValue())
+}
+
+// integerValue is the value of the integer literal just consumed.
+func (parser *Parser) integerValue() value.Value {
+	numStr := parser.previous.Lexeme
+
+	if len(numStr) > 2 && numStr[0] == '0' && numStr[1] > '9' {
+		// hex and binary literals may use all 64 bits, so 0xffffffffffffffff is -1
+		val, err := strconv.ParseUint(numStr, 0, 64)
+		if err != nil {
+			parser.error("Integer literal out of range.")
+			return value.ValInt(0)
+		}
+		return value.ValInt(int64(val))
+	}
+
+	val, err := strconv.ParseInt(numStr, 10, 64)
+	if err != nil {
+		// decimal literals too large for an int stay numbers, as they always were
+		fval, _ := strconv.ParseFloat(numStr, 64)
+		return value.ValNumber(fval)
+	}
+	return value.ValInt(val)
+}
+
+func (parser *Parser) stringg(_ bool) ast.Expr {
+	return parser.literalExpr(parser.stringValue())
+}
+
+// stringValue is the value of the string literal just consumed.
+func (parser *Parser) stringValue() value.Value {
+	lexeme := parser.previous.Lexeme
+	return value.ValObjString(lexeme[1 : len(lexeme)-1])
+}
+
+func (parser *Parser) literal(_ bool) ast.Expr {
+	switch parser.previous.Type {
+	case tokentype.TOKEN_FALSE:
+		return parser.literalExpr(value.ValBool(false))
+	case tokentype.TOKEN_TRUE:
+		return parser.literalExpr(value.ValBool(true))
+	}
+	return parser.literalExpr(value.ValNil())
+}
+
+func (parser *Parser) variable(canAssign bool) ast.Expr {
+	variable := &ast.VariableExpr{Span: ast.TokenSpan(parser.previous), Name: parser.previous}
+	return parser.assignment(variable, canAssign)
+}
+
+func (parser *Parser) grouping(_ bool) ast.Expr {
+	if parser.isArrowFunction() {
+		return parser.arrowFunction()
+	}
+
+	start := parser.previous
+	expr := parser.expression()
+	parser.consume(tokentype.TOKEN_RIGHT_PAREN, "Expect ')' after expression.")
+	return &ast.GroupingExpr{Span: parser.spanFrom(start), Expr: expr}
+}
+
+// call parses the arguments of a call. Spread and keyword arguments are
+// checked to come in an order the call can be made in.
+func (parser *Parser) call(callee ast.Expr, _ bool) ast.Expr {
+	args := []*ast.Argument{}
+	positional := 0
+	keywords := 0
+	seen := make(map[string]bool)
+
+	if !parser.check(tokentype.TOKEN_RIGHT_PAREN) {
+		for ok := true; ok; ok = parser.match(tokentype.TOKEN_COMMA) {
+			start := parser.current
+			arg := new(ast.Argument)
+
+			if parser.match(tokentype.TOKEN_ELLIPSIS) {
+				if keywords > 0 {
+					parser.error("Spread argument can't follow keyword arguments.")
+				}
+				arg.Spread = true
+				arg.Value = parser.expression()
+			} else if parser.check(tokentype.TOKEN_IDENTIFIER) && parser.peekToken(1).Type == tokentype.TOKEN_COLON {
+				parser.advance()
+				name := parser.previous
+				if seen[name.Lexeme] {
+					parser.error(fmt.Sprintf("Duplicate keyword argument '%s'.", name.Lexeme))
+				}
+				seen[name.Lexeme] = true
+				arg.Name = &name
+				parser.advance()
+				arg.Value = parser.expression()
+				keywords++
+				if keywords > 255 {
+					parser.error("Can't have more than 255 keyword arguments.")
+				}
+			} else {
+				if keywords > 0 {
+					parser.error("Positional argument can't follow keyword arguments.")
+				}
+				arg.Value = parser.expression()
+				if positional == 255 {
+					parser.error("Can't have more than 255 arguments.")
+				}
+				positional++
+			}
+
+			arg.Span = parser.spanFrom(start)
+			args = append(args, arg)
+		}
+	}
+
+	parser.consume(tokentype.TOKEN_RIGHT_PAREN, "Expect ')' after arguments.")
+
+	return &ast.CallExpr{Span: parser.extend(callee), Callee: callee, Args: args}
+}
+
+// yield parses `yield value`, or a bare `yield` before a token that can't
+// start an expression.
+func (parser *Parser) yield(_ bool) ast.Expr {
+	expr := &ast.YieldExpr{Keyword: parser.previous}
+
+	switch parser.current.Type {
+	case tokentype.TOKEN_SEMICOLON, tokentype.TOKEN_RIGHT_PAREN, tokentype.TOKEN_RIGHT_BRACKET, tokentype.TOKEN_COMMA:
+	default:
+		expr.Value = parser.parsePrecedence(PREC_ASSIGNMENT)
+	}
+
+	expr.Span = parser.spanFrom(expr.Keyword)
+	return expr
+}
+
+func (parser *Parser) dot(object ast.Expr, _ bool) ast.Expr {
+	parser.consume(tokentype.TOKEN_IDENTIFIER, "Expect property name after '.'.")
+	return &ast.PropertyExpr{Span: parser.extend(object), Object: object, Name: parser.previous}
+}
+
+func (parser *Parser) unary(_ bool) ast.Expr {
+	op := parser.previous
+	operand := parser.parsePrecedence(PREC_UNARY)
+	return &ast.UnaryExpr{Span: ast.TokenSpan(op).To(operand.Position()), Op: op, Operand: operand}
+}
+
+func (parser *Parser) binary(left ast.Expr, _ bool) ast.Expr {
+	op := parser.previous
+	rule := rules[op.Type]
+	right := parser.parsePrecedence(rule.precedence + 1)
+	return &ast.BinaryExpr{Span: left.Position().To(right.Position()), Op: op, Left: left, Right: right}
+}
+
+// lambda parses an anonymous `fun (params) { body }` expression.
+func (parser *Parser) lambda(_ bool) ast.Expr {
+	return parser.function(parser.previous, token.Token{})
+}
+
+func (parser *Parser) list(canAssign bool) ast.Expr {
+	if canAssign && parser.isSwap() {
+		return parser.destructuringAssignment()
+	}
+
+	start := parser.previous
+	items := []ast.Expr{}
+	if !parser.check(tokentype.TOKEN_RIGHT_BRACKET) {
+		for ok := true; ok; ok = parser.match(tokentype.TOKEN_COMMA) {
+			if parser.check(tokentype.TOKEN_RIGHT_BRACKET) {
+				break // trailing comma case
+			}
+
+			items = append(items, parser.parsePrecedence(PREC_CONDITIONAL))
+
+			if len(items) == 257 {
+				parser.error("Cannot have more than 256 items in a list literal.")
+			}
+		}
+	}
+
+	parser.consume(tokentype.TOKEN_RIGHT_BRACKET, "Expect ']' after list literal.")
+
+	return &ast.ListExpr{Span: parser.spanFrom(start), Items: items}
+}
+
+// mapLiteral parses `{key: value, ...}`. A key that is a bare identifier
+// is the string of its name, any other key is an expression.
+func (parser *Parser) mapLiteral(_ bool) ast.Expr {
+	start := parser.previous
+	entries := []*ast.MapEntry{}
+	if !parser.check(tokentype.TOKEN_RIGHT_BRACE) {
+		for ok := true; ok; ok = parser.match(tokentype.TOKEN_COMMA) {
+			if parser.check(tokentype.TOKEN_RIGHT_BRACE) {
+				break // trailing comma case
+			}
+
+			var key ast.Expr
+			if parser.check(tokentype.TOKEN_IDENTIFIER) && parser.peekToken(1).Type == tokentype.TOKEN_COLON {
+				parser.advance()
+				key = parser.literalExpr(value.ValObjString(parser.previous.Lexeme))
+			} else {
+				key = parser.parsePrecedence(PREC_OR)
+			}
+			parser.consume(tokentype.TOKEN_COLON, "Expect ':' after map key.")
+			val := parser.parsePrecedence(PREC_CONDITIONAL)
+			entries = append(entries, &ast.MapEntry{Span: key.Position().To(val.Position()), Key: key, Value: val})
+
+			if len(entries) == 257 {
+				parser.error("Cannot have more than 256 entries in a map literal.")
+			}
+		}
+	}
+
+	parser.consume(tokentype.TOKEN_RIGHT_BRACE, "Expect '}' after map literal.")
+
+	return &ast.MapExpr{Span: parser.spanFrom(start), Entries: entries}
+}
+
+// sliceBound parses an optional part of a slice, nil when it's left out.
+func (parser *Parser) sliceBound() ast.Expr {
+	if parser.check(tokentype.TOKEN_COLON) || parser.check(tokentype.TOKEN_RIGHT_BRACKET) {
+		return nil
+	}
+	return parser.parsePrecedence(PREC_CONDITIONAL)
+}
+
+// slice parses the rest of `a[start:end:step]` after the first ':'. Only
+// plain assignment is allowed to a slice.
+func (parser *Parser) slice(object ast.Expr, start ast.Expr, canAssign bool) ast.Expr {
+	slice := &ast.SliceExpr{Object: object, Start: start}
+	slice.End = parser.sliceBound()
+	if parser.match(tokentype.TOKEN_COLON) {
+		slice.Step = parser.sliceBound()
+	}
+	parser.consume(tokentype.TOKEN_RIGHT_BRACKET, "Expect ']' after slice.")
+	slice.Span = parser.extend(object)
+
+	if canAssign && parser.match(tokentype.TOKEN_EQUAL) {
+		op := parser.previous
+		val := parser.expression()
+		return &ast.AssignExpr{Span: slice.Span.To(val.Position()), Target: slice, Op: op, Value: val}
+	}
+	return slice
+}
+
+func (parser *Parser) subscr(object ast.Expr, canAssign bool) ast.Expr {
+	var index ast.Expr
+	if !parser.check(tokentype.TOKEN_COLON) {
+		index = parser.parsePrecedence(PREC_CONDITIONAL)
+	}
+	if parser.match(tokentype.TOKEN_COLON) {
+		return parser.slice(object, index, canAssign)
+	}
+	parser.consume(tokentype.TOKEN_RIGHT_BRACKET, "Expect ']' after index.")
+
+	return parser.assignment(&ast.IndexExpr{Span: parser.extend(object), Object: object, Index: index}, canAssign)
+}
+
+// prefixIncrement parses `++target` and `--target`. The target is a
+// variable optionally followed by subscripts, the same forms that can
+// appear on the left of `=`.
+func (parser *Parser) prefixIncrement(_ bool) ast.Expr {
+	op := parser.previous
+
+	parser.consume(tokentype.TOKEN_IDENTIFIER, "Invalid increment target.")
+	var target ast.Expr = &ast.VariableExpr{Span: ast.TokenSpan(parser.previous), Name: parser.previous}
+
+	for parser.match(tokentype.TOKEN_LEFT_BRACKET) {
+		index := parser.parsePrecedence(PREC_CONDITIONAL)
+		parser.consume(tokentype.TOKEN_RIGHT_BRACKET, "Expect ']' after index.")
+		target = &ast.IndexExpr{Span: parser.extend(target), Object: target, Index: index}
+	}
+
+	if parser.check(tokentype.TOKEN_LEFT_PAREN) {
+		parser.errorAtCurrent("Invalid increment target.")
+	}
+
+	return &ast.IncrementExpr{Span: ast.TokenSpan(op).To(target.Position()), Target: target, Op: op, Prefix: true}
+}
+
+// postfixIncrement is only reached when `++` or `--` follows something
+// that isn't a variable or a subscript; those consume the operator
+// themselves.
+func (parser *Parser) postfixIncrement(operand ast.Expr, _ bool) ast.Expr {
+	parser.error("Invalid increment target.")
+	return &ast.BadExpr{Span: parser.extend(operand)}
+}
@@ -0,0 +1,583 @@
+// Package parser builds the syntax tree of lox source. Syntax errors are
+// reported as they're found and parsing carries on from the next
+// statement, so one run reports every independent error and the tree
+// still covers the whole source, with bad nodes where the errors were.
+package parser
+
+import (
+	"fmt"
+	"golox/ast"
+	"golox/scanner"
+	"golox/scanner/token"
+	"golox/scanner/token/tokentype"
+	"os"
+)
+
+type Parser struct {
+	panicMode bool
+	hadError  bool
+	previous  token.Token
+	current   token.Token
+	tokens    chan token.Token
+	lookahead []token.Token // tokens after current read by peekToken
+}
+
+// Parse parses a whole source file. It returns false if there were syntax
+// errors, which have been printed to stderr.
+func Parse(source *string) (*ast.Program, bool) {
+	var scanner scanner.Scanner
+	scanner.Init(source)
+	tokens := make(chan token.Token, 1024)
+	go scanner.Scan(tokens)
+
+	parser := new(Parser)
+	parser.tokens = tokens
+
+	initRules()
+
+	parser.advance()
+	start := parser.current
+
+	program := new(ast.Program)
+	for !parser.match(tokentype.TOKEN_EOF) {
+		program.Stmts = append(program.Stmts, parser.declaration())
+	}
+	program.Span = parser.spanFrom(start)
+
+	return program, !parser.hadError
+}
+
+func (parser *Parser) errorAtCurrent(msg string) {
+	parser.errorAt(&parser.current, msg)
+}
+
+func (parser *Parser) error(msg string) {
+	parser.errorAt(&parser.previous, msg)
+}
+
+func (parser *Parser) errorAt(token *token.Token, msg string) {
+	if parser.panicMode {
+		return
+	}
+	parser.panicMode = true
+	parser.hadError = true
+
+	fmt.Fprintf(os.Stderr, "[line %d] Error", token.Line)
+
+	if token.Type == tokentype.TOKEN_EOF {
+		fmt.Fprintf(os.Stderr, " at end")
+	} else if token.Type == tokentype.TOKEN_ERROR {
+		// nothing
+	} else {
+		fmt.Fprintf(os.Stderr, " at '%s'", token.Lexeme)
+	}
+
+	fmt.Fprintf(os.Stderr, ": %s\n", msg)
+}
+
+func (parser *Parser) nextToken() token.Token {
+	if len(parser.lookahead) > 0 {
+		next := parser.lookahead[0]
+		parser.lookahead = parser.lookahead[1:]
+		return next
+	}
+
+	next, ok := <-parser.tokens
+	if !ok {
+		// the scanner is done, keep handing out EOF
+		return parser.eof()
+	}
+	return next
+}
+
+func (parser *Parser) eof() token.Token {
+	end := parser.current.Start + len(parser.current.Lexeme)
+	return token.Token{Type: tokentype.TOKEN_EOF, Start: end, Line: parser.current.Line}
+}
+
+// peekToken returns the token n places after the current one without
+// consuming anything.
+func (parser *Parser) peekToken(n int) token.Token {
+	for len(parser.lookahead) < n {
+		next, ok := <-parser.tokens
+		if !ok {
+			next = parser.eof()
+		}
+		parser.lookahead = append(parser.lookahead, next)
+	}
+	return parser.lookahead[n-1]
+}
+
+// tokenAhead is the current token for 0, or the one n tokens after it.
+func (parser *Parser) tokenAhead(n int) token.Token {
+	if n == 0 {
+		return parser.current
+	}
+	return parser.peekToken(n)
+}
+
+func (parser *Parser) advance() {
+	parser.previous = parser.current
+
+	for {
+		parser.current = parser.nextToken()
+		if parser.current.Type != tokentype.TOKEN_ERROR {
+			break
+		}
+
+		parser.errorAtCurrent(parser.current.Lexeme)
+	}
+}
+
+func (parser *Parser) consume(typee tokentype.TokenType, msg string) {
+	if parser.current.Type == typee {
+		parser.advance()
+		return
+	}
+
+	parser.errorAtCurrent(msg)
+}
+
+func (parser *Parser) check(typee tokentype.TokenType) bool {
+	return parser.current.Type == typee
+}
+
+func (parser *Parser) match(typee tokentype.TokenType) bool {
+	if !parser.check(typee) {
+		return false
+	}
+	parser.advance()
+	return true
+}
+
+// spanFrom is the span from start to the token just consumed.
+func (parser *Parser) spanFrom(start token.Token) ast.Span {
+	if parser.previous.Start < start.Start {
+		return ast.TokenSpan(start)
+	}
+	return ast.TokenSpan(start).To(ast.TokenSpan(parser.previous))
+}
+
+// extend is the span from the start of node to the token just consumed.
+func (parser *Parser) extend(node ast.Node) ast.Span {
+	return node.Position().To(ast.TokenSpan(parser.previous))
+}
+
+func (parser *Parser) block() []ast.Stmt {
+	stmts := []ast.Stmt{}
+	for !parser.check(tokentype.TOKEN_RIGHT_BRACE) && !parser.check(tokentype.TOKEN_EOF) {
+		stmts = append(stmts, parser.declaration())
+	}
+
+	parser.consume(tokentype.TOKEN_RIGHT_BRACE, "Expect '}' after block.")
+	return stmts
+}
+
+func (parser *Parser) expressionStatement() ast.Stmt {
+	expr := parser.expression()
+	parser.consume(tokentype.TOKEN_SEMICOLON, "Expect ';' after expression.")
+	return &ast.ExprStmt{Span: parser.extend(expr), Expr: expr}
+}
+
+func (parser *Parser) printStatement() ast.Stmt {
+	start := parser.previous
+	expr := parser.expression()
+	parser.consume(tokentype.TOKEN_SEMICOLON, "Expect ';' after value.")
+	return &ast.PrintStmt{Span: parser.spanFrom(start), Expr: expr}
+}
+
+func (parser *Parser) ifStatement() ast.Stmt {
+	start := parser.previous
+	parser.consume(tokentype.TOKEN_LEFT_PAREN, "Expect '(' after 'if'.")
+	condition := parser.expression()
+	parser.consume(tokentype.TOKEN_RIGHT_PAREN, "Expect ')' after condition.")
+
+	stmt := &ast.IfStmt{Condition: condition, Then: parser.statement()}
+	if parser.match(tokentype.TOKEN_ELSE) {
+		stmt.Else = parser.statement()
+	}
+
+	stmt.Span = parser.spanFrom(start)
+	return stmt
+}
+
+func (parser *Parser) whileStatement() ast.Stmt {
+	start := parser.previous
+	parser.consume(tokentype.TOKEN_LEFT_PAREN, "Expect '(' after while.")
+	condition := parser.expression()
+	parser.consume(tokentype.TOKEN_RIGHT_PAREN, "Expect ')' after while.")
+	body := parser.statement()
+
+	return &ast.WhileStmt{Span: parser.spanFrom(start), Condition: condition, Body: body}
+}
+
+// isForIn looks ahead for the `x in` or `i, x in` that starts a for-in
+// loop.
+func (parser *Parser) isForIn() bool {
+	end := parser.variableEnd(0)
+	if end < 0 {
+		return false
+	}
+	if parser.tokenAhead(end).Type == tokentype.TOKEN_IN {
+		return true
+	}
+	if parser.tokenAhead(end).Type != tokentype.TOKEN_COMMA {
+		return false
+	}
+	end = parser.variableEnd(end + 1)
+	return end > 0 && parser.tokenAhead(end).Type == tokentype.TOKEN_IN
+}
+
+// forInStatement parses the rest of `for (x in iterable)` or `for (i, x
+// in iterable)`.
+func (parser *Parser) forInStatement(start token.Token) ast.Stmt {
+	stmt := new(ast.ForInStmt)
+	for ok := true; ok; ok = parser.match(tokentype.TOKEN_COMMA) {
+		stmt.Vars = append(stmt.Vars, parser.binding("Expect variable name."))
+	}
+	parser.consume(tokentype.TOKEN_IN, "Expect 'in' after loop variable.")
+	stmt.Iterable = parser.expression()
+	parser.consume(tokentype.TOKEN_RIGHT_PAREN, "Expect ')' after for-in clause.")
+	stmt.Body = parser.statement()
+
+	stmt.Span = parser.spanFrom(start)
+	return stmt
+}
+
+func (parser *Parser) forStatement() ast.Stmt {
+	start := parser.previous
+	parser.consume(tokentype.TOKEN_LEFT_PAREN, "Expect '(' after 'for'.")
+
+	if parser.isForIn() {
+		return parser.forInStatement(start)
+	}
+
+	stmt := new(ast.ForStmt)
+	if parser.match(tokentype.TOKEN_VAR) {
+		stmt.Init = parser.varDeclaration(false)
+	} else if !parser.match(tokentype.TOKEN_SEMICOLON) {
+		expr := parser.expression()
+		parser.consume(tokentype.TOKEN_SEMICOLON, "Expect ';' after loop initializer.")
+		stmt.Init = &ast.ExprStmt{Span: parser.extend(expr), Expr: expr}
+	}
+
+	if !parser.match(tokentype.TOKEN_SEMICOLON) {
+		stmt.Condition = parser.expression()
+		parser.consume(tokentype.TOKEN_SEMICOLON, "Expect ';' after loop condition.")
+	}
+
+	if !parser.match(tokentype.TOKEN_RIGHT_PAREN) {
+		stmt.Increment = parser.expression()
+		parser.consume(tokentype.TOKEN_RIGHT_PAREN, "Expect ')' after for clauses.")
+	}
+
+	stmt.Body = parser.statement()
+
+	stmt.Span = parser.spanFrom(start)
+	return stmt
+}
+
+// returnStatement parses `return;`, `return value;` or `return a, b;`,
+// which returns the list [a, b].
+func (parser *Parser) returnStatement() ast.Stmt {
+	stmt := &ast.ReturnStmt{Keyword: parser.previous}
+
+	if !parser.match(tokentype.TOKEN_SEMICOLON) {
+		stmt.Values = append(stmt.Values, parser.expression())
+		for parser.match(tokentype.TOKEN_COMMA) {
+			stmt.Values = append(stmt.Values, parser.parsePrecedence(PREC_CONDITIONAL))
+		}
+		if len(stmt.Values) > 255 {
+			parser.error("Can't return more than 255 values.")
+		}
+		parser.consume(tokentype.TOKEN_SEMICOLON, "Expect ';' after return value.")
+	}
+
+	stmt.Span = parser.spanFrom(stmt.Keyword)
+	return stmt
+}
+
+func (parser *Parser) statement() ast.Stmt {
+	if parser.match(tokentype.TOKEN_PRINT) {
+		return parser.printStatement()
+	} else if parser.match(tokentype.TOKEN_LEFT_BRACE) {
+		start := parser.previous
+		stmts := parser.block()
+		return &ast.BlockStmt{Span: parser.spanFrom(start), Stmts: stmts}
+	} else if parser.match(tokentype.TOKEN_IF) {
+		return parser.ifStatement()
+	} else if parser.match(tokentype.TOKEN_WHILE) {
+		return parser.whileStatement()
+	} else if parser.match(tokentype.TOKEN_FOR) {
+		return parser.forStatement()
+	} else if parser.match(tokentype.TOKEN_MATCH) {
+		return parser.matchStatement()
+	} else if parser.match(tokentype.TOKEN_RETURN) {
+		return parser.returnStatement()
+	}
+
+	return parser.expressionStatement()
+}
+
+// binding parses the name or destructuring pattern a declaration,
+// parameter or for-in loop binds.
+func (parser *Parser) binding(err string) *ast.Binding {
+	if parser.match(tokentype.TOKEN_LEFT_BRACKET) || parser.match(tokentype.TOKEN_LEFT_BRACE) {
+		pattern := parser.destructuringPattern()
+		return &ast.Binding{Span: pattern.Span, Pattern: pattern}
+	}
+
+	parser.consume(tokentype.TOKEN_IDENTIFIER, err)
+	return &ast.Binding{Span: ast.TokenSpan(parser.previous), Name: parser.previous}
+}
+
+// parameters parses a parameter list after its '('.
+func (parser *Parser) parameters() []*ast.Param {
+	params := []*ast.Param{}
+	rest, defaults := false, false
+
+	if !parser.check(tokentype.TOKEN_RIGHT_PAREN) {
+		for ok := true; ok; ok = parser.match(tokentype.TOKEN_COMMA) {
+			if len(params)+1 > 255 {
+				parser.errorAtCurrent("Can't have more than 255 parameters.")
+			}
+			if rest {
+				parser.errorAtCurrent("Rest parameter must be the last parameter.")
+			}
+
+			start := parser.current
+			if parser.match(tokentype.TOKEN_ELLIPSIS) {
+				parser.consume(tokentype.TOKEN_IDENTIFIER, "Expect rest parameter name.")
+				name := parser.previous
+				binding := &ast.Binding{Span: ast.TokenSpan(name), Name: name}
+				params = append(params, &ast.Param{Span: parser.spanFrom(start), Binding: binding, Rest: true})
+				rest = true
+				continue
+			}
+
+			param := &ast.Param{Binding: parser.binding("Expect parameter name.")}
+			if parser.match(tokentype.TOKEN_EQUAL) {
+				param.Default = parser.expression()
+				defaults = true
+			} else if defaults {
+				parser.error("Parameter without a default value can't follow one with a default.")
+			}
+
+			param.Span = parser.spanFrom(start)
+			params = append(params, param)
+		}
+	}
+
+	parser.consume(tokentype.TOKEN_RIGHT_PAREN, "Expect ')' after parameters.")
+	return params
+}
+
+// function parses the parameters and body of a function declaration or
+// lambda, the function's name or `fun` having just been consumed.
+func (parser *Parser) function(start token.Token, name token.Token) *ast.FunctionExpr {
+	fn := &ast.FunctionExpr{Name: name}
+
+	parser.consume(tokentype.TOKEN_LEFT_PAREN, "Expect '(' after function name.")
+	fn.Params = parser.parameters()
+	parser.consume(tokentype.TOKEN_LEFT_BRACE, "Expect '{' before function body.")
+	fn.Body = parser.block()
+
+	fn.Span = parser.spanFrom(start)
+	return fn
+}
+
+// isArrowFunction is called with the '(' of a grouping just consumed and
+// looks ahead for the matching ')' followed by '=>'.
+func (parser *Parser) isArrowFunction() bool {
+	if parser.check(tokentype.TOKEN_RIGHT_PAREN) {
+		return parser.peekToken(1).Type == tokentype.TOKEN_ARROW
+	}
+
+	// every parameter list starts with a rest parameter or with a name or
+	// pattern followed by one of these, which rules out most groupings
+	// without scanning them
+	if parser.check(tokentype.TOKEN_ELLIPSIS) {
+		return true
+	}
+	end := parser.variableEnd(0)
+	if end < 0 {
+		return false
+	}
+	switch parser.tokenAhead(end).Type {
+	case tokentype.TOKEN_COMMA, tokentype.TOKEN_RIGHT_PAREN, tokentype.TOKEN_EQUAL:
+	default:
+		return false
+	}
+
+	depth := 0
+	for i := end; ; i++ {
+		switch parser.peekToken(i).Type {
+		case tokentype.TOKEN_LEFT_PAREN:
+			depth++
+		case tokentype.TOKEN_RIGHT_PAREN:
+			if depth == 0 {
+				return parser.peekToken(i+1).Type == tokentype.TOKEN_ARROW
+			}
+			depth--
+		case tokentype.TOKEN_EOF:
+			return false
+		}
+	}
+}
+
+// arrowFunction parses `(params) => expr` and `(params) => { body }` once
+// the '(' has been consumed. An expression body is returned.
+func (parser *Parser) arrowFunction() ast.Expr {
+	start := parser.previous
+	fn := &ast.FunctionExpr{Arrow: true}
+
+	fn.Params = parser.parameters()
+	parser.consume(tokentype.TOKEN_ARROW, "Expect '=>' after parameters.")
+
+	if parser.match(tokentype.TOKEN_LEFT_BRACE) {
+		fn.Body = parser.block()
+	} else {
+		body := parser.parsePrecedence(PREC_ASSIGNMENT)
+		fn.Body = []ast.Stmt{&ast.ReturnStmt{Span: body.Position(), Values: []ast.Expr{body}}}
+	}
+
+	fn.Span = parser.spanFrom(start)
+	return fn
+}
+
+func (parser *Parser) varDeclaration(isConst bool) ast.Stmt {
+	start := parser.previous
+	decl := &ast.VarDecl{Const: isConst}
+
+	switch {
+	case parser.check(tokentype.TOKEN_LEFT_BRACKET) || parser.check(tokentype.TOKEN_LEFT_BRACE):
+		decl.Binding = parser.binding("")
+		parser.consume(tokentype.TOKEN_EQUAL, "Expect '=' after pattern.")
+		decl.Init = parser.expression()
+		parser.consume(tokentype.TOKEN_SEMICOLON, "Expect ; after variable declaration")
+	case isConst:
+		decl.Binding = parser.binding("Expect constant name.")
+		parser.consume(tokentype.TOKEN_EQUAL, "Expect '=' after constant name.")
+		decl.Init = parser.expression()
+		parser.consume(tokentype.TOKEN_SEMICOLON, "Expect ; after constant declaration")
+	default:
+		decl.Binding = parser.binding("Expect variable name.")
+		if parser.match(tokentype.TOKEN_EQUAL) {
+			decl.Init = parser.expression()
+		}
+		parser.consume(tokentype.TOKEN_SEMICOLON, "Expect ; after variable declaration")
+	}
+
+	decl.Span = parser.spanFrom(start)
+	return decl
+}
+
+// importDeclaration parses `import "path" as name;`.
+func (parser *Parser) importDeclaration() ast.Stmt {
+	start := parser.previous
+	decl := new(ast.ImportDecl)
+
+	parser.consume(tokentype.TOKEN_STRING, "Expect module path after 'import'.")
+	decl.Path = parser.previous
+	parser.consume(tokentype.TOKEN_AS, "Expect 'as' after module path.")
+	parser.consume(tokentype.TOKEN_IDENTIFIER, "Expect module name after 'as'.")
+	decl.Name = parser.previous
+	parser.consume(tokentype.TOKEN_SEMICOLON, "Expect ';' after import.")
+
+	decl.Span = parser.spanFrom(start)
+	return decl
+}
+
+// fromDeclaration parses `from "path" import a, b;`.
+func (parser *Parser) fromDeclaration() ast.Stmt {
+	start := parser.previous
+	decl := new(ast.FromDecl)
+
+	parser.consume(tokentype.TOKEN_STRING, "Expect module path after 'from'.")
+	decl.Path = parser.previous
+	parser.consume(tokentype.TOKEN_IMPORT, "Expect 'import' after module path.")
+
+	for ok := true; ok; ok = parser.match(tokentype.TOKEN_COMMA) {
+		parser.consume(tokentype.TOKEN_IDENTIFIER, "Expect name to import.")
+		decl.Names = append(decl.Names, parser.previous)
+	}
+
+	parser.consume(tokentype.TOKEN_SEMICOLON, "Expect ';' after import.")
+
+	decl.Span = parser.spanFrom(start)
+	return decl
+}
+
+func (parser *Parser) funDeclaration() ast.Stmt {
+	start := parser.previous
+	parser.consume(tokentype.TOKEN_IDENTIFIER, "Expect function name.")
+	fn := parser.function(start, parser.previous)
+	return &ast.FunDecl{Span: fn.Span, Function: fn}
+}
+
+// declaration parses a declaration or statement. One with a syntax error
+// becomes a BadStmt covering everything up to where parsing resumes.
+func (parser *Parser) declaration() ast.Stmt {
+	start := parser.current
+	var stmt ast.Stmt
+
+	if parser.match(tokentype.TOKEN_VAR) {
+		stmt = parser.varDeclaration(false)
+	} else if parser.match(tokentype.TOKEN_CONST) {
+		stmt = parser.varDeclaration(true)
+	} else if parser.check(tokentype.TOKEN_FUN) && parser.peekToken(1).Type == tokentype.TOKEN_IDENTIFIER {
+		parser.advance()
+		stmt = parser.funDeclaration()
+	} else if parser.match(tokentype.TOKEN_IMPORT) {
+		stmt = parser.importDeclaration()
+	} else if parser.match(tokentype.TOKEN_FROM) {
+		stmt = parser.fromDeclaration()
+	} else {
+		stmt = parser.statement()
+	}
+
+	if parser.panicMode {
+		parser.synchronize()
+		return &ast.BadStmt{Span: parser.spanFrom(start)}
+	}
+
+	return stmt
+}
+
+// synchronize skips to the end of the statement with the error, or to the
+// start of the next one.
+func (parser *Parser) synchronize() {
+	parser.panicMode = false
+	for parser.current.Type != tokentype.TOKEN_EOF {
+		if parser.previous.Type == tokentype.TOKEN_SEMICOLON {
+			return
+		}
+
+		switch parser.current.Type {
+		case tokentype.TOKEN_FUN:
+			return
+		case tokentype.TOKEN_VAR:
+			return
+		case tokentype.TOKEN_CONST:
+			return
+		case tokentype.TOKEN_FOR:
+			return
+		case tokentype.TOKEN_IF:
+			return
+		case tokentype.TOKEN_WHILE:
+			return
+		case tokentype.TOKEN_MATCH:
+			return
+		case tokentype.TOKEN_PRINT:
+			return
+		case tokentype.TOKEN_RETURN:
+			return
+		case tokentype.TOKEN_IMPORT:
+			return
+		case tokentype.TOKEN_FROM:
+			return
+		}
+
+		parser.advance()
+	}
+}
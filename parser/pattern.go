@@ -0,0 +1,221 @@
+package parser
+
+import (
+	"golox/ast"
+	"golox/ast/patternkind"
+	"golox/scanner/token/tokentype"
+	"golox/value"
+	"math"
+)
+
+func (parser *Parser) pattern() *ast.MatchPattern {
+	start := parser.current
+	pattern := parser.patternKind()
+	pattern.Span = parser.spanFrom(start)
+	return pattern
+}
+
+func (parser *Parser) patternKind() *ast.MatchPattern {
+	switch {
+	case parser.match(tokentype.TOKEN_LEFT_BRACKET):
+		list := &ast.MatchPattern{Kind: patternkind.PATTERN_LIST, Elements: []*ast.MatchPattern{}}
+		if !parser.check(tokentype.TOKEN_RIGHT_BRACKET) {
+			for ok := true; ok; ok = parser.match(tokentype.TOKEN_COMMA) {
+				if parser.check(tokentype.TOKEN_RIGHT_BRACKET) {
+					break // trailing comma case
+				}
+				if parser.match(tokentype.TOKEN_ELLIPSIS) {
+					parser.consume(tokentype.TOKEN_IDENTIFIER, "Expect name after '...'.")
+					rest := parser.previous
+					list.Rest = &rest
+					break
+				}
+				list.Elements = append(list.Elements, parser.pattern())
+			}
+		}
+		parser.consume(tokentype.TOKEN_RIGHT_BRACKET, "Expect ']' after list pattern.")
+		if len(list.Elements) > math.MaxUint8 {
+			parser.error("Too many elements in list pattern.")
+		}
+		return list
+	case parser.match(tokentype.TOKEN_IDENTIFIER):
+		if parser.previous.Lexeme == "_" {
+			return &ast.MatchPattern{Kind: patternkind.PATTERN_WILDCARD}
+		}
+		return &ast.MatchPattern{Kind: patternkind.PATTERN_BINDING, Name: parser.previous}
+	case parser.match(tokentype.TOKEN_INTEGER):
+		return &ast.MatchPattern{Kind: patternkind.PATTERN_LITERAL, Literal: parser.integerValue()}
+	case parser.match(tokentype.TOKEN_NUMBER):
+		return &ast.MatchPattern{Kind: patternkind.PATTERN_LITERAL, Literal: parser.numberValue()}
+	case parser.match(tokentype.TOKEN_MINUS):
+		if parser.match(tokentype.TOKEN_INTEGER) {
+			literal := parser.integerValue()
+			if !literal.IsInt() {
+				// too large for an int, so it's a number like in expressions
+				return &ast.MatchPattern{Kind: patternkind.PATTERN_LITERAL, Literal: value.ValNumber(-literal.AsNumber())}
+			}
+			return &ast.MatchPattern{Kind: patternkind.PATTERN_LITERAL, Literal: value.ValInt(-literal.AsInt())}
+		}
+		parser.consume(tokentype.TOKEN_NUMBER, "Expect number after '-' in pattern.")
+		return &ast.MatchPattern{Kind: patternkind.PATTERN_LITERAL, Literal: value.ValNumber(-parser.numberValue().AsNumber())}
+	case parser.match(tokentype.TOKEN_STRING):
+		return &ast.MatchPattern{Kind: patternkind.PATTERN_LITERAL, Literal: parser.stringValue()}
+	case parser.match(tokentype.TOKEN_TRUE), parser.match(tokentype.TOKEN_FALSE):
+		return &ast.MatchPattern{Kind: patternkind.PATTERN_LITERAL, Literal: value.ValBool(parser.previous.Type == tokentype.TOKEN_TRUE)}
+	case parser.match(tokentype.TOKEN_NIL):
+		return &ast.MatchPattern{Kind: patternkind.PATTERN_LITERAL, Literal: value.ValNil()}
+	}
+
+	parser.errorAtCurrent("Expect pattern.")
+	return &ast.MatchPattern{Kind: patternkind.PATTERN_WILDCARD}
+}
+
+// matchArm parses `patterns [if guard] => statement`.
+func (parser *Parser) matchArm() *ast.MatchArm {
+	start := parser.current
+	arm := new(ast.MatchArm)
+
+	for ok := true; ok; ok = parser.match(tokentype.TOKEN_COMMA) {
+		arm.Patterns = append(arm.Patterns, parser.pattern())
+	}
+	if len(arm.Patterns) > 1 {
+		for _, pattern := range arm.Patterns {
+			if pattern.Binds() {
+				parser.error("Alternative patterns can't bind variables.")
+				break
+			}
+		}
+	}
+
+	if parser.match(tokentype.TOKEN_IF) {
+		arm.Guard = parser.expression()
+	}
+
+	parser.consume(tokentype.TOKEN_ARROW, "Expect '=>' after pattern.")
+	arm.Body = parser.statement()
+
+	arm.Span = parser.spanFrom(start)
+	return arm
+}
+
+// matchStatement parses
+//
+//	match (value) { pattern, ... [if guard] => statement ... }
+func (parser *Parser) matchStatement() ast.Stmt {
+	stmt := &ast.MatchStmt{Keyword: parser.previous, Arms: []*ast.MatchArm{}}
+
+	parser.consume(tokentype.TOKEN_LEFT_PAREN, "Expect '(' after 'match'.")
+	stmt.Value = parser.expression()
+	parser.consume(tokentype.TOKEN_RIGHT_PAREN, "Expect ')' after match value.")
+
+	parser.consume(tokentype.TOKEN_LEFT_BRACE, "Expect '{' before match arms.")
+	for !parser.check(tokentype.TOKEN_RIGHT_BRACE) && !parser.check(tokentype.TOKEN_EOF) {
+		stmt.Arms = append(stmt.Arms, parser.matchArm())
+	}
+	parser.consume(tokentype.TOKEN_RIGHT_BRACE, "Expect '}' after match arms.")
+
+	stmt.Span = parser.spanFrom(stmt.Keyword)
+	return stmt
+}
+
+// destructuringPattern parses the pattern whose opening '[' or '{' was
+// just consumed.
+func (parser *Parser) destructuringPattern() *ast.Destructure {
+	start := parser.previous
+	d := &ast.Destructure{IsMap: start.Type == tokentype.TOKEN_LEFT_BRACE}
+	closing, what := tokentype.TOKEN_RIGHT_BRACKET, "']' after list pattern."
+	if d.IsMap {
+		closing, what = tokentype.TOKEN_RIGHT_BRACE, "'}' after map pattern."
+	}
+
+	if !parser.check(closing) {
+		for ok := true; ok; ok = parser.match(tokentype.TOKEN_COMMA) {
+			if parser.check(closing) {
+				break // trailing comma case
+			}
+			if !d.IsMap && parser.match(tokentype.TOKEN_ELLIPSIS) {
+				parser.consume(tokentype.TOKEN_IDENTIFIER, "Expect name after '...'.")
+				d.Names = append(d.Names, parser.previous)
+				d.Rest = true
+				break
+			}
+
+			parser.consume(tokentype.TOKEN_IDENTIFIER, "Expect variable name in pattern.")
+			name := parser.previous
+			if d.IsMap {
+				d.Keys = append(d.Keys, name)
+				if parser.match(tokentype.TOKEN_COLON) {
+					parser.consume(tokentype.TOKEN_IDENTIFIER, "Expect variable name after ':'.")
+					name = parser.previous
+				}
+			}
+			d.Names = append(d.Names, name)
+		}
+	}
+
+	parser.consume(closing, "Expect "+what)
+	if len(d.Names) > math.MaxUint8 {
+		parser.error("Too many variables in pattern.")
+	}
+
+	d.Span = parser.spanFrom(start)
+	return d
+}
+
+// variableEnd returns how many tokens ahead the variable name or
+// destructuring pattern starting n tokens ahead ends, or -1 if there's
+// none there.
+func (parser *Parser) variableEnd(n int) int {
+	var closing tokentype.TokenType
+	switch parser.tokenAhead(n).Type {
+	case tokentype.TOKEN_IDENTIFIER:
+		return n + 1
+	case tokentype.TOKEN_LEFT_BRACKET:
+		closing = tokentype.TOKEN_RIGHT_BRACKET
+	case tokentype.TOKEN_LEFT_BRACE:
+		closing = tokentype.TOKEN_RIGHT_BRACE
+	default:
+		return -1
+	}
+
+	for n++; ; n++ {
+		switch parser.tokenAhead(n).Type {
+		case tokentype.TOKEN_IDENTIFIER, tokentype.TOKEN_COMMA, tokentype.TOKEN_COLON, tokentype.TOKEN_ELLIPSIS:
+		case closing:
+			return n + 1
+		default:
+			return -1
+		}
+	}
+}
+
+// isSwap reports whether the list literal being parsed, whose '[' was
+// just consumed, is the target of an assignment like `[a, b] = [b, a]`.
+func (parser *Parser) isSwap() bool {
+	n := 0
+	for {
+		if parser.tokenAhead(n).Type == tokentype.TOKEN_ELLIPSIS {
+			n++
+		}
+		if parser.tokenAhead(n).Type != tokentype.TOKEN_IDENTIFIER {
+			return false
+		}
+		n++
+		if parser.tokenAhead(n).Type != tokentype.TOKEN_COMMA {
+			break
+		}
+		n++
+	}
+	return parser.tokenAhead(n).Type == tokentype.TOKEN_RIGHT_BRACKET &&
+		parser.tokenAhead(n+1).Type == tokentype.TOKEN_EQUAL
+}
+
+// destructuringAssignment parses `[a, b, ...rest] = list`.
+func (parser *Parser) destructuringAssignment() ast.Expr {
+	pattern := parser.destructuringPattern()
+	parser.consume(tokentype.TOKEN_EQUAL, "Expect '=' after pattern.")
+	op := parser.previous
+	val := parser.expression()
+
+	return &ast.AssignExpr{Span: pattern.Span.To(val.Position()), Target: pattern, Op: op, Value: val}
+}
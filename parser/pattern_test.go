@@ -0,0 +1,34 @@
+package parser
+
+import (
+	"golox/ast"
+	"golox/value"
+	"math"
+	"testing"
+)
+
+func TestNegativePatternLiterals(t *testing.T) {
+	tests := []struct {
+		pattern string
+		want    value.Value
+	}{
+		{"-1", value.ValInt(-1)},
+		{"-9223372036854775807", value.ValInt(-math.MaxInt64)},
+		{"-1.5", value.ValNumber(-1.5)},
+		// ints too large for an int are numbers
+		{"-9223372036854775808", value.ValNumber(math.MinInt64)},
+		{"-100000000000000000000", value.ValNumber(-1e20)},
+	}
+	for _, test := range tests {
+		source := "match (0) { " + test.pattern + " => print 1; }\x00"
+		program, ok := Parse(&source)
+		if !ok {
+			t.Errorf("%s: syntax error", test.pattern)
+			continue
+		}
+		got := program.Stmts[0].(*ast.MatchStmt).Arms[0].Patterns[0].Literal
+		if got != test.want {
+			t.Errorf("%s: got %v, want %v", test.pattern, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+// Package register is an experimental backend running lox on a register
+// machine instead of the stack vm. Its instructions (see regop) name the
+// frame slots they read and write, so most of the OP_GET_LOCAL and
+// OP_POP traffic of the stack vm goes away.
+//
+// It compiles the syntax tree the parser builds, but only covers part of
+// the language: no classes, modules, maps, slices, destructuring, match,
+// for-in loops, default or keyword arguments. Programs using them are
+// rejected at compile time. Closures capture locals as upvalues pointing
+// at the registers until they're closed, and generators save their
+// frame's registers when they yield, like the stack vm does its stack.
+package register
+
+import (
+	"encoding/binary"
+	"golox/chunk"
+)
+
+// Chunk is a function's register code with the number of registers its
+// frames need, and what each upvalue of its closures captures. Every
+// instruction takes four bytes.
+type Chunk struct {
+	chunk.Chunk
+	Registers int
+	Captures  []Capture
+}
+
+// Capture is where OP_CLOSURE finds an upvalue: the register Index of the
+// function creating the closure when Local, else its upvalue Index.
+type Capture struct {
+	Index int
+	Local bool
+}
+
+func (c *Chunk) emit(op uint8, a uint8, b uint8, cc uint8, line int) {
+	c.Write(op, line)
+	c.Write(a, line)
+	c.Write(b, line)
+	c.Write(cc, line)
+}
+
+// emitBx emits an instruction whose B and C are one 16-bit operand.
+func (c *Chunk) emitBx(op uint8, a uint8, bx int, line int) {
+	bytes := make([]byte, 2)
+	binary.LittleEndian.PutUint16(bytes, uint16(bx))
+	c.emit(op, a, bytes[0], bytes[1], line)
+}
+
+func bx(code []byte, ip int) int {
+	return int(binary.LittleEndian.Uint16(code[ip+2:]))
+}
+
+// sbx is the signed jump offset of the instruction at ip.
+func sbx(code []byte, ip int) int {
+	return bx(code, ip) - 0x8000
+}
@@ -0,0 +1,101 @@
+package register
+
+import (
+	"fmt"
+	"golox/register/regop"
+)
+
+var names = map[uint8]string{
+	regop.OP_MOVE:        "OP_MOVE",
+	regop.OP_LOADK:       "OP_LOADK",
+	regop.OP_LOADNIL:     "OP_LOADNIL",
+	regop.OP_LOADTRUE:    "OP_LOADTRUE",
+	regop.OP_LOADFALSE:   "OP_LOADFALSE",
+	regop.OP_GETGLOBAL:   "OP_GETGLOBAL",
+	regop.OP_SETGLOBAL:   "OP_SETGLOBAL",
+	regop.OP_DEFGLOBAL:   "OP_DEFGLOBAL",
+	regop.OP_ADD:         "OP_ADD",
+	regop.OP_SUBTRACT:    "OP_SUBTRACT",
+	regop.OP_MULTIPLY:    "OP_MULTIPLY",
+	regop.OP_DIVIDE:      "OP_DIVIDE",
+	regop.OP_MODULO:      "OP_MODULO",
+	regop.OP_LESS:        "OP_LESS",
+	regop.OP_GREATER:     "OP_GREATER",
+	regop.OP_EQUAL:       "OP_EQUAL",
+	regop.OP_BIT_AND:     "OP_BIT_AND",
+	regop.OP_BIT_OR:      "OP_BIT_OR",
+	regop.OP_BIT_XOR:     "OP_BIT_XOR",
+	regop.OP_SHIFT_LEFT:  "OP_SHIFT_LEFT",
+	regop.OP_SHIFT_RIGHT: "OP_SHIFT_RIGHT",
+	regop.OP_NOT:         "OP_NOT",
+	regop.OP_NEGATE:      "OP_NEGATE",
+	regop.OP_BIT_NOT:     "OP_BIT_NOT",
+	regop.OP_JUMP:        "OP_JUMP",
+	regop.OP_JUMP_IF:     "OP_JUMP_IF",
+	regop.OP_JUMP_UNLESS: "OP_JUMP_UNLESS",
+	regop.OP_CALL:        "OP_CALL",
+	regop.OP_RETURN:      "OP_RETURN",
+	regop.OP_PRINT:       "OP_PRINT",
+	regop.OP_LIST:        "OP_LIST",
+	regop.OP_INDEX:       "OP_INDEX",
+	regop.OP_STORE:       "OP_STORE",
+	regop.OP_FUNCTION:    "OP_FUNCTION",
+	regop.OP_CLOSURE:     "OP_CLOSURE",
+	regop.OP_GETUPVAL:    "OP_GETUPVAL",
+	regop.OP_SETUPVAL:    "OP_SETUPVAL",
+	regop.OP_CLOSE:       "OP_CLOSE",
+	regop.OP_YIELD:       "OP_YIELD",
+}
+
+// Disassemble prints the instructions of c, in the format of the stack
+// vm's disassembler.
+func Disassemble(c *Chunk, name string) {
+	fmt.Printf("\n==== %s (%d registers) ====\n\n", name, c.Registers)
+
+	for offset := 0; offset < len(c.Code); offset += 4 {
+		fmt.Printf("%04d ", offset)
+		if offset > 0 && c.Lines[offset] == c.Lines[offset-4] {
+			fmt.Printf("   | ")
+		} else {
+			fmt.Printf("%4d ", c.Lines[offset])
+		}
+
+		op, a, b, cc := c.Code[offset], c.Code[offset+1], c.Code[offset+2], c.Code[offset+3]
+		name, ok := names[op]
+		if !ok {
+			fmt.Printf("Unknown opcode %d\n", op)
+			continue
+		}
+
+		switch op {
+		case regop.OP_LOADK, regop.OP_GETGLOBAL, regop.OP_SETGLOBAL, regop.OP_DEFGLOBAL, regop.OP_FUNCTION:
+			index := bx(c.Code, offset)
+			fmt.Printf("%-16s %4d %4d ", name, a, index)
+			c.Constants[index].Print()
+			fmt.Println()
+		case regop.OP_CLOSURE:
+			index := bx(c.Code, offset)
+			fmt.Printf("%-16s %4d %4d ", name, a, index)
+			c.Constants[index].Print()
+			fmt.Println()
+			for _, capture := range c.Constants[index].AsObjFunction().Chunk.(*Chunk).Captures {
+				kind := "upvalue"
+				if capture.Local {
+					kind = "local"
+				}
+				fmt.Printf("%04d      |                     %s %d\n", offset, kind, capture.Index)
+			}
+		case regop.OP_JUMP:
+			fmt.Printf("%-16s      %4d -> %d\n", name, offset, offset+4+sbx(c.Code, offset))
+		case regop.OP_JUMP_IF, regop.OP_JUMP_UNLESS:
+			fmt.Printf("%-16s %4d %4d -> %d\n", name, a, offset, offset+4+sbx(c.Code, offset))
+		case regop.OP_LOADNIL, regop.OP_LOADTRUE, regop.OP_LOADFALSE, regop.OP_RETURN, regop.OP_PRINT, regop.OP_CLOSE:
+			fmt.Printf("%-16s %4d\n", name, a)
+		case regop.OP_MOVE, regop.OP_NOT, regop.OP_NEGATE, regop.OP_BIT_NOT, regop.OP_CALL,
+			regop.OP_GETUPVAL, regop.OP_SETUPVAL, regop.OP_YIELD:
+			fmt.Printf("%-16s %4d %4d\n", name, a, b)
+		default:
+			fmt.Printf("%-16s %4d %4d %4d\n", name, a, b, cc)
+		}
+	}
+}
@@ -0,0 +1,412 @@
+package register
+
+import (
+	"golox/ast"
+	"golox/register/regop"
+	"golox/scanner/token/tokentype"
+	"golox/value"
+	"golox/value/valuetype"
+)
+
+// binaryOps maps each binary operator to the register instruction
+// computing it into the destination, with an OP_NOT of the destination
+// after it for !=, >= and <=.
+var binaryOps = map[tokentype.TokenType][]uint8{
+	tokentype.TOKEN_PLUS:            {regop.OP_ADD},
+	tokentype.TOKEN_MINUS:           {regop.OP_SUBTRACT},
+	tokentype.TOKEN_STAR:            {regop.OP_MULTIPLY},
+	tokentype.TOKEN_SLASH:           {regop.OP_DIVIDE},
+	tokentype.TOKEN_PERCENT:         {regop.OP_MODULO},
+	tokentype.TOKEN_EQUAL_EQUAL:     {regop.OP_EQUAL},
+	tokentype.TOKEN_BANG_EQUAL:      {regop.OP_EQUAL, regop.OP_NOT},
+	tokentype.TOKEN_GREATER:         {regop.OP_GREATER},
+	tokentype.TOKEN_GREATER_EQUAL:   {regop.OP_LESS, regop.OP_NOT},
+	tokentype.TOKEN_LESS:            {regop.OP_LESS},
+	tokentype.TOKEN_LESS_EQUAL:      {regop.OP_GREATER, regop.OP_NOT},
+	tokentype.TOKEN_AMPERSAND:       {regop.OP_BIT_AND},
+	tokentype.TOKEN_PIPE:            {regop.OP_BIT_OR},
+	tokentype.TOKEN_CARET:           {regop.OP_BIT_XOR},
+	tokentype.TOKEN_LESS_LESS:       {regop.OP_SHIFT_LEFT},
+	tokentype.TOKEN_GREATER_GREATER: {regop.OP_SHIFT_RIGHT},
+}
+
+// compoundOps maps compound assignment operators to the instruction
+// combining the old value with the right hand side.
+var compoundOps = map[tokentype.TokenType]uint8{
+	tokentype.TOKEN_PLUS_EQUAL:    regop.OP_ADD,
+	tokentype.TOKEN_MINUS_EQUAL:   regop.OP_SUBTRACT,
+	tokentype.TOKEN_STAR_EQUAL:    regop.OP_MULTIPLY,
+	tokentype.TOKEN_SLASH_EQUAL:   regop.OP_DIVIDE,
+	tokentype.TOKEN_PERCENT_EQUAL: regop.OP_MODULO,
+}
+
+// operand returns a register holding the value of expr: a local's own
+// register, or a new temporary the caller releases. A local closures may
+// share is copied, as a call later in the expression could change it.
+func (generator *Generator) operand(expr ast.Expr) int {
+	if variable, ok := unwrap(expr).(*ast.VariableExpr); ok && !generator.current.shared[variable.Name.Lexeme] {
+		if reg, ok := generator.resolve(variable); ok {
+			return reg
+		}
+	}
+	reg := generator.alloc()
+	generator.expression(expr, reg)
+	return reg
+}
+
+func unwrap(expr ast.Expr) ast.Expr {
+	for {
+		grouping, ok := expr.(*ast.GroupingExpr)
+		if !ok {
+			return expr
+		}
+		expr = grouping.Expr
+	}
+}
+
+// assigns reports whether evaluating expr can assign to a local, which
+// an operand read from the local's register before it must not see.
+func assigns(expr ast.Expr) bool {
+	switch expr := expr.(type) {
+	case *ast.AssignExpr, *ast.IncrementExpr:
+		return true
+	case *ast.GroupingExpr:
+		return assigns(expr.Expr)
+	case *ast.UnaryExpr:
+		return assigns(expr.Operand)
+	case *ast.BinaryExpr:
+		return assigns(expr.Left) || assigns(expr.Right)
+	case *ast.LogicalExpr:
+		return assigns(expr.Left) || assigns(expr.Right)
+	case *ast.ConditionalExpr:
+		return assigns(expr.Condition) || assigns(expr.Then) || assigns(expr.Else)
+	case *ast.IndexExpr:
+		return assigns(expr.Object) || assigns(expr.Index)
+	case *ast.CallExpr:
+		for _, arg := range expr.Args {
+			if assigns(arg.Value) {
+				return true
+			}
+		}
+		return assigns(expr.Callee)
+	case *ast.ListExpr:
+		for _, item := range expr.Items {
+			if assigns(item) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// operands returns registers holding left and right, evaluated in that
+// order.
+func (generator *Generator) operands(left ast.Expr, right ast.Expr) (int, int) {
+	var l int
+	if assigns(right) {
+		l = generator.alloc()
+		generator.expression(left, l)
+	} else {
+		l = generator.operand(left)
+	}
+	return l, generator.operand(right)
+}
+
+// effect evaluates expr for its side effects only.
+func (generator *Generator) effect(expr ast.Expr) {
+	top := generator.current.top
+	switch expr := expr.(type) {
+	case *ast.AssignExpr:
+		generator.assignment(expr, -1)
+	case *ast.IncrementExpr:
+		generator.increment(expr, -1)
+	default:
+		generator.expression(expr, generator.alloc())
+	}
+	generator.free(top)
+}
+
+// expression evaluates expr into dest. The temporaries it needs are
+// released again.
+func (generator *Generator) expression(expr ast.Expr, dest int) {
+	generator.line = expr.Position().Line
+	top := generator.current.top
+	defer generator.free(top)
+
+	switch expr := expr.(type) {
+	case *ast.LiteralExpr:
+		generator.at(expr)
+		generator.load(expr.Value, dest)
+	case *ast.VariableExpr:
+		generator.at(expr)
+		if reg, ok := generator.resolve(expr); ok {
+			generator.move(dest, reg)
+			return
+		}
+		get, _, index := generator.nonLocal(expr.Name.Lexeme)
+		generator.emitBx(get, dest, index)
+	case *ast.GroupingExpr:
+		generator.expression(expr.Expr, dest)
+	case *ast.AssignExpr:
+		generator.assignment(expr, dest)
+	case *ast.IncrementExpr:
+		generator.increment(expr, dest)
+	case *ast.UnaryExpr:
+		reg := generator.operand(expr.Operand)
+		generator.at(expr)
+		switch expr.Op.Type {
+		case tokentype.TOKEN_BANG:
+			generator.emit(regop.OP_NOT, dest, reg, 0)
+		case tokentype.TOKEN_MINUS:
+			generator.emit(regop.OP_NEGATE, dest, reg, 0)
+		case tokentype.TOKEN_TILDE:
+			generator.emit(regop.OP_BIT_NOT, dest, reg, 0)
+		}
+	case *ast.BinaryExpr:
+		l, r := generator.operands(expr.Left, expr.Right)
+		generator.at(expr)
+		ops := binaryOps[expr.Op.Type]
+		generator.emit(ops[0], dest, l, r)
+		if len(ops) > 1 {
+			generator.emit(ops[1], dest, dest, 0)
+		}
+	case *ast.LogicalExpr:
+		generator.logical(expr, dest)
+	case *ast.ConditionalExpr:
+		elseJump := generator.condition(expr.Condition)
+		generator.expression(expr.Then, dest)
+		endJump := generator.emitJump(regop.OP_JUMP, 0)
+		generator.patchJump(elseJump)
+		generator.expression(expr.Else, dest)
+		generator.patchJump(endJump)
+	case *ast.CallExpr:
+		generator.call(expr, dest)
+	case *ast.IndexExpr:
+		if expr.Optional {
+			generator.unsupported(expr, "Optional chaining")
+			return
+		}
+		object, index := generator.operands(expr.Object, expr.Index)
+		generator.at(expr)
+		generator.emit(regop.OP_INDEX, dest, object, index)
+	case *ast.ListExpr:
+		base := generator.current.top
+		for _, item := range expr.Items {
+			generator.expression(item, generator.alloc())
+		}
+		generator.at(expr)
+		generator.emit(regop.OP_LIST, dest, base, len(expr.Items))
+	case *ast.FunctionExpr:
+		generator.function(expr, dest)
+	case *ast.MapExpr:
+		generator.unsupported(expr, "A map")
+	case *ast.SliceExpr:
+		generator.unsupported(expr, "A slice")
+	case *ast.PropertyExpr:
+		generator.unsupported(expr, "A property")
+	case *ast.YieldExpr:
+		generator.yield(expr, dest)
+	}
+}
+
+func (generator *Generator) move(dest int, reg int) {
+	if dest != reg {
+		generator.emit(regop.OP_MOVE, dest, reg, 0)
+	}
+}
+
+func (generator *Generator) load(val value.Value, dest int) {
+	switch {
+	case val.Type == valuetype.VAL_NIL:
+		generator.emit(regop.OP_LOADNIL, dest, 0, 0)
+	case val.IsBool() && val.AsBool():
+		generator.emit(regop.OP_LOADTRUE, dest, 0, 0)
+	case val.IsBool():
+		generator.emit(regop.OP_LOADFALSE, dest, 0, 0)
+	default:
+		generator.emitBx(regop.OP_LOADK, dest, generator.makeConstant(val))
+	}
+}
+
+// logical compiles `and` and `or`, leaving the left operand in dest when
+// it decides the result.
+func (generator *Generator) logical(expr *ast.LogicalExpr, dest int) {
+	var op uint8
+	switch expr.Op.Type {
+	case tokentype.TOKEN_AND:
+		op = regop.OP_JUMP_UNLESS
+	case tokentype.TOKEN_OR:
+		op = regop.OP_JUMP_IF
+	default:
+		generator.unsupported(expr, "The ?? operator")
+		return
+	}
+
+	generator.expression(expr.Left, dest)
+	generator.line = expr.Op.Line
+	endJump := generator.emitJump(op, dest)
+	generator.expression(expr.Right, dest)
+	generator.patchJump(endJump)
+}
+
+// call puts the callee and arguments in consecutive registers, where the
+// callee's frame starts and its result is left, and moves the result to
+// dest.
+func (generator *Generator) call(expr *ast.CallExpr, dest int) {
+	if expr.Optional {
+		generator.unsupported(expr, "Optional chaining")
+		return
+	}
+
+	// a call into the last register taken needs no move afterwards
+	base := dest
+	if dest != generator.current.top-1 {
+		base = generator.alloc()
+	}
+	generator.expression(expr.Callee, base)
+	for _, arg := range expr.Args {
+		if arg.Spread || arg.Name != nil {
+			generator.unsupported(arg, "A spread or keyword argument")
+			return
+		}
+		generator.expression(arg.Value, generator.alloc())
+	}
+	generator.at(expr)
+	generator.emit(regop.OP_CALL, base, len(expr.Args), 0)
+	generator.move(dest, base)
+}
+
+// assignment compiles an assignment, leaving the value assigned in dest
+// unless it's -1.
+func (generator *Generator) assignment(expr *ast.AssignExpr, dest int) {
+	op, compound := compoundOps[expr.Op.Type]
+
+	switch target := expr.Target.(type) {
+	case *ast.VariableExpr:
+		if reg, ok := generator.resolve(target); ok {
+			generator.assignLocal(expr, reg, op, compound)
+			if dest >= 0 {
+				generator.move(dest, reg)
+			}
+			return
+		}
+
+		get, set, index := generator.nonLocal(target.Name.Lexeme)
+		reg := dest
+		if reg < 0 {
+			reg = generator.alloc()
+		}
+		if compound {
+			generator.emitBx(get, reg, index)
+			r := generator.operand(expr.Value)
+			generator.at(expr)
+			generator.emit(op, reg, reg, r)
+		} else {
+			generator.expression(expr.Value, reg)
+			generator.at(expr)
+		}
+		generator.emitBx(set, reg, index)
+
+	case *ast.IndexExpr:
+		object, index := generator.operands(target.Object, target.Index)
+		reg := dest
+		if reg < 0 {
+			reg = generator.alloc()
+		}
+		if compound {
+			generator.at(target)
+			generator.emit(regop.OP_INDEX, reg, object, index)
+			r := generator.operand(expr.Value)
+			generator.at(expr)
+			generator.emit(op, reg, reg, r)
+		} else {
+			generator.expression(expr.Value, reg)
+			generator.at(expr)
+		}
+		generator.emit(regop.OP_STORE, object, index, reg)
+
+	default:
+		generator.unsupported(expr, "This assignment")
+	}
+}
+
+// assignLocal assigns to the local in reg. Values that could read the
+// local after writing part of the result to it are computed elsewhere
+// first.
+func (generator *Generator) assignLocal(expr *ast.AssignExpr, reg int, op uint8, compound bool) {
+	if compound {
+		r := generator.operand(expr.Value)
+		generator.at(expr)
+		generator.emit(op, reg, reg, r)
+		return
+	}
+
+	switch unwrap(expr.Value).(type) {
+	case *ast.LiteralExpr, *ast.VariableExpr, *ast.UnaryExpr, *ast.BinaryExpr, *ast.FunctionExpr:
+		generator.expression(expr.Value, reg)
+	default:
+		temp := generator.alloc()
+		generator.expression(expr.Value, temp)
+		generator.at(expr)
+		generator.move(reg, temp)
+	}
+}
+
+// increment compiles `++x`, `x++`, `--x` and `x--` on a variable, leaving
+// the new or old value in dest unless it's -1.
+func (generator *Generator) increment(expr *ast.IncrementExpr, dest int) {
+	target, ok := expr.Target.(*ast.VariableExpr)
+	if !ok {
+		generator.unsupported(expr, "Incrementing an element")
+		return
+	}
+
+	op := regop.OP_ADD
+	if expr.Op.Type != tokentype.TOKEN_PLUS_PLUS {
+		op = regop.OP_SUBTRACT
+	}
+
+	generator.at(expr)
+	reg, local := generator.resolve(target)
+	var set uint8
+	var index int
+	if !local {
+		var get uint8
+		get, set, index = generator.nonLocal(target.Name.Lexeme)
+		reg = generator.alloc()
+		generator.emitBx(get, reg, index)
+	}
+	if dest >= 0 && !expr.Prefix {
+		generator.move(dest, reg)
+	}
+	one := generator.alloc()
+	generator.load(value.ValInt(1), one)
+	generator.emit(op, reg, reg, one)
+	if !local {
+		generator.emitBx(set, reg, index)
+	}
+	if dest >= 0 && expr.Prefix {
+		generator.move(dest, reg)
+	}
+}
+
+// yield compiles `yield value` into dest, which gets whatever the
+// generator is resumed with. Any function containing it becomes a
+// generator.
+func (generator *Generator) yield(expr *ast.YieldExpr, dest int) {
+	if generator.isScript() {
+		generator.error("Can't yield from top-level code.")
+		return
+	}
+	generator.current.function.IsGenerator = true
+
+	var reg int
+	if expr.Value != nil {
+		reg = generator.operand(expr.Value)
+	} else {
+		reg = generator.alloc()
+		generator.emit(regop.OP_LOADNIL, reg, 0, 0)
+	}
+	generator.at(expr)
+	generator.emit(regop.OP_YIELD, dest, reg, 0)
+}
@@ -0,0 +1,525 @@
+package register
+
+import (
+	"fmt"
+	"golox/ast"
+	"golox/config"
+	"golox/parser"
+	"golox/register/regop"
+	"golox/value"
+	"os"
+)
+
+type local struct {
+	name     string
+	reg      int
+	depth    int
+	captured bool
+}
+
+// function is the state of a function being generated. Its registers are
+// used like a stack: register 0 holds the function called, then come the
+// parameters and locals, and temporaries go above those while an
+// expression needs them.
+type function struct {
+	enclosing *function
+	function  *value.ObjFunction
+	code      *Chunk
+	locals    []local
+	upvalues  []Capture
+	shared    map[string]bool // see sharedNames
+	depth     int
+	top       int // the first free register
+}
+
+type Generator struct {
+	hadError bool
+	current  *function
+	line     int
+}
+
+// Compile parses source and generates register code for it, returning
+// nil if there were errors.
+func Compile(source *string) *value.ObjFunction {
+	program, ok := parser.Parse(source)
+	if !ok {
+		return nil
+	}
+
+	return Generate(program)
+}
+
+// Generate emits register code for the top level of program and each
+// function in it, returning the script function. Constructs the register
+// machine can't run are reported on stderr and make it return nil.
+func Generate(program *ast.Program) *value.ObjFunction {
+	generator := new(Generator)
+	generator.begin("")
+	generator.current.shared = sharedNames(program.Stmts)
+
+	for _, stmt := range program.Stmts {
+		generator.statement(stmt)
+	}
+
+	generator.line = program.EndLine
+	function := generator.end()
+
+	if generator.hadError {
+		return nil
+	}
+	return function
+}
+
+func (generator *Generator) error(msg string) {
+	generator.hadError = true
+	fmt.Fprintf(os.Stderr, "[line %d] Error: %s\n", generator.line, msg)
+}
+
+// unsupported reports a construct the register machine can't run.
+func (generator *Generator) unsupported(node ast.Node, what string) {
+	generator.line = node.Position().Line
+	generator.error(fmt.Sprintf("%s isn't supported by the register backend.", what))
+}
+
+// at gives the instructions emitted from now on the line node ends on.
+func (generator *Generator) at(node ast.Node) {
+	generator.line = node.Position().EndLine
+}
+
+func (generator *Generator) emit(op uint8, a int, b int, c int) {
+	generator.current.code.emit(op, uint8(a), uint8(b), uint8(c), generator.line)
+}
+
+func (generator *Generator) emitBx(op uint8, a int, bx int) {
+	generator.current.code.emitBx(op, uint8(a), bx, generator.line)
+}
+
+// emitJump emits a jump to be patched and returns its offset.
+func (generator *Generator) emitJump(op uint8, a int) int {
+	generator.emitBx(op, a, 0)
+	return len(generator.current.code.Code) - 4
+}
+
+// patchJump makes the jump at offset go to the next instruction.
+func (generator *Generator) patchJump(offset int) {
+	generator.setJump(offset, len(generator.current.code.Code))
+}
+
+// emitLoop emits a jump back to start.
+func (generator *Generator) emitLoop(start int) {
+	generator.setJump(generator.emitJump(regop.OP_JUMP, 0), start)
+}
+
+func (generator *Generator) setJump(offset int, target int) {
+	jump := target - (offset + 4) + 0x8000
+	if jump < 0 || jump > 0xffff {
+		generator.error("Too much code to jump over.")
+		return
+	}
+	code := generator.current.code.Code
+	code[offset+2] = uint8(jump)
+	code[offset+3] = uint8(jump >> 8)
+}
+
+// makeConstant returns the index of val in the constant pool, adding it
+// unless it's there already.
+func (generator *Generator) makeConstant(val value.Value) int {
+	code := generator.current.code
+	index := code.FindConstant(val)
+	if index < 0 {
+		index = code.AddConstant(val)
+	}
+	if index > 0xffff {
+		generator.error("Too many constants in one chunk.")
+		return 0
+	}
+	return index
+}
+
+// alloc reserves the next free register.
+func (generator *Generator) alloc() int {
+	current := generator.current
+	if current.top > 255 {
+		generator.error("Too many registers in one function.")
+		return 0
+	}
+	reg := current.top
+	current.top++
+	if current.top > current.code.Registers {
+		current.code.Registers = current.top
+	}
+	return reg
+}
+
+// free releases the registers from reg on.
+func (generator *Generator) free(reg int) {
+	generator.current.top = reg
+}
+
+// begin starts generating a function called name, or the script when
+// name is empty.
+func (generator *Generator) begin(name string) {
+	code := new(Chunk)
+	fn := value.NewObjFunction(code)
+	if len(name) == 0 {
+		name = "<script>"
+	}
+	fn.Name = value.NewObjString(name)
+	generator.current = &function{enclosing: generator.current, function: fn, code: code}
+	generator.alloc()
+}
+
+func (generator *Generator) end() *value.ObjFunction {
+	reg := generator.alloc()
+	generator.emit(regop.OP_LOADNIL, reg, 0, 0)
+	generator.emit(regop.OP_RETURN, reg, 0, 0)
+
+	fn := generator.current.function
+	if config.DEBUG_PRINT_CODE {
+		Disassemble(generator.current.code, fn.Name.String)
+	}
+
+	generator.current = generator.current.enclosing
+	return fn
+}
+
+func (generator *Generator) isScript() bool {
+	return generator.current.enclosing == nil
+}
+
+func (generator *Generator) beginScope() {
+	generator.current.depth++
+}
+
+// endScope drops the scope's locals, closing the upvalues of those
+// closures captured.
+func (generator *Generator) endScope() {
+	current := generator.current
+	current.depth--
+	close := -1
+	for len(current.locals) > 0 && current.locals[len(current.locals)-1].depth > current.depth {
+		if local := current.locals[len(current.locals)-1]; local.captured {
+			close = local.reg
+		}
+		current.locals = current.locals[:len(current.locals)-1]
+	}
+	if close >= 0 {
+		generator.emit(regop.OP_CLOSE, close, 0, 0)
+	}
+}
+
+// declareLocal makes a new local called name living in the next free
+// register.
+func (generator *Generator) declareLocal(name string) int {
+	reg := generator.alloc()
+	current := generator.current
+	current.locals = append(current.locals, local{name: name, reg: reg, depth: current.depth})
+	return reg
+}
+
+// resolve finds the register of the local called name.
+func (generator *Generator) resolve(name *ast.VariableExpr) (int, bool) {
+	if i := generator.current.findLocal(name.Name.Lexeme); i >= 0 {
+		return generator.current.locals[i].reg, true
+	}
+	return 0, false
+}
+
+func (fn *function) findLocal(name string) int {
+	for i := len(fn.locals) - 1; i >= 0; i-- {
+		if fn.locals[i].name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// resolveUpvalue finds the upvalue of fn for the variable called name,
+// adding it and those of the functions in between if it's a local of an
+// enclosing function. It's -1 for a global.
+func (generator *Generator) resolveUpvalue(fn *function, name string) int {
+	if fn.enclosing == nil {
+		return -1
+	}
+	if i := fn.enclosing.findLocal(name); i >= 0 {
+		fn.enclosing.locals[i].captured = true
+		return generator.addUpvalue(fn, Capture{Index: fn.enclosing.locals[i].reg, Local: true})
+	}
+	if index := generator.resolveUpvalue(fn.enclosing, name); index >= 0 {
+		return generator.addUpvalue(fn, Capture{Index: index})
+	}
+	return -1
+}
+
+func (generator *Generator) addUpvalue(fn *function, capture Capture) int {
+	for i, upvalue := range fn.upvalues {
+		if upvalue == capture {
+			return i
+		}
+	}
+	if len(fn.upvalues) > 255 {
+		generator.error("Too many closure variables in function.")
+		return 0
+	}
+	fn.upvalues = append(fn.upvalues, capture)
+	return len(fn.upvalues) - 1
+}
+
+// nonLocal returns the instructions reading and writing the variable
+// called name when it isn't a local, with their Bx operand: an upvalue's
+// index, or a global's name.
+func (generator *Generator) nonLocal(name string) (uint8, uint8, int) {
+	if index := generator.resolveUpvalue(generator.current, name); index >= 0 {
+		return regop.OP_GETUPVAL, regop.OP_SETUPVAL, index
+	}
+	return regop.OP_GETGLOBAL, regop.OP_SETGLOBAL, generator.makeConstant(value.ValObjString(name))
+}
+
+// sharedNames returns the names used in the functions nested in stmts.
+// Locals called that may be captured, and changed by a call while an
+// expression is evaluated, so operands don't read their registers in
+// place.
+func sharedNames(stmts []ast.Stmt) map[string]bool {
+	names := make(map[string]bool)
+	for _, stmt := range stmts {
+		ast.Inspect(stmt, func(node ast.Node) bool {
+			fn, ok := node.(*ast.FunctionExpr)
+			if !ok {
+				return true
+			}
+			ast.Inspect(fn, func(node ast.Node) bool {
+				if variable, ok := node.(*ast.VariableExpr); ok {
+					names[variable.Name.Lexeme] = true
+				}
+				return true
+			})
+			return false
+		})
+	}
+	return names
+}
+
+func (generator *Generator) isGlobalScope() bool {
+	return generator.isScript() && generator.current.depth == 0
+}
+
+func (generator *Generator) statement(stmt ast.Stmt) {
+	generator.line = stmt.Position().Line
+	top, locals := generator.current.top, len(generator.current.locals)
+
+	switch stmt := stmt.(type) {
+	case *ast.ExprStmt:
+		generator.effect(stmt.Expr)
+	case *ast.PrintStmt:
+		reg := generator.operand(stmt.Expr)
+		generator.at(stmt)
+		generator.emit(regop.OP_PRINT, reg, 0, 0)
+	case *ast.BlockStmt:
+		generator.block(stmt.Stmts)
+	case *ast.IfStmt:
+		generator.ifStatement(stmt)
+	case *ast.WhileStmt:
+		generator.whileStatement(stmt)
+	case *ast.ForStmt:
+		generator.forStatement(stmt)
+	case *ast.ReturnStmt:
+		generator.returnStatement(stmt)
+	case *ast.VarDecl:
+		generator.varDeclaration(stmt)
+	case *ast.FunDecl:
+		generator.funDeclaration(stmt)
+	case *ast.ForInStmt:
+		generator.unsupported(stmt, "A for-in loop")
+	case *ast.MatchStmt:
+		generator.unsupported(stmt, "A match statement")
+	case *ast.ImportDecl, *ast.FromDecl:
+		generator.unsupported(stmt, "An import")
+	}
+
+	// the temporaries are released after each statement, but not the
+	// register of a local it declared
+	if current := generator.current; len(current.locals) > locals {
+		top = current.locals[len(current.locals)-1].reg + 1
+	}
+	generator.free(top)
+}
+
+func (generator *Generator) block(stmts []ast.Stmt) {
+	generator.beginScope()
+	top := generator.current.top
+	for _, stmt := range stmts {
+		generator.statement(stmt)
+	}
+	generator.endScope()
+	generator.free(top)
+}
+
+// condition emits a jump taken when cond is falsy and returns it for
+// patching.
+func (generator *Generator) condition(cond ast.Expr) int {
+	top := generator.current.top
+	reg := generator.operand(cond)
+	generator.at(cond)
+	jump := generator.emitJump(regop.OP_JUMP_UNLESS, reg)
+	generator.free(top)
+	return jump
+}
+
+func (generator *Generator) ifStatement(stmt *ast.IfStmt) {
+	elseJump := generator.condition(stmt.Condition)
+	generator.statement(stmt.Then)
+	if stmt.Else == nil {
+		generator.patchJump(elseJump)
+		return
+	}
+
+	endJump := generator.emitJump(regop.OP_JUMP, 0)
+	generator.patchJump(elseJump)
+	generator.statement(stmt.Else)
+	generator.patchJump(endJump)
+}
+
+func (generator *Generator) whileStatement(stmt *ast.WhileStmt) {
+	start := len(generator.current.code.Code)
+	exitJump := generator.condition(stmt.Condition)
+	generator.statement(stmt.Body)
+	generator.at(stmt)
+	generator.emitLoop(start)
+	generator.patchJump(exitJump)
+}
+
+func (generator *Generator) forStatement(stmt *ast.ForStmt) {
+	generator.beginScope()
+	top := generator.current.top
+	if stmt.Init != nil {
+		generator.statement(stmt.Init)
+	}
+
+	start := len(generator.current.code.Code)
+	exitJump := -1
+	if stmt.Condition != nil {
+		exitJump = generator.condition(stmt.Condition)
+	}
+	generator.statement(stmt.Body)
+	if stmt.Increment != nil {
+		generator.effect(stmt.Increment)
+	}
+	generator.at(stmt)
+	generator.emitLoop(start)
+	if exitJump >= 0 {
+		generator.patchJump(exitJump)
+	}
+
+	generator.endScope()
+	generator.free(top)
+}
+
+func (generator *Generator) returnStatement(stmt *ast.ReturnStmt) {
+	if generator.isScript() {
+		generator.error("Can't return from top-level code.")
+		return
+	}
+
+	switch len(stmt.Values) {
+	case 0:
+		reg := generator.alloc()
+		generator.at(stmt)
+		generator.emit(regop.OP_LOADNIL, reg, 0, 0)
+		generator.emit(regop.OP_RETURN, reg, 0, 0)
+	case 1:
+		reg := generator.operand(stmt.Values[0])
+		generator.at(stmt)
+		generator.emit(regop.OP_RETURN, reg, 0, 0)
+	default:
+		generator.unsupported(stmt, "Returning several values")
+	}
+}
+
+func (generator *Generator) varDeclaration(decl *ast.VarDecl) {
+	switch {
+	case decl.Const:
+		generator.unsupported(decl, "A constant")
+		return
+	case decl.Binding.Pattern != nil:
+		generator.unsupported(decl, "Destructuring")
+		return
+	}
+
+	if generator.isGlobalScope() {
+		reg := generator.alloc()
+		generator.valueOrNil(decl.Init, reg)
+		generator.at(decl)
+		generator.emitBx(regop.OP_DEFGLOBAL, reg, generator.makeConstant(value.ValObjString(decl.Binding.Name.Lexeme)))
+		return
+	}
+
+	// the initializer goes straight into the local's register, which it
+	// can't see yet
+	reg := generator.alloc()
+	generator.valueOrNil(decl.Init, reg)
+	generator.current.locals = append(generator.current.locals,
+		local{name: decl.Binding.Name.Lexeme, reg: reg, depth: generator.current.depth})
+}
+
+func (generator *Generator) valueOrNil(expr ast.Expr, reg int) {
+	if expr == nil {
+		generator.emit(regop.OP_LOADNIL, reg, 0, 0)
+		return
+	}
+	generator.expression(expr, reg)
+}
+
+func (generator *Generator) funDeclaration(decl *ast.FunDecl) {
+	if generator.isGlobalScope() {
+		reg := generator.alloc()
+		generator.function(decl.Function, reg)
+		generator.at(decl)
+		generator.emitBx(regop.OP_DEFGLOBAL, reg, generator.makeConstant(value.ValObjString(decl.Function.Name.Lexeme)))
+		return
+	}
+
+	reg := generator.declareLocal(decl.Function.Name.Lexeme)
+	generator.function(decl.Function, reg)
+}
+
+// function generates fn and emits the instruction loading it into reg.
+func (generator *Generator) function(fn *ast.FunctionExpr, reg int) {
+	name := fn.Name.Lexeme
+	if len(name) == 0 {
+		name = fmt.Sprintf("lambda@%d", fn.Line)
+	}
+	generator.begin(name)
+	generator.beginScope()
+	generator.current.shared = sharedNames(fn.Body)
+
+	function := generator.current.function
+	for _, param := range fn.Params {
+		switch {
+		case param.Rest:
+			generator.unsupported(param, "A rest parameter")
+		case param.Default != nil:
+			generator.unsupported(param, "A default value")
+		case param.Binding.Pattern != nil:
+			generator.unsupported(param, "Destructuring")
+		}
+		generator.declareLocal(param.Binding.Name.Lexeme)
+		function.ParamNames = append(function.ParamNames, param.Binding.Name.Lexeme)
+		function.Arity++
+	}
+	function.RequiredArity = function.Arity
+
+	for _, stmt := range fn.Body {
+		generator.statement(stmt)
+	}
+
+	generator.at(fn)
+	upvalues := generator.current.upvalues
+	generator.current.code.Captures = upvalues
+	function.UpvalueCount = len(upvalues)
+	function = generator.end()
+	if len(upvalues) > 0 {
+		generator.emitBx(regop.OP_CLOSURE, reg, generator.makeConstant(value.ValObjFunction(function)))
+		return
+	}
+	generator.emitBx(regop.OP_FUNCTION, reg, generator.makeConstant(value.ValObjFunction(function)))
+}
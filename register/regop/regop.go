@@ -0,0 +1,48 @@
+// Package regop lists the instructions of the register machine. Every
+// instruction is four bytes: the opcode and the operands A, B and C.
+// Most operands are registers, numbered from the frame's base; Bx is B
+// and C read as one little-endian 16-bit operand and sBx that operand
+// less 0x8000, a signed jump offset from the next instruction.
+package regop
+
+const (
+	OP_MOVE        uint8 = iota // R[A] = R[B]
+	OP_LOADK       uint8 = iota // R[A] = K[Bx]
+	OP_LOADNIL     uint8 = iota // R[A] = nil
+	OP_LOADTRUE    uint8 = iota // R[A] = true
+	OP_LOADFALSE   uint8 = iota // R[A] = false
+	OP_GETGLOBAL   uint8 = iota // R[A] = the global named K[Bx]
+	OP_SETGLOBAL   uint8 = iota // the global named K[Bx] = R[A]
+	OP_DEFGLOBAL   uint8 = iota // define the global named K[Bx] as R[A]
+	OP_ADD         uint8 = iota // R[A] = R[B] + R[C]
+	OP_SUBTRACT    uint8 = iota // R[A] = R[B] - R[C]
+	OP_MULTIPLY    uint8 = iota // R[A] = R[B] * R[C]
+	OP_DIVIDE      uint8 = iota // R[A] = R[B] / R[C]
+	OP_MODULO      uint8 = iota // R[A] = R[B] % R[C]
+	OP_LESS        uint8 = iota // R[A] = R[B] < R[C]
+	OP_GREATER     uint8 = iota // R[A] = R[B] > R[C]
+	OP_EQUAL       uint8 = iota // R[A] = R[B] == R[C]
+	OP_BIT_AND     uint8 = iota // R[A] = R[B] & R[C]
+	OP_BIT_OR      uint8 = iota // R[A] = R[B] | R[C]
+	OP_BIT_XOR     uint8 = iota // R[A] = R[B] ^ R[C]
+	OP_SHIFT_LEFT  uint8 = iota // R[A] = R[B] << R[C]
+	OP_SHIFT_RIGHT uint8 = iota // R[A] = R[B] >> R[C]
+	OP_NOT         uint8 = iota // R[A] = !R[B]
+	OP_NEGATE      uint8 = iota // R[A] = -R[B]
+	OP_BIT_NOT     uint8 = iota // R[A] = ~R[B]
+	OP_JUMP        uint8 = iota // ip += sBx
+	OP_JUMP_IF     uint8 = iota // if R[A] is truthy, ip += sBx
+	OP_JUMP_UNLESS uint8 = iota // if R[A] is falsy, ip += sBx
+	OP_CALL        uint8 = iota // R[A] = R[A](R[A+1], ..., R[A+B])
+	OP_RETURN      uint8 = iota // return R[A]
+	OP_PRINT       uint8 = iota // print R[A]
+	OP_LIST        uint8 = iota // R[A] = [R[B], ..., R[B+C-1]]
+	OP_INDEX       uint8 = iota // R[A] = R[B][R[C]]
+	OP_STORE       uint8 = iota // R[A][R[B]] = R[C]
+	OP_FUNCTION    uint8 = iota // R[A] = the function K[Bx]
+	OP_CLOSURE     uint8 = iota // R[A] = a closure of the function K[Bx]
+	OP_GETUPVAL    uint8 = iota // R[A] = Upvalue[B]
+	OP_SETUPVAL    uint8 = iota // Upvalue[B] = R[A]
+	OP_CLOSE       uint8 = iota // close the upvalues of R[A] and the registers above it
+	OP_YIELD       uint8 = iota // yield R[B], and R[A] = the value sent when resumed
+)
@@ -0,0 +1,466 @@
+package register
+
+import (
+	"fmt"
+	"golox/arith"
+	"golox/builtins"
+	"golox/chunk/opcode"
+	"golox/interp"
+	"golox/register/regop"
+	"golox/value"
+	"golox/value/genstate"
+	"golox/value/objtype"
+	"golox/vm/interpretresult"
+	"time"
+)
+
+const (
+	FRAMES_MAX    int = 128
+	REGISTERS_MAX int = FRAMES_MAX * 256
+)
+
+type VM struct {
+	registers    []value.Value
+	frames       []CallFrame
+	openUpvalues []*value.ObjUpvalue
+	globals      map[string]value.Value
+	builtins     map[string]value.Value
+	aborted      bool // set by a runtime error until the next Interpret
+
+	// Dispatches counts the instructions run, to compare with the stack vm.
+	Dispatches int
+
+	// Elapsed is the time the last program spent in run, once its
+	// register code had been generated.
+	Elapsed time.Duration
+}
+
+// CallFrame is a call running. Its registers start at base, where the
+// caller put the function called and where the result goes. Functions
+// capturing variables run with their closure, and generators with the
+// generator they're resumed from.
+type CallFrame struct {
+	function  *value.ObjFunction
+	closure   *value.ObjClosure
+	generator *value.ObjGenerator
+	ip        int
+	base      int
+}
+
+// upvalues are the upvalues of the frame's closure, if any.
+func (frame *CallFrame) upvalues() []*value.ObjUpvalue {
+	if frame.closure == nil {
+		return nil
+	}
+	return frame.closure.Upvalues
+}
+
+func (frame *CallFrame) chunk() *Chunk {
+	return frame.function.Chunk.(*Chunk)
+}
+
+func (vm *VM) resetStack() {
+	vm.registers = make([]value.Value, REGISTERS_MAX)
+	vm.frames = make([]CallFrame, 0, FRAMES_MAX)
+	vm.openUpvalues = nil
+}
+
+// Init sets up the globals, with the builtins the stack vm has too. Those
+// for generators are intrinsics run by call.
+func (vm *VM) Init() {
+	vm.globals = make(map[string]value.Value)
+	vm.builtins = make(map[string]value.Value)
+	vm.resetStack()
+	for _, native := range interp.Natives {
+		vm.builtins[native.Name] = value.ValNative(native.Function)
+	}
+	vm.builtins["next"] = value.ValIntrinsic("next", intrinsicNext)
+	vm.builtins["send"] = value.ValIntrinsic("send", intrinsicSend)
+	vm.builtins["done"] = value.ValNative(builtins.Done)
+}
+
+// runtimeError reports err with the line each frame is at. A frame's ip
+// is past the four bytes of the instruction it's running, whose line
+// is the one shown.
+func (vm *VM) runtimeError(err string) {
+	fmt.Println(err)
+	vm.aborted = true
+	vm.finishGenerators()
+
+	frames := make([]interp.Frame, 0, len(vm.frames))
+	for i := len(vm.frames) - 1; i >= 0; i-- {
+		frame := &vm.frames[i]
+		frames = append(frames, interp.Frame{Function: frame.function.Name.String, Line: frame.chunk().Lines[frame.ip-4]})
+	}
+	interp.PrintTraceback(frames)
+
+	vm.resetStack()
+}
+
+// errorAt reports a runtime error raised by the instruction of frame just
+// before ip, which run keeps in a local, and stores ip back in the frame
+// for the traceback.
+func (vm *VM) errorAt(frame *CallFrame, ip int, err string) interpretresult.InterpretResult {
+	frame.ip = ip
+	vm.runtimeError(err)
+	return interpretresult.INTERPRET_RUNTIME_ERROR
+}
+
+// top is the first register no frame uses.
+func (vm *VM) top() int {
+	if len(vm.frames) == 0 {
+		return 0
+	}
+	frame := &vm.frames[len(vm.frames)-1]
+	return frame.base + frame.chunk().Registers
+}
+
+// call calls the value in register at with the argCount arguments in the
+// registers after it. A native's result is stored in at straight away, a
+// function's when its frame returns.
+func (vm *VM) call(at int, argCount int) bool {
+	callee := vm.registers[at]
+	if callee.IsObj() {
+		switch callee.AsObj().Type {
+		case objtype.OBJ_FUNCTION:
+			return vm.callFunction(callee.AsObjFunction(), nil, at, argCount)
+		case objtype.OBJ_CLOSURE:
+			closure := callee.AsObjClosure()
+			return vm.callFunction(closure.Function, closure, at, argCount)
+		case objtype.OBJ_INTRINSIC:
+			return vm.callIntrinsic(callee.AsObjIntrinsic().ID, at, argCount)
+		case objtype.OBJ_NATIVE:
+			native := callee.AsNative()
+			result, err := (native)(vm, argCount, vm.registers[at+1:at+1+argCount])
+			if vm.aborted {
+				// a lox function the native called through Call failed
+				return false
+			}
+			if len(err) > 0 {
+				vm.runtimeError(err)
+				return false
+			}
+			vm.registers[at] = result
+			return true
+		}
+	}
+
+	vm.runtimeError("Can only call functions and classes.")
+	return false
+}
+
+// callFunction pushes a frame running function, of closure when it has
+// one, or for a generator function leaves a generator in at.
+func (vm *VM) callFunction(function *value.ObjFunction, closure *value.ObjClosure, at int, argCount int) bool {
+	if argCount != function.Arity {
+		vm.runtimeError(interp.ArityError(function, argCount))
+		return false
+	}
+	registers := function.Chunk.(*Chunk).Registers
+	if len(vm.frames) == FRAMES_MAX || at+registers > REGISTERS_MAX {
+		vm.runtimeError("Stack overflow.")
+		return false
+	}
+
+	if function.IsGenerator {
+		if closure == nil {
+			closure = value.NewObjClosure(function)
+		}
+		saved := make([]value.Value, registers)
+		copy(saved, vm.registers[at:at+argCount+1])
+		vm.registers[at] = value.ValObjGenerator(value.NewObjGenerator(closure, saved))
+		return true
+	}
+
+	vm.frames = append(vm.frames, CallFrame{function: function, closure: closure, base: at})
+	return true
+}
+
+// captureUpvalue returns the open upvalue of register reg, making it if
+// no closure has captured the register yet.
+func (vm *VM) captureUpvalue(reg int) *value.ObjUpvalue {
+	for _, up := range vm.openUpvalues {
+		if up.Slot == reg {
+			return up
+		}
+	}
+
+	upvalue := value.NewObjUpvalue(&vm.registers[reg], reg)
+	vm.openUpvalues = append(vm.openUpvalues, upvalue)
+
+	return upvalue
+}
+
+// closeUpvalues closes every open upvalue for a register at or above
+// last.
+func (vm *VM) closeUpvalues(last int) {
+	open := vm.openUpvalues[:0]
+	for _, up := range vm.openUpvalues {
+		if up.Slot >= last {
+			up.Close()
+		} else {
+			open = append(open, up)
+		}
+	}
+	vm.openUpvalues = open
+}
+
+// closure makes a closure of function, capturing the upvalues its chunk
+// lists from the frame creating it.
+func (vm *VM) closure(frame *CallFrame, function *value.ObjFunction) *value.ObjClosure {
+	closure := value.NewObjClosure(function)
+	for i, capture := range function.Chunk.(*Chunk).Captures {
+		if capture.Local {
+			closure.Upvalues[i] = vm.captureUpvalue(frame.base + capture.Index)
+		} else {
+			closure.Upvalues[i] = frame.closure.Upvalues[capture.Index]
+		}
+	}
+	return closure
+}
+
+// arithmetic applies the instruction op, one of the binary operators
+// other than OP_ADD, OP_LESS and OP_EQUAL, which run has cases of their own.
+func arithmetic(op uint8, a value.Value, b value.Value) (value.Value, string) {
+	switch op {
+	case regop.OP_SUBTRACT:
+		return arith.Binary(opcode.OP_SUBTRACT, a, b)
+	case regop.OP_MULTIPLY:
+		return arith.Binary(opcode.OP_MULTIPLY, a, b)
+	case regop.OP_DIVIDE:
+		return arith.Binary(opcode.OP_DIVIDE, a, b)
+	case regop.OP_MODULO:
+		return arith.Binary(opcode.OP_MODULO, a, b)
+	case regop.OP_GREATER:
+		return arith.Binary(opcode.OP_GREATER, a, b)
+	case regop.OP_BIT_AND:
+		return arith.Bitwise(opcode.OP_BIT_AND, a, b)
+	case regop.OP_BIT_OR:
+		return arith.Bitwise(opcode.OP_BIT_OR, a, b)
+	case regop.OP_BIT_XOR:
+		return arith.Bitwise(opcode.OP_BIT_XOR, a, b)
+	case regop.OP_SHIFT_LEFT:
+		return arith.Bitwise(opcode.OP_SHIFT_LEFT, a, b)
+	}
+	return arith.Bitwise(opcode.OP_SHIFT_RIGHT, a, b)
+}
+
+// run runs instructions until the frame count drops back to base.
+func (vm *VM) run(base int) interpretresult.InterpretResult {
+	frame := &vm.frames[len(vm.frames)-1]
+	code, constants, ip := frame.chunk().Code, frame.chunk().Constants, frame.ip
+	r, upvalues := vm.registers[frame.base:], frame.upvalues()
+
+	for {
+		vm.Dispatches++
+		op, a, b, c := code[ip], code[ip+1], code[ip+2], code[ip+3]
+		ip += 4
+
+		switch op {
+		case regop.OP_MOVE:
+			r[a] = r[b]
+		case regop.OP_LOADK:
+			r[a] = constants[bx(code, ip-4)]
+		case regop.OP_LOADNIL:
+			r[a] = value.ValNil()
+		case regop.OP_LOADTRUE:
+			r[a] = value.ValBool(true)
+		case regop.OP_LOADFALSE:
+			r[a] = value.ValBool(false)
+
+		case regop.OP_GETGLOBAL:
+			name := constants[bx(code, ip-4)].AsGoString()
+			val, ok := vm.globals[name]
+			if !ok {
+				val, ok = vm.builtins[name]
+			}
+			if !ok {
+				return vm.errorAt(frame, ip, interp.UndefinedVariable(name))
+			}
+			r[a] = val
+		case regop.OP_SETGLOBAL:
+			name := constants[bx(code, ip-4)].AsGoString()
+			if _, ok := vm.globals[name]; !ok {
+				return vm.errorAt(frame, ip, interp.UndefinedVariable(name))
+			}
+			vm.globals[name] = r[a]
+		case regop.OP_DEFGLOBAL:
+			name := constants[bx(code, ip-4)].AsGoString()
+			if _, ok := vm.globals[name]; ok {
+				return vm.errorAt(frame, ip, fmt.Sprintf("Variable %s is already defined.", name))
+			}
+			vm.globals[name] = r[a]
+
+		case regop.OP_ADD:
+			x, y := r[b], r[c]
+			if x.IsNumeric() && y.IsNumeric() {
+				r[a] = arith.AddNumbers(x, y)
+				continue
+			}
+			result, err := arith.Add(x, y)
+			if len(err) > 0 {
+				return vm.errorAt(frame, ip, err)
+			}
+			r[a] = result
+		case regop.OP_LESS:
+			x, y := r[b], r[c]
+			if x.IsNumeric() && y.IsNumeric() {
+				r[a] = value.ValBool(arith.LessNumbers(x, y))
+				continue
+			}
+			return vm.errorAt(frame, ip, "Operands must be numbers.")
+		case regop.OP_SUBTRACT, regop.OP_MULTIPLY, regop.OP_DIVIDE, regop.OP_MODULO, regop.OP_GREATER,
+			regop.OP_BIT_AND, regop.OP_BIT_OR, regop.OP_BIT_XOR, regop.OP_SHIFT_LEFT, regop.OP_SHIFT_RIGHT:
+			result, err := arithmetic(op, r[b], r[c])
+			if len(err) > 0 {
+				return vm.errorAt(frame, ip, err)
+			}
+			r[a] = result
+		case regop.OP_EQUAL:
+			r[a] = value.ValBool(value.AreEqual(r[b], r[c]))
+
+		case regop.OP_NOT:
+			r[a] = value.ValBool(!r[b].IsTruey())
+		case regop.OP_NEGATE:
+			result, err := arith.Negate(r[b])
+			if len(err) > 0 {
+				return vm.errorAt(frame, ip, err)
+			}
+			r[a] = result
+		case regop.OP_BIT_NOT:
+			result, err := arith.BitNot(r[b])
+			if len(err) > 0 {
+				return vm.errorAt(frame, ip, err)
+			}
+			r[a] = result
+
+		case regop.OP_JUMP:
+			ip += sbx(code, ip-4)
+		case regop.OP_JUMP_IF:
+			if r[a].IsTruey() {
+				ip += sbx(code, ip-4)
+			}
+		case regop.OP_JUMP_UNLESS:
+			if !r[a].IsTruey() {
+				ip += sbx(code, ip-4)
+			}
+
+		case regop.OP_CALL:
+			frame.ip = ip
+			if !vm.call(frame.base+int(a), int(b)) {
+				return interpretresult.INTERPRET_RUNTIME_ERROR
+			}
+			frame = &vm.frames[len(vm.frames)-1]
+			code, constants, ip = frame.chunk().Code, frame.chunk().Constants, frame.ip
+			r, upvalues = vm.registers[frame.base:], frame.upvalues()
+		case regop.OP_RETURN:
+			vm.closeUpvalues(frame.base)
+			if frame.generator != nil {
+				frame.generator.State = genstate.GEN_DONE
+				frame.generator.Stack = nil
+			}
+			vm.registers[frame.base] = r[a]
+			vm.frames = vm.frames[:len(vm.frames)-1]
+			if len(vm.frames) == base {
+				return interpretresult.INTERPRET_OK
+			}
+			frame = &vm.frames[len(vm.frames)-1]
+			code, constants, ip = frame.chunk().Code, frame.chunk().Constants, frame.ip
+			r, upvalues = vm.registers[frame.base:], frame.upvalues()
+
+		case regop.OP_PRINT:
+			r[a].Print()
+			fmt.Println()
+
+		case regop.OP_LIST:
+			items := make([]value.Value, c)
+			copy(items, r[b:int(b)+int(c)])
+			r[a] = value.ValObjList(items)
+		case regop.OP_INDEX:
+			result, err := arith.Index(r[b], r[c])
+			if len(err) > 0 {
+				return vm.errorAt(frame, ip, err)
+			}
+			r[a] = result
+		case regop.OP_STORE:
+			if err := arith.SetIndex(r[a], r[b], r[c]); len(err) > 0 {
+				return vm.errorAt(frame, ip, err)
+			}
+		case regop.OP_FUNCTION:
+			r[a] = constants[bx(code, ip-4)]
+		case regop.OP_CLOSURE:
+			r[a] = value.ValObjClosure(vm.closure(frame, constants[bx(code, ip-4)].AsObjFunction()))
+		case regop.OP_GETUPVAL:
+			r[a] = *upvalues[b].Location
+		case regop.OP_SETUPVAL:
+			*upvalues[b].Location = r[a]
+		case regop.OP_CLOSE:
+			vm.closeUpvalues(frame.base + int(a))
+		case regop.OP_YIELD:
+			frame.ip = ip
+			vm.yield(frame, r[b])
+			if len(vm.frames) == base {
+				return interpretresult.INTERPRET_OK
+			}
+			frame = &vm.frames[len(vm.frames)-1]
+			code, constants, ip = frame.chunk().Code, frame.chunk().Constants, frame.ip
+			r, upvalues = vm.registers[frame.base:], frame.upvalues()
+		}
+	}
+}
+
+// Call is how natives such as map call back into lox: callee and args
+// are put in the registers above the top frame's and a nested run loop
+// runs until the call returns there. It returns false when a runtime
+// error was reported, which has unwound every loop.
+func (vm *VM) Call(callee value.Value, args ...value.Value) (value.Value, bool) {
+	if vm.aborted {
+		return value.ValNil(), false
+	}
+
+	at := vm.top()
+	if at+len(args)+1 > REGISTERS_MAX {
+		vm.runtimeError("Stack overflow.")
+		return value.ValNil(), false
+	}
+
+	base := len(vm.frames)
+	vm.registers[at] = callee
+	copy(vm.registers[at+1:], args)
+
+	if !vm.call(at, len(args)) {
+		return value.ValNil(), false
+	}
+
+	if len(vm.frames) > base && vm.run(base) != interpretresult.INTERPRET_OK {
+		return value.ValNil(), false
+	}
+
+	return vm.registers[at], true
+}
+
+func (vm *VM) Interpret(source string) interpretresult.InterpretResult {
+	vm.aborted = false
+
+	function := Compile(&source)
+
+	if function == nil {
+		return interpretresult.INTERPRET_COMPILE_ERROR
+	}
+
+	start := time.Now()
+	defer func() { vm.Elapsed = time.Since(start) }()
+
+	vm.registers[0] = value.ValObjFunction(function)
+	if !vm.call(0, 0) {
+		return interpretresult.INTERPRET_RUNTIME_ERROR
+	}
+
+	return vm.run(0)
+}
+
+// InterpretFile runs source. The register machine doesn't support
+// imports, so path isn't needed.
+func (vm *VM) InterpretFile(path string, source string) interpretresult.InterpretResult {
+	return vm.Interpret(source)
+}
@@ -0,0 +1,123 @@
+package register
+
+import (
+	"golox/interp"
+	"golox/value"
+	"golox/value/genstate"
+	"golox/value/objtype"
+)
+
+// The intrinsics, builtins call runs itself as they push frames.
+const (
+	intrinsicNext int = iota
+	intrinsicSend int = iota
+)
+
+// callIntrinsic runs next(generator) or send(generator, value) called
+// from register at.
+func (vm *VM) callIntrinsic(id int, at int, argCount int) bool {
+	arity := 1
+	if id == intrinsicSend {
+		arity = 2
+	}
+	if argCount != arity {
+		vm.runtimeError(interp.ArityError(&value.ObjFunction{Arity: arity, RequiredArity: arity}, argCount))
+		return false
+	}
+
+	sent := value.ValNil()
+	if id == intrinsicSend {
+		sent = vm.registers[at+2]
+	}
+	return vm.resume(vm.registers[at+1], sent, at)
+}
+
+// resume pushes a frame continuing generator from register at, with its
+// saved registers and the upvalues still open on them moved back. The
+// yield it's paused at gets sent. What it yields or returns next ends up
+// in at.
+func (vm *VM) resume(callee value.Value, sent value.Value, at int) bool {
+	if !callee.IsOBjType(objtype.OBJ_GENERATOR) {
+		vm.runtimeError("Can only resume generators.")
+		return false
+	}
+
+	generator := callee.AsObjGenerator()
+	switch generator.State {
+	case genstate.GEN_RUNNING:
+		vm.runtimeError("Generator is already running.")
+		return false
+	case genstate.GEN_DONE:
+		vm.runtimeError("Generator is already done.")
+		return false
+	}
+
+	if len(vm.frames) == FRAMES_MAX || at+len(generator.Stack) > REGISTERS_MAX {
+		vm.runtimeError("Stack overflow.")
+		return false
+	}
+
+	copy(vm.registers[at:], generator.Stack)
+	for _, upvalue := range generator.Upvalues {
+		upvalue.Slot += at
+		upvalue.Location = &vm.registers[upvalue.Slot]
+		vm.openUpvalues = append(vm.openUpvalues, upvalue)
+	}
+	generator.Upvalues = nil
+
+	function := generator.Closure.Function
+	if generator.State == genstate.GEN_SUSPENDED {
+		// the A of the OP_YIELD just run
+		dest := function.Chunk.(*Chunk).Code[generator.IP-3]
+		vm.registers[at+int(dest)] = sent
+	}
+
+	frame := CallFrame{
+		function:  function,
+		closure:   generator.Closure,
+		generator: generator,
+		ip:        generator.IP,
+		base:      at,
+	}
+	vm.frames = append(vm.frames, frame)
+	generator.State = genstate.GEN_RUNNING
+
+	return true
+}
+
+// yield suspends the generator running in frame, the top one, saving its
+// registers in the generator and moving the upvalues open on them along,
+// and returns result to whoever resumed it.
+func (vm *VM) yield(frame *CallFrame, result value.Value) {
+	generator := frame.generator
+	copy(generator.Stack, vm.registers[frame.base:])
+
+	open := vm.openUpvalues[:0]
+	for _, upvalue := range vm.openUpvalues {
+		if upvalue.Slot >= frame.base {
+			upvalue.Slot -= frame.base
+			upvalue.Location = &generator.Stack[upvalue.Slot]
+			generator.Upvalues = append(generator.Upvalues, upvalue)
+		} else {
+			open = append(open, upvalue)
+		}
+	}
+	vm.openUpvalues = open
+
+	generator.IP = frame.ip
+	generator.State = genstate.GEN_SUSPENDED
+
+	vm.registers[frame.base] = result
+	vm.frames = vm.frames[:len(vm.frames)-1]
+}
+
+// finishGenerators marks the generators running in the active frames as
+// done, so a runtime error inside one doesn't leave it resumable.
+func (vm *VM) finishGenerators() {
+	for _, frame := range vm.frames {
+		if frame.generator != nil {
+			frame.generator.State = genstate.GEN_DONE
+			frame.generator.Stack = nil
+		}
+	}
+}
@@ -27,6 +27,14 @@ func isDigit(c rune) bool {
 	return c >= '0' && c <= '9'
 }
 
+func isHexDigit(c rune) bool {
+	return isDigit(c) || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
+func isBinaryDigit(c rune) bool {
+	return c == '0' || c == '1'
+}
+
 func isAlpha(c rune) bool {
 	return (c >= 'a' && c <= 'z') ||
 		(c >= 'A' && c <= 'Z') ||
@@ -126,6 +134,20 @@ func (scanner *Scanner) identifierType() tokentype.TokenType {
 		return tokentype.TOKEN_TRUE
 	case "while":
 		return tokentype.TOKEN_WHILE
+	case "import":
+		return tokentype.TOKEN_IMPORT
+	case "from":
+		return tokentype.TOKEN_FROM
+	case "as":
+		return tokentype.TOKEN_AS
+	case "yield":
+		return tokentype.TOKEN_YIELD
+	case "in":
+		return tokentype.TOKEN_IN
+	case "const":
+		return tokentype.TOKEN_CONST
+	case "match":
+		return tokentype.TOKEN_MATCH
 	}
 
 	return tokentype.TOKEN_IDENTIFIER
@@ -139,6 +161,28 @@ func (scanner *Scanner) identifier() token.Token {
 }
 
 func (scanner *Scanner) number() token.Token {
+	// 0x and 0b prefixed literals are always integers
+	if (*scanner.source)[scanner.start] == '0' && scanner.current == scanner.start+1 {
+		switch scanner.currChar() {
+		case 'x', 'X':
+			if isHexDigit(scanner.nextChar()) {
+				scanner.advance()
+				for isHexDigit(scanner.currChar()) {
+					scanner.advance()
+				}
+				return scanner.makeToken(tokentype.TOKEN_INTEGER)
+			}
+		case 'b', 'B':
+			if isBinaryDigit(scanner.nextChar()) {
+				scanner.advance()
+				for isBinaryDigit(scanner.currChar()) {
+					scanner.advance()
+				}
+				return scanner.makeToken(tokentype.TOKEN_INTEGER)
+			}
+		}
+	}
+
 	for isDigit(scanner.currChar()) {
 		scanner.advance()
 	}
@@ -149,9 +193,11 @@ func (scanner *Scanner) number() token.Token {
 		for isDigit(scanner.currChar()) {
 			scanner.advance()
 		}
+
+		return scanner.makeToken(tokentype.TOKEN_NUMBER)
 	}
 
-	return scanner.makeToken(tokentype.TOKEN_NUMBER)
+	return scanner.makeToken(tokentype.TOKEN_INTEGER)
 }
 
 func (scanner *Scanner) string() token.Token {
@@ -205,23 +251,65 @@ func (scanner *Scanner) Scan(tokens chan token.Token) {
 		case ',':
 			token = scanner.makeToken(tokentype.TOKEN_COMMA)
 		case '.':
-			token = scanner.makeToken(tokentype.TOKEN_DOT)
+			if scanner.currChar() == '.' && scanner.nextChar() == '.' {
+				scanner.advance()
+				scanner.advance()
+				token = scanner.makeToken(tokentype.TOKEN_ELLIPSIS)
+			} else {
+				token = scanner.makeToken(tokentype.TOKEN_DOT)
+			}
+		case ':':
+			token = scanner.makeToken(tokentype.TOKEN_COLON)
+		case '?':
+			if scanner.match('?') {
+				token = scanner.makeToken(tokentype.TOKEN_QUESTION_QUESTION)
+			} else if scanner.match('.') {
+				token = scanner.makeToken(tokentype.TOKEN_QUESTION_DOT)
+			} else {
+				token = scanner.makeToken(tokentype.TOKEN_QUESTION)
+			}
 		case '-':
 			if scanner.match('-') {
 				token = scanner.makeToken(tokentype.TOKEN_MINUS_MINUS)
+			} else if scanner.match('=') {
+				token = scanner.makeToken(tokentype.TOKEN_MINUS_EQUAL)
 			} else {
 				token = scanner.makeToken(tokentype.TOKEN_MINUS)
 			}
 		case '+':
 			if scanner.match('+') {
 				token = scanner.makeToken(tokentype.TOKEN_PLUS_PLUS)
+			} else if scanner.match('=') {
+				token = scanner.makeToken(tokentype.TOKEN_PLUS_EQUAL)
 			} else {
 				token = scanner.makeToken(tokentype.TOKEN_PLUS)
 			}
 		case '/':
-			token = scanner.makeToken(tokentype.TOKEN_SLASH)
+			if scanner.match('=') {
+				token = scanner.makeToken(tokentype.TOKEN_SLASH_EQUAL)
+			} else {
+				token = scanner.makeToken(tokentype.TOKEN_SLASH)
+			}
 		case '*':
-			token = scanner.makeToken(tokentype.TOKEN_STAR)
+			if scanner.match('=') {
+				token = scanner.makeToken(tokentype.TOKEN_STAR_EQUAL)
+			} else {
+				token = scanner.makeToken(tokentype.TOKEN_STAR)
+			}
+		case '%':
+			if scanner.match('=') {
+				token = scanner.makeToken(tokentype.TOKEN_PERCENT_EQUAL)
+			} else {
+				token = scanner.makeToken(tokentype.TOKEN_PERCENT)
+			}
+		case '&':
+			token = scanner.makeToken(tokentype.TOKEN_AMPERSAND)
+		case '|':
+			token = scanner.makeToken(tokentype.TOKEN_PIPE)
+		case '^':
+			token = scanner.makeToken(tokentype.TOKEN_CARET)
+		case '~':
+			token = scanner.makeToken(tokentype.TOKEN_TILDE)
 		case '!':
 			if scanner.match('=') {
 				token = scanner.makeToken(tokentype.TOKEN_BANG_EQUAL)
@@ -231,18 +319,24 @@ func (scanner *Scanner) Scan(tokens chan token.Token) {
 		case '=':
 			if scanner.match('=') {
 				token = scanner.makeToken(tokentype.TOKEN_EQUAL_EQUAL)
+			} else if scanner.match('>') {
+				token = scanner.makeToken(tokentype.TOKEN_ARROW)
 			} else {
 				token = scanner.makeToken(tokentype.TOKEN_EQUAL)
 			}
 		case '<':
 			if scanner.match('=') {
 				token = scanner.makeToken(tokentype.TOKEN_LESS_EQUAL)
+			} else if scanner.match('<') {
+				token = scanner.makeToken(tokentype.TOKEN_LESS_LESS)
 			} else {
 				token = scanner.makeToken(tokentype.TOKEN_LESS)
 			}
 		case '>':
 			if scanner.match('=') {
 				token = scanner.makeToken(tokentype.TOKEN_GREATER_EQUAL)
+			} else if scanner.match('>') {
+				token = scanner.makeToken(tokentype.TOKEN_GREATER_GREATER)
 			} else {
 				token = scanner.makeToken(tokentype.TOKEN_GREATER)
 			}
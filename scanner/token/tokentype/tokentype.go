@@ -15,25 +15,44 @@ const (
 	TOKEN_SEMICOLON     TokenType = iota
 	TOKEN_SLASH         TokenType = iota
 	TOKEN_STAR          TokenType = iota
+	TOKEN_AMPERSAND     TokenType = iota
+	TOKEN_PIPE          TokenType = iota
+	TOKEN_CARET         TokenType = iota
+	TOKEN_TILDE         TokenType = iota
+	TOKEN_PERCENT       TokenType = iota
+	TOKEN_COLON         TokenType = iota
+	TOKEN_QUESTION      TokenType = iota
 
 	// One or two character tokens.
-	TOKEN_MINUS         TokenType = iota
-	TOKEN_MINUS_MINUS   TokenType = iota
-	TOKEN_PLUS          TokenType = iota
-	TOKEN_PLUS_PLUS     TokenType = iota
-	TOKEN_BANG          TokenType = iota
-	TOKEN_BANG_EQUAL    TokenType = iota
-	TOKEN_EQUAL         TokenType = iota
-	TOKEN_EQUAL_EQUAL   TokenType = iota
-	TOKEN_GREATER       TokenType = iota
-	TOKEN_GREATER_EQUAL TokenType = iota
-	TOKEN_LESS          TokenType = iota
-	TOKEN_LESS_EQUAL    TokenType = iota
+	TOKEN_MINUS             TokenType = iota
+	TOKEN_MINUS_MINUS       TokenType = iota
+	TOKEN_PLUS              TokenType = iota
+	TOKEN_PLUS_PLUS         TokenType = iota
+	TOKEN_MINUS_EQUAL       TokenType = iota
+	TOKEN_PLUS_EQUAL        TokenType = iota
+	TOKEN_STAR_EQUAL        TokenType = iota
+	TOKEN_SLASH_EQUAL       TokenType = iota
+	TOKEN_PERCENT_EQUAL     TokenType = iota
+	TOKEN_ARROW             TokenType = iota
+	TOKEN_ELLIPSIS          TokenType = iota
+	TOKEN_QUESTION_QUESTION TokenType = iota
+	TOKEN_QUESTION_DOT      TokenType = iota
+	TOKEN_BANG              TokenType = iota
+	TOKEN_BANG_EQUAL        TokenType = iota
+	TOKEN_EQUAL             TokenType = iota
+	TOKEN_EQUAL_EQUAL       TokenType = iota
+	TOKEN_GREATER           TokenType = iota
+	TOKEN_GREATER_EQUAL     TokenType = iota
+	TOKEN_LESS              TokenType = iota
+	TOKEN_LESS_EQUAL        TokenType = iota
+	TOKEN_LESS_LESS         TokenType = iota
+	TOKEN_GREATER_GREATER   TokenType = iota
 
 	// Literals.
 	TOKEN_IDENTIFIER TokenType = iota
 	TOKEN_STRING     TokenType = iota
 	TOKEN_NUMBER     TokenType = iota
+	TOKEN_INTEGER    TokenType = iota
 
 	// Keywords.
 	TOKEN_AND    TokenType = iota
@@ -50,6 +69,13 @@ const (
 	TOKEN_TRUE   TokenType = iota
 	TOKEN_VAR    TokenType = iota
 	TOKEN_WHILE  TokenType = iota
+	TOKEN_IMPORT TokenType = iota
+	TOKEN_FROM   TokenType = iota
+	TOKEN_AS     TokenType = iota
+	TOKEN_YIELD  TokenType = iota
+	TOKEN_IN     TokenType = iota
+	TOKEN_CONST  TokenType = iota
+	TOKEN_MATCH  TokenType = iota
 
 	TOKEN_ERROR TokenType = iota
 	TOKEN_EOF   TokenType = iota
@@ -0,0 +1,10 @@
+package genstate
+
+type GenState uint8
+
+const (
+	GEN_CREATED   GenState = iota // called but never resumed
+	GEN_SUSPENDED GenState = iota // paused at a yield
+	GEN_RUNNING   GenState = iota
+	GEN_DONE      GenState = iota
+)
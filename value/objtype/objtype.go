@@ -3,11 +3,17 @@ package objtype
 type ObjType uint8
 
 const (
-	OBJ_STRING   ObjType = iota
-	OBJ_LIST     ObjType = iota
-	OBJ_NATIVE   ObjType = iota
-	OBJ_FUNCTION ObjType = iota
-	OBJ_CLOSURE  ObjType = iota
-	OBJ_UPVALUE  ObjType = iota
-	OBJ_CLASS    ObjType = iota
+	OBJ_STRING    ObjType = iota
+	OBJ_LIST      ObjType = iota
+	OBJ_NATIVE    ObjType = iota
+	OBJ_FUNCTION  ObjType = iota
+	OBJ_CLOSURE   ObjType = iota
+	OBJ_UPVALUE   ObjType = iota
+	OBJ_CLASS     ObjType = iota
+	OBJ_MODULE    ObjType = iota
+	OBJ_GENERATOR ObjType = iota
+	OBJ_INTRINSIC ObjType = iota
+	OBJ_MAP       ObjType = iota
+	OBJ_RANGE     ObjType = iota
+	OBJ_ITERATOR  ObjType = iota
 )
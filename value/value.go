@@ -2,8 +2,10 @@ package value
 
 import (
 	"fmt"
+	"golox/value/genstate"
 	"golox/value/objtype"
 	"golox/value/valuetype"
+	"math"
 	"strconv"
 	"unsafe"
 )
@@ -22,6 +24,54 @@ type ObjList struct {
 	List []Value
 }
 
+// ObjMap is a hash map that remembers the order keys were added in, which
+// is the order it's iterated in.
+type ObjMap struct {
+	Obj
+	Entries map[MapKey]Value
+	Keys    []Value
+}
+
+// MapKey is the comparable form of a value used to key an ObjMap, see
+// Value.Key.
+type MapKey struct {
+	Type valuetype.ValueType
+	Data interface{}
+}
+
+// ObjRange is the sequence of ints from Start up to, but not including,
+// End in steps of Step.
+type ObjRange struct {
+	Obj
+	Start int64
+	End   int64
+	Step  int64
+}
+
+// Len is the number of ints in the range, worked out in uint64s so that
+// it's right however far apart Start and End are.
+func (objRange *ObjRange) Len() uint64 {
+	var span, step uint64
+	switch {
+	case objRange.Step > 0 && objRange.Start < objRange.End:
+		span, step = uint64(objRange.End)-uint64(objRange.Start), uint64(objRange.Step)
+	case objRange.Step < 0 && objRange.Start > objRange.End:
+		span, step = uint64(objRange.Start)-uint64(objRange.End), -uint64(objRange.Step)
+	default:
+		return 0
+	}
+	return (span-1)/step + 1
+}
+
+// ObjIterator is the state of a for-in loop over Iterable. Index is the
+// position in the iterable, Count the number of values produced so far.
+type ObjIterator struct {
+	Obj
+	Iterable Value
+	Index    int
+	Count    int
+}
+
 type ObjString struct {
 	Obj
 	String string
@@ -34,25 +84,68 @@ type FuncChunk interface {
 
 type ObjFunction struct {
 	Obj
-	Arity        int
-	UpvalueCount int
-	Chunk        FuncChunk
-	Name         *ObjString // TODO: why not just `string`?
+	Arity         int      // named parameters, not counting a rest parameter
+	RequiredArity int      // leading parameters that have no default value
+	Variadic      bool     // whether a rest parameter follows the named ones
+	ParamNames    []string // names of the named parameters, for keyword arguments
+	IsGenerator   bool     // whether the body yields, making calls return a generator
+	UpvalueCount  int
+	Chunk         FuncChunk
+	Name          *ObjString // TODO: why not just `string`?
 }
 
 type ObjClosure struct {
 	Obj
 	Function *ObjFunction
 	Upvalues []*ObjUpvalue
+	Module   *ObjModule // the module whose globals the closure sees
+}
+
+type ObjModule struct {
+	Obj
+	Name    string
+	Path    string
+	Globals map[string]Value
+	Consts  map[string]bool // globals declared with const
+	Loaded  bool            // false while the module body is still running
 }
 
 type ObjUpvalue struct {
 	Obj
 	Closed   Value
-	Location *Value
+	Location *Value // points into the VM stack while open, at Closed once closed
+	Slot     int    // stack index of the variable while open
 }
 
-type NativeFn func(argCount int, args []Value) (Value, string)
+// ObjGenerator holds a suspended call of a generator function: the
+// frame's stack slice and where to resume in its code.
+type ObjGenerator struct {
+	Obj
+	Closure  *ObjClosure
+	Stack    []Value       // the frame's slots and temporaries while not running
+	IP       int           // offset of the instruction to resume at
+	Upvalues []*ObjUpvalue // upvalues still open on Stack, Slot relative to it
+	State    genstate.GenState
+}
+
+// Caller is the VM as natives see it, letting them call back into Lox.
+// Call runs callee with args to completion and returns its result. It
+// returns false after a runtime error, which has already been reported;
+// the native should then return straight away.
+type Caller interface {
+	Call(callee Value, args ...Value) (Value, bool)
+}
+
+type NativeFn func(vm Caller, argCount int, args []Value) (Value, string)
+
+// ObjIntrinsic is a builtin implemented by the VM itself, because it needs
+// more than its arguments, for instance to resume a generator in a new
+// frame. ID indexes the VM's table of intrinsics.
+type ObjIntrinsic struct {
+	Obj
+	Name string
+	ID   int
+}
 
 type ObjNative struct {
 	Obj
@@ -67,10 +160,18 @@ func ValNumber(val float64) Value {
 	return Value{valuetype.VAL_NUMBER, val}
 }
 
+func ValInt(val int64) Value {
+	return Value{valuetype.VAL_INT, val}
+}
+
 func ValNil() Value {
 	return Value{valuetype.VAL_NIL, nil}
 }
 
+func ValUndefined() Value {
+	return Value{valuetype.VAL_UNDEFINED, nil}
+}
+
 func ValObjFunction(function *ObjFunction) Value {
 	return Value{Type: valuetype.VAL_OBJ, Data: (*Obj)(unsafe.Pointer(function))}
 }
@@ -79,6 +180,10 @@ func ValObjClosure(closure *ObjClosure) Value {
 	return Value{Type: valuetype.VAL_OBJ, Data: (*Obj)(unsafe.Pointer(closure))}
 }
 
+func ValObjModule(module *ObjModule) Value {
+	return Value{Type: valuetype.VAL_OBJ, Data: (*Obj)(unsafe.Pointer(module))}
+}
+
 func ValObjList(list []Value) Value {
 	objList := NewObjList(list)
 	return Value{Type: valuetype.VAL_OBJ, Data: (*Obj)(unsafe.Pointer(objList))}
@@ -96,6 +201,32 @@ func ValNative(function NativeFn) Value {
 	return Value{Type: valuetype.VAL_OBJ, Data: (*Obj)(unsafe.Pointer(nativeFunc))}
 }
 
+func ValObjMap(objMap *ObjMap) Value {
+	return Value{Type: valuetype.VAL_OBJ, Data: (*Obj)(unsafe.Pointer(objMap))}
+}
+
+func ValObjRange(start int64, end int64, step int64) Value {
+	objRange := ObjRange{Obj: Obj{Type: objtype.OBJ_RANGE}, Start: start, End: end, Step: step}
+	return Value{Type: valuetype.VAL_OBJ, Data: (*Obj)(unsafe.Pointer(&objRange))}
+}
+
+func ValObjIterator(iterable Value) Value {
+	iterator := ObjIterator{Obj: Obj{Type: objtype.OBJ_ITERATOR}, Iterable: iterable}
+	return Value{Type: valuetype.VAL_OBJ, Data: (*Obj)(unsafe.Pointer(&iterator))}
+}
+
+func ValObjGenerator(generator *ObjGenerator) Value {
+	return Value{Type: valuetype.VAL_OBJ, Data: (*Obj)(unsafe.Pointer(generator))}
+}
+
+func ValIntrinsic(name string, id int) Value {
+	intrinsic := new(ObjIntrinsic)
+	intrinsic.Name = name
+	intrinsic.ID = id
+	intrinsic.Obj.Type = objtype.OBJ_INTRINSIC
+	return Value{Type: valuetype.VAL_OBJ, Data: (*Obj)(unsafe.Pointer(intrinsic))}
+}
+
 func NewObjList(list []Value) *ObjList {
 	objList := new(ObjList)
 	objList.List = list
@@ -103,6 +234,28 @@ func NewObjList(list []Value) *ObjList {
 	return objList
 }
 
+func NewObjMap() *ObjMap {
+	objMap := new(ObjMap)
+	objMap.Entries = make(map[MapKey]Value)
+	objMap.Obj.Type = objtype.OBJ_MAP
+	return objMap
+}
+
+// Get returns the value stored under key.
+func (objMap *ObjMap) Get(key Value) (Value, bool) {
+	val, ok := objMap.Entries[key.Key()]
+	return val, ok
+}
+
+// Set stores val under key, adding key at the end if it's new.
+func (objMap *ObjMap) Set(key Value, val Value) {
+	mapKey := key.Key()
+	if _, ok := objMap.Entries[mapKey]; !ok {
+		objMap.Keys = append(objMap.Keys, key)
+	}
+	objMap.Entries[mapKey] = val
+}
+
 func NewObjString(val string) *ObjString {
 	objStr := ObjString{Obj: Obj{Type: objtype.OBJ_STRING}, String: val}
 	return &objStr
@@ -123,13 +276,39 @@ func NewObjClosure(function *ObjFunction) *ObjClosure {
 	return objClosure
 }
 
-func NewObjUpvalue(slot *Value) *ObjUpvalue {
+func NewObjModule(name string, path string) *ObjModule {
+	module := new(ObjModule)
+	module.Name = name
+	module.Path = path
+	module.Globals = make(map[string]Value)
+	module.Consts = make(map[string]bool)
+	module.Type = objtype.OBJ_MODULE
+	return module
+}
+
+func NewObjGenerator(closure *ObjClosure, stack []Value) *ObjGenerator {
+	generator := new(ObjGenerator)
+	generator.Closure = closure
+	generator.Stack = stack
+	generator.State = genstate.GEN_CREATED
+	generator.Type = objtype.OBJ_GENERATOR
+	return generator
+}
+
+func NewObjUpvalue(location *Value, slot int) *ObjUpvalue {
 	upvalue := new(ObjUpvalue)
-	upvalue.Closed = *slot
-	upvalue.Location = &upvalue.Closed
+	upvalue.Type = objtype.OBJ_UPVALUE
+	upvalue.Location = location
+	upvalue.Slot = slot
 	return upvalue
 }
 
+// Close moves the captured variable off the stack into the upvalue.
+func (upvalue *ObjUpvalue) Close() {
+	upvalue.Closed = *upvalue.Location
+	upvalue.Location = &upvalue.Closed
+}
+
 func (value Value) AsBool() bool {
 	return value.Data.(bool)
 }
@@ -138,6 +317,18 @@ func (value Value) AsNumber() float64 {
 	return value.Data.(float64)
 }
 
+func (value Value) AsInt() int64 {
+	return value.Data.(int64)
+}
+
+// AsFloat returns the value of an int or a number as a float64
+func (value Value) AsFloat() float64 {
+	if value.Type == valuetype.VAL_INT {
+		return float64(value.AsInt())
+	}
+	return value.AsNumber()
+}
+
 func (value Value) AsObj() *Obj {
 	return value.Data.(*Obj)
 }
@@ -162,6 +353,30 @@ func (value Value) AsObjClosure() *ObjClosure {
 	return (*ObjClosure)(unsafe.Pointer(value.AsObj()))
 }
 
+func (value Value) AsObjModule() *ObjModule {
+	return (*ObjModule)(unsafe.Pointer(value.AsObj()))
+}
+
+func (value Value) AsObjMap() *ObjMap {
+	return (*ObjMap)(unsafe.Pointer(value.AsObj()))
+}
+
+func (value Value) AsObjRange() *ObjRange {
+	return (*ObjRange)(unsafe.Pointer(value.AsObj()))
+}
+
+func (value Value) AsObjIterator() *ObjIterator {
+	return (*ObjIterator)(unsafe.Pointer(value.AsObj()))
+}
+
+func (value Value) AsObjGenerator() *ObjGenerator {
+	return (*ObjGenerator)(unsafe.Pointer(value.AsObj()))
+}
+
+func (value Value) AsObjIntrinsic() *ObjIntrinsic {
+	return (*ObjIntrinsic)(unsafe.Pointer(value.AsObj()))
+}
+
 func (value Value) AsNative() NativeFn {
 	return (*ObjNative)(unsafe.Pointer(value.AsObj())).Function
 }
@@ -174,6 +389,19 @@ func (value Value) IsNumber() bool {
 	return value.Type == valuetype.VAL_NUMBER
 }
 
+func (value Value) IsInt() bool {
+	return value.Type == valuetype.VAL_INT
+}
+
+// IsNumeric reports whether the value is either an int or a number
+func (value Value) IsNumeric() bool {
+	return value.IsNumber() || value.IsInt()
+}
+
+func (value Value) IsUndefined() bool {
+	return value.Type == valuetype.VAL_UNDEFINED
+}
+
 func (value Value) IsObj() bool {
 	return value.Type == valuetype.VAL_OBJ
 }
@@ -200,11 +428,84 @@ func (value Value) IsTruey() bool {
 		if value.AsNumber() == 0 {
 			return false
 		}
+	case valuetype.VAL_INT:
+		if value.AsInt() == 0 {
+			return false
+		}
 	}
 	return true
 }
 
+// CompareNumbers compares two ints or numbers exactly, giving -1, 0 or 1
+// as a is less than, equal to or greater than b. It's false when either
+// is NaN, which compares to nothing.
+func CompareNumbers(a Value, b Value) (int, bool) {
+	switch {
+	case a.IsInt() && b.IsInt():
+		return compareInts(a.AsInt(), b.AsInt()), true
+	case a.IsInt():
+		c, ok := compareIntFloat(a.AsInt(), b.AsNumber())
+		return c, ok
+	case b.IsInt():
+		c, ok := compareIntFloat(b.AsInt(), a.AsNumber())
+		return -c, ok
+	}
+
+	x, y := a.AsNumber(), b.AsNumber()
+	switch {
+	case x < y:
+		return -1, true
+	case x > y:
+		return 1, true
+	case x == y:
+		return 0, true
+	}
+	return 0, false
+}
+
+// compareIntFloat compares i and f without turning i into a float, which
+// would round ints past 2^53.
+func compareIntFloat(i int64, f float64) (int, bool) {
+	switch {
+	case math.IsNaN(f):
+		return 0, false
+	case f >= math.MaxInt64: // 2^63 as a float
+		return -1, true
+	case f < math.MinInt64:
+		return 1, true
+	}
+
+	// the whole part fits in an int, and only the fraction is left when
+	// it's equal to i
+	whole := math.Trunc(f)
+	if c := compareInts(i, int64(whole)); c != 0 {
+		return c, true
+	}
+	switch {
+	case f > whole:
+		return -1, true
+	case f < whole:
+		return 1, true
+	}
+	return 0, true
+}
+
+func compareInts(a int64, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
 func AreEqual(a Value, b Value) bool {
+	if a.IsNumeric() && b.IsNumeric() {
+		c, ok := CompareNumbers(a, b)
+		return ok && c == 0
+	}
+
 	if a.Type != b.Type {
 		return false
 	}
@@ -220,11 +521,31 @@ func AreEqual(a Value, b Value) bool {
 	case valuetype.VAL_NUMBER:
 		return a.AsNumber() == b.AsNumber()
 	case valuetype.VAL_OBJ:
-		return a.AsGoString() == b.AsGoString()
+		if a.IsString() && b.IsString() {
+			return a.AsGoString() == b.AsGoString()
+		}
+		return a.AsObj() == b.AsObj()
 	}
 	return false
 }
 
+// Key returns what the value is stored under in a map. Strings are keyed
+// by content and numbers by value, so 1 and 1.0 are the same key; other
+// objects are keyed by identity. NaN isn't equal to itself, so all NaNs
+// share a key for the map to find them again.
+func (value Value) Key() MapKey {
+	switch {
+	case value.IsString():
+		return MapKey{valuetype.VAL_OBJ, value.AsGoString()}
+	case value.IsNumber() && math.IsNaN(value.AsNumber()):
+		return MapKey{valuetype.VAL_NUMBER, "NaN"}
+	case value.IsNumber() && value.AsNumber() == math.Trunc(value.AsNumber()) &&
+		value.AsNumber() >= math.MinInt64 && value.AsNumber() < math.MaxInt64:
+		return MapKey{valuetype.VAL_INT, int64(value.AsNumber())}
+	}
+	return MapKey{value.Type, value.Data}
+}
+
 func (value Value) Stringify() string {
 	switch value.Type {
 	case valuetype.VAL_NIL:
@@ -233,6 +554,8 @@ func (value Value) Stringify() string {
 		return fmt.Sprint(value.AsBool())
 	case valuetype.VAL_NUMBER:
 		return strconv.FormatFloat(value.AsNumber(), 'f', -1, 64)
+	case valuetype.VAL_INT:
+		return strconv.FormatInt(value.AsInt(), 10)
 	case valuetype.VAL_OBJ:
 		switch value.AsObj().Type {
 		case objtype.OBJ_STRING:
@@ -244,12 +567,32 @@ func (value Value) Stringify() string {
 			}
 			result += "]"
 			return result
+		case objtype.OBJ_MAP:
+			objMap := value.AsObjMap()
+			result := "{ "
+			for _, key := range objMap.Keys {
+				val, _ := objMap.Get(key)
+				result = result + key.Stringify() + ": " + val.Stringify() + ", "
+			}
+			result += "}"
+			return result
+		case objtype.OBJ_RANGE:
+			objRange := value.AsObjRange()
+			return fmt.Sprintf("range(%d, %d, %d)", objRange.Start, objRange.End, objRange.Step)
+		case objtype.OBJ_ITERATOR:
+			return "<iterator>"
 		case objtype.OBJ_FUNCTION:
 			return fmt.Sprintf("<fn %s>", value.AsObjFunction().Name.String)
 		case objtype.OBJ_CLOSURE:
 			return fmt.Sprintf("<fn %s>", value.AsObjClosure().Function.Name.String)
 		case objtype.OBJ_NATIVE:
 			return "<native fn>"
+		case objtype.OBJ_MODULE:
+			return fmt.Sprintf("<module %s>", value.AsObjModule().Name)
+		case objtype.OBJ_GENERATOR:
+			return fmt.Sprintf("<generator %s>", value.AsObjGenerator().Closure.Function.Name.String)
+		case objtype.OBJ_INTRINSIC:
+			return "<native fn>"
 		}
 	}
 	return "<undefined>"
@@ -0,0 +1,68 @@
+package value
+
+import (
+	"math"
+	"testing"
+)
+
+func TestNaNKey(t *testing.T) {
+	m := NewObjMap()
+	m.Set(ValNumber(math.NaN()), ValInt(1))
+	m.Set(ValNumber(-math.NaN()), ValInt(2))
+	m.Set(ValNumber(math.Float64frombits(0x7ff8000000000001)), ValInt(3))
+
+	if len(m.Keys) != 1 {
+		t.Fatalf("got %d keys, want 1", len(m.Keys))
+	}
+	if got, ok := m.Get(ValNumber(math.NaN())); !ok || got != ValInt(3) {
+		t.Errorf("got %v, %t, want 3", got, ok)
+	}
+	// the key isn't mistaken for the string
+	if _, ok := m.Get(ValObjString("NaN")); ok {
+		t.Error("found the string \"NaN\"")
+	}
+}
+
+func TestCompareNumbers(t *testing.T) {
+	tests := []struct {
+		a, b Value
+		want int
+	}{
+		{ValInt(1), ValInt(2), -1},
+		{ValInt(2), ValNumber(1.5), 1},
+		{ValNumber(1.5), ValInt(2), -1},
+		{ValInt(-2), ValNumber(-1.5), -1},
+		{ValInt(-1), ValNumber(-1.5), 1},
+		{ValInt(3), ValNumber(3), 0},
+		// 2^53 + 1 isn't a float, and turning it into one rounds it down
+		{ValInt(1<<53 + 1), ValNumber(1 << 53), 1},
+		{ValNumber(1 << 53), ValInt(1<<53 + 1), -1},
+		// 2^63 is past every int
+		{ValInt(math.MaxInt64), ValNumber(math.MaxInt64), -1},
+		{ValInt(math.MinInt64), ValNumber(math.MinInt64), 0},
+		{ValInt(math.MinInt64), ValNumber(-1e19), 1},
+		{ValInt(0), ValNumber(math.Inf(1)), -1},
+		{ValNumber(math.Inf(-1)), ValInt(0), -1},
+		{ValNumber(0), ValNumber(math.Copysign(0, -1)), 0},
+	}
+	for _, test := range tests {
+		got, ok := CompareNumbers(test.a, test.b)
+		if !ok || got != test.want {
+			t.Errorf("%v <=> %v = %d, %t, want %d", test.a, test.b, got, ok, test.want)
+		}
+		// equal numbers are the same key, and others aren't
+		if equal := AreEqual(test.a, test.b); equal != (test.a.Key() == test.b.Key()) {
+			t.Errorf("%v == %v is %t but their keys disagree", test.a, test.b, equal)
+		}
+	}
+
+	nan := ValNumber(math.NaN())
+	for _, other := range []Value{ValInt(0), ValNumber(1), nan} {
+		if _, ok := CompareNumbers(nan, other); ok {
+			t.Errorf("NaN compared to %v", other)
+		}
+		if _, ok := CompareNumbers(other, nan); ok {
+			t.Errorf("%v compared to NaN", other)
+		}
+	}
+}
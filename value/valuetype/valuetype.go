@@ -6,5 +6,11 @@ const (
 	VAL_NIL    = iota
 	VAL_BOOL   = iota
 	VAL_NUMBER = iota
+	VAL_INT    = iota
 	VAL_OBJ    = iota
+
+	// VAL_UNDEFINED fills a parameter slot no argument was passed for,
+	// until the function's prologue evaluates the default value. Scripts
+	// never see it.
+	VAL_UNDEFINED = iota
 )
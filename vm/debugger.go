@@ -0,0 +1,537 @@
+package vm
+
+import (
+	"bufio"
+	"fmt"
+	"golox/chunk"
+	"golox/compiler"
+	"golox/ir"
+	"golox/parser"
+	"golox/value"
+	"golox/value/genstate"
+	"golox/vm/interpretresult"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type stepMode int
+
+const (
+	STEP_START stepMode = iota // stop where a top-level statement starts
+	STEP_NONE  stepMode = iota // run to the next breakpoint
+	STEP_IN    stepMode = iota // stop at the next line, in any frame
+	STEP_OVER  stepMode = iota // stop at the next line of the frame or its callers
+	STEP_OUT   stepMode = iota // stop once the frame has returned
+)
+
+const debuggerHelp = `break [file:]line  stop when a line starts (b)
+delete [n]         remove breakpoint n, or all of them
+breakpoints        list the breakpoints
+continue           run to the next breakpoint (c)
+step               run to the next line, stepping into calls (s)
+next               run to the next line, stepping over calls (n)
+finish             run until the current function returns
+backtrace          show the call stack (bt)
+frame n            select frame n of the call stack
+locals             show the variables of the selected frame
+print expr         evaluate expr in the selected frame (p)
+list               show the source around the selected frame (l)
+quit               stop the program (q)
+`
+
+// breakpoint stops the program when a line of the file at path starts.
+type breakpoint struct {
+	path    string
+	line    int
+	pending bool // set until the file has been loaded and line checked
+}
+
+// debugger is the state of `golox debug`: the breakpoints, where a step
+// started and the commands still to read. It is consulted before every
+// instruction run.
+type debugger struct {
+	input       *bufio.Scanner
+	breakpoints map[int]*breakpoint
+	nextID      int
+	scripts     map[string]*value.ObjFunction // the top-level code of each file loaded
+	sources     map[string][]string           // the lines of each file listed
+
+	mode  stepMode
+	depth int // the frame count and line a step started from
+	line  int
+
+	selected   int  // the frame locals and print look at
+	evaluating bool // set while an expression typed in runs
+	quit       bool // set once told to quit, or out of commands
+
+	// the lines the top-level statements of the main script start on
+	starts map[int]bool
+}
+
+// Debug runs source as the main module like InterpretFile, under the
+// debugger reading commands from in. The program stops before its first
+// statement. The code isn't optimized or JIT compiled, so that it runs as
+// written and the compiler's tables of local variables hold. The result
+// is INTERPRET_STOPPED when the program was quit before it ended.
+func (vm *VM) Debug(path string, source string, in io.Reader) interpretresult.InterpretResult {
+	vm.Optimize = false
+	vm.IR = false
+	vm.DisableJIT()
+
+	vm.debugger = &debugger{
+		input:       bufio.NewScanner(in),
+		breakpoints: make(map[int]*breakpoint),
+		nextID:      1,
+		scripts:     make(map[string]*value.ObjFunction),
+		sources:     make(map[string][]string),
+		mode:        STEP_START,
+		starts:      make(map[int]bool),
+	}
+	defer func() { vm.debugger = nil }()
+
+	if abs, err := filepath.Abs(path); err == nil {
+		vm.main.Path = abs
+	}
+	vm.aborted = false
+	program, ok := parser.Parse(&source)
+	if !ok {
+		return interpretresult.INTERPRET_COMPILE_ERROR
+	}
+	function := compiler.Generate(program, false)
+	if function == nil {
+		return interpretresult.INTERPRET_COMPILE_ERROR
+	}
+	// the code of a statement such as a function declaration can all be
+	// on its last line, so the first stop waits for a statement's first
+	for _, stmt := range program.Stmts {
+		vm.debugger.starts[stmt.Position().Line] = true
+	}
+	vm.debugger.loaded(vm.main.Path, function)
+
+	closure := value.NewObjClosure(function)
+	closure.Module = vm.main
+	vm.callValue(value.ValObjClosure(closure), 0)
+	result := vm.run(0)
+	if vm.debugger.quit {
+		vm.resetStack()
+		return interpretresult.INTERPRET_STOPPED
+	}
+	if result == interpretresult.INTERPRET_OK {
+		fmt.Println("Program exited.")
+	}
+	return result
+}
+
+// loaded records the top-level function of the file at path once it has
+// been compiled, placing the breakpoints waiting for it.
+func (debugger *debugger) loaded(path string, function *value.ObjFunction) {
+	debugger.scripts[path] = function
+	for _, id := range debugger.breakpointIDs() {
+		bp := debugger.breakpoints[id]
+		if bp.pending && bp.path == path && !debugger.place(id, bp) {
+			delete(debugger.breakpoints, id)
+		}
+	}
+}
+
+// check stops the program before the instruction at the ip of the top
+// frame when a step ends there, or when it starts a line with a
+// breakpoint. It returns false if the program is to be quit.
+func (debugger *debugger) check(vm *VM) bool {
+	depth := len(vm.frames)
+	frame := &vm.frames[depth-1]
+	c := frame.chunk()
+	line := c.Lines[frame.ip]
+
+	stop := false
+	switch debugger.mode {
+	case STEP_START:
+		stop = depth == 1 && debugger.starts[line]
+	case STEP_IN:
+		stop = depth != debugger.depth || line != debugger.line
+	case STEP_OVER:
+		stop = depth < debugger.depth || depth == debugger.depth && line != debugger.line
+	case STEP_OUT:
+		stop = depth < debugger.depth
+	}
+	if !stop && (frame.ip == 0 || c.Lines[frame.ip-1] != line) {
+		stop = debugger.breakpointAt(frame.closure.Module, line)
+	}
+	if stop {
+		debugger.pause(vm)
+	}
+	return !debugger.quit
+}
+
+func (debugger *debugger) breakpointAt(module *value.ObjModule, line int) bool {
+	for _, bp := range debugger.breakpoints {
+		if bp.line == line && !bp.pending && bp.path == module.Path {
+			return true
+		}
+	}
+	return false
+}
+
+// pause reads and runs commands until one resumes the program, or quits
+// it, which sets quit.
+func (debugger *debugger) pause(vm *VM) {
+	debugger.mode = STEP_NONE
+	debugger.selected = len(vm.frames) - 1
+	debugger.where(vm)
+
+	for {
+		fmt.Print("(debug) ")
+		if !debugger.input.Scan() {
+			fmt.Println()
+			debugger.quit = true
+			return
+		}
+		command := strings.TrimSpace(debugger.input.Text())
+		arg := ""
+		if i := strings.IndexAny(command, " \t"); i >= 0 {
+			command, arg = command[:i], strings.TrimSpace(command[i+1:])
+		}
+
+		switch command {
+		case "":
+		case "c", "continue":
+			return
+		case "s", "step":
+			debugger.step(vm, STEP_IN)
+			return
+		case "n", "next":
+			debugger.step(vm, STEP_OVER)
+			return
+		case "finish":
+			debugger.step(vm, STEP_OUT)
+			return
+		case "b", "break":
+			debugger.setBreakpoint(vm, arg)
+		case "delete":
+			debugger.deleteBreakpoint(arg)
+		case "breakpoints":
+			debugger.listBreakpoints()
+		case "bt", "backtrace":
+			debugger.backtrace(vm)
+		case "frame":
+			n, err := strconv.Atoi(arg)
+			if err != nil || n < 0 || n >= len(vm.frames) {
+				fmt.Printf("No frame %s.\n", arg)
+				continue
+			}
+			debugger.selected = len(vm.frames) - 1 - n
+			debugger.where(vm)
+		case "locals":
+			debugger.locals(vm)
+		case "p", "print":
+			debugger.evaluate(vm, arg)
+		case "l", "list":
+			debugger.list(vm)
+		case "h", "help":
+			fmt.Print(debuggerHelp)
+		case "q", "quit":
+			debugger.quit = true
+			return
+		default:
+			fmt.Printf("Unknown command '%s'. Try 'help'.\n", command)
+		}
+	}
+}
+
+// step resumes the program until a step of mode from the top frame ends.
+func (debugger *debugger) step(vm *VM, mode stepMode) {
+	debugger.mode = mode
+	debugger.depth = len(vm.frames)
+	debugger.line = debugger.lineOf(vm, len(vm.frames)-1)
+}
+
+// pc is the offset of the instruction frame i is at: the next one for the
+// top frame and the call for those below it.
+func (debugger *debugger) pc(vm *VM, i int) int {
+	if i == len(vm.frames)-1 {
+		return vm.frames[i].ip
+	}
+	return vm.frames[i].ip - 1
+}
+
+func (debugger *debugger) lineOf(vm *VM, i int) int {
+	return vm.frames[i].chunk().Lines[debugger.pc(vm, i)]
+}
+
+// describe names frame i and where it is, as in "fib() at fib.lox:3".
+func (debugger *debugger) describe(vm *VM, i int) string {
+	frame := &vm.frames[i]
+	name := "script"
+	if i > 0 && frame.module == nil {
+		name = frame.closure.Function.Name.String + "()"
+	}
+	return fmt.Sprintf("%s at %s:%d", name, displayPath(frame.closure.Module.Path), debugger.lineOf(vm, i))
+}
+
+func displayPath(path string) string {
+	if path == "" {
+		return "<main>"
+	}
+	return filepath.Base(path)
+}
+
+// where shows the selected frame and its line of source.
+func (debugger *debugger) where(vm *VM) {
+	fmt.Println(debugger.describe(vm, debugger.selected))
+	line := debugger.lineOf(vm, debugger.selected)
+	if text, ok := debugger.sourceLine(vm.frames[debugger.selected].closure.Module.Path, line); ok {
+		fmt.Printf("%4d  %s\n", line, text)
+	}
+}
+
+// sourceLine returns line of the file at path, reading it the first time.
+func (debugger *debugger) sourceLine(path string, line int) (string, bool) {
+	lines, ok := debugger.sources[path]
+	if !ok {
+		if source, err := os.ReadFile(path); err == nil {
+			lines = strings.Split(string(source), "\n")
+		}
+		debugger.sources[path] = lines
+	}
+	if line < 1 || line > len(lines) {
+		return "", false
+	}
+	return strings.TrimRight(lines[line-1], "\r"), true
+}
+
+func (debugger *debugger) list(vm *VM) {
+	path := vm.frames[debugger.selected].closure.Module.Path
+	current := debugger.lineOf(vm, debugger.selected)
+	for line := current - 5; line <= current+5; line++ {
+		text, ok := debugger.sourceLine(path, line)
+		if !ok {
+			continue
+		}
+		marker := " "
+		if line == current {
+			marker = ">"
+		}
+		fmt.Printf("%s%4d  %s\n", marker, line, text)
+	}
+}
+
+func (debugger *debugger) backtrace(vm *VM) {
+	for i := len(vm.frames) - 1; i >= 0; i-- {
+		marker := " "
+		if i == debugger.selected {
+			marker = "*"
+		}
+		fmt.Printf("%s#%d  %s\n", marker, len(vm.frames)-1-i, debugger.describe(vm, i))
+	}
+}
+
+func (debugger *debugger) breakpointIDs() []int {
+	ids := make([]int, 0, len(debugger.breakpoints))
+	for id := range debugger.breakpoints {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+// setBreakpoint adds a breakpoint at spec, "file:line" or a line of the
+// main script.
+func (debugger *debugger) setBreakpoint(vm *VM, spec string) {
+	bp := &breakpoint{path: vm.main.Path}
+	lineSpec := spec
+	if i := strings.LastIndex(spec, ":"); i >= 0 {
+		bp.path, lineSpec = debugger.findPath(spec[:i]), spec[i+1:]
+	}
+	line, err := strconv.Atoi(lineSpec)
+	if err != nil || line < 1 {
+		fmt.Println("Usage: break [file:]line")
+		return
+	}
+	bp.line = line
+
+	// the number is only used up by a breakpoint that's kept
+	if debugger.place(debugger.nextID, bp) {
+		debugger.breakpoints[debugger.nextID] = bp
+		debugger.nextID++
+	}
+}
+
+// findPath returns the path of a file named in a breakpoint: that of a
+// file already loaded with that name, or else the file relative to the
+// working directory.
+func (debugger *debugger) findPath(file string) string {
+	abs, err := filepath.Abs(file)
+	if err != nil {
+		abs = file
+	}
+	if _, ok := debugger.scripts[abs]; ok || strings.ContainsRune(file, filepath.Separator) {
+		return abs
+	}
+	for path := range debugger.scripts {
+		if filepath.Base(path) == file {
+			return path
+		}
+	}
+	return abs
+}
+
+// place moves breakpoint id to the first line from its own that has
+// code, going by the lines of the file's chunks, and reports whether
+// there is one. It stays pending while the file hasn't been loaded.
+func (debugger *debugger) place(id int, bp *breakpoint) bool {
+	script, ok := debugger.scripts[bp.path]
+	if !ok {
+		bp.pending = true
+		fmt.Printf("Breakpoint %d at %s:%d, pending until the file is loaded.\n", id, displayPath(bp.path), bp.line)
+		return true
+	}
+	bp.pending = false
+
+	placed := 0
+	for _, function := range ir.Functions(script) {
+		for _, line := range function.Chunk.(*chunk.Chunk).Lines {
+			if line >= bp.line && (placed == 0 || line < placed) {
+				placed = line
+			}
+		}
+	}
+	if placed == 0 {
+		fmt.Printf("No code at or after line %d of %s.\n", bp.line, displayPath(bp.path))
+		return false
+	}
+	bp.line = placed
+	fmt.Printf("Breakpoint %d at %s:%d.\n", id, displayPath(bp.path), bp.line)
+	return true
+}
+
+func (debugger *debugger) deleteBreakpoint(arg string) {
+	if arg == "" {
+		debugger.breakpoints = make(map[int]*breakpoint)
+		return
+	}
+	id, err := strconv.Atoi(arg)
+	if _, ok := debugger.breakpoints[id]; err != nil || !ok {
+		fmt.Printf("No breakpoint %s.\n", arg)
+		return
+	}
+	delete(debugger.breakpoints, id)
+}
+
+func (debugger *debugger) listBreakpoints() {
+	if len(debugger.breakpoints) == 0 {
+		fmt.Println("No breakpoints.")
+	}
+	for _, id := range debugger.breakpointIDs() {
+		bp := debugger.breakpoints[id]
+		pending := ""
+		if bp.pending {
+			pending = " (pending)"
+		}
+		fmt.Printf("%d  %s:%d%s\n", id, displayPath(bp.path), bp.line, pending)
+	}
+}
+
+// variable is a variable visible in a frame and where its value is kept.
+type variable struct {
+	name     string
+	location *value.Value
+}
+
+// variables lists the variables frame i can see besides the globals: the
+// upvalues of its closure and the locals in scope where it is, with those
+// shadowing others of the same name replacing them.
+func (debugger *debugger) variables(vm *VM, i int) []variable {
+	frame := &vm.frames[i]
+	c := frame.chunk()
+	pc := debugger.pc(vm, i)
+
+	var variables []variable
+	index := make(map[string]int)
+	add := func(name string, location *value.Value) {
+		if j, ok := index[name]; ok {
+			variables[j].location = location
+			return
+		}
+		index[name] = len(variables)
+		variables = append(variables, variable{name, location})
+	}
+	for j, name := range c.Upvalues {
+		add(name, frame.closure.Upvalues[j].Location)
+	}
+	for _, local := range c.Locals {
+		if local.Start <= pc && pc < local.End {
+			add(local.Name, &vm.stack[frame.slots+local.Slot])
+		}
+	}
+	return variables
+}
+
+func (debugger *debugger) locals(vm *VM) {
+	variables := debugger.variables(vm, debugger.selected)
+	if len(variables) == 0 {
+		fmt.Println("No locals.")
+	}
+	for _, v := range variables {
+		fmt.Printf("%s = %s\n", v.name, v.location.Stringify())
+	}
+}
+
+// evaluate evaluates the expression source in the selected frame and
+// prints its value. The expression is compiled as a function of the
+// frame's variables, whose values are passed in and stored back after,
+// so it can assign to them. Globals are those of the frame's module.
+func (debugger *debugger) evaluate(vm *VM, source string) {
+	source = strings.TrimSuffix(strings.TrimSpace(source), ";")
+	if source == "" {
+		fmt.Println("Usage: print expr")
+		return
+	}
+
+	variables := debugger.variables(vm, debugger.selected)
+	names := make([]string, len(variables))
+	args := make([]value.Value, len(variables))
+	for i, v := range variables {
+		names[i], args[i] = v.name, *v.location
+	}
+	// appending "\x00" so that currChar() does not give runtime error
+	src := source + ";\x00"
+	function := compiler.CompileEval(&src, names)
+	if function == nil {
+		return
+	}
+	closure := value.NewObjClosure(function)
+	closure.Module = vm.frames[debugger.selected].closure.Module
+
+	frameCount, stackTop := len(vm.frames), vm.stackTop
+	debugger.evaluating = true
+	result, ok := vm.Call(value.ValObjClosure(closure), args...)
+	debugger.evaluating = false
+	if !ok {
+		// unwind the frames of the expression, leaving the program's
+		for _, frame := range vm.frames[frameCount:] {
+			if frame.generator != nil {
+				frame.generator.State = genstate.GEN_DONE
+				frame.generator.Stack = nil
+			}
+		}
+		vm.closeUpvalues(stackTop)
+		vm.frames = vm.frames[:frameCount]
+		vm.stackTop = stackTop
+		vm.aborted = false
+		return
+	}
+
+	values := result.AsObjList().List
+	fmt.Println(values[0].Stringify())
+	// only those it assigned to, as a function it called may have changed
+	// a captured one
+	for i, v := range variables {
+		if values[i+1].Type != args[i].Type || !value.AreEqual(values[i+1], args[i]) {
+			*v.location = values[i+1]
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package vm
+
+import (
+	"golox/interp"
+	"golox/value"
+	"golox/value/genstate"
+	"golox/value/objtype"
+)
+
+// defineIntrinsic registers a builtin that runs inside the VM instead of
+// being handed its arguments.
+func (vm *VM) defineIntrinsic(name string, function func(argCount int) bool) {
+	vm.builtins[name] = value.ValIntrinsic(name, len(vm.intrinsics))
+	vm.intrinsics = append(vm.intrinsics, function)
+}
+
+// newGenerator suspends a call of a generator function before its first
+// instruction. The callee and arguments are moved off the stack into the
+// generator, which is left in their place.
+func (vm *VM) newGenerator(closure *value.ObjClosure, argCount int) {
+	slots := vm.stackTop - argCount - 1
+	stack := make([]value.Value, argCount+1)
+	copy(stack, vm.stack[slots:vm.stackTop])
+	vm.stackTop = slots
+	vm.push(value.ValObjGenerator(value.NewObjGenerator(closure, stack)))
+}
+
+// next resumes a generator, evaluating to the value of the next yield, or
+// to the function's return value once it finishes.
+func (vm *VM) next(argCount int) bool {
+	if argCount != 1 {
+		vm.runtimeError(interp.ArityError(&value.ObjFunction{Arity: 1, RequiredArity: 1}, argCount))
+		return false
+	}
+	return vm.resumeGenerator(vm.peek(0), value.ValNil(), argCount)
+}
+
+// send resumes a generator like next, with the paused yield evaluating to
+// the value sent.
+func (vm *VM) send(argCount int) bool {
+	if argCount != 2 {
+		vm.runtimeError(interp.ArityError(&value.ObjFunction{Arity: 2, RequiredArity: 2}, argCount))
+		return false
+	}
+	return vm.resumeGenerator(vm.peek(1), vm.peek(0), argCount)
+}
+
+// resumeGenerator replaces the intrinsic call on the stack with the
+// generator's saved frame and continues it. The value it yields or returns
+// ends up where the call was.
+func (vm *VM) resumeGenerator(callee value.Value, sent value.Value, argCount int) bool {
+	if !callee.IsOBjType(objtype.OBJ_GENERATOR) {
+		vm.runtimeError("Can only resume generators.")
+		return false
+	}
+
+	generator := callee.AsObjGenerator()
+	switch generator.State {
+	case genstate.GEN_RUNNING:
+		vm.runtimeError("Generator is already running.")
+		return false
+	case genstate.GEN_DONE:
+		vm.runtimeError("Generator is already done.")
+		return false
+	}
+
+	if len(vm.frames) == FRAMES_INITIAL_SIZE || vm.stackTop+len(generator.Stack) >= len(vm.stack) {
+		vm.runtimeError("Stack overflow.")
+		return false
+	}
+
+	vm.stackTop -= argCount + 1
+	vm.resume(generator, sent)
+
+	return true
+}
+
+// resume pushes a frame continuing generator on top of the stack. The
+// generator's state must already have been checked.
+func (vm *VM) resume(generator *value.ObjGenerator, sent value.Value) *CallFrame {
+	base := vm.stackTop
+	for _, slot := range generator.Stack {
+		vm.push(slot)
+	}
+	for _, upvalue := range generator.Upvalues {
+		upvalue.Slot += base
+		upvalue.Location = &vm.stack[upvalue.Slot]
+		vm.openUpvalues = append(vm.openUpvalues, upvalue)
+	}
+	generator.Upvalues = nil
+
+	if generator.State == genstate.GEN_SUSPENDED {
+		vm.push(sent)
+	}
+
+	frame := CallFrame{
+		closure:   generator.Closure,
+		ip:        generator.IP,
+		slots:     base,
+		generator: generator,
+	}
+	vm.frames = append(vm.frames, frame)
+	generator.State = genstate.GEN_RUNNING
+
+	return &vm.frames[len(vm.frames)-1]
+}
+
+// yield suspends the generator running in the top frame. Its stack slice
+// is saved in the generator and upvalues still pointing into it are moved
+// along, then the yielded value is returned to whoever resumed it.
+func (vm *VM) yield(result value.Value) {
+	frame := &vm.frames[len(vm.frames)-1]
+	generator := frame.generator
+
+	generator.Stack = make([]value.Value, vm.stackTop-frame.slots)
+	copy(generator.Stack, vm.stack[frame.slots:vm.stackTop])
+
+	open := vm.openUpvalues[:0]
+	for _, upvalue := range vm.openUpvalues {
+		if upvalue.Slot >= frame.slots {
+			upvalue.Slot -= frame.slots
+			upvalue.Location = &generator.Stack[upvalue.Slot]
+			generator.Upvalues = append(generator.Upvalues, upvalue)
+		} else {
+			open = append(open, upvalue)
+		}
+	}
+	vm.openUpvalues = open
+
+	generator.IP = frame.ip
+	generator.State = genstate.GEN_SUSPENDED
+
+	vm.stackTop = frame.slots
+	vm.frames = vm.frames[:len(vm.frames)-1]
+	vm.push(result)
+}
+
+// finishGenerators marks the generators running in the active frames as
+// done, so a runtime error inside one doesn't leave it resumable.
+func (vm *VM) finishGenerators() {
+	for _, frame := range vm.frames {
+		if frame.generator != nil {
+			frame.generator.State = genstate.GEN_DONE
+			frame.generator.Stack = nil
+		}
+	}
+}
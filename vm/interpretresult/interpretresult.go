@@ -6,4 +6,5 @@ const (
 	INTERPRET_OK = iota
 	INTERPRET_COMPILE_ERROR
 	INTERPRET_RUNTIME_ERROR
+	INTERPRET_STOPPED // the debugger was told to quit
 )
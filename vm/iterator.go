@@ -0,0 +1,167 @@
+package vm
+
+import (
+	"golox/value"
+	"golox/value/genstate"
+	"golox/value/objtype"
+	"unicode/utf8"
+)
+
+// isCallable reports whether val can be called, without calling it.
+func isCallable(val value.Value) bool {
+	if !val.IsObj() {
+		return false
+	}
+	switch val.AsObj().Type {
+	case objtype.OBJ_FUNCTION, objtype.OBJ_CLOSURE, objtype.OBJ_NATIVE, objtype.OBJ_INTRINSIC:
+		return true
+	}
+	return false
+}
+
+// iterate replaces the value on top of the stack with an iterator over it.
+// A map with a callable `iter` entry implements the iteration protocol:
+// iter() is called and whatever it returns is iterated over instead, so it
+// is usually a generator.
+func (vm *VM) iterate() bool {
+	iterable := vm.peek(0)
+
+	if iterable.IsOBjType(objtype.OBJ_MAP) {
+		iter, ok := iterable.AsObjMap().Get(value.ValObjString("iter"))
+		if ok && isCallable(iter) {
+			vm.stack[vm.stackTop-1] = iter
+			frameCount := len(vm.frames)
+			if !vm.callValue(iter, 0) {
+				return false
+			}
+			if len(vm.frames) > frameCount {
+				// the result is turned into an iterator when iter returns
+				vm.frames[len(vm.frames)-1].iterInit = true
+				return true
+			}
+		}
+	}
+
+	return vm.makeIterator()
+}
+
+// makeIterator replaces the value on top of the stack with an iterator
+// over it.
+func (vm *VM) makeIterator() bool {
+	iterable := vm.peek(0)
+
+	if iterable.IsObj() {
+		switch iterable.AsObj().Type {
+		case objtype.OBJ_LIST, objtype.OBJ_STRING, objtype.OBJ_MAP, objtype.OBJ_RANGE, objtype.OBJ_GENERATOR:
+			vm.stack[vm.stackTop-1] = value.ValObjIterator(iterable)
+			return true
+		case objtype.OBJ_ITERATOR:
+			return true
+		}
+	}
+
+	vm.runtimeError("Can only iterate over lists, strings, maps, ranges and generators.")
+	return false
+}
+
+// forIter advances the iterator on top of the stack, pushing the loop's
+// variables: the next value, preceded by its index or key when withIndex
+// is set. When the iterator is exhausted the loop jumps to exit instead.
+func (vm *VM) forIter(withIndex bool, exit int) bool {
+	iterator := vm.peek(0).AsObjIterator()
+	iterable := iterator.Iterable
+	frame := &vm.frames[len(vm.frames)-1]
+
+	var index, next value.Value
+
+	switch iterable.AsObj().Type {
+	case objtype.OBJ_LIST:
+		list := iterable.AsObjList().List
+		if iterator.Index >= len(list) {
+			frame.ip = exit
+			return true
+		}
+		index, next = value.ValInt(int64(iterator.Index)), list[iterator.Index]
+		iterator.Index++
+
+	case objtype.OBJ_STRING:
+		str := iterable.AsGoString()
+		if iterator.Index >= len(str) {
+			frame.ip = exit
+			return true
+		}
+		char, size := utf8.DecodeRuneInString(str[iterator.Index:])
+		index, next = value.ValInt(int64(iterator.Count)), value.ValObjString(string(char))
+		iterator.Index += size
+
+	case objtype.OBJ_MAP:
+		objMap := iterable.AsObjMap()
+		if iterator.Index >= len(objMap.Keys) {
+			frame.ip = exit
+			return true
+		}
+		key := objMap.Keys[iterator.Index]
+		if withIndex {
+			index = key
+			next, _ = objMap.Get(key)
+		} else {
+			next = key
+		}
+		iterator.Index++
+
+	case objtype.OBJ_RANGE:
+		objRange := iterable.AsObjRange()
+		if uint64(iterator.Index) >= objRange.Len() {
+			frame.ip = exit
+			return true
+		}
+		// the product can wrap, but the sum is in the range so it comes
+		// out right
+		current := objRange.Start + int64(iterator.Index)*objRange.Step
+		index, next = value.ValInt(int64(iterator.Count)), value.ValInt(current)
+		iterator.Index++
+
+	case objtype.OBJ_GENERATOR:
+		return vm.forIterGenerator(iterator, withIndex, exit)
+	}
+
+	if withIndex {
+		vm.push(index)
+	}
+	vm.push(next)
+	iterator.Count++
+
+	return true
+}
+
+// forIterGenerator resumes the generator being iterated over. The value it
+// yields becomes the loop variable, and the loop ends when it returns.
+func (vm *VM) forIterGenerator(iterator *value.ObjIterator, withIndex bool, exit int) bool {
+	generator := iterator.Iterable.AsObjGenerator()
+
+	switch generator.State {
+	case genstate.GEN_DONE:
+		vm.frames[len(vm.frames)-1].ip = exit
+		return true
+	case genstate.GEN_RUNNING:
+		vm.runtimeError("Generator is already running.")
+		return false
+	}
+
+	if len(vm.frames) == FRAMES_INITIAL_SIZE || vm.stackTop+len(generator.Stack)+1 >= len(vm.stack) {
+		vm.runtimeError("Stack overflow.")
+		return false
+	}
+
+	iterTop := vm.stackTop
+	if withIndex {
+		vm.push(value.ValInt(int64(iterator.Count)))
+	}
+	iterator.Count++
+
+	frame := vm.resume(generator, value.ValNil())
+	frame.iterExit = exit
+	frame.iterTop = iterTop
+
+	return true
+}
@@ -0,0 +1,470 @@
+package vm
+
+import (
+	"encoding/binary"
+	"fmt"
+	"golox/arith"
+	"golox/asm"
+	"golox/chunk"
+	"golox/chunk/opcode"
+	"golox/config"
+	"golox/jit"
+	"golox/value"
+	"golox/value/objtype"
+	"golox/value/valuetype"
+	"math"
+	"unsafe"
+)
+
+// compiled is what the baseline JIT knows about a function's chunk.
+type compiled struct {
+	calls    int
+	function *jit.Function // nil until compiled, and for good if that failed
+}
+
+// baseline is the state of the baseline JIT: the code cache, the helper
+// compiled code calls, the cells it runs on, a Context for each compiled
+// call in progress, and the objects their cells refer to.
+type baseline struct {
+	cache    asm.CodeCache
+	helper   asm.HelperID
+	stack    *jit.Stack
+	contexts []*jit.Context
+	depth    int
+	objects  []value.Value
+	chunks   map[*chunk.Chunk]*compiled
+
+	// marks has how many objects there were when each compiled call in
+	// progress started, which are dropped down to when it returns
+	marks []int
+	// limit is the number of objects the table can reach before collect
+	// drops those no cell refers to anymore
+	limit int
+}
+
+// minObjects is the smallest limit of the table of objects.
+const minObjects = 1024
+
+// EnableJIT makes the vm compile functions to machine code once they've
+// been called config.JIT_THRESHOLD times.
+func (vm *VM) EnableJIT() {
+	vm.baseline = &baseline{
+		stack:    jit.NewStack(STACK_INITIAL_SIZE),
+		contexts: make([]*jit.Context, FRAMES_INITIAL_SIZE),
+		chunks:   make(map[*chunk.Chunk]*compiled),
+		limit:    minObjects,
+	}
+	for i := range vm.baseline.contexts {
+		vm.baseline.contexts[i] = jit.NewContext()
+	}
+	vm.baseline.helper = asm.RegisterHelper(vm.jitBridge)
+}
+
+// DisableJIT frees the machine code and memory of the JIT. The functions
+// compiled go back to being interpreted.
+func (vm *VM) DisableJIT() {
+	state := vm.baseline
+	if state == nil {
+		return
+	}
+	state.cache.Free()
+	state.helper.Release()
+	state.stack.Free()
+	for _, context := range state.contexts {
+		context.Free()
+	}
+	vm.baseline = nil
+}
+
+// JITCodeSize is how many bytes of machine code the JIT has generated.
+func (vm *VM) JITCodeSize() int {
+	if vm.baseline == nil {
+		return 0
+	}
+	return vm.baseline.cache.Used()
+}
+
+// reset drops the compiled calls a runtime error unwound.
+func (state *baseline) reset() {
+	state.depth = 0
+	state.objects = nil
+	state.marks = state.marks[:0]
+}
+
+// collect drops the objects no cell below top refers to once the table
+// has grown past its limit, moving the others down and renumbering the
+// cells and marks. Cells are copied by compiled code without the vm
+// knowing, so a loop would otherwise keep adding objects until its call
+// returned. It runs when compiled code calls into the vm, when every
+// cell in use is below the stack pointer.
+func (state *baseline) collect(top int) {
+	if len(state.objects) < state.limit {
+		return
+	}
+
+	// renumbered[i] is the new number of object i, both counting from 1,
+	// or 0 when it's dropped
+	renumbered := make([]uint64, len(state.objects)+1)
+	cells := state.stack.Cells[:top]
+	for _, cell := range cells {
+		if isObjectCell(cell) {
+			renumbered[cell.Bits] = 1
+		}
+	}
+	kept := 0
+	for i, object := range state.objects {
+		if renumbered[i+1] != 0 {
+			state.objects[kept] = object
+			kept++
+			renumbered[i+1] = uint64(kept)
+		}
+	}
+	for i := kept; i < len(state.objects); i++ {
+		state.objects[i] = value.Value{}
+	}
+	for i, cell := range cells {
+		if isObjectCell(cell) {
+			cells[i].Bits = renumbered[cell.Bits]
+		}
+	}
+	for i, mark := range state.marks {
+		// the objects kept before the mark are still before it
+		for mark > 0 && renumbered[mark] == 0 {
+			mark--
+		}
+		if mark > 0 {
+			mark = int(renumbered[mark])
+		}
+		state.marks[i] = mark
+	}
+	state.objects = state.objects[:kept]
+
+	state.limit = 2 * kept
+	if state.limit < minObjects {
+		state.limit = minObjects
+	}
+}
+
+// isObjectCell reports whether cell refers to an entry of the table of
+// objects.
+func isObjectCell(cell jit.Cell) bool {
+	switch cell.Tag {
+	case valuetype.VAL_NIL, valuetype.VAL_BOOL, valuetype.VAL_INT, valuetype.VAL_NUMBER:
+		return false
+	}
+	return true
+}
+
+// promote counts a call of function and returns its machine code, if it
+// has some by now.
+func (state *baseline) promote(function *value.ObjFunction) *jit.Function {
+	c := function.Chunk.(*chunk.Chunk)
+	entry, ok := state.chunks[c]
+	if !ok {
+		entry = new(compiled)
+		state.chunks[c] = entry
+	}
+	if entry.function != nil {
+		return entry.function
+	}
+
+	entry.calls++
+	if entry.calls == config.JIT_THRESHOLD {
+		// a chunk that can't be compiled just stays interpreted
+		entry.function, _ = jit.Compile(c, &state.cache, state.helper)
+	}
+	return entry.function
+}
+
+func (state *baseline) toCell(val value.Value) jit.Cell {
+	switch val.Type {
+	case valuetype.VAL_NIL:
+		return jit.Cell{Tag: valuetype.VAL_NIL}
+	case valuetype.VAL_BOOL:
+		if val.AsBool() {
+			return jit.Cell{Tag: valuetype.VAL_BOOL, Bits: 1}
+		}
+		return jit.Cell{Tag: valuetype.VAL_BOOL}
+	case valuetype.VAL_INT:
+		return jit.Cell{Tag: valuetype.VAL_INT, Bits: uint64(val.AsInt())}
+	case valuetype.VAL_NUMBER:
+		return jit.Cell{Tag: valuetype.VAL_NUMBER, Bits: math.Float64bits(val.AsNumber())}
+	}
+	state.objects = append(state.objects, val)
+	return jit.Cell{Tag: uint64(val.Type), Bits: uint64(len(state.objects))}
+}
+
+func (state *baseline) toValue(cell jit.Cell) value.Value {
+	switch cell.Tag {
+	case valuetype.VAL_NIL:
+		return value.ValNil()
+	case valuetype.VAL_BOOL:
+		return value.ValBool(cell.Bits != 0)
+	case valuetype.VAL_INT:
+		return value.ValInt(int64(cell.Bits))
+	case valuetype.VAL_NUMBER:
+		return value.ValNumber(math.Float64frombits(cell.Bits))
+	}
+	return state.objects[cell.Bits-1]
+}
+
+func (state *baseline) push(context *jit.Context, val value.Value) {
+	top := state.stack.Index(context.SP)
+	state.stack.Cells[top] = state.toCell(val)
+	context.SP = state.stack.Addr(top + 1)
+}
+
+func (state *baseline) pop(context *jit.Context) value.Value {
+	top := state.stack.Index(context.SP) - 1
+	context.SP = state.stack.Addr(top)
+	return state.toValue(state.stack.Cells[top])
+}
+
+// slot is the index of the cell of a local of the frame context runs.
+func (state *baseline) slot(context *jit.Context, local int) int {
+	return state.stack.Index(context.Base) + local
+}
+
+// runCompiled runs the frame just pushed for a call with its machine code
+// and replaces the call with its result, as OP_RETURN would.
+func (vm *VM) runCompiled(function *jit.Function) bool {
+	state := vm.baseline
+	frame := &vm.frames[len(vm.frames)-1]
+
+	base := 0
+	if state.depth > 0 {
+		base = state.stack.Index(state.contexts[state.depth-1].SP)
+	}
+	args := vm.stackTop - frame.slots
+	if state.depth == len(state.contexts) || base+args+function.MaxCells > len(state.stack.Cells) {
+		vm.runtimeError("Stack overflow.")
+		return false
+	}
+
+	state.collect(base)
+	state.marks = append(state.marks, len(state.objects))
+	for i := 0; i < args; i++ {
+		state.stack.Cells[base+i] = state.toCell(vm.stack[frame.slots+i])
+	}
+	context := state.contexts[state.depth]
+	context.Base = state.stack.Addr(base)
+	context.SP = state.stack.Addr(base + args)
+	function.Start(context)
+
+	state.depth++
+	for offset := function.Enter(context); offset != jit.DONE; offset = function.Enter(context) {
+		switch offset {
+		case jit.FAILED:
+			return false
+		case jit.DEOPT:
+			return vm.deoptimize(frame, context)
+		case jit.EXIT:
+			state.collect(state.stack.Index(context.SP))
+			next, ok := vm.jitHelper(frame, context, int(context.Offset))
+			if !ok {
+				return false
+			}
+			offset = next
+		}
+		function.ResumeAt(context, offset)
+	}
+	state.depth--
+
+	result := state.toValue(context.Result)
+	state.release()
+
+	vm.frames = vm.frames[:len(vm.frames)-1]
+	vm.stackTop = frame.slots
+	vm.push(result)
+	return true
+}
+
+// release drops the objects the compiled call ending added to the table:
+// its cells are gone, so are the objects only they held.
+func (state *baseline) release() {
+	objects := state.marks[len(state.marks)-1]
+	state.marks = state.marks[:len(state.marks)-1]
+	for i := objects; i < len(state.objects); i++ {
+		state.objects[i] = value.Value{}
+	}
+	state.objects = state.objects[:objects]
+}
+
+// deoptimize moves the cells of the frame that compiled code gave back to
+// the interpreter onto the vm's stack, and leaves the frame to carry on
+// at the instruction the code stopped at.
+func (vm *VM) deoptimize(frame *CallFrame, context *jit.Context) bool {
+	state := vm.baseline
+	base, top := state.stack.Index(context.Base), state.stack.Index(context.SP)
+	if frame.slots+top-base > len(vm.stack) {
+		vm.runtimeError("Stack overflow.")
+		return false
+	}
+
+	vm.stackTop = frame.slots
+	for i := base; i < top; i++ {
+		vm.push(state.toValue(state.stack.Cells[i]))
+	}
+	frame.ip = int(context.Offset)
+
+	state.depth--
+	state.release()
+	return true
+}
+
+// jitBridge is the helper compiled code calls through the asm bridge. It
+// runs the instruction at offset for the innermost compiled call and
+// returns the offset to carry on at, or jit.FAILED.
+func (vm *VM) jitBridge(context unsafe.Pointer, sp uintptr, base uintptr, offset int64) int64 {
+	vm.baseline.collect(vm.baseline.stack.Index(sp))
+	next, ok := vm.jitHelper(&vm.frames[len(vm.frames)-1], (*jit.Context)(context), int(offset))
+	if !ok {
+		return jit.FAILED
+	}
+	return int64(next)
+}
+
+// jitHelper runs the instruction at offset for compiled code, on its
+// cells, and returns the offset of the instruction to resume at. It
+// returns false after a runtime error.
+func (vm *VM) jitHelper(frame *CallFrame, context *jit.Context, offset int) (int, bool) {
+	state := vm.baseline
+	code, constants := frame.chunk().Code, frame.chunk().Constants
+	op := code[offset]
+	next := offset + jit.Size(op)
+	frame.ip = next
+
+	fail := func(err string) (int, bool) {
+		vm.runtimeError(err)
+		return 0, false
+	}
+
+	switch op {
+	case opcode.OP_CONSTANT:
+		state.push(context, constants[code[offset+1]])
+
+	case opcode.OP_ADD, opcode.OP_ADD_NUM, opcode.OP_ADD_STR:
+		b, a := state.pop(context), state.pop(context)
+		result, err := arith.Add(a, b)
+		if len(err) > 0 {
+			return fail(err)
+		}
+		state.push(context, result)
+	case opcode.OP_ADD_CONST:
+		result, err := arith.Add(state.pop(context), constants[code[offset+1]])
+		if len(err) > 0 {
+			return fail(err)
+		}
+		state.push(context, result)
+	case opcode.OP_SUBTRACT, opcode.OP_MULTIPLY, opcode.OP_DIVIDE, opcode.OP_MODULO, opcode.OP_GREATER,
+		opcode.OP_LESS, opcode.OP_LESS_NUM:
+		if op == opcode.OP_LESS_NUM {
+			op = opcode.OP_LESS
+		}
+		b, a := state.pop(context), state.pop(context)
+		result, err := arith.Binary(op, a, b)
+		if len(err) > 0 {
+			return fail(err)
+		}
+		state.push(context, result)
+	case opcode.OP_BIT_AND, opcode.OP_BIT_OR, opcode.OP_BIT_XOR, opcode.OP_SHIFT_LEFT, opcode.OP_SHIFT_RIGHT:
+		b, a := state.pop(context), state.pop(context)
+		result, err := arith.Bitwise(op, a, b)
+		if len(err) > 0 {
+			return fail(err)
+		}
+		state.push(context, result)
+	case opcode.OP_EQUAL:
+		b, a := state.pop(context), state.pop(context)
+		state.push(context, value.ValBool(value.AreEqual(a, b)))
+	case opcode.OP_NEGATE:
+		result, err := arith.Negate(state.pop(context))
+		if len(err) > 0 {
+			return fail(err)
+		}
+		state.push(context, result)
+	case opcode.OP_BIT_NOT:
+		result, err := arith.BitNot(state.pop(context))
+		if len(err) > 0 {
+			return fail(err)
+		}
+		state.push(context, result)
+
+	case opcode.OP_INCR_LOCAL:
+		slot := state.slot(context, int(code[offset+1]))
+		result, err := arith.Add(state.toValue(state.stack.Cells[slot]), value.ValInt(1))
+		if len(err) > 0 {
+			return fail(err)
+		}
+		state.stack.Cells[slot] = state.toCell(result)
+	case opcode.OP_LESS_JUMP_IF_FALSE:
+		b, a := state.pop(context), state.pop(context)
+		result, err := arith.Binary(opcode.OP_LESS, a, b)
+		if len(err) > 0 {
+			return fail(err)
+		}
+		if !result.AsBool() {
+			next += int(binary.LittleEndian.Uint16(code[offset+1:]))
+		}
+
+	case opcode.OP_GET_GLOBAL:
+		name := constants[code[offset+1]].AsGoString()
+		val, err := vm.getGlobal(frame.closure.Module, name)
+		if len(err) > 0 {
+			return fail(err)
+		}
+		state.push(context, val)
+	case opcode.OP_SET_GLOBAL:
+		name := constants[code[offset+1]].AsGoString()
+		val := state.pop(context)
+		if err := setGlobal(frame.closure.Module, name, val); len(err) > 0 {
+			return fail(err)
+		}
+		state.push(context, val)
+
+	case opcode.OP_CALL:
+		args := make([]value.Value, code[offset+1])
+		for i := len(args) - 1; i >= 0; i-- {
+			args[i] = state.pop(context)
+		}
+		result, ok := vm.Call(state.pop(context), args...)
+		if !ok {
+			return 0, false
+		}
+		state.push(context, result)
+
+	case opcode.OP_CHECK_INLINE:
+		function := constants[code[offset+1]].AsObjFunction()
+		top := state.stack.Index(context.SP)
+		callee := state.toValue(state.stack.Cells[top-1-int(code[offset+2])])
+		if !callee.IsOBjType(objtype.OBJ_CLOSURE) || callee.AsObjClosure().Function != function {
+			return next + int(binary.LittleEndian.Uint16(code[offset+3:])), true
+		}
+
+	case opcode.OP_LIST:
+		list := make([]value.Value, code[offset+1])
+		for i := len(list) - 1; i >= 0; i-- {
+			list[i] = state.pop(context)
+		}
+		state.push(context, value.ValObjList(list))
+	case opcode.OP_INDEX:
+		index, container := state.pop(context), state.pop(context)
+		val, ok := vm.getIndex(container, index)
+		if !ok {
+			return 0, false
+		}
+		state.push(context, val)
+	case opcode.OP_STORE:
+		newValue, index, container := state.pop(context), state.pop(context), state.pop(context)
+		if !vm.setIndex(container, index, newValue) {
+			return 0, false
+		}
+		state.push(context, newValue)
+
+	case opcode.OP_PRINT:
+		state.pop(context).Print()
+		fmt.Println()
+	}
+
+	return next, true
+}
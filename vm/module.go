@@ -0,0 +1,149 @@
+package vm
+
+import (
+	"fmt"
+	"golox/value"
+	"golox/value/objtype"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// moduleName is the name a module is shown with, the file name without
+// its extension.
+func moduleName(path string) string {
+	base := filepath.Base(path)
+	return strings.TrimSuffix(base, filepath.Ext(base))
+}
+
+// resolveModule finds the file for an import, first relative to the
+// importing module and then in each directory of the search path.
+func (vm *VM) resolveModule(importer *value.ObjModule, path string) (string, bool) {
+	var candidates []string
+
+	if filepath.IsAbs(path) {
+		candidates = append(candidates, path)
+	} else {
+		dir := "."
+		if importer.Path != "" {
+			dir = filepath.Dir(importer.Path)
+		}
+		candidates = append(candidates, filepath.Join(dir, path))
+		for _, searchDir := range vm.SearchPath {
+			candidates = append(candidates, filepath.Join(searchDir, path))
+		}
+	}
+
+	for _, candidate := range candidates {
+		info, err := os.Stat(candidate)
+		if err != nil || info.IsDir() {
+			continue
+		}
+		abs, err := filepath.Abs(candidate)
+		if err != nil {
+			continue
+		}
+		return abs, true
+	}
+
+	return "", false
+}
+
+func (vm *VM) importCycle(module *value.ObjModule) string {
+	cycle := ""
+	for _, loading := range vm.loading {
+		cycle += filepath.Base(loading.Path) + " -> "
+	}
+	return cycle + filepath.Base(module.Path)
+}
+
+// importModule pushes the module for path. A module that hasn't been
+// imported yet is compiled and its body is called; the module is left on
+// the stack when the body returns.
+func (vm *VM) importModule(importer *value.ObjModule, path string) bool {
+	fullPath, ok := vm.resolveModule(importer, path)
+	if !ok {
+		vm.runtimeError(fmt.Sprintf("Could not find module '%s'.", path))
+		return false
+	}
+
+	if module, ok := vm.modules[fullPath]; ok {
+		if !module.Loaded {
+			vm.runtimeError(fmt.Sprintf("Import cycle: %s.", vm.importCycle(module)))
+			return false
+		}
+		vm.push(value.ValObjModule(module))
+		return true
+	}
+
+	source, err := os.ReadFile(fullPath)
+	if err != nil {
+		vm.runtimeError(fmt.Sprintf("Could not read module '%s'.", path))
+		return false
+	}
+
+	// appending "\x00" so that currChar() does not give runtime error
+	src := string(source) + "\x00"
+	function := vm.compile(&src)
+	if function == nil {
+		vm.runtimeError(fmt.Sprintf("Could not compile module '%s'.", path))
+		return false
+	}
+	if vm.debugger != nil {
+		vm.debugger.loaded(fullPath, function)
+	}
+
+	module := value.NewObjModule(moduleName(fullPath), fullPath)
+	vm.modules[fullPath] = module
+	vm.loading = append(vm.loading, module)
+
+	closure := value.NewObjClosure(function)
+	closure.Module = module
+	vm.push(value.ValObjClosure(closure))
+	if !vm.call(closure, 0) {
+		return false
+	}
+	vm.frames[len(vm.frames)-1].module = module
+
+	return true
+}
+
+// finishModule marks the module whose body just returned as loaded.
+func (vm *VM) finishModule(module *value.ObjModule) {
+	module.Loaded = true
+	vm.loading = vm.loading[:len(vm.loading)-1]
+}
+
+// abortImports forgets modules whose body didn't finish, so they can be
+// imported again after a runtime error.
+func (vm *VM) abortImports() {
+	for _, module := range vm.loading {
+		delete(vm.modules, module.Path)
+	}
+	vm.loading = nil
+}
+
+func (vm *VM) getProperty(object value.Value, name string) (value.Value, bool) {
+	if object.IsOBjType(objtype.OBJ_MAP) {
+		member, ok := object.AsObjMap().Get(value.ValObjString(name))
+		if !ok {
+			vm.runtimeError(fmt.Sprintf("Undefined property '%s'.", name))
+			return value.ValNil(), false
+		}
+		return member, true
+	}
+
+	if !object.IsOBjType(objtype.OBJ_MODULE) {
+		vm.runtimeError("Only modules and maps have properties.")
+		return value.ValNil(), false
+	}
+
+	module := object.AsObjModule()
+	member, ok := module.Globals[name]
+	if !ok {
+		vm.runtimeError(fmt.Sprintf("Undefined property '%s' in module '%s'.", name, module.Name))
+		return value.ValNil(), false
+	}
+
+	return member, true
+}
@@ -0,0 +1,56 @@
+package vm
+
+import (
+	"golox/chunk"
+	"golox/chunk/opcode"
+	"golox/config"
+	"golox/value"
+)
+
+// operandKinds classifies the operands of a binary instruction for its
+// feedback.
+func operandKinds(a value.Value, b value.Value) uint8 {
+	switch {
+	case a.IsNumeric() && b.IsNumeric():
+		return chunk.SEEN_NUMBERS
+	case a.IsString() && b.IsString():
+		return chunk.SEEN_STRINGS
+	}
+	return chunk.SEEN_OTHER
+}
+
+// specialized is the instruction the generic op is quickened into when
+// it only ever runs on operands of the kinds seen, or op itself.
+func specialized(op uint8, seen uint8) uint8 {
+	switch {
+	case op == opcode.OP_ADD && seen == chunk.SEEN_NUMBERS:
+		return opcode.OP_ADD_NUM
+	case op == opcode.OP_ADD && seen == chunk.SEEN_STRINGS:
+		return opcode.OP_ADD_STR
+	case op == opcode.OP_LESS && seen == chunk.SEEN_NUMBERS:
+		return opcode.OP_LESS_NUM
+	}
+	return op
+}
+
+// observe records the operands of the generic instruction at offset in
+// code. Once it has run often enough on operands of one kind, it's
+// rewritten in place into the instruction specialized for them.
+func observe(code *chunk.Chunk, offset int, a value.Value, b value.Value) {
+	feedback := code.FeedbackAt(offset)
+	feedback.Seen |= operandKinds(a, b)
+	feedback.Count++
+
+	if feedback.Count == config.QUICKEN_THRESHOLD && feedback.Deopts < config.QUICKEN_MAX_DEOPTS {
+		code.Code[offset] = specialized(code.Code[offset], feedback.Seen)
+	}
+}
+
+// deopt turns the specialized instruction at offset back into the generic
+// one, whose guard has failed, to gather feedback again.
+func deopt(code *chunk.Chunk, offset int, generic uint8) {
+	feedback := code.FeedbackAt(offset)
+	feedback.Deopts++
+	feedback.Count, feedback.Seen = 0, 0
+	code.Code[offset] = generic
+}
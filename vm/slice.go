@@ -0,0 +1,170 @@
+package vm
+
+import (
+	"fmt"
+	"golox/arith"
+	"golox/value"
+	"golox/value/objtype"
+	"golox/value/valuetype"
+	"math"
+)
+
+// sliceBound converts a slice bound, with nil meaning byDefault. Negative
+// bounds count from the end and out of range ones are clamped to
+// [low, high].
+func sliceBound(val value.Value, length int, byDefault int, low int, high int) (int, bool) {
+	if val.Type == valuetype.VAL_NIL {
+		return byDefault, true
+	}
+
+	i, ok := arith.IntIndex(val)
+	if !ok {
+		return 0, false
+	}
+
+	if i < 0 {
+		i += length
+	}
+	if i < low {
+		i = low
+	}
+	if i > high {
+		i = high
+	}
+
+	return i, true
+}
+
+// sliceIndices returns the indices a[start:end:step] selects from a
+// sequence of length items, the way Python does.
+func (vm *VM) sliceIndices(start value.Value, end value.Value, step value.Value, length int) ([]int, bool) {
+	stride, ok := sliceBound(step, 0, 1, math.MinInt, math.MaxInt)
+	if !ok {
+		vm.runtimeError("Slice indices must be integers or nil.")
+		return nil, false
+	}
+
+	if stride == 0 {
+		vm.runtimeError("Slice step cannot be zero.")
+		return nil, false
+	}
+
+	var from, to int
+	var ok1, ok2 bool
+	if stride > 0 {
+		from, ok1 = sliceBound(start, length, 0, 0, length)
+		to, ok2 = sliceBound(end, length, length, 0, length)
+	} else {
+		// going backwards -1 stands for before the first item
+		from, ok1 = sliceBound(start, length, length-1, -1, length-1)
+		to, ok2 = sliceBound(end, length, -1, -1, length-1)
+	}
+	if !ok1 || !ok2 {
+		vm.runtimeError("Slice indices must be integers or nil.")
+		return nil, false
+	}
+
+	// i + stride can overflow, so stop once the end is a stride or less away
+	var indices []int
+	if stride > 0 {
+		for i := from; i < to; i += stride {
+			indices = append(indices, i)
+			if to-i <= stride {
+				break
+			}
+		}
+	} else {
+		for i := from; i > to; i += stride {
+			indices = append(indices, i)
+			if i-to <= -stride {
+				break
+			}
+		}
+	}
+
+	return indices, true
+}
+
+// getSlice evaluates container[start:end:step] for lists and strings,
+// giving a new list or string.
+func (vm *VM) getSlice(container value.Value, start value.Value, end value.Value, step value.Value) (value.Value, bool) {
+	switch {
+	case container.IsOBjType(objtype.OBJ_LIST):
+		list := container.AsObjList().List
+		indices, ok := vm.sliceIndices(start, end, step, len(list))
+		if !ok {
+			return value.ValNil(), false
+		}
+		result := make([]value.Value, len(indices))
+		for i, index := range indices {
+			result[i] = list[index]
+		}
+		return value.ValObjList(result), true
+
+	case container.IsString():
+		chars := []rune(container.AsGoString())
+		indices, ok := vm.sliceIndices(start, end, step, len(chars))
+		if !ok {
+			return value.ValNil(), false
+		}
+		result := make([]rune, len(indices))
+		for i, index := range indices {
+			result[i] = chars[index]
+		}
+		return value.ValObjString(string(result)), true
+	}
+
+	vm.runtimeError("Can only slice lists and strings.")
+	return value.ValNil(), false
+}
+
+// setSlice performs list[start:end:step] = items. A plain slice is
+// replaced by the items, which may change the length of the list; a slice
+// with a step must be given exactly as many items as it selects.
+func (vm *VM) setSlice(container value.Value, start value.Value, end value.Value, step value.Value, items value.Value) bool {
+	if container.IsString() {
+		vm.runtimeError("Strings can't be modified.")
+		return false
+	}
+	if !container.IsOBjType(objtype.OBJ_LIST) {
+		vm.runtimeError("Can only slice lists and strings.")
+		return false
+	}
+	if !items.IsOBjType(objtype.OBJ_LIST) {
+		vm.runtimeError("Can only assign a list to a slice.")
+		return false
+	}
+
+	objList := container.AsObjList()
+	newItems := items.AsObjList().List
+	indices, ok := vm.sliceIndices(start, end, step, len(objList.List))
+	if !ok {
+		return false
+	}
+
+	if stride, _ := sliceBound(step, 0, 1, math.MinInt, math.MaxInt); stride == 1 {
+		from, _ := sliceBound(start, len(objList.List), 0, 0, len(objList.List))
+		to := from + len(indices)
+
+		list := make([]value.Value, 0, len(objList.List)-len(indices)+len(newItems))
+		list = append(list, objList.List[:from]...)
+		list = append(list, newItems...)
+		list = append(list, objList.List[to:]...)
+		objList.List = list
+		return true
+	}
+
+	if len(indices) != len(newItems) {
+		vm.runtimeError(fmt.Sprintf("Slice assignment expects %d items but got %d.", len(indices), len(newItems)))
+		return false
+	}
+
+	// copied first in case the list is assigned a slice of itself
+	values := make([]value.Value, len(newItems))
+	copy(values, newItems)
+	for i, index := range indices {
+		objList.List[index] = values[i]
+	}
+
+	return true
+}
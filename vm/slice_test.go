@@ -0,0 +1,39 @@
+package vm
+
+import (
+	"golox/value"
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestSliceIndices(t *testing.T) {
+	var machine VM
+	machine.Init()
+
+	none := value.ValNil()
+	tests := []struct {
+		start, end, step value.Value
+		want             []int
+	}{
+		{none, none, none, []int{0, 1, 2, 3, 4, 5}},
+		{value.ValInt(1), value.ValInt(-1), value.ValInt(2), []int{1, 3}},
+		{none, none, value.ValInt(-2), []int{5, 3, 1}},
+		{value.ValInt(4), value.ValInt(1), value.ValInt(1), nil},
+		// i + step overflowing used to wrap around
+		{value.ValInt(5), none, value.ValInt(math.MaxInt64), []int{5}},
+		{none, none, value.ValInt(math.MaxInt64 - 1), []int{0}},
+		{value.ValInt(0), none, value.ValInt(math.MinInt64), []int{0}},
+		{none, none, value.ValInt(math.MinInt64 + 1), []int{5}},
+	}
+	for _, test := range tests {
+		got, ok := machine.sliceIndices(test.start, test.end, test.step, 6)
+		if !ok {
+			t.Errorf("[%v:%v:%v] failed", test.start, test.end, test.step)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("[%v:%v:%v] = %v, want %v", test.start, test.end, test.step, got, test.want)
+		}
+	}
+}
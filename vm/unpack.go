@@ -0,0 +1,71 @@
+package vm
+
+import (
+	"fmt"
+	"golox/value"
+	"golox/value/objtype"
+)
+
+// unpackList replaces the list on top of the stack with its items, for
+// destructuring into pattern. With hasRest the items after the first count
+// are pushed as one more list, otherwise there must be exactly count.
+func (vm *VM) unpackList(count int, hasRest bool, pattern string) bool {
+	subject := vm.peek(0)
+	if !subject.IsOBjType(objtype.OBJ_LIST) {
+		vm.runtimeError(fmt.Sprintf("Can only unpack a list into %s.", pattern))
+		return false
+	}
+
+	list := subject.AsObjList().List
+	if hasRest && len(list) < count {
+		vm.runtimeError(fmt.Sprintf("Expected at least %d values to unpack into %s but got %d.", count, pattern, len(list)))
+		return false
+	}
+	if !hasRest && len(list) != count {
+		vm.runtimeError(fmt.Sprintf("Expected %d values to unpack into %s but got %d.", count, pattern, len(list)))
+		return false
+	}
+	if vm.stackTop+count >= len(vm.stack) {
+		vm.runtimeError("Stack overflow.")
+		return false
+	}
+
+	vm.pop()
+	for _, item := range list[:count] {
+		vm.push(item)
+	}
+	if hasRest {
+		rest := make([]value.Value, len(list)-count)
+		copy(rest, list[count:])
+		vm.push(value.ValObjList(rest))
+	}
+
+	return true
+}
+
+// unpackMap replaces the map on top of the stack with its values for keys,
+// which must all be present, for destructuring into pattern.
+func (vm *VM) unpackMap(keys []value.Value, pattern string) bool {
+	subject := vm.peek(0)
+	if !subject.IsOBjType(objtype.OBJ_MAP) {
+		vm.runtimeError(fmt.Sprintf("Can only unpack a map into %s.", pattern))
+		return false
+	}
+	if vm.stackTop+len(keys) >= len(vm.stack) {
+		vm.runtimeError("Stack overflow.")
+		return false
+	}
+
+	objMap := subject.AsObjMap()
+	vm.pop()
+	for _, key := range keys {
+		val, ok := objMap.Get(key)
+		if !ok {
+			vm.runtimeError(fmt.Sprintf("Missing key '%s' to unpack into %s.", key.AsGoString(), pattern))
+			return false
+		}
+		vm.push(val)
+	}
+
+	return true
+}
@@ -3,17 +3,21 @@ package vm
 import (
 	"encoding/binary"
 	"fmt"
+	"golox/arith"
 	"golox/builtins"
 	"golox/chunk"
 	"golox/chunk/opcode"
 	"golox/compiler"
 	"golox/config"
+	"golox/interp"
+	"golox/ir"
 	"golox/value"
+	"golox/value/genstate"
 	"golox/value/objtype"
 	"golox/value/valuetype"
 	"golox/vm/interpretresult"
-	"os"
-	"unsafe"
+	"path/filepath"
+	"time"
 )
 
 const (
@@ -26,36 +30,80 @@ type VM struct {
 	stack        []value.Value
 	frames       []CallFrame
 	openUpvalues []*value.ObjUpvalue
-	globals      map[string]value.Value
+	builtins     map[string]value.Value
+	main         *value.ObjModule
+	modules      map[string]*value.ObjModule
+	loading      []*value.ObjModule
+	intrinsics   []func(argCount int) bool
+	aborted      bool // set by a runtime error until the next Interpret
+
+	// SearchPath lists the directories searched for modules that aren't
+	// found next to the importing file.
+	SearchPath []string
+
+	// Optimize runs the bytecode optimizer over the code compiled, which
+	// Init turns on.
+	Optimize bool
+
+	// IR also runs the code compiled through its SSA form and the passes
+	// over it, for the functions that can be.
+	IR bool
+
+	// Dispatches counts the instructions run.
+	Dispatches int
+
+	// Elapsed is how long the last program took to run, leaving out
+	// compiling it.
+	Elapsed time.Duration
+
+	baseline *baseline // the JIT's state, nil unless EnableJIT was called
+	debugger *debugger // set while Debug runs a program
 }
 
 type CallFrame struct {
-	slots   int
-	ip      *byte
-	closure *value.ObjClosure
+	slots     int
+	ip        int // the offset of the next instruction, kept in a local by run
+	closure   *value.ObjClosure
+	module    *value.ObjModule    // set when the frame runs an imported module's body
+	generator *value.ObjGenerator // set when the frame runs a resumed generator
+
+	// a generator resumed by a for-in loop ends the loop when it returns,
+	// jumping to iterExit with the stack cut back to iterTop. It's 0 for
+	// other frames, as the exit is never the start of a function
+	iterExit int
+	iterTop  int
+	iterInit bool // set when the frame runs an iter() whose result is iterated over
 }
 
 func (vm *VM) resetStack() {
 	vm.stackTop = 0
 	vm.stack = make([]value.Value, STACK_INITIAL_SIZE)
 	vm.frames = make([]CallFrame, 0, FRAMES_INITIAL_SIZE)
-	vm.globals = make(map[string]value.Value)
+	vm.openUpvalues = nil
+	vm.abortImports()
+	if vm.baseline != nil {
+		vm.baseline.reset()
+	}
 }
 
 func (vm *VM) initBuiltins() {
-	vm.defineNative("clock", builtins.Clock)
-
-	vm.defineNative("mod", builtins.Mod)
+	for _, native := range interp.Natives {
+		vm.defineNative(native.Name, native.Function)
+	}
 
-	vm.defineNative("list", builtins.List)
-	vm.defineNative("append", builtins.Append)
-	vm.defineNative("len", builtins.Len)
-	vm.defineNative("pop", builtins.Pop)
+	vm.defineIntrinsic("next", vm.next)
+	vm.defineIntrinsic("send", vm.send)
+	vm.defineNative("done", builtins.Done)
 }
 
 func (vm *VM) Init() {
+	vm.builtins = make(map[string]value.Value)
+	vm.intrinsics = nil
+	vm.main = value.NewObjModule("main", "")
+	vm.modules = make(map[string]*value.ObjModule)
 	vm.resetStack()
 	vm.initBuiltins()
+	vm.Optimize = true
 }
 
 func (vm *VM) push(value value.Value) {
@@ -72,80 +120,52 @@ func (vm *VM) peek(distance int) value.Value {
 	return vm.stack[vm.stackTop-distance-1]
 }
 
-func (vm *VM) readByte() uint8 {
-	frame := &vm.frames[len(vm.frames)-1]
-	instruction := *frame.ip
-	frame.ip = incr(frame.ip, 1)
-	return instruction
-}
-
-func (vm *VM) readTwoBytes() uint16 {
-	frame := &vm.frames[len(vm.frames)-1]
-	bytes := make([]uint8, 2)
-	bytes[0] = *frame.ip
-	frame.ip = incr(frame.ip, 1)
-	bytes[1] = *frame.ip
-	frame.ip = incr(frame.ip, 1)
-	return binary.LittleEndian.Uint16(bytes)
-}
-
-func (vm *VM) readFourBytes() uint32 {
-	frame := &vm.frames[len(vm.frames)-1]
-	bytes := make([]uint8, 4)
-	for i := 0; i < 4; i++ {
-		bytes[i] = *frame.ip
-		frame.ip = incr(frame.ip, 1)
-	}
-	return binary.LittleEndian.Uint32(bytes)
-}
-
-func (vm *VM) readConstant() value.Value {
-	frame := &vm.frames[len(vm.frames)-1]
-	chunk := frame.closure.Function.Chunk.(*chunk.Chunk)
-	return chunk.Constants[vm.readByte()]
-}
-
-func incr(pointer *byte, steps int) *byte {
-	addressHolder := uintptr(unsafe.Pointer(pointer))
-	addressHolder = addressHolder + unsafe.Sizeof(*(pointer))*uintptr(steps)
-	return (*byte)(unsafe.Pointer(addressHolder))
-}
-
-func decr(pointer *byte, steps int) *byte {
-	addressHolder := uintptr(unsafe.Pointer(pointer))
-	addressHolder = addressHolder - unsafe.Sizeof(*(pointer))*uintptr(steps)
-	return (*byte)(unsafe.Pointer(addressHolder))
-}
-
-func diff(p1 *byte, p2 *byte) int {
-	return int(uintptr(unsafe.Pointer(p1)) - uintptr(unsafe.Pointer(p2)))
+// chunk is the chunk of the function frame runs.
+func (frame *CallFrame) chunk() *chunk.Chunk {
+	return frame.closure.Function.Chunk.(*chunk.Chunk)
 }
 
 func (vm *VM) runtimeError(err string) {
 	fmt.Println(err)
+	if vm.debugger != nil {
+		if vm.debugger.evaluating {
+			// the expression is unwound by the debugger, leaving the
+			// program as it was
+			vm.aborted = true
+			return
+		}
+		// the stack can still be looked at before it's unwound
+		vm.debugger.pause(vm)
+	}
+	vm.aborted = true
 
+	frames := make([]interp.Frame, 0, len(vm.frames))
 	for i := len(vm.frames) - 1; i >= 0; i-- {
 		frame := &vm.frames[i]
-		function := frame.closure.Function
-		// -1 because the IP is sitting on the next instruction to be
-		// executed.
-		chunk := frame.closure.Function.Chunk.(*chunk.Chunk)
-		offset := diff(frame.ip, &((chunk.Code)[0]))
-		line := (chunk.Lines)[offset]
-		fmt.Fprintf(os.Stderr, "[line %d] in ", line)
-		if function.Name == nil {
-			fmt.Fprintf(os.Stderr, "script\n")
-		} else {
-			fmt.Fprintf(os.Stderr, "%s()\n", function.Name.String)
+		// ip is past the start of the instruction that failed
+		if inlined := frame.chunk().InlinedAt(frame.ip - 1); inlined != nil {
+			frames = append(frames, interp.Frame{Function: inlined.Function, Line: inlined.Line})
+		}
+		traced := interp.Frame{Line: frame.chunk().Lines[frame.ip]}
+		if function := frame.closure.Function; function.Name != nil {
+			traced.Function = function.Name.String
 		}
+		frames = append(frames, traced)
 	}
+	interp.PrintTraceback(frames)
 
+	vm.finishGenerators()
 	vm.resetStack()
 }
 
+// call starts a frame for closure with argCount positional arguments on
+// the stack. Missing optional parameters are left undefined for the
+// prologue to fill in and extra arguments go into the rest parameter.
 func (vm *VM) call(closure *value.ObjClosure, argCount int) bool {
-	if argCount != closure.Function.Arity {
-		vm.runtimeError(fmt.Sprintf("Expect %d arguments but got %d.", closure.Function.Arity, argCount))
+	function := closure.Function
+
+	if argCount < function.RequiredArity || (argCount > function.Arity && !function.Variadic) {
+		vm.runtimeError(interp.ArityError(function, argCount))
 		return false
 	}
 
@@ -154,13 +174,125 @@ func (vm *VM) call(closure *value.ObjClosure, argCount int) bool {
 		return false
 	}
 
-	chunk := closure.Function.Chunk.(*chunk.Chunk)
-	frame := CallFrame{closure: closure, ip: &((chunk.Code)[0]), slots: vm.stackTop - argCount - 1}
+	for ; argCount < function.Arity; argCount++ {
+		vm.push(value.ValUndefined())
+	}
+
+	if function.Variadic {
+		extra := argCount - function.Arity
+		rest := make([]value.Value, extra)
+		copy(rest, vm.stack[vm.stackTop-extra:vm.stackTop])
+		vm.stackTop -= extra
+		vm.push(value.ValObjList(rest))
+		argCount = function.Arity + 1
+	}
+
+	if function.IsGenerator {
+		vm.newGenerator(closure, argCount)
+		return true
+	}
+
+	frame := CallFrame{closure: closure, slots: vm.stackTop - argCount - 1}
 	vm.frames = append(vm.frames, frame)
 
+	if vm.baseline != nil {
+		if compiled := vm.baseline.promote(function); compiled != nil {
+			return vm.runCompiled(compiled)
+		}
+	}
+
 	return true
 }
 
+// callKeywords binds argCount positional arguments on the stack and the
+// keyword arguments to closure's parameters before calling it.
+func (vm *VM) callKeywords(closure *value.ObjClosure, argCount int, names []string, kwValues []value.Value) bool {
+	function := closure.Function
+
+	if argCount > function.Arity && !function.Variadic {
+		vm.runtimeError(interp.ArityError(function, argCount+len(names)))
+		return false
+	}
+
+	args := make([]value.Value, function.Arity)
+	for i := range args {
+		args[i] = value.ValUndefined()
+	}
+
+	positional := vm.stack[vm.stackTop-argCount : vm.stackTop]
+	copy(args, positional)
+	var extra []value.Value
+	if argCount > function.Arity {
+		extra = append(extra, positional[function.Arity:]...)
+	}
+
+	for i, name := range names {
+		index := -1
+		for j, param := range function.ParamNames {
+			if param == name {
+				index = j
+				break
+			}
+		}
+		if index == -1 {
+			vm.runtimeError(fmt.Sprintf("Unexpected keyword argument '%s'.", name))
+			return false
+		}
+		if !args[index].IsUndefined() {
+			vm.runtimeError(fmt.Sprintf("Got multiple values for argument '%s'.", name))
+			return false
+		}
+		args[index] = kwValues[i]
+	}
+
+	for i := 0; i < function.RequiredArity; i++ {
+		if args[i].IsUndefined() {
+			vm.runtimeError(fmt.Sprintf("Missing argument '%s'.", function.ParamNames[i]))
+			return false
+		}
+	}
+
+	vm.stackTop -= argCount
+	for _, arg := range args {
+		vm.push(arg)
+	}
+	for _, arg := range extra {
+		vm.push(arg)
+	}
+
+	return vm.call(closure, len(args)+len(extra))
+}
+
+// callEx performs an OP_CALL_EX: the stack holds the callee, a list of the
+// positional arguments and then the keyword argument values.
+func (vm *VM) callEx(names []string) bool {
+	kwValues := make([]value.Value, len(names))
+	copy(kwValues, vm.stack[vm.stackTop-len(names):vm.stackTop])
+	vm.stackTop -= len(names)
+
+	positional := vm.pop().AsObjList().List
+	callee := vm.peek(0)
+
+	if vm.stackTop+len(positional) > len(vm.stack) {
+		vm.runtimeError("Stack overflow.")
+		return false
+	}
+	for _, arg := range positional {
+		vm.push(arg)
+	}
+
+	if len(names) == 0 {
+		return vm.callValue(callee, len(positional))
+	}
+
+	if !callee.IsOBjType(objtype.OBJ_CLOSURE) {
+		vm.runtimeError("Only Lox functions take keyword arguments.")
+		return false
+	}
+
+	return vm.callKeywords(callee.AsObjClosure(), len(positional), names, kwValues)
+}
+
 func (vm *VM) callValue(callee value.Value, argCount int) bool {
 	if callee.IsObj() {
 		switch callee.AsObj().Type {
@@ -168,7 +300,11 @@ func (vm *VM) callValue(callee value.Value, argCount int) bool {
 			return vm.call(value.NewObjClosure(callee.AsObjFunction()), argCount)
 		case objtype.OBJ_NATIVE:
 			native := callee.AsNative()
-			result, err := (native)(argCount, vm.stack[vm.stackTop-argCount:])
+			result, err := (native)(vm, argCount, vm.stack[vm.stackTop-argCount:])
+			if vm.aborted {
+				// a call the native made has already reported an error
+				return false
+			}
 			if len(err) > 0 {
 				vm.runtimeError(err)
 				return false
@@ -179,6 +315,8 @@ func (vm *VM) callValue(callee value.Value, argCount int) bool {
 		case objtype.OBJ_CLOSURE:
 			closure := callee.AsObjClosure()
 			return vm.call(closure, argCount)
+		case objtype.OBJ_INTRINSIC:
+			return vm.intrinsics[callee.AsObjIntrinsic().ID](argCount)
 		}
 	}
 
@@ -186,59 +324,107 @@ func (vm *VM) callValue(callee value.Value, argCount int) bool {
 	return false
 }
 
-func (vm *VM) binaryOp(op rune) {
-	if vm.peek(0).IsNumber() && vm.peek(1).IsNumber() {
-		a := vm.pop().AsNumber()
-		b := vm.pop().AsNumber()
-		switch op {
-		case '>':
-			vm.push(value.ValBool(b > a))
-		case '<':
-			vm.push(value.ValBool(b < a))
-		case '+':
-			vm.push(value.ValNumber(b + a))
-		case '-':
-			vm.push(value.ValNumber(b - a))
-		case '*':
-			vm.push(value.ValNumber(b * a))
-		case '/':
-			vm.push(value.ValNumber(b / a))
-		}
-	} else {
-		vm.runtimeError("Operands must be numbers.")
+// replaceOperands replaces the two operands on top of the stack with the
+// result of an operator.
+func (vm *VM) replaceOperands(result value.Value) {
+	vm.stackTop--
+	vm.stack[vm.stackTop-1] = result
+}
+
+// errorAt reports a runtime error raised by an instruction of frame, with
+// ip where run had got to.
+func (vm *VM) errorAt(frame *CallFrame, ip int, err string) interpretresult.InterpretResult {
+	frame.ip = ip
+	vm.runtimeError(err)
+	return interpretresult.INTERPRET_RUNTIME_ERROR
+}
+
+// getIndex evaluates container[index] for lists, strings and maps.
+func (vm *VM) getIndex(container value.Value, index value.Value) (value.Value, bool) {
+	val, err := arith.Index(container, index)
+	if len(err) > 0 {
+		vm.runtimeError(err)
+		return value.ValNil(), false
 	}
+	return val, true
+}
+
+// setIndex performs container[index] = newValue for lists and maps.
+func (vm *VM) setIndex(container value.Value, index value.Value, newValue value.Value) bool {
+	if err := arith.SetIndex(container, index, newValue); len(err) > 0 {
+		vm.runtimeError(err)
+		return false
+	}
+	return true
 }
 
 func (vm *VM) defineNative(name string, function value.NativeFn) {
-	vm.globals[name] = value.ValNative(function)
+	vm.builtins[name] = value.ValNative(function)
 }
 
-func (vm *VM) captureUpvalue(l *value.Value) *value.ObjUpvalue {
+// getGlobal looks a global up in the module's own namespace and then in
+// the builtins shared by every module, returning an error if it's in
+// neither. The interpreter and the JIT's helper both read globals with it.
+func (vm *VM) getGlobal(module *value.ObjModule, name string) (value.Value, string) {
+	if val, ok := module.Globals[name]; ok {
+		return val, ""
+	}
+	if val, ok := vm.builtins[name]; ok {
+		return val, ""
+	}
+	return value.ValNil(), interp.UndefinedVariable(name)
+}
+
+// setGlobal assigns val to a global of module that isn't a constant, or
+// returns the error for assigning to it. Builtins can't be assigned to
+// until they've been redefined by the module.
+func setGlobal(module *value.ObjModule, name string, val value.Value) string {
+	if _, ok := module.Globals[name]; !ok {
+		return interp.UndefinedVariable(name)
+	}
+	if module.Consts[name] {
+		return fmt.Sprintf("Can't assign to constant '%s'.", name)
+	}
+	module.Globals[name] = val
+	return ""
+}
+
+func (vm *VM) captureUpvalue(slot int) *value.ObjUpvalue {
 	for _, up := range vm.openUpvalues {
-		if up.Location == l {
+		if up.Slot == slot {
 			return up
 		}
 	}
 
-	upvalue := value.NewObjUpvalue(l)
-	upvalue.Closed = *upvalue.Location
-	upvalue.Location = &upvalue.Closed
+	upvalue := value.NewObjUpvalue(&vm.stack[slot], slot)
 	vm.openUpvalues = append(vm.openUpvalues, upvalue)
 
 	return upvalue
 }
 
-func (vm *VM) removeUpvalue(l *value.Value) {
-	for i, up := range vm.openUpvalues {
-		if up.Location == l {
-			vm.openUpvalues = append(vm.openUpvalues[:i], vm.openUpvalues[i+1:]...)
-			return
+// closeUpvalues closes every open upvalue for a stack slot at or above
+// last.
+func (vm *VM) closeUpvalues(last int) {
+	open := vm.openUpvalues[:0]
+	for _, up := range vm.openUpvalues {
+		if up.Slot >= last {
+			up.Close()
+		} else {
+			open = append(open, up)
 		}
 	}
+	vm.openUpvalues = open
 }
 
-func (vm *VM) run() interpretresult.InterpretResult {
+// run executes instructions until the frame count drops back to base,
+// which is 0 for a whole script and more for a nested call from a native.
+//
+// The running frame's code, constants and ip are kept in locals. The ip
+// is stored back in the frame before anything that can call, return or
+// report an error, and the locals are loaded again when the frame changes.
+func (vm *VM) run(base int) interpretresult.InterpretResult {
 	frame := &vm.frames[len(vm.frames)-1]
+	code, constants, ip := frame.chunk().Code, frame.chunk().Constants, frame.ip
 
 	for {
 		if config.DEBUG_TRACE_EXECUTION {
@@ -253,40 +439,97 @@ func (vm *VM) run() interpretresult.InterpretResult {
 			// fmt.Printf("\t  upvalues: %v\n", vm.openUpvalues)
 		}
 
-		switch vm.readByte() {
+		if vm.debugger != nil && !vm.debugger.evaluating {
+			frame.ip = ip
+			if !vm.debugger.check(vm) {
+				// unwinds the loops as an error does, for Debug to tell
+				vm.aborted = true
+				return interpretresult.INTERPRET_STOPPED
+			}
+		}
+
+		vm.Dispatches++
+		instruction := code[ip]
+		ip++
+		switch instruction {
 
 		case opcode.OP_CONSTANT:
-			constant := vm.readConstant()
+			constant := constants[code[ip]]
+			ip++
 			vm.push(constant)
 
 		case opcode.OP_ADD:
+			a, b := vm.peek(1), vm.peek(0)
+			observe(frame.chunk(), ip-1, a, b)
+			result, err := arith.Add(a, b)
+			if len(err) > 0 {
+				return vm.errorAt(frame, ip, err)
+			}
+			vm.replaceOperands(result)
+
+		case opcode.OP_ADD_NUM:
+			a, b := vm.peek(1), vm.peek(0)
+			if !a.IsNumeric() || !b.IsNumeric() {
+				deopt(frame.chunk(), ip-1, opcode.OP_ADD)
+				ip--
+				continue
+			}
+			vm.replaceOperands(arith.AddNumbers(a, b))
+
+		case opcode.OP_ADD_STR:
+			a, b := vm.peek(1), vm.peek(0)
+			if !a.IsString() || !b.IsString() {
+				deopt(frame.chunk(), ip-1, opcode.OP_ADD)
+				ip--
+				continue
+			}
+			vm.replaceOperands(value.ValObjString(a.AsGoString() + b.AsGoString()))
 
-			if vm.peek(0).IsString() && vm.peek(1).IsString() {
-				a := vm.pop().AsGoString()
-				b := vm.pop().AsGoString()
-				vm.push(value.ValObjString(b + a))
-			} else if vm.peek(1).IsString() {
-				strfied := vm.pop().Stringify()
-				str := vm.pop().AsGoString()
-				vm.push(value.ValObjString(str + strfied))
-			} else if vm.peek(0).IsString() {
-				str := vm.pop().AsGoString()
-				strfied := vm.pop().Stringify()
-				vm.push(value.ValObjString(strfied + str))
-			} else {
-				vm.binaryOp('+')
-			}
-
-		case opcode.OP_SUBTRACT:
-			vm.binaryOp('-')
-		case opcode.OP_MULTIPLY:
-			vm.binaryOp('*')
-		case opcode.OP_DIVIDE:
-			vm.binaryOp('/')
-		case opcode.OP_GREATER:
-			vm.binaryOp('>')
 		case opcode.OP_LESS:
-			vm.binaryOp('<')
+			a, b := vm.peek(1), vm.peek(0)
+			observe(frame.chunk(), ip-1, a, b)
+			result, err := arith.Binary(instruction, a, b)
+			if len(err) > 0 {
+				return vm.errorAt(frame, ip, err)
+			}
+			vm.replaceOperands(result)
+
+		case opcode.OP_LESS_NUM:
+			a, b := vm.peek(1), vm.peek(0)
+			if !a.IsNumeric() || !b.IsNumeric() {
+				deopt(frame.chunk(), ip-1, opcode.OP_LESS)
+				ip--
+				continue
+			}
+			vm.replaceOperands(value.ValBool(arith.LessNumbers(a, b)))
+
+		case opcode.OP_ADD_CONST:
+			constant := constants[code[ip]]
+			ip++
+			result, err := arith.Add(vm.peek(0), constant)
+			if len(err) > 0 {
+				return vm.errorAt(frame, ip, err)
+			}
+			vm.stack[vm.stackTop-1] = result
+
+		case opcode.OP_SUBTRACT, opcode.OP_MULTIPLY, opcode.OP_DIVIDE, opcode.OP_MODULO, opcode.OP_GREATER:
+			result, err := arith.Binary(instruction, vm.peek(1), vm.peek(0))
+			if len(err) > 0 {
+				return vm.errorAt(frame, ip, err)
+			}
+			vm.replaceOperands(result)
+		case opcode.OP_BIT_AND, opcode.OP_BIT_OR, opcode.OP_BIT_XOR, opcode.OP_SHIFT_LEFT, opcode.OP_SHIFT_RIGHT:
+			result, err := arith.Bitwise(instruction, vm.peek(1), vm.peek(0))
+			if len(err) > 0 {
+				return vm.errorAt(frame, ip, err)
+			}
+			vm.replaceOperands(result)
+		case opcode.OP_BIT_NOT:
+			result, err := arith.BitNot(vm.peek(0))
+			if len(err) > 0 {
+				return vm.errorAt(frame, ip, err)
+			}
+			vm.stack[vm.stackTop-1] = result
 		case opcode.OP_NIL:
 			vm.push(value.ValNil())
 		case opcode.OP_TRUE:
@@ -296,52 +539,74 @@ func (vm *VM) run() interpretresult.InterpretResult {
 		case opcode.OP_EQUAL:
 			vm.push(value.ValBool(value.AreEqual(vm.pop(), vm.pop())))
 		case opcode.OP_NEGATE:
-			vm.stack[vm.stackTop-1] = value.ValNumber(-vm.stack[vm.stackTop-1].AsNumber())
+			result, err := arith.Negate(vm.peek(0))
+			if len(err) > 0 {
+				return vm.errorAt(frame, ip, err)
+			}
+			vm.stack[vm.stackTop-1] = result
 		case opcode.OP_NOT:
 			vm.push(value.ValBool(!vm.pop().IsTruey()))
 		case opcode.OP_POP:
-			val := vm.pop()
-			if val.Type == valuetype.VAL_OBJ && val.AsObj().Type == objtype.OBJ_CLOSURE {
-				closure := val.AsObjClosure()
-				for _, up := range closure.Upvalues {
-					vm.removeUpvalue(up.Location)
-				}
-			}
+			vm.pop()
+		case opcode.OP_CLOSE_UPVALUE:
+			vm.closeUpvalues(vm.stackTop - 1)
+			vm.pop()
 		case opcode.OP_PRINT:
 			vm.pop().Print()
 			fmt.Println()
 		case opcode.OP_DEFINE_GLOBAL:
-			name := vm.readConstant().AsGoString()
-			_, ok := vm.globals[name]
+			name := constants[code[ip]].AsGoString()
+			ip++
+			globals := frame.closure.Module.Globals
+			_, ok := globals[name]
 			if ok {
-				vm.runtimeError(fmt.Sprintf("Variable %s is already defined.", name))
-			} else {
-				vm.globals[name] = vm.pop()
+				return vm.errorAt(frame, ip, fmt.Sprintf("Variable %s is already defined.", name))
 			}
+			globals[name] = vm.pop()
+		case opcode.OP_DEFINE_CONST:
+			name := constants[code[ip]].AsGoString()
+			ip++
+			module := frame.closure.Module
+			if _, ok := module.Globals[name]; ok {
+				return vm.errorAt(frame, ip, fmt.Sprintf("Variable %s is already defined.", name))
+			}
+			module.Globals[name] = vm.pop()
+			module.Consts[name] = true
 		case opcode.OP_GET_GLOBAL:
-			name := vm.readConstant().AsGoString()
-			val, ok := vm.globals[name]
-			if !ok {
-				vm.runtimeError(fmt.Sprintf("Undefined variable '%s'.", name))
-				return interpretresult.INTERPRET_RUNTIME_ERROR
+			name := constants[code[ip]].AsGoString()
+			ip++
+			val, err := vm.getGlobal(frame.closure.Module, name)
+			if len(err) > 0 {
+				return vm.errorAt(frame, ip, err)
 			}
 			vm.push(val)
 		case opcode.OP_SET_GLOBAL:
-			name := vm.readConstant().AsGoString()
-			_, ok := vm.globals[name]
-			if !ok {
-				vm.runtimeError(fmt.Sprintf("Undefined variable '%s'.", name))
-				return interpretresult.INTERPRET_RUNTIME_ERROR
+			name := constants[code[ip]].AsGoString()
+			ip++
+			if err := setGlobal(frame.closure.Module, name, vm.peek(0)); len(err) > 0 {
+				return vm.errorAt(frame, ip, err)
 			}
-			vm.globals[name] = vm.peek(0)
 		case opcode.OP_GET_LOCAL:
-			slot := vm.readByte()
+			slot := code[ip]
+			ip++
 			vm.push(vm.stack[frame.slots+int(slot)])
 		case opcode.OP_SET_LOCAL:
-			slot := vm.readByte()
+			slot := code[ip]
+			ip++
 			vm.stack[frame.slots+int(slot)] = vm.peek(0)
+		case opcode.OP_GET_LOCAL_0, opcode.OP_GET_LOCAL_1, opcode.OP_GET_LOCAL_2, opcode.OP_GET_LOCAL_3:
+			vm.push(vm.stack[frame.slots+int(instruction-opcode.OP_GET_LOCAL_0)])
+		case opcode.OP_INCR_LOCAL:
+			slot := frame.slots + int(code[ip])
+			ip++
+			result, err := arith.Add(vm.stack[slot], value.ValInt(1))
+			if len(err) > 0 {
+				return vm.errorAt(frame, ip, err)
+			}
+			vm.stack[slot] = result
 		case opcode.OP_LIST:
-			count := int(vm.readByte())
+			count := int(code[ip])
+			ip++
 			list := make([]value.Value, count)
 			for i := count; i > 0; i-- {
 				list[count-i] = vm.peek(i - 1)
@@ -351,95 +616,284 @@ func (vm *VM) run() interpretresult.InterpretResult {
 				vm.pop()
 			}
 			vm.push(value.ValObjList(list))
+		case opcode.OP_MAP:
+			count := int(code[ip])
+			ip++
+			objMap := value.NewObjMap()
+			for i := count * 2; i > 0; i -= 2 {
+				objMap.Set(vm.peek(i-1), vm.peek(i-2))
+			}
+			vm.stackTop -= count * 2
+			vm.push(value.ValObjMap(objMap))
 		case opcode.OP_INDEX:
 			valueIndex := vm.pop()
 			valueList := vm.pop()
 
-			if valueList.AsObj().Type != objtype.OBJ_LIST {
-				vm.runtimeError("Invalid type to index into.")
+			frame.ip = ip
+			val, ok := vm.getIndex(valueList, valueIndex)
+			if !ok {
+				return interpretresult.INTERPRET_RUNTIME_ERROR
+			}
+
+			vm.push(val)
+
+		case opcode.OP_STORE:
+
+			newValue := vm.pop()
+			valueIndex := vm.pop()
+			valueList := vm.pop()
+
+			frame.ip = ip
+			if !vm.setIndex(valueList, valueIndex, newValue) {
 				return interpretresult.INTERPRET_RUNTIME_ERROR
 			}
 
-			objList := valueList.AsObjList()
+			vm.push(newValue)
 
-			if valueIndex.Type != valuetype.VAL_NUMBER {
-				vm.runtimeError("List index is not a number.")
+		case opcode.OP_MATCH_LIST:
+
+			count := int(code[ip])
+			ip++
+			hasRest := code[ip] == 1
+			ip++
+			subject := vm.pop()
+			matches := false
+			if subject.IsOBjType(objtype.OBJ_LIST) {
+				length := len(subject.AsObjList().List)
+				matches = length == count || hasRest && length > count
+			}
+			vm.push(value.ValBool(matches))
+
+		case opcode.OP_UNPACK_LIST:
+
+			count := int(code[ip])
+			ip++
+			hasRest := code[ip] == 1
+			ip++
+			pattern := constants[code[ip]].AsGoString()
+			ip++
+			frame.ip = ip
+			if !vm.unpackList(count, hasRest, pattern) {
 				return interpretresult.INTERPRET_RUNTIME_ERROR
 			}
 
-			index := valueIndex.AsNumber()
+		case opcode.OP_UNPACK_MAP:
 
-			if int(index) >= len(objList.List) {
-				vm.runtimeError("List index out of range.")
+			count := int(code[ip])
+			ip++
+			pattern := constants[code[ip]].AsGoString()
+			ip++
+			keys := make([]value.Value, count)
+			for i := range keys {
+				keys[i] = constants[code[ip]]
+				ip++
+			}
+			frame.ip = ip
+			if !vm.unpackMap(keys, pattern) {
 				return interpretresult.INTERPRET_RUNTIME_ERROR
 			}
 
-			vm.push(objList.List[int(index)])
+		case opcode.OP_JUMP_TABLE:
 
-		case opcode.OP_STORE:
+			low := constants[code[ip]].AsInt()
+			ip++
+			count := int(binary.LittleEndian.Uint16(code[ip:]))
+			target := int(binary.LittleEndian.Uint16(code[ip+2:]))
+			// low+count-1 is the largest case, so it can't overflow
+			if index, ok := arith.IntIndex(vm.pop()); ok && int64(index) >= low && int64(index) <= low+int64(count)-1 {
+				entry := int(int64(index) - low)
+				target = int(binary.LittleEndian.Uint16(code[ip+4+2*entry:]))
+			}
+			ip = target
 
-			newValue := vm.pop()
-			valueIndex := vm.pop()
-			valueList := vm.pop()
+		case opcode.OP_SLICE:
+
+			step := vm.pop()
+			end := vm.pop()
+			start := vm.pop()
+			container := vm.pop()
 
-			if valueList.AsObj().Type != objtype.OBJ_LIST {
-				vm.runtimeError("Invalid type to index into.")
+			frame.ip = ip
+			result, ok := vm.getSlice(container, start, end, step)
+			if !ok {
 				return interpretresult.INTERPRET_RUNTIME_ERROR
 			}
 
-			objList := valueList.AsObjList()
+			vm.push(result)
+
+		case opcode.OP_STORE_SLICE:
+
+			items := vm.pop()
+			step := vm.pop()
+			end := vm.pop()
+			start := vm.pop()
+			container := vm.pop()
 
-			if valueIndex.Type != valuetype.VAL_NUMBER {
-				vm.runtimeError("List index is not a number.")
+			frame.ip = ip
+			if !vm.setSlice(container, start, end, step, items) {
 				return interpretresult.INTERPRET_RUNTIME_ERROR
 			}
 
-			index := valueIndex.AsNumber()
+			vm.push(items)
 
-			if int(index) >= len(objList.List) {
-				vm.runtimeError("List index out of range.")
+		case opcode.OP_STORE_POSTFIX:
+
+			// like OP_STORE but leaves the value below the list, the
+			// old value for `a[i]++`
+			newValue := vm.pop()
+			oldValue := vm.pop()
+			valueIndex := vm.pop()
+			valueList := vm.pop()
+
+			frame.ip = ip
+			if !vm.setIndex(valueList, valueIndex, newValue) {
 				return interpretresult.INTERPRET_RUNTIME_ERROR
 			}
 
-			objList.List[int(index)] = newValue
+			vm.push(oldValue)
 
-			vm.push(newValue)
+		case opcode.OP_LIST_APPEND:
+			item := vm.pop()
+			objList := vm.peek(0).AsObjList()
+			objList.List = append(objList.List, item)
+		case opcode.OP_LIST_EXTEND:
+			items := vm.pop()
+			if !items.IsOBjType(objtype.OBJ_LIST) {
+				return vm.errorAt(frame, ip, "Can only spread lists.")
+			}
+			objList := vm.peek(0).AsObjList()
+			objList.List = append(objList.List, items.AsObjList().List...)
+		case opcode.OP_DUP:
+			vm.push(vm.peek(0))
+		case opcode.OP_DUP2:
+			vm.push(vm.peek(1))
+			vm.push(vm.peek(1))
+		case opcode.OP_PEEK:
+			vm.push(vm.peek(int(code[ip])))
+			ip++
+
+		case opcode.OP_CHECK_INLINE:
+
+			function := constants[code[ip]].AsObjFunction()
+			callee := vm.peek(int(code[ip+1]))
+			offset := int(binary.LittleEndian.Uint16(code[ip+2:]))
+			ip += 4
+			if !callee.IsOBjType(objtype.OBJ_CLOSURE) || callee.AsObjClosure().Function != function {
+				ip += offset
+			}
+		case opcode.OP_INLINE_RETURN:
+			result := vm.pop()
+			vm.stackTop -= int(code[ip]) + 1
+			ip++
+			vm.push(result)
 
 		case opcode.OP_JUMP_IF_FALSE:
 
-			offset := vm.readTwoBytes()
+			offset := int(binary.LittleEndian.Uint16(code[ip:]))
+			ip += 2
 			if !vm.peek(0).IsTruey() {
-				frame.ip = incr(frame.ip, int(offset))
+				ip += offset
+			}
+
+		case opcode.OP_JUMP_IF_TRUE:
+
+			offset := int(binary.LittleEndian.Uint16(code[ip:]))
+			ip += 2
+			if vm.peek(0).IsTruey() {
+				ip += offset
+			}
+
+		case opcode.OP_LESS_JUMP_IF_FALSE:
+			offset := int(binary.LittleEndian.Uint16(code[ip:]))
+			ip += 2
+			result, err := arith.Binary(opcode.OP_LESS, vm.peek(1), vm.peek(0))
+			if len(err) > 0 {
+				return vm.errorAt(frame, ip, err)
+			}
+			vm.stackTop -= 2
+			if !result.AsBool() {
+				ip += offset
+			}
+
+		case opcode.OP_JUMP_IF_NIL:
+
+			offset := int(binary.LittleEndian.Uint16(code[ip:]))
+			ip += 2
+			if vm.peek(0).Type == valuetype.VAL_NIL {
+				ip += offset
+			}
+
+		case opcode.OP_JUMP_IF_NOT_NIL:
+
+			offset := int(binary.LittleEndian.Uint16(code[ip:]))
+			ip += 2
+			if vm.peek(0).Type != valuetype.VAL_NIL {
+				ip += offset
 			}
 
 		case opcode.OP_JUMP:
 
-			offset := vm.readTwoBytes()
-			frame.ip = incr(frame.ip, int(offset))
+			offset := int(binary.LittleEndian.Uint16(code[ip:]))
+			ip += 2
+			ip += offset
 
 		case opcode.OP_LOOP:
 
-			offset := vm.readTwoBytes()
-			frame.ip = decr(frame.ip, int(offset))
+			offset := int(binary.LittleEndian.Uint16(code[ip:]))
+			ip += 2
+			ip -= offset
 
 		case opcode.OP_CALL:
 
-			argCount := vm.readByte()
+			argCount := code[ip]
+			ip++
+			frame.ip = ip
 			if !vm.callValue(vm.peek(int(argCount)), int(argCount)) {
 				return interpretresult.INTERPRET_RUNTIME_ERROR
 			}
 			frame = &vm.frames[len(vm.frames)-1]
+			code, constants, ip = frame.chunk().Code, frame.chunk().Constants, frame.ip
+
+		case opcode.OP_CALL_EX:
+
+			kwCount := int(code[ip])
+			ip++
+			names := make([]string, kwCount)
+			for i := range names {
+				names[i] = constants[code[ip]].AsGoString()
+				ip++
+			}
+			frame.ip = ip
+			if !vm.callEx(names) {
+				return interpretresult.INTERPRET_RUNTIME_ERROR
+			}
+			frame = &vm.frames[len(vm.frames)-1]
+			code, constants, ip = frame.chunk().Code, frame.chunk().Constants, frame.ip
+
+		case opcode.OP_DEFAULT_ARG:
+
+			slot := code[ip]
+			ip++
+			offset := int(binary.LittleEndian.Uint16(code[ip:]))
+			ip += 2
+			if !vm.stack[frame.slots+int(slot)].IsUndefined() {
+				ip += offset
+			}
 
 		case opcode.OP_CLOSURE:
 
-			function := vm.readConstant().AsObjFunction()
+			function := constants[code[ip]].AsObjFunction()
+			ip++
 			closure := value.NewObjClosure(function)
+			closure.Module = frame.closure.Module
 
 			for i := 0; i < len(closure.Upvalues); i++ {
-				isLocal := vm.readByte()
-				index := vm.readByte()
+				isLocal := code[ip]
+				ip++
+				index := code[ip]
+				ip++
 				if isLocal == 1 {
-					closure.Upvalues[i] = vm.captureUpvalue(&vm.stack[frame.slots+int(index)])
+					closure.Upvalues[i] = vm.captureUpvalue(frame.slots + int(index))
 				} else {
 					closure.Upvalues[i] = frame.closure.Upvalues[index]
 				}
@@ -449,44 +903,181 @@ func (vm *VM) run() interpretresult.InterpretResult {
 
 		case opcode.OP_GET_UPVALUE:
 
-			slot := vm.readByte()
+			slot := code[ip]
+			ip++
 			vm.push(*frame.closure.Upvalues[slot].Location)
 
 		case opcode.OP_SET_UPVALUE:
 
-			slot := vm.readByte()
+			slot := code[ip]
+			ip++
 			*(frame.closure.Upvalues[slot].Location) = vm.peek(0)
 
+		case opcode.OP_IMPORT:
+
+			path := constants[code[ip]].AsGoString()
+			ip++
+			frame.ip = ip
+			if !vm.importModule(frame.closure.Module, path) {
+				return interpretresult.INTERPRET_RUNTIME_ERROR
+			}
+			frame = &vm.frames[len(vm.frames)-1]
+			code, constants, ip = frame.chunk().Code, frame.chunk().Constants, frame.ip
+
+		case opcode.OP_GET_PROPERTY:
+
+			name := constants[code[ip]].AsGoString()
+			ip++
+			frame.ip = ip
+			member, ok := vm.getProperty(vm.pop(), name)
+			if !ok {
+				return interpretresult.INTERPRET_RUNTIME_ERROR
+			}
+			vm.push(member)
+
+		case opcode.OP_ITER:
+
+			frame.ip = ip
+			if !vm.iterate() {
+				return interpretresult.INTERPRET_RUNTIME_ERROR
+			}
+			frame = &vm.frames[len(vm.frames)-1]
+			code, constants, ip = frame.chunk().Code, frame.chunk().Constants, frame.ip
+
+		case opcode.OP_FOR_ITER:
+
+			withIndex := code[ip] == 1
+			ip++
+			offset := int(binary.LittleEndian.Uint16(code[ip:]))
+			ip += 2
+			frame.ip = ip
+			if !vm.forIter(withIndex, ip+offset) {
+				return interpretresult.INTERPRET_RUNTIME_ERROR
+			}
+			frame = &vm.frames[len(vm.frames)-1]
+			code, constants, ip = frame.chunk().Code, frame.chunk().Constants, frame.ip
+
+		case opcode.OP_YIELD:
+
+			frame.ip = ip
+			vm.yield(vm.pop())
+			if len(vm.frames) == base {
+				return interpretresult.INTERPRET_OK
+			}
+			frame = &vm.frames[len(vm.frames)-1]
+			code, constants, ip = frame.chunk().Code, frame.chunk().Constants, frame.ip
+
 		case opcode.OP_RETURN:
 
 			result := vm.pop()
+			vm.closeUpvalues(frame.slots)
+			if frame.module != nil {
+				vm.finishModule(frame.module)
+				result = value.ValObjModule(frame.module)
+			}
+			if frame.generator != nil {
+				frame.generator.State = genstate.GEN_DONE
+				frame.generator.Stack = nil
+			}
 			vm.frames = vm.frames[:len(vm.frames)-1]
 			if len(vm.frames) == 0 {
 				return interpretresult.INTERPRET_OK
 			}
 
+			if frame.iterExit != 0 {
+				vm.stackTop = frame.iterTop
+				vm.frames[len(vm.frames)-1].ip = frame.iterExit
+				frame = &vm.frames[len(vm.frames)-1]
+				code, constants, ip = frame.chunk().Code, frame.chunk().Constants, frame.ip
+				break
+			}
+
 			for vm.stackTop != frame.slots {
 				vm.pop()
 			}
 
 			vm.push(result)
+			if frame.iterInit && !vm.makeIterator() {
+				return interpretresult.INTERPRET_RUNTIME_ERROR
+			}
+			if len(vm.frames) == base {
+				return interpretresult.INTERPRET_OK
+			}
 			frame = &vm.frames[len(vm.frames)-1]
+			code, constants, ip = frame.chunk().Code, frame.chunk().Constants, frame.ip
 		}
 	}
 }
 
+// Call calls callee with args from a native, running a nested run loop
+// until it returns. A runtime error inside unwinds every loop, nested or
+// not, so Call then returns false.
+func (vm *VM) Call(callee value.Value, args ...value.Value) (value.Value, bool) {
+	if vm.aborted {
+		return value.ValNil(), false
+	}
+
+	if vm.stackTop+len(args)+1 > len(vm.stack) {
+		vm.runtimeError("Stack overflow.")
+		return value.ValNil(), false
+	}
+
+	base := len(vm.frames)
+	vm.push(callee)
+	for _, arg := range args {
+		vm.push(arg)
+	}
+
+	if !vm.callValue(callee, len(args)) {
+		return value.ValNil(), false
+	}
+
+	// natives and calls that make a generator are done already
+	if len(vm.frames) > base && vm.run(base) != interpretresult.INTERPRET_OK {
+		return value.ValNil(), false
+	}
+
+	return vm.pop(), true
+}
+
+// compile compiles source as the vm is set up to.
+func (vm *VM) compile(source *string) *value.ObjFunction {
+	function := compiler.Compile(source, vm.Optimize)
+	if function != nil && vm.IR {
+		for _, f := range ir.Functions(function) {
+			// a function the IR can't handle keeps its bytecode
+			ir.Recompile(f)
+		}
+	}
+	return function
+}
+
 func (vm *VM) Interpret(source string) interpretresult.InterpretResult {
+	vm.aborted = false
 
-	function := compiler.Compile(&source)
+	function := vm.compile(&source)
 
 	if function == nil {
 		return interpretresult.INTERPRET_COMPILE_ERROR
 	}
 
 	closure := value.NewObjClosure(function)
+	closure.Module = vm.main
 	valClosure := value.ValObjClosure(closure)
 	// vm.push(valClosure) // useless?
 	vm.callValue(valClosure, 0)
 
-	return vm.run()
+	start := time.Now()
+	result := vm.run(0)
+	vm.Elapsed = time.Since(start)
+	return result
+}
+
+// InterpretFile runs source as the main module, with imports resolved
+// relative to path.
+func (vm *VM) InterpretFile(path string, source string) interpretresult.InterpretResult {
+	if abs, err := filepath.Abs(path); err == nil {
+		vm.main.Path = abs
+	}
+	return vm.Interpret(source)
 }